@@ -2,9 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"html"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	_ "time/tzdata" // база часовых поясов для server.timezone и ?tz= в alpine-образе
 
 	"github.com/gin-gonic/gin"
 	"github.com/robfig/cron/v3"
@@ -24,6 +34,11 @@ import (
 )
 
 func main() {
+	// Контекст процесса: отменяется по SIGINT/SIGTERM, прерывая запросы к Wialon
+	// в фоновых задачах (синхронизация, снимки)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Загрузка конфигурации
 	cfg, err := config.Load("config.yaml")
 	if err != nil {
@@ -38,12 +53,52 @@ func main() {
 
 	// Инициализация репозиториев
 	repo := repository.NewRepository(db)
+	if ttl := cfg.Cache.SelectedAccountsTTL; ttl != 0 {
+		if ttl < 0 {
+			ttl = 0
+		}
+		repo.SetSelectedAccountsTTL(time.Duration(ttl) * time.Second)
+	}
+	if n, err := repo.FailInterruptedSyncJobs(); err != nil {
+		log.Printf("Ошибка закрытия прерванных синхронизаций: %v", err)
+	} else if n > 0 {
+		log.Printf("Синхронизаций, прерванных перезапуском: %d", n)
+	}
 
 	// Инициализация сервисов
-	wialonClient := wialon.NewClient(cfg.Wialon)
+	// Клиенты Wialon (основной и подключений) — с флагами, таймаутом и ограничением запросов
+	// из конфигурации; лимитер подключения общий для всех клиентов фабрики
+	wialonFactory := wialon.NewFactory(cfg.Wialon)
+	wialonClient := wialonFactory.NewClient(cfg.Wialon.BaseURL, cfg.Wialon.Token, 0)
 	snapshotService := snapshot.NewService(repo, wialonClient)
+	snapshotService.SetClientFactory(wialonFactory.NewAPI)
+	snapshotService.SetSnapshotDelay(time.Duration(cfg.Wialon.SnapshotDelayHours) * time.Hour)
+	snapshotService.SetUsageFallback(!cfg.Wialon.DisableUsageFallback)
 	nbkService := nbk.NewService(repo)
-	invoiceService := invoice.NewService(db, repo, nbkService)
+	nbkService.SetCurrencies(cfg.NBK.Currencies)
+	if missing, err := nbkService.CheckTrackedCurrencies(); err != nil {
+		log.Printf("[НБК] Не удалось проверить валюты модулей и аккаунтов: %v", err)
+	} else if len(missing) > 0 {
+		log.Printf("[НБК] ВНИМАНИЕ: курсы валют %s не загружаются (nbk.currencies: %s) — счета в них не пересчитаются в тенге",
+			strings.Join(missing, ", "), strings.Join(nbkService.Currencies(), ", "))
+	}
+	if ttl := cfg.Cache.ExchangeRatesTTL; ttl != 0 {
+		if ttl < 0 {
+			ttl = 0
+		}
+		nbkService.SetRefetchWindow(time.Duration(ttl) * time.Second)
+	}
+	invoiceService := invoice.NewService(db, repo, nbkService, cfg.Billing.DefaultBillingCurrency)
+	invoiceService.SetCurrencyPrecision(cfg.Billing.CurrencyPrecision)
+	pdfGenerator := invoice.NewPDFGenerator(cfg.PDF.FontsDir, invoiceService.Precision())
+	if dir, err := pdfGenerator.FontsDir(); err != nil {
+		log.Printf("ОШИБКА: PDF счетов не будут формироваться: %v", err)
+	} else {
+		log.Printf("Шрифты PDF: %s", dir)
+	}
+	invoiceService.SetBlockStatusRefresher(func(accounts []models.Account) error {
+		return snapshotService.RefreshBlockedStatus(ctx, accounts)
+	})
 
 	// Инициализация AI сервиса
 	aiService := ai.NewService(repo)
@@ -51,13 +106,22 @@ func main() {
 		log.Printf("[AI] Предупреждение: ошибка инициализации AI: %v", err)
 	}
 
+	// Инициализация Email-сервиса
+	emailService := email.NewService(repo)
+	emailService.SetMaxAttachmentsSize(int64(cfg.Email.MaxAttachmentsSizeMB) << 20)
+	if cfg.Email.TestMode {
+		emailService.SetTestMode(cfg.Email.TestModeRecipient)
+	}
+
 	// Инициализация cron-задач
 	c := cron.New(cron.WithLocation(time.UTC))
 
-	// Снимки — каждый час, идемпотентно (проверяет наличие снимка за вчера)
+	// Снимки — каждый час, идемпотентно (проверяет наличие снимка за вчера с учётом snapshot_delay_hours).
+	// Часовой пояс и час снимка (snapshot_timezone, snapshot_hour) читаются из настроек биллинга
+	// при каждой проверке, поэтому расписание — ежечасное и не зависит от часового пояса cron
 	_, err = c.AddFunc("0 * * * *", func() {
 		log.Println("[Cron] Проверка снимков...")
-		if err := snapshotService.EnsureDailySnapshot(); err != nil {
+		if err := snapshotService.EnsureDailySnapshot(ctx); err != nil {
 			log.Printf("[Cron] Ошибка создания снимка: %v", err)
 		}
 	})
@@ -83,32 +147,51 @@ func main() {
 			log.Printf("[Старт] Ошибка загрузки курсов: %v", err)
 		}
 		log.Println("[Старт] Проверка снимков за вчера...")
-		if err := snapshotService.EnsureDailySnapshot(); err != nil {
+		if err := snapshotService.EnsureDailySnapshot(ctx); err != nil {
 			log.Printf("[Старт] Ошибка создания снимка: %v", err)
 		}
 		// Запуск AI анализа аккаунтов при старте
 		log.Println("[Старт] Запуск AI анализа аккаунтов...")
-		if err := aiService.AnalyzeLatestSnapshots(context.Background()); err != nil {
+		if summary, err := aiService.AnalyzeLatestSnapshots(context.Background()); err != nil {
 			log.Printf("[Старт] Ошибка AI анализа: %v", err)
 		} else {
-			log.Println("[Старт] AI анализ аккаунтов завершён")
+			log.Printf("[Старт] AI анализ аккаунтов завершён: проанализировано %d из %d", summary.Analyzed, summary.Total)
 		}
 	}()
 
+	// Пересчёт счетов, выставленных без курса, — ежедневно в 04:30 UTC (после загрузки курсов НБК)
+	_, err = c.AddFunc("30 4 * * *", func() {
+		reissueInvoicesAwaitingRates(repo, invoiceService, emailService)
+	})
+	if err != nil {
+		log.Fatalf("Ошибка добавления cron-задачи пересчёта счетов: %v", err)
+	}
+
 	// Генерация счетов — 1-го числа каждого месяца в 03:00 UTC
-	// Если курсы НБК недоступны — повторяем каждый час
+	// Если курсы НБК недоступны — повторяем каждый час; незавершённая генерация
+	// (ожидание курсов) продолжается после перезапуска
+	onInvoicesGenerated := func(period time.Time) {
+		sendMonthlySummaries(repo, snapshotService, invoiceService, emailService, period)
+	}
+	invoiceRuns := newInvoiceRunner(ctx, repo, invoiceService, nbkService, onInvoicesGenerated)
+	invoiceRuns.resume()
 	_, err = c.AddFunc("0 3 1 * *", func() {
 		log.Println("[Счета] Запуск автоматической генерации счетов...")
-		go generateInvoicesWithRetry(invoiceService, nbkService)
+		invoiceRuns.startMonthly()
 	})
 	if err != nil {
 		log.Fatalf("Ошибка добавления cron-задачи счетов: %v", err)
 	}
+	// Генерации, брошенные упавшим процессом, подхватываются после истечения их захвата
+	_, err = c.AddFunc("20 * * * *", invoiceRuns.resume)
+	if err != nil {
+		log.Fatalf("Ошибка добавления cron-задачи продолжения генераций: %v", err)
+	}
 
 	// AI анализ аккаунтов — ежедневно в 05:00 UTC (после завершения снимков)
 	_, err = c.AddFunc("0 5 * * *", func() {
 		log.Println("[AI Cron] Запуск ежедневного анализа аккаунтов...")
-		if err := aiService.AnalyzeLatestSnapshots(context.Background()); err != nil {
+		if _, err := aiService.AnalyzeLatestSnapshots(context.Background()); err != nil {
 			log.Printf("[AI Cron] Ошибка анализа: %v", err)
 		}
 	})
@@ -116,6 +199,27 @@ func main() {
 		log.Fatalf("Ошибка добавления cron-задачи AI анализа: %v", err)
 	}
 
+	// Очистка истёкших AI-инсайтов — ежедневно в 05:30 UTC (после анализа)
+	_, err = c.AddFunc("30 5 * * *", func() {
+		deleted, err := aiService.CleanupExpiredInsights()
+		if err != nil {
+			log.Printf("[AI Cron] Ошибка очистки инсайтов: %v", err)
+			return
+		}
+		log.Printf("[AI Cron] Удалено %d истёкших инсайтов", deleted)
+	})
+	if err != nil {
+		log.Fatalf("Ошибка добавления cron-задачи очистки AI инсайтов: %v", err)
+	}
+
+	// Очистка устаревших данных по срокам хранения — ежедневно в 02:00 UTC
+	_, err = c.AddFunc("0 2 * * *", func() {
+		purgeExpiredData(repo, cfg.Retention)
+	})
+	if err != nil {
+		log.Fatalf("Ошибка добавления cron-задачи очистки данных: %v", err)
+	}
+
 	c.Start()
 	defer c.Stop()
 
@@ -123,10 +227,13 @@ func main() {
 	router := gin.Default()
 
 	// CORS middleware
-	router.Use(middleware.CORS())
+	if len(cfg.Server.CORS.AllowedOrigins) == 0 {
+		log.Printf("CORS: server.cors.allowed_origins не задан — кроссдоменные запросы запрещены")
+	}
+	router.Use(middleware.CORS(cfg.Server.CORS))
 
-	// Инициализация Email-сервиса
-	emailService := email.NewService(repo)
+	// Лимит времени обработки запросов
+	router.Use(middleware.Timeout(requestTimeouts(cfg.Server)))
 
 	// Сид дефолтных шаблонов писем
 	seedEmailTemplates(db)
@@ -135,14 +242,29 @@ func main() {
 	authHandler := auth.NewAuthHandler(repo, emailService)
 
 	// API handlers
-	h := handlers.NewHandler(repo, wialonClient, snapshotService, nbkService, invoiceService)
+	h := handlers.NewHandler(repo, wialonClient, snapshotService, nbkService, invoiceService,
+		config.SupportedCurrencies(nbkService.Currencies()))
+	h.SetBillingDefaults(cfg.Billing)
+	h.SetPagination(cfg.Pagination)
+	h.SetTimezone(cfg.Server.Timezone)
+	h.SetBaseContext(ctx)
+	h.SetPDFGenerator(pdfGenerator)
+	h.SetWialonFactory(wialonFactory.NewAPI)
 	connHandler := handlers.NewConnectionHandler(repo, wialonClient)
+	connHandler.SetWialonFactory(wialonFactory.NewAPI)
 	aiHandler := handlers.NewAIHandler(aiService)
-	smtpHandler := handlers.NewSMTPHandler(repo, emailService, invoiceService)
+	aiHandler.SetPagination(cfg.Pagination)
+	smtpHandler := handlers.NewSMTPHandler(repo, emailService, invoiceService, pdfGenerator)
 
 	// Маршруты API
 	api := router.Group("/api")
 	{
+		// Версия сборки (без авторизации)
+		api.GET("/version", h.GetVersion)
+
+		// Сводка состояния системы (только для админов)
+		api.GET("/admin/status", middleware.Auth(), middleware.RequireAdmin(), h.GetAdminStatus)
+
 		// Авторизация (без middleware)
 		api.POST("/auth/request-code", authHandler.RequestCode)
 		api.POST("/auth/verify-code", authHandler.VerifyCode)
@@ -169,6 +291,7 @@ func main() {
 			accounts.GET("/:id/stats", h.GetAccountStats)
 			accounts.GET("/:id/charges", h.GetAccountCharges)
 			accounts.GET("/:id/charges/excel", h.ExportAccountChargesExcel)
+			accounts.GET("/:id/forecast", h.GetAccountForecast)
 		}
 
 		// Учётные записи (только для админов)
@@ -176,10 +299,15 @@ func main() {
 		adminAccounts.Use(middleware.Auth(), middleware.RequireAdmin())
 		{
 			adminAccounts.POST("/sync", h.SyncAccounts)
+			adminAccounts.GET("/sync/:job_id", h.GetSyncJob)
+			adminAccounts.GET("/requisites-check", h.CheckAccountRequisites)
 			adminAccounts.PUT("/:id/toggle", h.ToggleAccount)
 			adminAccounts.PUT("/:id/details", h.UpdateAccountDetails)
+			adminAccounts.GET("/:id/invoice-preferences", h.GetInvoicePreferences)
+			adminAccounts.PUT("/:id/invoice-preferences", h.UpdateInvoicePreferences)
 			adminAccounts.POST("/:id/modules", h.AssignModule)
 			adminAccounts.POST("/:id/invite", h.InviteDealer)
+			adminAccounts.GET("/:id/usage-breakdown", h.GetAccountUsageBreakdown)
 		}
 
 		// Модули (только для админов)
@@ -187,6 +315,7 @@ func main() {
 		modules.Use(middleware.Auth(), middleware.RequireAdmin())
 		{
 			modules.GET("", h.GetModules)
+			modules.GET("/stats", h.GetModuleStats)
 			modules.POST("", h.CreateModule)
 			modules.PUT("/:id", h.UpdateModule)
 			modules.DELETE("/:id", h.DeleteModule)
@@ -196,6 +325,18 @@ func main() {
 
 		// Массовая установка валюты
 		api.POST("/accounts/set-currency-bulk", middleware.Auth(), middleware.RequireAdmin(), h.SetCurrencyBulk)
+		api.POST("/accounts/set-modules-bulk", middleware.Auth(), middleware.RequireAdmin(), h.SetAccountModulesBulk)
+		api.POST("/accounts/set-group-bulk", middleware.Auth(), middleware.RequireAdmin(), h.SetAccountGroupBulk)
+
+		// Группы учётных записей (только для админов)
+		accountGroups := api.Group("/account-groups")
+		accountGroups.Use(middleware.Auth(), middleware.RequireAdmin())
+		{
+			accountGroups.GET("", h.GetAccountGroups)
+			accountGroups.POST("", h.CreateAccountGroup)
+			accountGroups.PUT("/:id", h.UpdateAccountGroup)
+			accountGroups.DELETE("/:id", h.DeleteAccountGroup)
+		}
 
 		// Настройки (только для админов)
 		settings := api.Group("/settings")
@@ -203,11 +344,17 @@ func main() {
 		{
 			settings.GET("", h.GetSettings)
 			settings.PUT("", h.UpdateSettings)
+			settings.GET("/pdf-templates", h.GetPDFTemplates)
+			settings.GET("/bank-accounts", h.GetSupplierBankAccounts)
+			settings.POST("/bank-accounts", h.CreateSupplierBankAccount)
+			settings.PUT("/bank-accounts/:id", h.UpdateSupplierBankAccount)
+			settings.DELETE("/bank-accounts/:id", h.DeleteSupplierBankAccount)
 			settings.POST("/api-token", h.GenerateAPIToken)
 		}
 
 		// Курсы валют (только для админов)
 		api.GET("/exchange-rates", middleware.Auth(), h.GetExchangeRates)
+		api.GET("/exchange-rates/convert", middleware.Auth(), h.ConvertCurrency)
 		api.POST("/exchange-rates/backfill", middleware.Auth(), middleware.RequireAdmin(), h.BackfillExchangeRates)
 
 		// Dashboard (для всех авторизованных, с фильтрацией по дилеру)
@@ -216,15 +363,35 @@ func main() {
 		// Снимки: GET для всех (с фильтрацией для дилеров), POST только для админов
 		api.GET("/snapshots", middleware.Auth(), middleware.DealerContext(), h.GetSnapshots)
 
+		// Поиск объекта в снимках (дилер и партнёр — только в своём аккаунте)
+		api.GET("/snapshot-units/search", middleware.Auth(), middleware.DealerContext(), middleware.PartnerContext(),
+			h.SearchSnapshotUnits)
+
+		// События Wialon об объектах: приём по общему секрету, просмотр — админам
+		api.POST("/wialon/events", middleware.SharedSecretAuth(cfg.Wialon.EventsSecret), h.IngestWialonEvents)
+		api.GET("/wialon/events", middleware.Auth(), middleware.RequireAdmin(), h.GetWialonEvents)
+		api.GET("/accounts/:id/unit-tally", middleware.Auth(), middleware.RequireAdmin(), h.GetAccountUnitTally)
+
+		// Сравнение двух месяцев аккаунта (дилер и партнёр — только свой аккаунт)
+		api.GET("/accounts/:id/compare", middleware.Auth(), middleware.DealerContext(), middleware.PartnerContext(),
+			h.CompareAccountPeriods)
+
 		snapshotsAdmin := api.Group("/snapshots")
 		snapshotsAdmin.Use(middleware.Auth(), middleware.RequireAdmin())
 		{
 			snapshotsAdmin.POST("", h.CreateSnapshot)
 			snapshotsAdmin.POST("/date", h.CreateSnapshotsForDate)
 			snapshotsAdmin.POST("/range", h.CreateSnapshotsForRange)
+			snapshotsAdmin.GET("/gaps", h.GetSnapshotGaps)
+			snapshotsAdmin.POST("/fill-gaps", h.FillSnapshotGaps)
+			snapshotsAdmin.GET("/export", h.ExportSnapshots)
 			snapshotsAdmin.DELETE("/clear", h.ClearAllSnapshots)
+			snapshotsAdmin.DELETE("", h.DeleteSnapshots)
 		}
 
+		// Досчёт начислений за прошлые месяцы (после загрузки исторических снимков)
+		api.POST("/charges/backfill", middleware.Auth(), middleware.RequireAdmin(), h.BackfillCharges)
+
 		// Изменения (для всех авторизованных)
 		api.GET("/changes", middleware.Auth(), middleware.DealerContext(), h.GetChanges)
 
@@ -237,9 +404,14 @@ func main() {
 			invoices.GET("/:id/pdf", h.GetInvoicePDF)
 			invoices.GET("/:id/excel", h.GetInvoiceExcel)
 			invoices.POST("/generate", h.GenerateInvoices)
+			invoices.POST("/preview-pdf", h.PreviewInvoicePDF)
 			invoices.PUT("/:id/status", h.UpdateInvoiceStatus)
 			invoices.DELETE("/clear", h.ClearAllInvoices)
 			invoices.POST("/:id/send", smtpHandler.SendInvoiceEmail)
+			invoices.POST("/:id/resend", smtpHandler.ResendInvoiceEmail)
+			invoices.GET("/:id/history", h.GetInvoiceHistory)
+			invoices.PUT("/:id/deliveries/:deliveryId", h.UpdateInvoiceDelivery)
+			invoices.POST("/:id/validate", h.ValidateInvoice)
 		}
 
 		// Экспорт для 1С (по API-токену, без JWT)
@@ -283,8 +455,11 @@ func main() {
 				aiAdmin.GET("/settings", aiHandler.GetAISettings)
 				aiAdmin.PUT("/settings", aiHandler.UpdateAISettings)
 				aiAdmin.GET("/usage", aiHandler.GetAIUsage)
+				aiAdmin.GET("/usage/logs", aiHandler.GetAIUsageLogs)
 				aiAdmin.POST("/analyze", aiHandler.TriggerAnalysis)
+				aiAdmin.POST("/analyze/account/:account_id", aiHandler.AnalyzeAccount)
 				aiAdmin.POST("/fleet-analysis", aiHandler.AnalyzeFleetTrends)
+				aiAdmin.POST("/cleanup", aiHandler.CleanupInsights)
 			}
 		}
 
@@ -297,10 +472,13 @@ func main() {
 		{
 			partner.GET("/account", h.GetPartnerAccount)
 			partner.GET("/invoices", h.GetPartnerInvoices)
+			partner.GET("/invoices/archive", h.GetPartnerInvoicesArchive)
 			partner.GET("/invoices/:id/pdf", h.GetPartnerInvoicePDF)
 			partner.GET("/charges", h.GetPartnerCharges)
+			partner.GET("/charges/excel", h.GetPartnerChargesExcel)
 			partner.GET("/balance", h.GetPartnerBalance)
 			partner.GET("/snapshots", h.GetPartnerSnapshots)
+			partner.GET("/dashboard", h.GetPartnerDashboard)
 		}
 	}
 
@@ -309,51 +487,419 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	log.Printf("Сервер запущен на порту %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatalf("Ошибка запуска сервера: %v", err)
-		os.Exit(1)
+	// Контексты запросов наследуют ctx: при остановке обращения к Wialon из обработчиков прерываются
+	srv := &http.Server{
+		Addr:        ":" + port,
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
+	go func() {
+		log.Printf("Сервер запущен на порту %s", port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Ошибка запуска сервера: %v", err)
+		}
+	}()
+
+	// Остановка: новые запросы не принимаются, текущим даётся shutdownTimeout на завершение
+	<-ctx.Done()
+	log.Println("Остановка сервера...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Ошибка остановки сервера: %v", err)
+	}
+}
+
+// shutdownTimeout - сколько ждать завершения текущих запросов при остановке
+const shutdownTimeout = 30 * time.Second
+
+// requestTimeouts возвращает лимит по умолчанию и увеличенные лимиты для медленных маршрутов
+func requestTimeouts(cfg config.ServerConfig) (time.Duration, map[string]time.Duration) {
+	defaultTimeout := 60 * time.Second
+	if cfg.RequestTimeout > 0 {
+		defaultTimeout = time.Duration(cfg.RequestTimeout) * time.Second
+	} else if cfg.RequestTimeout < 0 {
+		defaultTimeout = 0
+	}
+
+	// Синхронизация, снимки, пересчёт начислений и генерация счетов ходят в Wialon/НБК
+	routeTimeouts := cfg.RouteTimeouts
+	if len(routeTimeouts) == 0 {
+		routeTimeouts = map[string]int{
+			"/api/accounts/:id/stats":      300,
+			"/api/accounts/:id/charges":    300,
+			"/api/accounts/:id/compare":    300,
+			"/api/snapshots":               600,
+			"/api/invoices/generate":       600,
+			"/api/exchange-rates/backfill": 600,
+			"/api/ai/analyze/account":      300,
+		}
+	}
+
+	overrides := make(map[string]time.Duration, len(routeTimeouts))
+	for prefix, seconds := range routeTimeouts {
+		overrides[prefix] = time.Duration(seconds) * time.Second
+	}
+	return defaultTimeout, overrides
+}
+
+// Ожидание курсов НБК для ежемесячной генерации счетов
+const (
+	invoiceRunMaxAttempts   = 24        // проверок курсов до генерации без конвертации
+	invoiceRunRetryInterval = time.Hour // пауза между проверками
+)
+
+// invoiceRunLease - срок захвата генерации процессом: больше паузы между проверками курсов,
+// захват продлевается перед каждой проверкой
+const invoiceRunLease = invoiceRunRetryInterval + 15*time.Minute
+
+// invoiceRunner ведёт ежемесячные генерации счетов. Запись генерации захватывается в БД
+// (ClaimInvoiceRun), поэтому её ведёт только один процесс; active не даёт запустить одну
+// генерацию дважды в этом процессе. Ожидание курсов прерывается при остановке сервера.
+type invoiceRunner struct {
+	ctx            context.Context
+	repo           *repository.Repository
+	invoiceService *invoice.Service
+	nbkService     *nbk.Service
+	onGenerated    func(period time.Time)
+	owner          string // идентификатор процесса в claimed_by
+
+	mu     sync.Mutex
+	active map[uint]bool // генерации (по ID записи), выполняющиеся в этом процессе
 }
 
-// generateInvoicesWithRetry генерирует счета с повтором при отсутствии курсов НБК
-func generateInvoicesWithRetry(invoiceService *invoice.Service, nbkService *nbk.Service) {
+func newInvoiceRunner(ctx context.Context, repo *repository.Repository, invoiceService *invoice.Service, nbkService *nbk.Service, onGenerated func(period time.Time)) *invoiceRunner {
+	host, _ := os.Hostname()
+	return &invoiceRunner{
+		ctx:            ctx,
+		repo:           repo,
+		invoiceService: invoiceService,
+		nbkService:     nbkService,
+		onGenerated:    onGenerated,
+		owner:          fmt.Sprintf("%s:%d", host, os.Getpid()),
+		active:         make(map[uint]bool),
+	}
+}
+
+// startMonthly запускает генерацию счетов за прошлый месяц. Запись о генерации
+// сохраняется в БД: уже завершённая за период не повторяется, незавершённая продолжается.
+func (r *invoiceRunner) startMonthly() {
 	now := time.Now()
 	// Период — предыдущий месяц
 	prevMonth := now.AddDate(0, -1, 0)
-	period := time.Date(prevMonth.Year(), prevMonth.Month(), 1, 0, 0, 0, 0, time.Local)
+	period := time.Date(prevMonth.Year(), prevMonth.Month(), 1, 0, 0, 0, 0, time.UTC)
 	// Дата курса — 1-е число текущего месяца (следующий после периода)
 	rateDate := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
 
-	for attempt := 1; attempt <= 24; attempt++ {
-		// Пробуем загрузить курсы
-		nbkService.FetchExchangeRatesForDate(rateDate)
+	run, err := r.repo.StartInvoiceRun(period, rateDate)
+	if err != nil {
+		log.Printf("[Счета] Не удалось сохранить запуск генерации за %s: %v", period.Format("01.2006"), err)
+		return
+	}
+	if run.Status != models.InvoiceRunPending {
+		log.Printf("[Счета] Генерация за %s уже выполнена (%s), пропускаем", period.Format("01.2006"), run.Status)
+		return
+	}
+	r.launch(run)
+}
 
-		if invoiceService.CheckRatesAvailable(rateDate) {
-			log.Printf("[Счета] Курсы за %s доступны, генерируем счета (попытка %d)...",
-				rateDate.Format("02.01.2006"), attempt)
+// resume продолжает генерации счетов, прерванные перезапуском сервера или брошенные
+// упавшим процессом (после истечения срока его захвата)
+func (r *invoiceRunner) resume() {
+	runs, err := r.repo.GetPendingInvoiceRuns()
+	if err != nil {
+		log.Printf("[Счета] Ошибка получения незавершённых генераций: %v", err)
+		return
+	}
+	for i := range runs {
+		r.launch(&runs[i])
+	}
+}
 
-			invoices, err := invoiceService.GenerateMonthlyInvoices(period)
-			if err != nil {
-				log.Printf("[Счета] Ошибка генерации: %v", err)
-			} else {
-				log.Printf("[Счета] Успешно сгенерировано %d счетов за %s",
-					len(invoices), period.Format("01.2006"))
+// launch захватывает генерацию и выполняет её в фоне, если она ещё не выполняется
+// в этом процессе и не захвачена другим
+func (r *invoiceRunner) launch(run *models.InvoiceRun) {
+	r.mu.Lock()
+	if r.active[run.ID] {
+		r.mu.Unlock()
+		return
+	}
+	r.active[run.ID] = true
+	r.mu.Unlock()
+
+	if !r.claim(run) {
+		r.finish(run.ID)
+		return
+	}
+	if run.Attempt > 0 {
+		log.Printf("[Счета] Продолжаем генерацию за %s (проверок курсов: %d)",
+			run.Period.Format("01.2006"), run.Attempt)
+	}
+	go func() {
+		defer r.finish(run.ID)
+		r.generateWithRetry(run)
+	}()
+}
+
+func (r *invoiceRunner) finish(id uint) {
+	r.mu.Lock()
+	delete(r.active, id)
+	r.mu.Unlock()
+}
+
+// claim захватывает или продлевает генерацию за этим процессом
+func (r *invoiceRunner) claim(run *models.InvoiceRun) bool {
+	ok, err := r.repo.ClaimInvoiceRun(run, r.owner, time.Now().Add(invoiceRunLease))
+	if err != nil {
+		log.Printf("[Счета] Ошибка захвата генерации за %s: %v", run.Period.Format("01.2006"), err)
+		return false
+	}
+	if !ok {
+		log.Printf("[Счета] Генерация за %s выполняется другим процессом, пропускаем", run.Period.Format("01.2006"))
+	}
+	return ok
+}
+
+// wait ждёт до назначенной проверки курсов. При остановке сервера снимает захват
+// генерации и возвращает false; после ожидания продлевает захват.
+func (r *invoiceRunner) wait(run *models.InvoiceRun) bool {
+	if run.NextAttemptAt != nil {
+		if err := sleepContext(r.ctx, time.Until(*run.NextAttemptAt)); err != nil {
+			if err := r.repo.ReleaseInvoiceRun(run, r.owner); err != nil {
+				log.Printf("[Счета] Ошибка снятия захвата генерации за %s: %v", run.Period.Format("01.2006"), err)
 			}
+			log.Printf("[Счета] Ожидание курсов за %s прервано остановкой сервера", run.Period.Format("01.2006"))
+			return false
+		}
+	}
+	return r.claim(run)
+}
+
+// generateWithRetry генерирует счета с повтором при отсутствии курсов НБК.
+// Номер попытки и время следующей проверки сохраняются в run, поэтому после перезапуска
+// ожидание продолжается с того же места, а не начинается заново.
+func (r *invoiceRunner) generateWithRetry(run *models.InvoiceRun) {
+	period := time.Date(run.Period.Year(), run.Period.Month(), 1, 0, 0, 0, 0, time.Local)
+	rateDate := time.Date(run.RateDate.Year(), run.RateDate.Month(), run.RateDate.Day(), 0, 0, 0, 0, time.UTC)
+
+	saveRun := func() {
+		if err := r.repo.UpdateInvoiceRun(run); err != nil {
+			log.Printf("[Счета] Ошибка сохранения состояния генерации за %s: %v", period.Format("01.2006"), err)
+		}
+	}
+
+	generate := func(withoutRates bool) {
+		result, err := r.invoiceService.GenerateMonthlyInvoices(period, false)
+		now := time.Now()
+		run.NextAttemptAt = nil
+		run.WithoutRates = withoutRates
+		if err != nil {
+			log.Printf("[Счета] Ошибка генерации: %v", err)
+			run.Status = models.InvoiceRunFailed
+			run.LastError = err.Error()
+			saveRun()
+			return
+		}
+		run.Status = models.InvoiceRunCompleted
+		run.InvoicesCount = len(result.Invoices)
+		run.LastError = ""
+		run.CompletedAt = &now
+		saveRun()
+
+		if withoutRates {
+			log.Printf("[Счета] Сгенерировано %d счетов (без курсов, ниже минимальной суммы: %d, заблокированы: %d)",
+				len(result.Invoices), len(result.BelowMinimum), len(result.Blocked))
+		} else {
+			log.Printf("[Счета] Успешно сгенерировано %d счетов за %s (ниже минимальной суммы: %d, заблокированы: %d)",
+				len(result.Invoices), period.Format("01.2006"), len(result.BelowMinimum), len(result.Blocked))
+		}
+		r.onGenerated(period)
+	}
+
+	for run.Attempt < invoiceRunMaxAttempts {
+		// После перезапуска дожидаемся назначенной ранее проверки
+		if !r.wait(run) {
+			return
+		}
+
+		run.Attempt++
+		run.NextAttemptAt = nil
+		saveRun()
+
+		// В НБК обращаемся, только если курсов за дату ещё нет в БД
+		available := r.invoiceService.CheckRatesAvailable(rateDate)
+		if !available {
+			r.nbkService.FetchExchangeRatesForDate(rateDate)
+			available = r.invoiceService.CheckRatesAvailable(rateDate)
+		}
+
+		if available {
+			log.Printf("[Счета] Курсы за %s доступны, генерируем счета (попытка %d)...",
+				rateDate.Format("02.01.2006"), run.Attempt)
+			generate(false)
 			return
 		}
 
-		log.Printf("[Счета] Курсы за %s ещё недоступны, повтор через 1 час (попытка %d/24)...",
-			rateDate.Format("02.01.2006"), attempt)
-		time.Sleep(1 * time.Hour)
+		log.Printf("[Счета] Курсы за %s ещё недоступны, повтор через 1 час (попытка %d/%d)...",
+			rateDate.Format("02.01.2006"), run.Attempt, invoiceRunMaxAttempts)
+		next := time.Now().Add(invoiceRunRetryInterval)
+		run.NextAttemptAt = &next
+		saveRun()
 	}
 
+	// После последней неудачной проверки выдерживаем паузу, как и между попытками
+	if !r.wait(run) {
+		return
+	}
 	log.Println("[Счета] Курсы не появились за 24 часа. Генерация без конвертации...")
-	invoices, err := invoiceService.GenerateMonthlyInvoices(period)
+	generate(true)
+}
+
+// sleepContext ждёт d или отмены ctx (тогда возвращает ошибку контекста)
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// sendMonthlySummaries рассылает итоги закрытого месяца аккаунтам, включившим письмо
+// (monthly_summary_enabled) и указавшим buyer_email
+func sendMonthlySummaries(repo *repository.Repository, snapshotService *snapshot.Service, invoiceService *invoice.Service, emailService *email.Service, period time.Time) {
+	if !emailService.IsEnabled() {
+		return
+	}
+	accounts, err := repo.GetSelectedAccounts()
 	if err != nil {
-		log.Printf("[Счета] Ошибка генерации: %v", err)
-	} else {
-		log.Printf("[Счета] Сгенерировано %d счетов (без курсов)", len(invoices))
+		log.Printf("[Итоги месяца] Ошибка получения аккаунтов: %v", err)
+		return
+	}
+
+	if !emailService.IsTemplateActive("monthly_summary") {
+		log.Println("[Итоги месяца] Шаблон monthly_summary отключён, рассылка пропущена")
+		return
+	}
+
+	sent := 0
+	for i := range accounts {
+		account := &accounts[i]
+		if !account.MonthlySummaryEnabled || strings.TrimSpace(account.BuyerEmail) == "" {
+			continue
+		}
+		// Начисления за месяц должны быть окончательными
+		if err := snapshotService.CalculateDailyChargesForPeriod(account.ID, period.Year(), int(period.Month())); err != nil {
+			log.Printf("[Итоги месяца] Ошибка пересчёта начислений для %s: %v", account.Name, err)
+		}
+		summary, err := invoiceService.MonthlySummary(account.ID, period)
+		if err != nil {
+			log.Printf("[Итоги месяца] Ошибка расчёта для %s: %v", account.Name, err)
+			continue
+		}
+		if err := emailService.SendMonthlySummary(account.BuyerEmail, account, summary.Period, summary.AvgActiveUnits, summary.Charges); err != nil {
+			log.Printf("[Итоги месяца] Ошибка отправки %s: %v", account.BuyerEmail, err)
+			continue
+		}
+		sent++
+	}
+	log.Printf("[Итоги месяца] Отправлено писем за %s: %d", period.Format("01.2006"), sent)
+}
+
+// reissueInvoicesAwaitingRates пересчитывает счета, выставленные без курса НБК,
+// и уведомляет администраторов о пересчитанных счетах
+func reissueInvoicesAwaitingRates(repo *repository.Repository, invoiceService *invoice.Service, emailService *email.Service) {
+	results, err := invoiceService.ReissueInvoicesAwaitingRates()
+	if err != nil {
+		log.Printf("[Пересчёт] Ошибка: %v", err)
+		return
+	}
+	if len(results) == 0 {
+		return
+	}
+
+	var rows strings.Builder
+	reissued := 0
+	for _, r := range results {
+		status := fmt.Sprintf("%.2f → %.2f %s (%+.2f)", r.OldTotal, r.NewTotal, r.Currency, r.Delta)
+		if !r.Reissued {
+			status = "не пересчитан: " + r.Error
+		} else {
+			if r.ResendRequired {
+				status += " — требуется повторная отправка клиенту"
+			}
+			reissued++
+		}
+		rows.WriteString(fmt.Sprintf("<li>%s — %s: %s</li>",
+			html.EscapeString(r.Number), html.EscapeString(r.AccountName), html.EscapeString(status)))
+	}
+	log.Printf("[Пересчёт] Пересчитано счетов по курсу: %d из %d", reissued, len(results))
+
+	if !emailService.IsEnabled() || !emailService.IsTemplateActive("notification") {
+		return
+	}
+	admins, err := repo.GetAdminEmails()
+	if err != nil {
+		log.Printf("[Пересчёт] Ошибка получения администраторов: %v", err)
+		return
+	}
+	title := fmt.Sprintf("Пересчёт счетов по курсу НБК: %d", reissued)
+	message := "<p>Счета, выставленные без курса НБК, пересчитаны после публикации курса:</p><ul>" + rows.String() + "</ul>"
+	for _, addr := range admins {
+		if err := emailService.SendNotification(addr, title, message); err != nil {
+			log.Printf("[Пересчёт] Ошибка уведомления %s: %v", addr, err)
+		}
+	}
+}
+
+// purgeExpiredData удаляет данные старше сроков хранения
+func purgeExpiredData(repo *repository.Repository, cfg config.RetentionConfig) {
+	now := time.Now().UTC()
+	cutoff := func(months int) time.Time {
+		return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -months, 0)
+	}
+
+	if cfg.SnapshotsMonths > 0 {
+		if res, err := repo.PurgeSnapshotsBefore(cutoff(cfg.SnapshotsMonths)); err != nil {
+			log.Printf("[Очистка] Ошибка удаления снимков: %v", err)
+		} else {
+			log.Printf("[Очистка] Снимки старше %d мес.: снимков %d, объектов %d, изменений %d, начислений %d",
+				cfg.SnapshotsMonths, res.Snapshots, res.SnapshotUnits, res.Changes, res.DailyCharges)
+		}
+	}
+
+	if cfg.SnapshotUnitsMonths > 0 {
+		if n, err := repo.PurgeSnapshotUnitsBefore(cutoff(cfg.SnapshotUnitsMonths)); err != nil {
+			log.Printf("[Очистка] Ошибка удаления объектов снимков: %v", err)
+		} else {
+			log.Printf("[Очистка] Объекты снимков старше %d мес.: удалено %d", cfg.SnapshotUnitsMonths, n)
+		}
+	}
+
+	if cfg.ChangesMonths > 0 {
+		if n, err := repo.PurgeChangesBefore(cutoff(cfg.ChangesMonths)); err != nil {
+			log.Printf("[Очистка] Ошибка удаления изменений: %v", err)
+		} else {
+			log.Printf("[Очистка] Изменения старше %d мес.: удалено %d", cfg.ChangesMonths, n)
+		}
+		if n, err := repo.PurgeUnitEventsBefore(cutoff(cfg.ChangesMonths)); err != nil {
+			log.Printf("[Очистка] Ошибка удаления событий Wialon: %v", err)
+		} else {
+			log.Printf("[Очистка] События Wialon старше %d мес.: удалено %d", cfg.ChangesMonths, n)
+		}
+	}
+
+	if cfg.AIUsageLogsMonths > 0 {
+		if n, err := repo.PurgeAIUsageLogsBefore(cutoff(cfg.AIUsageLogsMonths)); err != nil {
+			log.Printf("[Очистка] Ошибка удаления логов AI: %v", err)
+		} else {
+			log.Printf("[Очистка] Логи AI старше %d мес.: удалено %d", cfg.AIUsageLogsMonths, n)
+		}
 	}
 }
 
@@ -410,6 +956,25 @@ func seedEmailTemplates(db *gorm.DB) {
 			Variables: `["title", "message", "date"]`,
 			IsActive:  true,
 		},
+		{
+			Type:    "monthly_summary",
+			Name:    "Итоги месяца",
+			Subject: "Итоги за {{period}}",
+			HTMLBody: `<div style="font-family: Arial, sans-serif; max-width: 600px; margin: 0 auto; padding: 20px;">
+<h2 style="color: #333;">Итоги за {{period}}</h2>
+<p>Уважаемый клиент <strong>{{company_name}}</strong>,</p>
+<p>Отчётный месяц закрыт, начисления за {{period}} зафиксированы:</p>
+<div style="background: #f8f9fa; padding: 15px; border-radius: 8px; margin: 15px 0;">
+<p><strong>Среднее активных объектов:</strong> {{avg_units}}</p>
+<p><strong>Начислено:</strong> {{charges_total}}</p>
+</div>
+<p>Счёт на оплату за период будет направлен отдельным письмом.</p>
+<hr style="border: none; border-top: 1px solid #eee; margin: 20px 0;">
+<p style="color: #999; font-size: 12px;">Это автоматическое уведомление от системы Wialon Billing.</p>
+</div>`,
+			Variables: `["company_name", "sender_company_name", "period", "avg_units", "charges_total"]`,
+			IsActive:  true,
+		},
 	}
 
 	for _, tmpl := range templates {
@@ -1,21 +1,49 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config - основная конфигурация приложения
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Database DatabaseConfig `yaml:"database"`
-	Wialon   WialonConfig   `yaml:"wialon"`
+	Server     ServerConfig     `yaml:"server"`
+	Database   DatabaseConfig   `yaml:"database"`
+	Wialon     WialonConfig     `yaml:"wialon"`
+	Cache      CacheConfig      `yaml:"cache"`
+	Billing    BillingConfig    `yaml:"billing"`
+	Retention  RetentionConfig  `yaml:"retention"`
+	Pagination PaginationConfig `yaml:"pagination"`
+	Email      EmailConfig      `yaml:"email"`
+
+	// Курсы Национального банка РК
+	NBK NBKConfig `yaml:"nbk"`
+
+	// Генерация PDF счетов
+	PDF PDFConfig `yaml:"pdf"`
 }
 
 // ServerConfig - настройки HTTP-сервера
 type ServerConfig struct {
-	Port string `yaml:"port"`
+	Port           string         `yaml:"port"`
+	RequestTimeout int            `yaml:"request_timeout"` // лимит обработки запроса, сек (0 — 60, -1 — без лимита)
+	RouteTimeouts  map[string]int `yaml:"route_timeouts"`  // лимиты для медленных маршрутов: префикс пути → сек
+	Timezone       string         `yaml:"timezone"`        // часовой пояс периодов по умолчанию (IANA, по умолчанию UTC)
+
+	// Кроссдоменные запросы из браузера (по умолчанию запрещены)
+	CORS CORSConfig `yaml:"cors"`
+}
+
+// CORSConfig - разрешённые источники для кроссдоменных запросов.
+// Пустой allowed_origins — разрешены только запросы с того же хоста; "*" — любой источник.
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins"`   // https://billing.example.com
+	AllowedMethods   []string `yaml:"allowed_methods"`   // по умолчанию GET, POST, PUT, DELETE, OPTIONS
+	AllowCredentials bool     `yaml:"allow_credentials"` // Access-Control-Allow-Credentials (cookies)
 }
 
 // DatabaseConfig - настройки подключения к PostgreSQL
@@ -33,6 +61,122 @@ type WialonConfig struct {
 	BaseURL string `yaml:"base_url"` // https://hst-api.wialon.com или Local URL
 	Token   string `yaml:"token"`
 	Type    string `yaml:"type"` // "hosting" или "local"
+
+	// Флаги core/search_items для объектов (0 — значения по умолчанию: 5 и 1439)
+	UnitFlags       int `yaml:"unit_flags"`        // GetUnits
+	UnitStatusFlags int `yaml:"unit_status_flags"` // GetAllUnitsWithStatus (act, dactt)
+
+	// Задержка ежедневного снимка, ч: данные Wialon за день стабилизируются не сразу после полуночи
+	// (0 — снимок за вчера без задержки)
+	SnapshotDelayHours int `yaml:"snapshot_delay_hours"`
+
+	// Отключить подстановку перебора объектов, когда avl_unit.usage вернул 0,
+	// а у аккаунта (bact) есть активные объекты (по умолчанию подстановка включена)
+	DisableUsageFallback bool `yaml:"disable_usage_fallback"`
+
+	// Ограничение запросов к Wialon на подключение (у подключения можно задать своё):
+	// 0 — 10 запросов/сек, -1 — без ограничения. Ответы «слишком много запросов»
+	// (HTTP 429, код 1003) повторяются rate_limit_retries раз с нарастающей паузой.
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	RateLimitBurst    int     `yaml:"rate_limit_burst"`   // 0 — 10
+	RateLimitRetries  int     `yaml:"rate_limit_retries"` // 0 — 3, -1 — без повторов
+
+	// Общий секрет для приёма событий об объектах от Wialon (POST /api/wialon/events):
+	// передаётся в заголовке X-Wialon-Secret или ?secret=. Пустой — приём выключен
+	EventsSecret string `yaml:"events_secret"`
+
+	// Предел ожидания ответа Wialon на запрос, сек (0 — 60): зависший хост не блокирует
+	// синхронизацию и снимки, запрос завершается ошибкой «Wialon timeout»
+	RequestTimeoutSeconds int `yaml:"request_timeout_seconds"`
+}
+
+// SupportedCurrencies возвращает валюты, поддерживаемые биллингом: тенге и валюты, курсы которых
+// загружаются из НБК (nbk.currencies; пустой список — DefaultNBKCurrencies)
+func SupportedCurrencies(nbkCurrencies []string) map[string]bool {
+	if len(nbkCurrencies) == 0 {
+		nbkCurrencies = DefaultNBKCurrencies
+	}
+	supported := map[string]bool{"KZT": true}
+	for _, currency := range nbkCurrencies {
+		supported[currency] = true
+	}
+	return supported
+}
+
+// RequisiteFields - реквизиты покупателя, которые можно сделать обязательными
+var RequisiteFields = map[string]bool{
+	"buyer_name": true, "buyer_bin": true, "buyer_address": true, "buyer_email": true,
+	"buyer_phone": true, "contract_number": true, "contract_date": true,
+}
+
+// BillingConfig - валюты по умолчанию и обязательные реквизиты
+type BillingConfig struct {
+	DefaultBillingCurrency string `yaml:"default_billing_currency"` // валюта счетов для новых аккаунтов (по умолчанию KZT)
+	DefaultModuleCurrency  string `yaml:"default_module_currency"`  // валюта цены новых модулей (по умолчанию EUR)
+
+	// Реквизиты, без которых счёт считается неполным (по умолчанию buyer_name, buyer_bin, contract_number)
+	RequiredRequisites []string `yaml:"required_requisites"`
+
+	// Знаков после запятой в суммах по валютам (0–6, не указанные — 2): округление цен,
+	// НДС и начислений и вывод в PDF/JSON
+	CurrencyPrecision map[string]int `yaml:"currency_precision"`
+
+	// Пересчёт начислений текущего месяца у затронутых аккаунтов после привязки, отвязки
+	// или изменения модуля: RecalculateOff (по умолчанию), RecalculateSync, RecalculateAsync
+	RecalculateOnModuleChange string `yaml:"recalculate_on_module_change"`
+}
+
+// Режимы пересчёта начислений после изменения модулей
+const (
+	RecalculateOff   = "off"   // не пересчитывать (начисления обновятся при следующем расчёте)
+	RecalculateSync  = "sync"  // пересчитать до ответа на запрос
+	RecalculateAsync = "async" // пересчитать в фоне
+)
+
+// DefaultNBKCurrencies - валюты, курсы которых к тенге загружаются из НБК по умолчанию
+var DefaultNBKCurrencies = []string{"EUR", "RUB"}
+
+// NBKConfig - загрузка курсов НБК
+type NBKConfig struct {
+	// Валюты, курсы которых к тенге загружаются ежедневно (по умолчанию EUR, RUB).
+	// Должны покрывать все валюты модулей и аккаунтов, иначе счета не пересчитаются в тенге.
+	Currencies []string `yaml:"currencies"`
+}
+
+// PDFConfig - генерация PDF счетов
+type PDFConfig struct {
+	// Папка со шрифтами Arial.ttf, Arial Bold.ttf, Arial Italic.ttf (переменная окружения FONTS_DIR).
+	// Пусто — папка fonts рядом с бинарником, а если её нет — fonts в рабочей папке.
+	FontsDir string `yaml:"fonts_dir"`
+}
+
+// CacheConfig - настройки кэширования
+type CacheConfig struct {
+	SelectedAccountsTTL int `yaml:"selected_accounts_ttl"` // TTL кэша аккаунтов в биллинге, сек (0 — по умолчанию 60, -1 — отключить)
+	ExchangeRatesTTL    int `yaml:"exchange_rates_ttl"`    // не запрашивать в НБК уже загруженные курсы за дату, сек (0 — по умолчанию 6 ч, -1 — отключить)
+}
+
+// PaginationConfig - размеры страниц списков
+type PaginationConfig struct {
+	DefaultPageSize int `yaml:"default_page_size"` // по умолчанию 20
+	MaxPageSize     int `yaml:"max_page_size"`     // по умолчанию 5000
+}
+
+// EmailConfig - ограничения отправки писем
+type EmailConfig struct {
+	MaxAttachmentsSizeMB int `yaml:"max_attachments_size_mb"` // суммарный размер вложений, МБ (0 — по умолчанию 20, -1 — без лимита)
+
+	// Тестовый режим (staging): все письма уходят на TestModeRecipient, в теме — исходный адресат
+	TestMode          bool   `yaml:"test_mode"`
+	TestModeRecipient string `yaml:"test_mode_recipient"`
+}
+
+// RetentionConfig - сроки хранения данных, мес. (0 — по умолчанию, -1 — не удалять)
+type RetentionConfig struct {
+	SnapshotUnitsMonths int `yaml:"snapshot_units_months"` // детализация объектов снимков (по умолчанию не удаляется)
+	ChangesMonths       int `yaml:"changes_months"`        // изменения и события Wialon (по умолчанию не удаляются)
+	AIUsageLogsMonths   int `yaml:"ai_usage_logs_months"`  // логи использования AI (по умолчанию не удаляются)
+	SnapshotsMonths     int `yaml:"snapshots_months"`      // снимки с начислениями (по умолчанию не удаляются)
 }
 
 // Load загружает конфигурацию из YAML-файла
@@ -57,6 +201,116 @@ func Load(path string) (*Config, error) {
 	if envWialonToken := os.Getenv("WIALON_TOKEN"); envWialonToken != "" {
 		cfg.Wialon.Token = envWialonToken
 	}
+	if envEventsSecret := os.Getenv("WIALON_EVENTS_SECRET"); envEventsSecret != "" {
+		cfg.Wialon.EventsSecret = envEventsSecret
+	}
+	if envFontsDir := os.Getenv("FONTS_DIR"); envFontsDir != "" {
+		cfg.PDF.FontsDir = envFontsDir
+	}
+
+	// Часовой пояс по умолчанию
+	if cfg.Server.Timezone == "" {
+		cfg.Server.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(cfg.Server.Timezone); err != nil {
+		return nil, fmt.Errorf("неизвестный часовой пояс server.timezone: %s", cfg.Server.Timezone)
+	}
+
+	// Валюты по умолчанию
+	if cfg.Billing.DefaultBillingCurrency == "" {
+		cfg.Billing.DefaultBillingCurrency = "KZT"
+	}
+	if cfg.Billing.DefaultModuleCurrency == "" {
+		cfg.Billing.DefaultModuleCurrency = "EUR"
+	}
+
+	// Обязательные реквизиты по умолчанию
+	if len(cfg.Billing.RequiredRequisites) == 0 {
+		cfg.Billing.RequiredRequisites = []string{"buyer_name", "buyer_bin", "contract_number"}
+	}
+	for _, field := range cfg.Billing.RequiredRequisites {
+		if !RequisiteFields[field] {
+			return nil, fmt.Errorf("неизвестный реквизит billing.required_requisites: %s", field)
+		}
+	}
+
+	switch cfg.Billing.RecalculateOnModuleChange {
+	case "":
+		cfg.Billing.RecalculateOnModuleChange = RecalculateOff
+	case RecalculateOff, RecalculateSync, RecalculateAsync:
+	default:
+		return nil, fmt.Errorf("billing.recalculate_on_module_change: допустимо off, sync или async, указано %s",
+			cfg.Billing.RecalculateOnModuleChange)
+	}
+
+	for currency, digits := range cfg.Billing.CurrencyPrecision {
+		if digits < 0 || digits > 6 {
+			return nil, fmt.Errorf("billing.currency_precision[%s]: допустимо от 0 до 6 знаков, указано %d", currency, digits)
+		}
+	}
+
+	// Валюты курсов НБК
+	if len(cfg.NBK.Currencies) == 0 {
+		cfg.NBK.Currencies = DefaultNBKCurrencies
+	}
+	seen := make(map[string]bool, len(cfg.NBK.Currencies))
+	currencies := make([]string, 0, len(cfg.NBK.Currencies))
+	for _, currency := range cfg.NBK.Currencies {
+		currency = strings.ToUpper(strings.TrimSpace(currency))
+		if len(currency) != 3 || currency == "KZT" {
+			return nil, fmt.Errorf("nbk.currencies: неверный код валюты %q (трёхбуквенный код, кроме KZT)", currency)
+		}
+		if !seen[currency] {
+			seen[currency] = true
+			currencies = append(currencies, currency)
+		}
+	}
+	cfg.NBK.Currencies = currencies
+
+	// Валюты по умолчанию должны быть среди поддерживаемых (тенге и nbk.currencies)
+	supported := SupportedCurrencies(cfg.NBK.Currencies)
+	if !supported[cfg.Billing.DefaultBillingCurrency] {
+		return nil, fmt.Errorf("неподдерживаемая валюта billing.default_billing_currency: %s", cfg.Billing.DefaultBillingCurrency)
+	}
+	if !supported[cfg.Billing.DefaultModuleCurrency] {
+		return nil, fmt.Errorf("неподдерживаемая валюта billing.default_module_currency: %s", cfg.Billing.DefaultModuleCurrency)
+	}
+
+	// Пагинация по умолчанию
+	if cfg.Pagination.DefaultPageSize <= 0 {
+		cfg.Pagination.DefaultPageSize = 20
+	}
+	if cfg.Pagination.MaxPageSize <= 0 {
+		cfg.Pagination.MaxPageSize = 5000
+	}
+	if cfg.Pagination.DefaultPageSize > cfg.Pagination.MaxPageSize {
+		return nil, fmt.Errorf("pagination.default_page_size (%d) больше max_page_size (%d)",
+			cfg.Pagination.DefaultPageSize, cfg.Pagination.MaxPageSize)
+	}
+
+	// Лимит вложений по умолчанию
+	if cfg.Email.MaxAttachmentsSizeMB == 0 {
+		cfg.Email.MaxAttachmentsSizeMB = 20
+	}
+
+	if cfg.Email.TestMode && cfg.Email.TestModeRecipient == "" {
+		return nil, fmt.Errorf("email.test_mode включён, но не задан email.test_mode_recipient")
+	}
+
+	// Сроки хранения по умолчанию: очистка выключена — она необратима, а детализация объектов
+	// нужна для льготы деактивации, проверки счетов и сверки событий Wialon
+	if cfg.Retention.SnapshotUnitsMonths == 0 {
+		cfg.Retention.SnapshotUnitsMonths = -1
+	}
+	if cfg.Retention.ChangesMonths == 0 {
+		cfg.Retention.ChangesMonths = -1
+	}
+	if cfg.Retention.AIUsageLogsMonths == 0 {
+		cfg.Retention.AIUsageLogsMonths = -1
+	}
+	if cfg.Retention.SnapshotsMonths == 0 {
+		cfg.Retention.SnapshotsMonths = -1
+	}
 
 	return &cfg, nil
 }
@@ -0,0 +1,26 @@
+package config
+
+import "testing"
+
+func TestSupportedCurrencies(t *testing.T) {
+	tests := []struct {
+		nbk  []string
+		want []string
+	}{
+		{nil, []string{"KZT", "EUR", "RUB"}},
+		{[]string{"USD"}, []string{"KZT", "USD"}},
+		{[]string{"EUR", "USD", "CNY"}, []string{"KZT", "EUR", "USD", "CNY"}},
+	}
+	for _, tt := range tests {
+		got := SupportedCurrencies(tt.nbk)
+		if len(got) != len(tt.want) {
+			t.Errorf("SupportedCurrencies(%v) = %v, ожидалось %v", tt.nbk, got, tt.want)
+			continue
+		}
+		for _, currency := range tt.want {
+			if !got[currency] {
+				t.Errorf("SupportedCurrencies(%v): нет %s", tt.nbk, currency)
+			}
+		}
+	}
+}
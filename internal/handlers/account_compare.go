@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// periodChargesSummary - итоги начислений аккаунта за месяц для сравнения периодов
+type periodChargesSummary struct {
+	Period          string                `json:"period"` // YYYY-MM
+	DaysInMonth     int                   `json:"days_in_month"`
+	DaysWithData    int                   `json:"days_with_data"`
+	AvgUnits        float64               `json:"avg_units"` // среднее объектов за дни с начислениями
+	CostByCurrency  map[string]float64    `json:"cost_by_currency"`
+	Modules         []chargeModuleSummary `json:"modules"`
+	BillingCurrency string                `json:"billing_currency"`
+	ConvertedTotal  *float64              `json:"converted_total"` // nil — месяц не закрыт или нет курса
+	Rate            *float64              `json:"rate,omitempty"`
+	RateDate        string                `json:"rate_date,omitempty"`
+}
+
+// periodDelta - изменение показателя во втором периоде относительно первого
+type periodDelta struct {
+	Diff    float64  `json:"diff"`
+	Percent *float64 `json:"percent"` // nil — в первом периоде 0
+}
+
+// CompareAccountPeriods сравнивает начисления аккаунта за два месяца: среднее объектов,
+// суммы по валютам, итог в валюте выставления и изменения period2 относительно period1.
+// Дилер и партнёр могут сравнивать только свой аккаунт.
+// GET /api/accounts/:id/compare?period1=YYYY-MM&period2=YYYY-MM
+func (h *Handler) CompareAccountPeriods(c *gin.Context) {
+	accountID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+
+	period1, err := h.parseMonthParam(c, "period1")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	period2, err := h.parseMonthParam(c, "period2")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.repo.GetAccountByID(uint(accountID))
+	if err != nil || account == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+	if wialonID, restricted := scopedWialonID(c); restricted {
+		if wialonID == nil || *wialonID != account.WialonID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Нет доступа"})
+			return
+		}
+	}
+
+	first, err := h.summarizeAccountPeriod(account, period1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	second, err := h.summarizeAccountPeriod(account, period2)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Изменения по валютам — по объединению валют обоих периодов
+	currencies := make(map[string]bool)
+	for cur := range first.CostByCurrency {
+		currencies[cur] = true
+	}
+	for cur := range second.CostByCurrency {
+		currencies[cur] = true
+	}
+	costDelta := make(map[string]periodDelta, len(currencies))
+	for cur := range currencies {
+		d := newPeriodDelta(first.CostByCurrency[cur], second.CostByCurrency[cur])
+		d.Diff = h.invoice.RoundAmount(d.Diff, cur)
+		costDelta[cur] = d
+	}
+
+	delta := gin.H{
+		"avg_units":        newPeriodDelta(first.AvgUnits, second.AvgUnits),
+		"cost_by_currency": costDelta,
+		"converted_total":  nil,
+	}
+	// Итоги в валюте выставления сравнимы, только если оба месяца пересчитаны в одну валюту
+	if first.ConvertedTotal != nil && second.ConvertedTotal != nil && first.BillingCurrency == second.BillingCurrency {
+		d := newPeriodDelta(*first.ConvertedTotal, *second.ConvertedTotal)
+		d.Diff = h.invoice.RoundAmount(d.Diff, first.BillingCurrency)
+		delta["converted_total"] = d
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"account": gin.H{
+			"id":        account.ID,
+			"name":      account.Name,
+			"wialon_id": account.WialonID,
+		},
+		"period1": first,
+		"period2": second,
+		"delta":   delta,
+	})
+}
+
+// summarizeAccountPeriod пересчитывает и сводит начисления аккаунта за месяц — как GetAccountCharges
+func (h *Handler) summarizeAccountPeriod(account *models.Account, period *Period) (*periodChargesSummary, error) {
+	year, month := period.Year, period.Month
+
+	// Пересчитываем начисления (на случай если ещё не рассчитаны)
+	if err := h.snapshot.CalculateDailyChargesForPeriod(account.ID, year, month); err != nil {
+		log.Printf("CompareAccountPeriods: ошибка пересчёта %04d-%02d: %v", year, month, err)
+	}
+
+	charges, err := h.repo.GetDailyCharges(account.ID, 0, year, month, true)
+	if err != nil {
+		return nil, err
+	}
+
+	moduleSummaries, costByCurrency := summarizeCharges(charges, h.invoice.Precision())
+	sort.Slice(moduleSummaries, func(i, j int) bool {
+		return moduleSummaries[i].ModuleID < moduleSummaries[j].ModuleID
+	})
+
+	// Объекты за день одинаковы во всех строках дня — берём по одной на дату
+	unitsByDay := make(map[string]float64)
+	for _, ch := range charges {
+		unitsByDay[ch.ChargeDate.Format("2006-01-02")] = float64(ch.TotalUnits) + ch.GraceUnits
+	}
+	var avgUnits float64
+	if len(unitsByDay) > 0 {
+		var total float64
+		for _, units := range unitsByDay {
+			total += units
+		}
+		avgUnits = math.Round(total/float64(len(unitsByDay))*10) / 10
+	}
+
+	billingCurrency := h.billing.DefaultBillingCurrency
+	if account.BillingCurrency != "" {
+		billingCurrency = account.BillingCurrency
+	}
+
+	summary := &periodChargesSummary{
+		Period:          period.Start.Format("2006-01"),
+		DaysInMonth:     time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day(),
+		DaysWithData:    len(unitsByDay),
+		AvgUnits:        avgUnits,
+		CostByCurrency:  costByCurrency,
+		Modules:         moduleSummaries,
+		BillingCurrency: billingCurrency,
+	}
+	if conv := h.convertChargeSummaries(account, year, month, moduleSummaries); conv != nil {
+		summary.ConvertedTotal = &conv.Total
+		summary.Rate = &conv.Rate
+		summary.RateDate = conv.RateDate.Format("2006-01-02")
+	}
+	return summary, nil
+}
+
+// newPeriodDelta считает разницу и процент изменения (процент округлён до 0.01)
+func newPeriodDelta(before, after float64) periodDelta {
+	d := periodDelta{Diff: math.Round((after-before)*100) / 100}
+	if before != 0 {
+		percent := math.Round((after-before)/before*10000) / 100
+		d.Percent = &percent
+	}
+	return d
+}
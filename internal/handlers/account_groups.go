@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// AccountGroupRequest - создание и изменение группы учётных записей
+type AccountGroupRequest struct {
+	Name     string `json:"name" binding:"required"`
+	ParentID *uint  `json:"parent_id"` // родительская группа (nil или 0 — верхний уровень)
+}
+
+// GetAccountGroups возвращает все группы учётных записей
+// GET /api/account-groups
+func (h *Handler) GetAccountGroups(c *gin.Context) {
+	groups, err := h.repo.GetAccountGroups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+// CreateAccountGroup создаёт группу учётных записей
+// POST /api/account-groups
+func (h *Handler) CreateAccountGroup(c *gin.Context) {
+	var req AccountGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите название группы"})
+		return
+	}
+
+	group := models.AccountGroup{}
+	if status, err := h.applyAccountGroupRequest(&group, req); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.repo.CreateAccountGroup(&group); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, group)
+}
+
+// UpdateAccountGroup переименовывает группу или переносит её в другую
+// PUT /api/account-groups/:id
+func (h *Handler) UpdateAccountGroup(c *gin.Context) {
+	group, ok := h.accountGroupFromParam(c)
+	if !ok {
+		return
+	}
+
+	var req AccountGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите название группы"})
+		return
+	}
+	if status, err := h.applyAccountGroupRequest(group, req); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.repo.UpdateAccountGroup(group); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+// DeleteAccountGroup удаляет группу: аккаунты остаются без группы, подгруппы переходят к родителю
+// DELETE /api/account-groups/:id
+func (h *Handler) DeleteAccountGroup(c *gin.Context) {
+	group, ok := h.accountGroupFromParam(c)
+	if !ok {
+		return
+	}
+	if err := h.repo.DeleteAccountGroup(group); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Группа удалена"})
+}
+
+// SetAccountGroupBulk переносит аккаунты в группу (group_id = null или 0 — убрать из групп)
+// POST /api/accounts/set-group-bulk
+func (h *Handler) SetAccountGroupBulk(c *gin.Context) {
+	var req struct {
+		AccountIDs []uint `json:"account_ids" binding:"required"`
+		GroupID    *uint  `json:"group_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.AccountIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Не выбраны аккаунты"})
+		return
+	}
+
+	if req.GroupID != nil && *req.GroupID == 0 {
+		req.GroupID = nil
+	}
+	if req.GroupID != nil {
+		group, err := h.repo.GetAccountGroupByID(*req.GroupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if group == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Группа не найдена"})
+			return
+		}
+	}
+
+	updated, err := h.repo.SetAccountsGroup(req.AccountIDs, req.GroupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	message := "Аккаунты перенесены в группу"
+	if req.GroupID == nil {
+		message = "Аккаунты убраны из групп"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": message,
+		"updated": updated,
+	})
+}
+
+// accountGroupFromParam загружает группу по :id; при ошибке ответ уже отправлен
+func (h *Handler) accountGroupFromParam(c *gin.Context) (*models.AccountGroup, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return nil, false
+	}
+	group, err := h.repo.GetAccountGroupByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if group == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Группа не найдена"})
+		return nil, false
+	}
+	return group, true
+}
+
+// applyAccountGroupRequest проверяет запрос и переносит его в группу.
+// Родитель должен существовать и не быть самой группой или её подгруппой.
+func (h *Handler) applyAccountGroupRequest(group *models.AccountGroup, req AccountGroupRequest) (int, error) {
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		return http.StatusBadRequest, fmt.Errorf("Укажите название группы")
+	}
+
+	parentID := req.ParentID
+	if parentID != nil && *parentID == 0 {
+		parentID = nil
+	}
+	if parentID != nil {
+		parent, err := h.repo.GetAccountGroupByID(*parentID)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if parent == nil {
+			return http.StatusBadRequest, fmt.Errorf("Родительская группа %d не найдена", *parentID)
+		}
+		if group.ID != 0 {
+			tree, err := h.repo.GetAccountGroupTreeIDs(group.ID)
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			for _, id := range tree {
+				if id == *parentID {
+					return http.StatusBadRequest, fmt.Errorf("Группу нельзя вложить в саму себя или в свою подгруппу")
+				}
+			}
+		}
+	}
+
+	group.Name = name
+	group.ParentID = parentID
+	return http.StatusOK, nil
+}
+
+// parseGroupFilter разбирает необязательный фильтр ?group_id=. Без параметра — nil (все аккаунты).
+// Возвращает группу и ID аккаунтов в ней и во всех её подгруппах.
+func (h *Handler) parseGroupFilter(c *gin.Context) (*models.AccountGroup, []uint, error) {
+	idStr := c.Query("group_id")
+	if idStr == "" {
+		return nil, nil, nil
+	}
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil || id == 0 {
+		return nil, nil, fmt.Errorf("неверный group_id: %s", idStr)
+	}
+	return h.resolveAccountGroup(uint(id))
+}
+
+// resolveAccountGroup возвращает группу и ID аккаунтов в ней и во всех её подгруппах
+func (h *Handler) resolveAccountGroup(groupID uint) (*models.AccountGroup, []uint, error) {
+	group, err := h.repo.GetAccountGroupByID(groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if group == nil {
+		return nil, nil, fmt.Errorf("группа %d не найдена", groupID)
+	}
+	ids, err := h.repo.GetAccountIDsInGroup(groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return group, ids, nil
+}
@@ -2,18 +2,24 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/config"
 	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/repository"
 	"github.com/user/wialon-billing-api/internal/services/ai"
 )
 
 // AIHandler - обработчики для AI эндпоинтов
 type AIHandler struct {
-	aiService *ai.Service
+	aiService  *ai.Service
+	pagination config.PaginationConfig
 }
 
 // NewAIHandler создаёт новый обработчик AI
@@ -35,6 +41,8 @@ func (h *AIHandler) GetAISettings(c *gin.Context) {
 			MaxTokens:        2500,
 			RateLimitPerHour: 1,
 			CacheTTLHours:    24,
+
+			ChangeThresholdUnits: 1,
 		}
 	}
 
@@ -48,8 +56,12 @@ func (h *AIHandler) GetAISettings(c *gin.Context) {
 		"rate_limit_per_hour": settings.RateLimitPerHour,
 		"cache_ttl_hours":     settings.CacheTTLHours,
 		"privacy_mode":        settings.PrivacyMode,
+		"daily_token_budget":  settings.DailyTokenBudget,
 		"updated_at":          settings.UpdatedAt,
 		"has_api_key":         settings.APIKey != "",
+
+		"analyze_only_changed":   settings.AnalyzeOnlyChanged,
+		"change_threshold_units": settings.ChangeThresholdUnits,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -66,12 +78,20 @@ func (h *AIHandler) UpdateAISettings(c *gin.Context) {
 		RateLimitPerHour int    `json:"rate_limit_per_hour"`
 		CacheTTLHours    int    `json:"cache_ttl_hours"`
 		PrivacyMode      bool   `json:"privacy_mode"`
+		DailyTokenBudget int    `json:"daily_token_budget"`
+
+		AnalyzeOnlyChanged   bool `json:"analyze_only_changed"`
+		ChangeThresholdUnits int  `json:"change_threshold_units"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.ChangeThresholdUnits < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "change_threshold_units не может быть отрицательным"})
+		return
+	}
 
 	// Получаем текущие настройки
 	settings := h.aiService.GetSettings()
@@ -87,6 +107,11 @@ func (h *AIHandler) UpdateAISettings(c *gin.Context) {
 	settings.RateLimitPerHour = req.RateLimitPerHour
 	settings.CacheTTLHours = req.CacheTTLHours
 	settings.PrivacyMode = req.PrivacyMode
+	settings.DailyTokenBudget = req.DailyTokenBudget
+	settings.AnalyzeOnlyChanged = req.AnalyzeOnlyChanged
+	if req.ChangeThresholdUnits > 0 {
+		settings.ChangeThresholdUnits = req.ChangeThresholdUnits
+	}
 
 	// Обновляем API ключ только если передан новый
 	if req.APIKey != "" {
@@ -105,11 +130,10 @@ func (h *AIHandler) UpdateAISettings(c *gin.Context) {
 // GetAIUsage возвращает статистику использования AI
 func (h *AIHandler) GetAIUsage(c *gin.Context) {
 	// Период в днях (по умолчанию 30)
-	days := 30
-	if daysStr := c.Query("days"); daysStr != "" {
-		if d, err := strconv.Atoi(daysStr); err == nil && d > 0 && d <= 365 {
-			days = d
-		}
+	days, err := queryInt(c, "days", 30, 1, 365)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	stats, err := h.aiService.GetUsageStats(days)
@@ -124,6 +148,61 @@ func (h *AIHandler) GetAIUsage(c *gin.Context) {
 	})
 }
 
+// SetPagination задаёт размеры страниц из конфигурации
+func (h *AIHandler) SetPagination(pagination config.PaginationConfig) {
+	h.pagination = pagination
+}
+
+// GetAIUsageLogs возвращает отдельные записи лога AI постранично
+// GET /api/ai/usage/logs?success=false&request_type=analyze&from=2026-01-01&to=2026-01-31&page=1&page_size=50
+func (h *AIHandler) GetAIUsageLogs(c *gin.Context) {
+	page, pageSize, err := parsePaginationConfig(c, h.pagination)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := repository.AIUsageLogFilter{RequestType: strings.TrimSpace(c.Query("request_type"))}
+	if successStr := c.Query("success"); successStr != "" {
+		success, err := strconv.ParseBool(successStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "success должен быть true или false"})
+			return
+		}
+		filter.Success = &success
+	}
+	if fromStr := c.Query("from"); fromStr != "" {
+		from, err := parseDateParam(fromStr, time.UTC)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.From = &from
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		to, err := parseDateParam(toStr, time.UTC)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Дата окончания включительно
+		to = to.AddDate(0, 0, 1)
+		filter.To = &to
+	}
+	if filter.From != nil && filter.To != nil && !filter.From.Before(*filter.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from должен быть не позже to"})
+		return
+	}
+
+	logs, total, err := h.aiService.GetUsageLogs(filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": logs, "total": total, "page": page, "page_size": pageSize})
+}
+
 // GetAIInsights возвращает активные инсайты
 func (h *AIHandler) GetAIInsights(c *gin.Context) {
 	insights, err := h.aiService.GetActiveInsights()
@@ -160,12 +239,17 @@ func (h *AIHandler) TriggerAnalysis(c *gin.Context) {
 		return
 	}
 
+	if h.aiService.IsAnalysisRunning() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Анализ уже выполняется"})
+		return
+	}
+
 	// Запускаем анализ асинхронно с фоновым контекстом
 	// Важно: используем context.Background() вместо c.Request.Context()
 	// потому что HTTP запрос завершится раньше анализа
 	go func() {
 		ctx := context.Background()
-		if err := h.aiService.AnalyzeLatestSnapshots(ctx); err != nil {
+		if _, err := h.aiService.AnalyzeLatestSnapshots(ctx); err != nil {
 			log.Printf("[AI] Ошибка фонового анализа: %v", err)
 		}
 	}()
@@ -173,6 +257,51 @@ func (h *AIHandler) TriggerAnalysis(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"message": "Анализ запущен"})
 }
 
+// AnalyzeAccount синхронно анализирует один аккаунт по последнему снимку (с учётом лимита
+// запросов и суточного бюджета) и возвращает созданный инсайт или причину отказа
+// POST /api/ai/analyze/account/:account_id
+func (h *AIHandler) AnalyzeAccount(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("account_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID аккаунта"})
+		return
+	}
+
+	insight, err := h.aiService.AnalyzeAccountByID(c.Request.Context(), uint(id))
+	if err != nil {
+		status := http.StatusBadGateway // ошибка запроса к AI
+		switch {
+		case errors.Is(err, ai.ErrAIDisabled):
+			status = http.StatusBadRequest
+		case errors.Is(err, ai.ErrAccountNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, ai.ErrNoSnapshot):
+			status = http.StatusUnprocessableEntity
+		case errors.Is(err, ai.ErrRateLimited), errors.Is(err, ai.ErrBudgetExceeded):
+			status = http.StatusTooManyRequests
+		case errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusGatewayTimeout
+		}
+		log.Printf("[AI] Ручной анализ аккаунта %d: %v", id, err)
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, insight)
+}
+
+// CleanupInsights вручную удаляет истёкшие инсайты
+func (h *AIHandler) CleanupInsights(c *gin.Context) {
+	deleted, err := h.aiService.CleanupExpiredInsights()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка очистки инсайтов"})
+		return
+	}
+
+	log.Printf("[AI] Ручная очистка: удалено %d истёкших инсайтов", deleted)
+	c.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
 // SendInsightFeedback сохраняет обратную связь по инсайту
 func (h *AIHandler) SendInsightFeedback(c *gin.Context) {
 	idStr := c.Param("id")
@@ -203,11 +332,10 @@ func (h *AIHandler) SendInsightFeedback(c *gin.Context) {
 // GetFleetTrends возвращает данные о трендах флота
 func (h *AIHandler) GetFleetTrends(c *gin.Context) {
 	// Период в днях (по умолчанию 7)
-	days := 7
-	if daysStr := c.Query("days"); daysStr != "" {
-		if d, err := strconv.Atoi(daysStr); err == nil && d > 0 && d <= 90 {
-			days = d
-		}
+	days, err := queryInt(c, "days", 7, 1, 90)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	result, err := h.aiService.GetFleetTrends(days)
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -13,20 +14,30 @@ import (
 
 const maxConnections = 20
 
+// maxRequestsPerSecond - предел ограничения запросов к Wialon, задаваемого для подключения
+const maxRequestsPerSecond = 100
+
 // ConnectionHandler - обработчики для Wialon подключений
 type ConnectionHandler struct {
-	repo   *repository.Repository
-	wialon *wialon.Client
+	repo      *repository.Repository
+	wialon    wialon.WialonAPI
+	newWialon wialon.ClientFactory // клиент для проверки подключения
 }
 
 // NewConnectionHandler создаёт новый обработчик подключений
-func NewConnectionHandler(repo *repository.Repository, wialonClient *wialon.Client) *ConnectionHandler {
+func NewConnectionHandler(repo *repository.Repository, wialonClient wialon.WialonAPI) *ConnectionHandler {
 	return &ConnectionHandler{
-		repo:   repo,
-		wialon: wialonClient,
+		repo:      repo,
+		wialon:    wialonClient,
+		newWialon: wialon.NewAPI,
 	}
 }
 
+// SetWialonFactory задаёт создание клиентов подключений с настройками Wialon из конфигурации
+func (h *ConnectionHandler) SetWialonFactory(factory wialon.ClientFactory) {
+	h.newWialon = factory
+}
+
 // GetConnections возвращает список подключений пользователя
 func (h *ConnectionHandler) GetConnections(c *gin.Context) {
 	userID, exists := c.Get("userID")
@@ -49,6 +60,11 @@ type CreateConnectionRequest struct {
 	Name       string `json:"name" binding:"required"`
 	WialonHost string `json:"host" binding:"required"`
 	Token      string `json:"token" binding:"required"`
+
+	SnapshotStrategy string `json:"snapshot_strategy"` // auto (по умолчанию), usage_api, enumerate_units
+
+	// Ограничение запросов к Wialon, запросов/сек (0 — из конфигурации)
+	RequestsPerSecond float64 `json:"requests_per_second"`
 }
 
 // CreateConnection создаёт новое подключение
@@ -76,6 +92,18 @@ func (h *ConnectionHandler) CreateConnection(c *gin.Context) {
 		return
 	}
 
+	if req.SnapshotStrategy == "" {
+		req.SnapshotStrategy = models.SnapshotStrategyAuto
+	}
+	if !models.ValidSnapshotStrategy(req.SnapshotStrategy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "snapshot_strategy: допустимо auto, usage_api или enumerate_units"})
+		return
+	}
+	if req.RequestsPerSecond < 0 || req.RequestsPerSecond > maxRequestsPerSecond {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("requests_per_second: от 0 до %d", maxRequestsPerSecond)})
+		return
+	}
+
 	// Проверка токена через Wialon API (получаем данные пользователя)
 	// TODO: Валидация токена через Wialon API
 	// Пока сохраняем без проверки
@@ -85,6 +113,9 @@ func (h *ConnectionHandler) CreateConnection(c *gin.Context) {
 		Name:       req.Name,
 		WialonHost: req.WialonHost,
 		Token:      req.Token,
+
+		SnapshotStrategy:  req.SnapshotStrategy,
+		RequestsPerSecond: req.RequestsPerSecond,
 	}
 
 	if err := h.repo.CreateConnection(conn); err != nil {
@@ -102,8 +133,12 @@ func (h *ConnectionHandler) CreateConnection(c *gin.Context) {
 
 // UpdateConnectionRequest - запрос на обновление подключения
 type UpdateConnectionRequest struct {
-	Name  string `json:"name"`
-	Token string `json:"token"`
+	Name             string `json:"name"`
+	Token            string `json:"token"`
+	SnapshotStrategy string `json:"snapshot_strategy"`
+
+	// Ограничение запросов к Wialon, запросов/сек: 0 — из конфигурации, nil — не менять
+	RequestsPerSecond *float64 `json:"requests_per_second"`
 }
 
 // UpdateConnection обновляет подключение
@@ -146,6 +181,20 @@ func (h *ConnectionHandler) UpdateConnection(c *gin.Context) {
 	if req.Token != "" {
 		conn.Token = req.Token
 	}
+	if req.SnapshotStrategy != "" {
+		if !models.ValidSnapshotStrategy(req.SnapshotStrategy) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "snapshot_strategy: допустимо auto, usage_api или enumerate_units"})
+			return
+		}
+		conn.SnapshotStrategy = req.SnapshotStrategy
+	}
+	if req.RequestsPerSecond != nil {
+		if *req.RequestsPerSecond < 0 || *req.RequestsPerSecond > maxRequestsPerSecond {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("requests_per_second: от 0 до %d", maxRequestsPerSecond)})
+			return
+		}
+		conn.RequestsPerSecond = *req.RequestsPerSecond
+	}
 
 	if err := h.repo.UpdateConnection(conn); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка обновления"})
@@ -221,11 +270,11 @@ func (h *ConnectionHandler) TestConnection(c *gin.Context) {
 
 	// Создаём Wialon клиент и проверяем подключение
 	wialonURL := "https://" + conn.WialonHost
-	wialonClient := wialon.NewClientWithToken(wialonURL, conn.Token)
+	wialonClient := h.newWialon(wialonURL, conn.Token, conn.RequestsPerSecond)
 
 	log.Printf("[TestConnection] Testing connection %d: URL=%s, TokenPrefix=%s", conn.ID, wialonURL, conn.Token[:20])
 
-	if err := wialonClient.Login(); err != nil {
+	if err := wialonClient.Login(c.Request.Context()); err != nil {
 		log.Printf("[TestConnection] Error for connection %d: %v", conn.ID, err)
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cyrillicTranslit - транслитерация кириллицы для ASCII-имени файла
+var cyrillicTranslit = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'ә': "a", 'ғ': "g", 'қ': "k", 'ң': "n", 'ө': "o", 'ұ': "u", 'ү': "u",
+	'һ': "h", 'і': "i",
+}
+
+// sanitizeFilename убирает из имени файла разделители путей, кавычки и управляющие символы
+func sanitizeFilename(name string) string {
+	name = strings.TrimSpace(name)
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\' || r == '"' || r == ':' || r == '*' || r == '?' || r == '<' || r == '>' || r == '|':
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, name)
+	if sanitized == "" {
+		return "file"
+	}
+	return sanitized
+}
+
+// asciiFilename - запасное ASCII-имя: кириллица транслитерируется, прочее заменяется на "_"
+func asciiFilename(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		lower := unicode.ToLower(r)
+		if tr, ok := cyrillicTranslit[lower]; ok {
+			if lower != r && tr != "" {
+				tr = strings.ToUpper(tr[:1]) + tr[1:]
+			}
+			b.WriteString(tr)
+			continue
+		}
+		if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-()", r)) {
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteByte('_')
+	}
+	return b.String()
+}
+
+// encodeRFC5987 кодирует строку для filename* (RFC 5987, attr-char без экранирования)
+func encodeRFC5987(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// contentDisposition формирует заголовок attachment с ASCII-именем и filename* в UTF-8
+func contentDisposition(filename string) string {
+	name := sanitizeFilename(filename)
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, asciiFilename(name), encodeRFC5987(name))
+}
+
+// setAttachment выставляет Content-Disposition для скачивания файла
+func setAttachment(c *gin.Context, filename string) {
+	c.Header("Content-Disposition", contentDisposition(filename))
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import "testing"
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"invoice_WH-1.pdf", "invoice_WH-1.pdf"},
+		{"  Счёт ТОО Ромашка.pdf  ", "Счёт ТОО Ромашка.pdf"},
+		{`Отчёт "Итоги" 1/2.xlsx`, "Отчёт _Итоги_ 1_2.xlsx"},
+		{`a\b:c*d?e<f>g|h.pdf`, "a_b_c_d_e_f_g_h.pdf"},
+		{"a\r\nb.pdf", "ab.pdf"},
+		{"", "file"},
+		{"   ", "file"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.name); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, ожидалось %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{
+			"invoice_WH-1.pdf",
+			`attachment; filename="invoice_WH-1.pdf"; filename*=UTF-8''invoice_WH-1.pdf`,
+		},
+		{
+			"report 2026.xlsx",
+			`attachment; filename="report_2026.xlsx"; filename*=UTF-8''report%202026.xlsx`,
+		},
+		{
+			"Счёт ТОО Ромашка.pdf",
+			`attachment; filename="Schet_TOO_Romashka.pdf"; filename*=UTF-8''` +
+				`%D0%A1%D1%87%D1%91%D1%82%20%D0%A2%D0%9E%D0%9E%20%D0%A0%D0%BE%D0%BC%D0%B0%D1%88%D0%BA%D0%B0.pdf`,
+		},
+		{
+			"Начисления Қазақ.xlsx",
+			`attachment; filename="Nachisleniya_Kazak.xlsx"; filename*=UTF-8''` +
+				`%D0%9D%D0%B0%D1%87%D0%B8%D1%81%D0%BB%D0%B5%D0%BD%D0%B8%D1%8F%20%D2%9A%D0%B0%D0%B7%D0%B0%D2%9B.xlsx`,
+		},
+		{
+			`Отчёт "Итоги" 1/2.xlsx`,
+			`attachment; filename="Otchet__Itogi__1_2.xlsx"; filename*=UTF-8''` +
+				`%D0%9E%D1%82%D1%87%D1%91%D1%82%20_%D0%98%D1%82%D0%BE%D0%B3%D0%B8_%201_2.xlsx`,
+		},
+		{
+			"",
+			`attachment; filename="file"; filename*=UTF-8''file`,
+		},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition(tt.name); got != tt.want {
+			t.Errorf("contentDisposition(%q)\n  = %s\n  ожидалось %s", tt.name, got, tt.want)
+		}
+	}
+}
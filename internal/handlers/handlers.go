@@ -2,19 +2,23 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/config"
 	"github.com/user/wialon-billing-api/internal/models"
 	"github.com/user/wialon-billing-api/internal/repository"
 	"github.com/user/wialon-billing-api/internal/services/invoice"
@@ -22,35 +26,89 @@ import (
 	"github.com/user/wialon-billing-api/internal/services/nbk"
 	"github.com/user/wialon-billing-api/internal/services/snapshot"
 	"github.com/user/wialon-billing-api/internal/services/wialon"
+	"github.com/user/wialon-billing-api/internal/version"
 	"github.com/xuri/excelize/v2"
 )
 
 // Handler - обработчики HTTP-запросов
 type Handler struct {
-	repo     *repository.Repository
-	wialon   *wialon.Client
-	snapshot *snapshot.Service
-	nbk      *nbk.Service
-	invoice  *invoice.Service
+	repo       *repository.Repository
+	wialon     wialon.WialonAPI
+	snapshot   *snapshot.Service
+	nbk        *nbk.Service
+	invoice    *invoice.Service
+	billing    config.BillingConfig
+	pagination config.PaginationConfig
+	location   *time.Location
+	newWialon  wialon.ClientFactory // клиент для подключений пользователей
+
+	// Валюты цен и счетов: тенге и валюты курсов НБК (config.SupportedCurrencies)
+	currencies map[string]bool
+
+	// Контекст процесса: фоновые задачи (синхронизация) прерываются при остановке сервера
+	baseCtx context.Context
+
+	// Генератор PDF счетов (шрифты из pdf.fonts_dir)
+	pdf *invoice.PDFGenerator
+
+	// Кэш сгенерированных PDF счетов по ETag
+	pdfCache *pdfCache
 }
 
 // NewHandler создаёт новый обработчик
 func NewHandler(
 	repo *repository.Repository,
-	wialon *wialon.Client,
+	wialonClient wialon.WialonAPI,
 	snapshot *snapshot.Service,
 	nbk *nbk.Service,
 	invoice *invoice.Service,
+	currencies map[string]bool,
 ) *Handler {
 	return &Handler{
-		repo:     repo,
-		wialon:   wialon,
-		snapshot: snapshot,
-		nbk:      nbk,
-		invoice:  invoice,
+		repo:       repo,
+		wialon:     wialonClient,
+		snapshot:   snapshot,
+		nbk:        nbk,
+		invoice:    invoice,
+		billing:    config.BillingConfig{DefaultBillingCurrency: "KZT", DefaultModuleCurrency: "EUR"},
+		newWialon:  wialon.NewAPI,
+		currencies: currencies,
+		baseCtx:    context.Background(),
+		pdf:        invoicesvc.NewPDFGenerator("", invoice.Precision()),
+		pdfCache:   newPDFCache(),
 	}
 }
 
+// currencyList возвращает поддерживаемые валюты через запятую (для сообщений об ошибке)
+func currencyList(currencies map[string]bool) string {
+	list := make([]string, 0, len(currencies))
+	for currency := range currencies {
+		list = append(list, currency)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+// SetWialonFactory задаёт создание клиентов подключений с настройками Wialon из конфигурации
+func (h *Handler) SetWialonFactory(factory wialon.ClientFactory) {
+	h.newWialon = factory
+}
+
+// SetPDFGenerator задаёт генератор PDF со шрифтами из конфигурации
+func (h *Handler) SetPDFGenerator(pdf *invoice.PDFGenerator) {
+	h.pdf = pdf
+}
+
+// SetBaseContext задаёт контекст процесса для фоновых задач (отменяется при остановке сервера)
+func (h *Handler) SetBaseContext(ctx context.Context) {
+	h.baseCtx = ctx
+}
+
+// SetBillingDefaults задаёт валюты по умолчанию из конфигурации
+func (h *Handler) SetBillingDefaults(billing config.BillingConfig) {
+	h.billing = billing
+}
+
 // === Auth ===
 
 // LoginRequest - запрос на авторизацию
@@ -76,8 +134,23 @@ func (h *Handler) Login(c *gin.Context) {
 
 // === Accounts ===
 
-// GetAccounts возвращает все учётные записи
+// GetAccounts возвращает все учётные записи (постранично, если передан page или page_size)
 func (h *Handler) GetAccounts(c *gin.Context) {
+	if hasPagination(c) {
+		page, pageSize, err := h.parsePagination(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		accounts, total, err := h.repo.GetAccountsPaginated(page, pageSize)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": accounts, "total": total, "page": page, "page_size": pageSize})
+		return
+	}
+
 	accounts, err := h.repo.GetAllAccounts()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -133,6 +206,16 @@ func (h *Handler) UpdateAccountDetails(c *gin.Context) {
 		BuyerPhone     string   `json:"buyer_phone"`
 		ContractNumber string   `json:"contract_number"`
 		ContractDate   *string  `json:"contract_date"` // формат: 2006-01-02
+		// Настройки счетов (как в PUT /api/accounts/:id/invoice-preferences)
+		InvoicePreferencesRequest
+		// Письмо с итогами месяца: nil — не менять
+		MonthlySummaryEnabled *bool `json:"monthly_summary_enabled"`
+		// Дата прекращения биллинга (2006-01-02): "" — снять, nil — не менять
+		BillingEndDate *string `json:"billing_end_date"`
+		// Причина прекращения биллинга: nil — не менять
+		BillingDisableReason *string `json:"billing_disable_reason"`
+		// День начала расчётного цикла: 1 — календарный месяц, nil — не менять
+		BillingCycleDay *int `json:"billing_cycle_day"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -152,6 +235,36 @@ func (h *Handler) UpdateAccountDetails(c *gin.Context) {
 	account.BuyerPhone = req.BuyerPhone
 	account.ContractNumber = req.ContractNumber
 
+	if err := applyInvoicePreferences(&account.InvoicePreferences, req.InvoicePreferencesRequest, h.currencies); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MonthlySummaryEnabled != nil {
+		account.MonthlySummaryEnabled = *req.MonthlySummaryEnabled
+	}
+	if req.BillingEndDate != nil {
+		if *req.BillingEndDate == "" {
+			account.BillingEndDate = nil
+		} else {
+			t, err := time.Parse("2006-01-02", *req.BillingEndDate)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат billing_end_date (YYYY-MM-DD)"})
+				return
+			}
+			account.BillingEndDate = &t
+		}
+	}
+	if req.BillingDisableReason != nil {
+		account.BillingDisableReason = strings.TrimSpace(*req.BillingDisableReason)
+	}
+	if req.BillingCycleDay != nil {
+		if *req.BillingCycleDay < 1 || *req.BillingCycleDay > models.MaxBillingCycleDay {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("billing_cycle_day должен быть от 1 до %d", models.MaxBillingCycleDay)})
+			return
+		}
+		account.BillingCycleDay = *req.BillingCycleDay
+	}
+
 	// Обработка дополнительных email для рассылки (не для OTP)
 	if len(req.CcEmails) > 0 {
 		// Лимит: максимум 5 адресов
@@ -190,9 +303,11 @@ func (h *Handler) UpdateAccountDetails(c *gin.Context) {
 
 	if req.ContractDate != nil && *req.ContractDate != "" {
 		t, err := time.Parse("2006-01-02", *req.ContractDate)
-		if err == nil {
-			account.ContractDate = &t
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат contract_date (YYYY-MM-DD)"})
+			return
 		}
+		account.ContractDate = &t
 	} else {
 		account.ContractDate = nil
 	}
@@ -222,11 +337,10 @@ func (h *Handler) GetAccountHistory(c *gin.Context) {
 	}
 
 	// Количество дней (по умолчанию 30)
-	days := 30
-	if daysStr := c.Query("days"); daysStr != "" {
-		if d, err := strconv.Atoi(daysStr); err == nil && d > 0 && d <= 365 {
-			days = d
-		}
+	days, err := queryInt(c, "days", 30, 1, 365)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
 	// Получаем токен пользователя
@@ -235,10 +349,10 @@ func (h *Handler) GetAccountHistory(c *gin.Context) {
 
 	// Создаём Wialon клиент
 	wialonURL := "https://hst-api.regwialon.com"
-	wialonClient := wialon.NewClientWithToken(wialonURL, userToken)
+	wialonClient := h.newWialon(wialonURL, userToken, 0)
 
 	// Получаем историю
-	history, err := wialonClient.GetAccountHistory(account.WialonID, days)
+	history, err := wialonClient.GetAccountHistory(c.Request.Context(), account.WialonID, days)
 	if err != nil {
 		log.Printf("Ошибка получения истории аккаунта %d: %v", account.WialonID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -270,21 +384,13 @@ func (h *Handler) GetAccountStats(c *gin.Context) {
 		return
 	}
 
-	// Парсим параметры периода (по умолчанию текущий месяц)
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
-
-	if yearStr := c.Query("year"); yearStr != "" {
-		if y, err := strconv.Atoi(yearStr); err == nil && y > 2000 && y < 2100 {
-			year = y
-		}
-	}
-	if monthStr := c.Query("month"); monthStr != "" {
-		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
-			month = m
-		}
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	year, month := period.Year, period.Month
 
 	// Рассчитываем период: с 1-го числа месяца до последнего
 	startOfMonth := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.Local)
@@ -294,14 +400,16 @@ func (h *Handler) GetAccountStats(c *gin.Context) {
 	toTime := endOfMonth.Unix()
 
 	// Выбираем Wialon клиент в зависимости от connection_id аккаунта
-	var wialonClient *wialon.Client
+	var wialonClient wialon.WialonAPI
+	var connectionName, wialonHost string
 	if account.ConnectionID != nil && *account.ConnectionID > 0 {
 		// Получаем подключение из БД
 		conn, err := h.repo.GetConnectionByID(*account.ConnectionID)
 		if err == nil && conn != nil {
+			connectionName, wialonHost = conn.Name, conn.WialonHost
 			wialonURL := "https://" + conn.WialonHost
-			wialonClient = wialon.NewClientWithToken(wialonURL, conn.Token)
-			if err := wialonClient.Login(); err != nil {
+			wialonClient = h.newWialon(wialonURL, conn.Token, conn.RequestsPerSecond)
+			if err := wialonClient.Login(c.Request.Context()); err != nil {
 				log.Printf("Ошибка авторизации для подключения %d: %v", *account.ConnectionID, err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка авторизации Wialon"})
 				return
@@ -315,7 +423,7 @@ func (h *Handler) GetAccountStats(c *gin.Context) {
 		wialonClient = h.wialon
 	}
 
-	stats, err := wialonClient.GetStatistics([]int64{account.WialonID}, fromTime, toTime)
+	stats, err := wialonClient.GetStatistics(c.Request.Context(), []int64{account.WialonID}, fromTime, toTime)
 	if err != nil {
 		log.Printf("Ошибка получения статистики аккаунта %d: %v", account.WialonID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -325,17 +433,31 @@ func (h *Handler) GetAccountStats(c *gin.Context) {
 	// Получаем статистику для этого аккаунта
 	accountStats := stats[account.WialonID]
 
+	// Итоги за месяц по всем сырым счётчикам Wialon
+	rawTotals := make(map[string]int)
+	for _, day := range accountStats {
+		for key, value := range day.Raw {
+			rawTotals[key] += value
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"account_id":   account.ID,
-		"wialon_id":    account.WialonID,
-		"account_name": account.Name,
-		"year":         year,
-		"month":        month,
-		"stats":        accountStats,
+		"account_id":      account.ID,
+		"wialon_id":       account.WialonID,
+		"account_name":    account.Name,
+		"connection_id":   account.ConnectionID,
+		"connection_name": connectionName,
+		"wialon_host":     wialonHost,
+		"year":            year,
+		"month":           month,
+		"stats":           accountStats,
+		"raw_totals":      rawTotals,
 	})
 }
 
-// SyncAccounts синхронизирует учётные записи с Wialon API через connections пользователя
+// SyncAccounts запускает фоновую синхронизацию учётных записей с Wialon API через connections
+// пользователя и сразу возвращает ID задачи: на больших парках синхронизация не укладывается
+// в лимит HTTP-запроса. Прогресс — GET /api/accounts/sync/:job_id
 func (h *Handler) SyncAccounts(c *gin.Context) {
 	// Получаем userID из контекста (устанавливается middleware.Auth)
 	userIDVal, exists := c.Get("userID")
@@ -358,147 +480,321 @@ func (h *Handler) SyncAccounts(c *gin.Context) {
 		return
 	}
 
-	var totalSynced int
-	var totalDealers int
-	var totalAccounts int
-	var allActiveIDs []int64
-	var syncErrors []string
+	// Одновременно выполняется только одна синхронизация
+	active, err := h.repo.GetActiveSyncJob()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if active != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Синхронизация уже выполняется", "job_id": active.ID})
+		return
+	}
 
-	// Синхронизируем по каждому подключению
-	for _, conn := range connections {
-		log.Printf("SyncAccounts: обработка подключения %s (host: %s)", conn.Name, conn.WialonHost)
+	job := &models.SyncJob{
+		UserID:           userID,
+		Status:           models.SyncJobPending,
+		ConnectionsTotal: len(connections),
+	}
+	if err := h.repo.CreateSyncJob(job); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-		// Формируем URL для API
-		wialonURL := "https://" + conn.WialonHost
+	// HTTP-запрос завершится раньше синхронизации — задача работает в своей горутине
+	// с контекстом процесса, а не запроса
+	go h.runSyncJob(h.baseCtx, job, connections)
 
-		// Создаём Wialon клиент с токеном из подключения
-		wialonClient := wialon.NewClientWithToken(wialonURL, conn.Token)
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Синхронизация запущена",
+		"job_id":  job.ID,
+		"status":  job.Status,
+	})
+}
 
-		// Авторизуемся для получения ID текущего пользователя
-		if err := wialonClient.Login(); err != nil {
-			log.Printf("SyncAccounts ERROR login for %s: %v", conn.Name, err)
-			syncErrors = append(syncErrors, conn.Name+": "+err.Error())
-			continue
-		}
+// GetSyncJob возвращает состояние задачи синхронизации: статус, прогресс по подключениям,
+// счётчики и ошибки подключений
+// GET /api/accounts/sync/:job_id
+func (h *Handler) GetSyncJob(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("job_id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID задачи"})
+		return
+	}
 
-		currentUserID := wialonClient.GetCurrentUserID()
-		// ID аккаунта пользователя (обычно userID + 1)
-		parentAccountID := currentUserID + 1
-		log.Printf("SyncAccounts: %s - userID=%d, parentAccountID=%d", conn.Name, currentUserID, parentAccountID)
+	job, err := h.repo.GetSyncJob(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Задача синхронизации не найдена"})
+		return
+	}
 
-		// Получаем все учётные записи из Wialon
-		accountsResp, err := wialonClient.GetAccounts()
-		if err != nil {
-			log.Printf("SyncAccounts ERROR for %s: %v", conn.Name, err)
-			syncErrors = append(syncErrors, conn.Name+": "+err.Error())
-			continue
+	syncErrors := []SyncError{}
+	if job.Errors != "" {
+		if err := json.Unmarshal([]byte(job.Errors), &syncErrors); err != nil {
+			log.Printf("SyncJob %d: ошибки не разобраны: %v", job.ID, err)
 		}
+	}
+	progress := 0
+	if job.ConnectionsTotal > 0 {
+		progress = job.ConnectionsDone * 100 / job.ConnectionsTotal
+	}
 
-		log.Printf("SyncAccounts: %s - получено %d аккаунтов", conn.Name, len(accountsResp.Items))
-		totalAccounts += len(accountsResp.Items)
+	c.JSON(http.StatusOK, gin.H{
+		"job":      job,
+		"progress": progress, // % обработанных подключений
+		"errors":   syncErrors,
+	})
+}
 
-		// Параллельная обработка GetAccountData с ограниченной конкурентностью
-		type accountResult struct {
-			item        wialon.WialonItem
-			accountData *wialon.AccountDataResponse
+// runSyncJob синхронизирует подключения по очереди, сохраняя прогресс задачи после каждого
+func (h *Handler) runSyncJob(ctx context.Context, job *models.SyncJob, connections []models.WialonConnection) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("SyncAccounts PANIC (задача %d): %v", job.ID, r)
+			finished := time.Now()
+			job.Status = models.SyncJobFailed
+			job.Error = fmt.Sprintf("Внутренняя ошибка: %v", r)
+			job.FinishedAt = &finished
+			h.saveSyncJob(job)
 		}
+	}()
+
+	started := time.Now()
+	job.Status = models.SyncJobRunning
+	job.StartedAt = &started
+	h.saveSyncJob(job)
+
+	var allActiveIDs []int64
+	var syncErrors []SyncError
 
-		results := make(chan accountResult, len(accountsResp.Items))
-		sem := make(chan struct{}, 10) // Ограничиваем до 10 параллельных запросов
+	// Синхронизируем по каждому подключению
+	for _, conn := range connections {
+		if ctx.Err() != nil {
+			break
+		}
+		job.CurrentConnection = conn.Name
+		h.saveSyncJob(job)
+
+		result := h.syncConnection(ctx, conn)
+		allActiveIDs = append(allActiveIDs, result.activeIDs...)
+		syncErrors = append(syncErrors, result.errors...)
+
+		job.Total += result.total
+		job.Synced += result.synced
+		job.DealersFound += result.dealers
+		job.ConnectionsDone++
+		if len(syncErrors) > 0 {
+			if data, err := json.Marshal(syncErrors); err == nil {
+				job.Errors = string(data)
+			}
+		}
+		h.saveSyncJob(job)
+	}
 
-		for _, item := range accountsResp.Items {
-			go func(it wialon.WialonItem) {
-				sem <- struct{}{}        // Захватываем слот
-				defer func() { <-sem }() // Освобождаем слот
+	// Остановка сервера: список аккаунтов неполный, деактивировать по нему нельзя
+	if ctx.Err() != nil {
+		finished := time.Now()
+		job.Status = models.SyncJobFailed
+		job.Error = "Прервано остановкой сервера"
+		job.CurrentConnection = ""
+		job.FinishedAt = &finished
+		h.saveSyncJob(job)
+		log.Printf("SyncAccounts: задача %d прервана остановкой сервера (подключений обработано: %d из %d)",
+			job.ID, job.ConnectionsDone, len(connections))
+		return
+	}
 
-				data, _ := wialonClient.GetAccountData(it.ID)
-				results <- accountResult{item: it, accountData: data}
-			}(item)
+	// Деактивируем аккаунты, которых нет в полученном списке
+	if len(allActiveIDs) > 0 {
+		if err := h.repo.DeactivateMissingAccounts(allActiveIDs); err != nil {
+			log.Printf("SyncAccounts ERROR deactivate: %v", err)
 		}
+	}
 
-		var synced int
-		var dealers int
-		processed := 0
+	finished := time.Now()
+	job.Status = models.SyncJobCompleted
+	job.CurrentConnection = ""
+	job.FinishedAt = &finished
+	h.saveSyncJob(job)
 
-		for range accountsResp.Items {
-			res := <-results
-			processed++
+	log.Printf("SyncAccounts: задача %d завершена. Подключений: %d, всего: %d, синхронизировано: %d",
+		job.ID, len(connections), job.Total, job.Synced)
+}
 
-			// Логируем прогресс каждые 500 аккаунтов
-			if processed%500 == 0 {
-				log.Printf("SyncAccounts: %s - обработано %d/%d", conn.Name, processed, len(accountsResp.Items))
-			}
+// saveSyncJob сохраняет состояние задачи синхронизации (ошибка только в лог — синхронизация продолжается)
+func (h *Handler) saveSyncJob(job *models.SyncJob) {
+	if err := h.repo.UpdateSyncJob(job); err != nil {
+		log.Printf("SyncAccounts ERROR: не удалось сохранить задачу %d: %v", job.ID, err)
+	}
+}
 
-			isDealer := false
-			var parentID int64 = 0
-			if res.accountData != nil {
-				isDealer = res.accountData.DealerRights == 1
-				parentID = res.accountData.ParentAccountId
-			}
+// connectionSyncResult - итог синхронизации одного подключения
+type connectionSyncResult struct {
+	total     int     // учётных записей в Wialon
+	synced    int     // сохранено в БД
+	dealers   int     // дилеров нашего аккаунта
+	activeIDs []int64 // Wialon ID, которые не нужно деактивировать
+	errors    []SyncError
+}
 
-			// Фильтр: только дилерские аккаунты с родителем = наш аккаунт
-			if !isDealer || parentID != parentAccountID {
-				continue
-			}
+// syncConnection загружает учётные записи подключения из Wialon и сохраняет дилеров нашего аккаунта
+func (h *Handler) syncConnection(ctx context.Context, conn models.WialonConnection) connectionSyncResult {
+	var result connectionSyncResult
 
-			dealers++
+	log.Printf("SyncAccounts: обработка подключения %s (host: %s)", conn.Name, conn.WialonHost)
 
-			// Создаём или обновляем аккаунт в БД
-			var parentIDPtr *int64
-			if parentID != 0 {
-				parentIDPtr = &parentID
-			}
+	// Формируем URL для API
+	wialonURL := "https://" + conn.WialonHost
 
-			// Определяем статус блокировки
-			isBlocked := false
-			if res.accountData != nil && res.accountData.Enabled != nil && *res.accountData.Enabled == 0 {
-				isBlocked = true
-			}
+	// Создаём Wialon клиент с токеном из подключения
+	wialonClient := h.newWialon(wialonURL, conn.Token, conn.RequestsPerSecond)
 
-			account := &models.Account{
-				WialonID:         res.item.ID,
-				Name:             res.item.Name,
-				IsDealer:         isDealer,
-				ParentID:         parentIDPtr,
-				IsBillingEnabled: false,
-				IsActive:         true,
-				IsBlocked:        isBlocked,
-				ConnectionID:     &conn.ID, // Привязываем к подключению
-			}
-			if err := h.repo.UpsertAccount(account); err == nil {
-				synced++
-				allActiveIDs = append(allActiveIDs, res.item.ID)
+	// Авторизуемся для получения ID текущего пользователя
+	if err := wialonClient.Login(ctx); err != nil {
+		log.Printf("SyncAccounts ERROR login for %s: %s", conn.Name, wialon.ScrubError(err, conn.Token))
+		result.errors = append(result.errors, newSyncError(conn, syncStageLogin, err))
+		return result
+	}
+
+	currentUserID := wialonClient.GetCurrentUserID()
+	// ID аккаунта пользователя (обычно userID + 1)
+	parentAccountID := currentUserID + 1
+	log.Printf("SyncAccounts: %s - userID=%d, parentAccountID=%d", conn.Name, currentUserID, parentAccountID)
+
+	// Получаем все учётные записи из Wialon
+	accountsResp, err := wialonClient.GetAccounts(ctx)
+	if err != nil {
+		log.Printf("SyncAccounts ERROR for %s: %s", conn.Name, wialon.ScrubError(err, conn.Token))
+		result.errors = append(result.errors, newSyncError(conn, syncStageGetAccounts, err))
+		return result
+	}
+
+	log.Printf("SyncAccounts: %s - получено %d аккаунтов", conn.Name, len(accountsResp.Items))
+	result.total = len(accountsResp.Items)
+
+	// Параллельная обработка GetAccountData с ограниченной конкурентностью
+	type accountResult struct {
+		item        wialon.WialonItem
+		accountData *wialon.AccountDataResponse
+		err         error
+	}
+
+	results := make(chan accountResult, len(accountsResp.Items))
+	sem := make(chan struct{}, 10) // Ограничиваем до 10 параллельных запросов
+
+	for _, item := range accountsResp.Items {
+		go func(it wialon.WialonItem) {
+			sem <- struct{}{}        // Захватываем слот
+			defer func() { <-sem }() // Освобождаем слот
+
+			data, err := wialonClient.GetAccountData(ctx, it.ID)
+			results <- accountResult{item: it, accountData: data, err: err}
+		}(item)
+	}
+
+	var synced int
+	var dealers int
+	var dataFailed int
+	var firstDataErr error
+	processed := 0
+
+	for range accountsResp.Items {
+		res := <-results
+		processed++
+
+		// Логируем прогресс каждые 500 аккаунтов
+		if processed%500 == 0 {
+			log.Printf("SyncAccounts: %s - обработано %d/%d", conn.Name, processed, len(accountsResp.Items))
+		}
+
+		// Данные не загрузились — неизвестно, дилер ли это; не деактивируем аккаунт
+		if res.err != nil {
+			dataFailed++
+			if firstDataErr == nil {
+				firstDataErr = res.err
 			}
+			result.activeIDs = append(result.activeIDs, res.item.ID)
+			continue
 		}
 
-		totalSynced += synced
-		totalDealers += dealers
-		log.Printf("SyncAccounts: %s - завершено. Дилеров: %d, синхронизировано: %d", conn.Name, dealers, synced)
-	}
+		isDealer := false
+		var parentID int64 = 0
+		if res.accountData != nil {
+			isDealer = res.accountData.DealerRights == 1
+			parentID = res.accountData.ParentAccountId
+		}
 
-	// Деактивируем аккаунты, которых нет в полученном списке
-	if len(allActiveIDs) > 0 {
-		if err := h.repo.DeactivateMissingAccounts(allActiveIDs); err != nil {
-			log.Printf("SyncAccounts ERROR deactivate: %v", err)
+		// Фильтр: только дилерские аккаунты с родителем = наш аккаунт
+		if !isDealer || parentID != parentAccountID {
+			continue
 		}
-	}
 
-	response := gin.H{
-		"message":       "Синхронизация завершена",
-		"total":         totalAccounts,
-		"synced":        totalSynced,
-		"dealers_found": totalDealers,
-		"connections":   len(connections),
+		dealers++
+
+		// Создаём или обновляем аккаунт в БД
+		var parentIDPtr *int64
+		if parentID != 0 {
+			parentIDPtr = &parentID
+		}
+
+		// Определяем статус блокировки
+		isBlocked := false
+		if res.accountData != nil && res.accountData.Enabled != nil && *res.accountData.Enabled == 0 {
+			isBlocked = true
+		}
+
+		account := &models.Account{
+			WialonID:         res.item.ID,
+			Name:             res.item.Name,
+			IsDealer:         isDealer,
+			ParentID:         parentIDPtr,
+			IsBillingEnabled: false,
+			IsActive:         true,
+			IsBlocked:        isBlocked,
+			BillingCurrency:  h.billing.DefaultBillingCurrency, // только при создании — upsert её не перезаписывает
+			ConnectionID:     &conn.ID,                         // Привязываем к подключению
+		}
+		if err := h.repo.UpsertAccount(account); err == nil {
+			synced++
+			result.activeIDs = append(result.activeIDs, res.item.ID)
+		}
 	}
 
-	if len(syncErrors) > 0 {
-		response["errors"] = syncErrors
+	if dataFailed > 0 {
+		result.errors = append(result.errors, newSyncError(conn, syncStageAccountData,
+			fmt.Errorf("не удалось получить данные %d из %d учётных записей: %w",
+				dataFailed, len(accountsResp.Items), firstDataErr)))
 	}
 
-	log.Printf("SyncAccounts: завершено. Подключений: %d, всего: %d, синхронизировано: %d",
-		len(connections), totalAccounts, totalSynced)
+	result.synced = synced
+	result.dealers = dealers
+	log.Printf("SyncAccounts: %s - завершено. Дилеров: %d, синхронизировано: %d", conn.Name, dealers, synced)
+	return result
+}
 
-	c.JSON(http.StatusOK, response)
+// Этапы синхронизации подключения (для SyncError.Stage)
+const (
+	syncStageLogin       = "login"        // авторизация по токену
+	syncStageGetAccounts = "get_accounts" // список учётных записей
+	syncStageAccountData = "account_data" // данные отдельных учётных записей
+)
+
+// SyncError - ошибка синхронизации одного подключения
+type SyncError struct {
+	ConnectionID   uint   `json:"connection_id"`
+	ConnectionName string `json:"connection_name"`
+	Stage          string `json:"stage"`
+	Error          string `json:"error"` // без токенов и сессий
+}
+
+// newSyncError формирует ошибку подключения с вычищенными учётными данными
+func newSyncError(conn models.WialonConnection, stage string, err error) SyncError {
+	return SyncError{
+		ConnectionID:   conn.ID,
+		ConnectionName: conn.Name,
+		Stage:          stage,
+		Error:          wialon.ScrubError(err, conn.Token),
+	}
 }
 
 // === Modules ===
@@ -514,6 +810,36 @@ func (h *Handler) GetModules(c *gin.Context) {
 	c.JSON(http.StatusOK, modules)
 }
 
+// GetModuleStats возвращает по каждому модулю число аккаунтов, объектов и начисления по валютам за месяц
+// GET /api/modules/stats?year=&month=&group_id=
+func (h *Handler) GetModuleStats(c *gin.Context) {
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Фильтр по группе: только аккаунты группы и её подгрупп
+	group, groupAccountIDs, err := h.parseGroupFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stats, err := h.repo.GetModuleStats(period.Year, period.Month, groupAccountIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"year":    period.Year,
+		"month":   period.Month,
+		"modules": stats,
+		"group":   group,
+	})
+}
+
 // CreateModule создаёт новый модуль
 func (h *Handler) CreateModule(c *gin.Context) {
 	var module models.Module
@@ -522,6 +848,14 @@ func (h *Handler) CreateModule(c *gin.Context) {
 		return
 	}
 
+	if module.Currency == "" {
+		module.Currency = h.billing.DefaultModuleCurrency
+	}
+	if !h.currencies[module.Currency] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверная валюта. Допустимые: " + currencyList(h.currencies)})
+		return
+	}
+
 	if err := h.repo.CreateModule(&module); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -551,9 +885,55 @@ func (h *Handler) UpdateModule(c *gin.Context) {
 		return
 	}
 
+	// Цена или валюта модуля могли измениться — пересчитываем начисления его аккаунтов
+	if h.billing.RecalculateOnModuleChange != config.RecalculateOff && h.billing.RecalculateOnModuleChange != "" {
+		accountIDs, err := h.repo.AccountIDsWithModule(module.ID)
+		if err != nil {
+			log.Printf("Пересчёт начислений после изменения модуля %d: %v", module.ID, err)
+		} else {
+			h.recalculateAfterModuleChange(accountIDs)
+		}
+	}
+
 	c.JSON(http.StatusOK, module)
 }
 
+// recalculateAfterModuleChange пересчитывает начисления текущего месяца у аккаунтов, модули
+// которых изменились (billing.recalculate_on_module_change: sync — сразу, async — в фоне).
+// Кэш аккаунтов в биллинге, на котором строится дашборд, сбрасывает сам репозиторий.
+// Возвращает режим пересчёта для ответа ("" — пересчёт не запускался).
+func (h *Handler) recalculateAfterModuleChange(accountIDs []uint) string {
+	mode := h.billing.RecalculateOnModuleChange
+	if len(accountIDs) == 0 || (mode != config.RecalculateSync && mode != config.RecalculateAsync) {
+		return ""
+	}
+
+	loc := h.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	now := time.Now().In(loc)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	ids := append([]uint(nil), accountIDs...)
+
+	recalculate := func() {
+		result, err := h.snapshot.BackfillDailyCharges(ids, month, month, 0)
+		if err != nil {
+			log.Printf("Пересчёт начислений после изменения модулей: %v", err)
+			return
+		}
+		if result.Failed > 0 {
+			log.Printf("Пересчёт начислений после изменения модулей: ошибок %d из %d", result.Failed, result.Total)
+		}
+	}
+	if mode == config.RecalculateAsync {
+		go recalculate()
+	} else {
+		recalculate()
+	}
+	return mode
+}
+
 // DeleteModule удаляет модуль
 func (h *Handler) DeleteModule(c *gin.Context) {
 	idStr := c.Param("id")
@@ -588,12 +968,30 @@ func (h *Handler) AssignModule(c *gin.Context) {
 		return
 	}
 
-	if err := h.repo.AssignModuleToAccount(uint(accountID), req.ModuleID); err != nil {
+	if _, err := h.repo.GetAccountByID(uint(accountID)); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+	if _, err := h.repo.GetModuleByID(req.ModuleID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Модуль не найден"})
+		return
+	}
+
+	created, err := h.repo.AssignModuleToAccount(uint(accountID), req.ModuleID)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !created {
+		c.JSON(http.StatusOK, gin.H{"message": "Модуль уже привязан", "already_assigned": true})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Модуль привязан"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":               "Модуль привязан",
+		"already_assigned":      false,
+		"charges_recalculation": h.recalculateAfterModuleChange([]uint{uint(accountID)}),
+	})
 }
 
 // === Settings ===
@@ -609,15 +1007,23 @@ func (h *Handler) GetSettings(c *gin.Context) {
 	if settings == nil {
 		// Возвращаем дефолтные настройки
 		settings = &models.BillingSettings{
-			WialonType: "hosting",
-			UnitPrice:  2.0,
-			Currency:   "EUR",
+			WialonType:       "hosting",
+			UnitPrice:        2.0,
+			Currency:         h.billing.DefaultModuleCurrency,
+			PricesIncludeVAT: true,
+			PDFTemplate:      invoice.DefaultPDFTemplate,
+			Locale:           invoice.DefaultLocale,
 		}
 	}
 
 	c.JSON(http.StatusOK, settings)
 }
 
+// GetPDFTemplates возвращает доступные шаблоны PDF счёта
+func (h *Handler) GetPDFTemplates(c *gin.Context) {
+	c.JSON(http.StatusOK, invoice.PDFTemplates)
+}
+
 // UpdateSettings обновляет настройки биллинга
 func (h *Handler) UpdateSettings(c *gin.Context) {
 	var settings models.BillingSettings
@@ -626,6 +1032,64 @@ func (h *Handler) UpdateSettings(c *gin.Context) {
 		return
 	}
 
+	if settings.MinimumInvoiceAmount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Минимальная сумма счёта не может быть отрицательной"})
+		return
+	}
+	if settings.MinSnapshotDaysForBilling < 0 || settings.MinSnapshotDaysForBilling > 31 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "min_snapshot_days_for_billing: допустимо от 0 до 31"})
+		return
+	}
+	if settings.DeactivationGraceDays < 0 || settings.DeactivationGraceDays > 31 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "deactivation_grace_days: допустимо от 0 до 31"})
+		return
+	}
+	settings.SnapshotTimezone = strings.TrimSpace(settings.SnapshotTimezone)
+	if _, err := time.LoadLocation(settings.SnapshotTimezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "snapshot_timezone: неизвестный часовой пояс " + settings.SnapshotTimezone})
+		return
+	}
+	if settings.SnapshotHour < 0 || settings.SnapshotHour > 23 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "snapshot_hour: допустимо от 0 до 23"})
+		return
+	}
+	if settings.MinimumInvoiceCurrency != "" && !h.currencies[settings.MinimumInvoiceCurrency] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверная валюта минимальной суммы. Допустимые: " + currencyList(h.currencies)})
+		return
+	}
+	switch settings.OnBelowMinimum {
+	case "", models.OnBelowMinimumSkip, models.OnBelowMinimumRoundUp:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "on_below_minimum: допустимые значения skip, round_up"})
+		return
+	}
+	if settings.PDFTemplate == "" {
+		settings.PDFTemplate = invoice.DefaultPDFTemplate
+	} else if !invoice.IsValidPDFTemplate(settings.PDFTemplate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неизвестный шаблон PDF"})
+		return
+	}
+	if settings.Locale == "" {
+		settings.Locale = invoice.DefaultLocale
+	} else if !invoice.IsValidLocale(settings.Locale) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неизвестная локаль. Допустимые: ru, en"})
+		return
+	}
+
+	// Подпись и печать проверяем сразу, чтобы не получить счета без них
+	if settings.SignatureImage != "" {
+		if err := invoice.ValidateBase64PNG(settings.SignatureImage); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Изображение подписи: " + err.Error()})
+			return
+		}
+	}
+	if settings.StampImage != "" {
+		if err := invoice.ValidateBase64PNG(settings.StampImage); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Изображение печати: " + err.Error()})
+			return
+		}
+	}
+
 	if err := h.repo.SaveSettings(&settings); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -634,6 +1098,90 @@ func (h *Handler) UpdateSettings(c *gin.Context) {
 	c.JSON(http.StatusOK, settings)
 }
 
+// === Supplier Bank Accounts ===
+
+// GetSupplierBankAccounts возвращает банковские счета поставщика
+func (h *Handler) GetSupplierBankAccounts(c *gin.Context) {
+	accounts, err := h.repo.GetSupplierBankAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+// CreateSupplierBankAccount добавляет банковский счёт поставщика
+func (h *Handler) CreateSupplierBankAccount(c *gin.Context) {
+	var account models.SupplierBankAccount
+	if err := c.ShouldBindJSON(&account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	account.ID = 0
+	h.saveSupplierBankAccount(c, &account, http.StatusCreated)
+}
+
+// UpdateSupplierBankAccount обновляет банковский счёт поставщика
+func (h *Handler) UpdateSupplierBankAccount(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+	existing, err := h.repo.GetSupplierBankAccountByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Банковский счёт не найден"})
+		return
+	}
+
+	var account models.SupplierBankAccount
+	if err := c.ShouldBindJSON(&account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	account.ID = existing.ID
+	account.CreatedAt = existing.CreatedAt
+	h.saveSupplierBankAccount(c, &account, http.StatusOK)
+}
+
+// saveSupplierBankAccount проверяет и сохраняет банковский счёт поставщика
+func (h *Handler) saveSupplierBankAccount(c *gin.Context, account *models.SupplierBankAccount, status int) {
+	account.Currency = strings.ToUpper(strings.TrimSpace(account.Currency))
+	account.IIK = strings.TrimSpace(account.IIK)
+	if !h.currencies[account.Currency] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверная валюта. Допустимые: " + currencyList(h.currencies)})
+		return
+	}
+	if account.IIK == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите ИИК"})
+		return
+	}
+
+	if err := h.repo.SaveSupplierBankAccount(account); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(status, account)
+}
+
+// DeleteSupplierBankAccount удаляет банковский счёт поставщика
+func (h *Handler) DeleteSupplierBankAccount(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+
+	if err := h.repo.DeleteSupplierBankAccount(uint(id)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Банковский счёт удалён"})
+}
+
 // === Exchange Rates ===
 
 // GetExchangeRates возвращает историю курсов
@@ -647,11 +1195,52 @@ func (h *Handler) GetExchangeRates(c *gin.Context) {
 	c.JSON(http.StatusOK, rates)
 }
 
+// ConvertCurrency конвертирует сумму между валютами по курсу НБК
+// GET /api/exchange-rates/convert?from=EUR&to=KZT&amount=100&date=2026-01-31
+func (h *Handler) ConvertCurrency(c *gin.Context) {
+	from := strings.ToUpper(c.Query("from"))
+	to := strings.ToUpper(c.Query("to"))
+	if from == "" || to == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "укажите from и to"})
+		return
+	}
+
+	amount := 1.0
+	if amountStr := c.Query("amount"); amountStr != "" {
+		a, err := strconv.ParseFloat(amountStr, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный формат amount"})
+			return
+		}
+		amount = a
+	}
+
+	now := time.Now()
+	date := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if dateStr := c.Query("date"); dateStr != "" {
+		d, err := time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "неверный формат date"})
+			return
+		}
+		date = d
+	}
+
+	result, err := h.invoice.ConvertCurrency(amount, from, to, date)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
 // BackfillExchangeRates заполняет курсы валют за период
 func (h *Handler) BackfillExchangeRates(c *gin.Context) {
 	var req struct {
-		From string `json:"from"` // формат: 2025-11-01
-		To   string `json:"to"`   // формат: 2026-01-30
+		From   string `json:"from"`    // формат: 2025-11-01
+		To     string `json:"to"`      // формат: 2026-01-30
+		DryRun bool   `json:"dry_run"` // только проверить покрытие, без сохранения
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -671,6 +1260,11 @@ func (h *Handler) BackfillExchangeRates(c *gin.Context) {
 		return
 	}
 
+	if req.DryRun {
+		h.previewExchangeRatesBackfill(c, fromDate, toDate)
+		return
+	}
+
 	// Запрашиваем курсы для каждого дня
 	count := 0
 	for d := fromDate; !d.After(toDate); d = d.AddDate(0, 0, 1) {
@@ -689,8 +1283,85 @@ func (h *Handler) BackfillExchangeRates(c *gin.Context) {
 	})
 }
 
+// previewExchangeRatesBackfill показывает покрытие курсов за период без сохранения:
+// exists — курсы уже в БД, fetchable — НБК отдаёт курсы, missing — курсов нет (выходной/праздник), error — ошибка запроса
+func (h *Handler) previewExchangeRatesBackfill(c *gin.Context, fromDate, toDate time.Time) {
+	type dayStatus struct {
+		Date   string             `json:"date"`
+		Status string             `json:"status"`
+		Rates  map[string]float64 `json:"rates,omitempty"`
+		Error  string             `json:"error,omitempty"`
+	}
+
+	days := []dayStatus{}
+	summary := map[string]int{"exists": 0, "fetchable": 0, "missing": 0, "error": 0}
+
+	for d := fromDate; !d.After(toDate); d = d.AddDate(0, 0, 1) {
+		day := dayStatus{Date: d.Format("2006-01-02")}
+
+		// Курсы всех отслеживаемых валют (nbk.currencies) уже есть в БД
+		stored := make(map[string]float64, len(h.nbk.Currencies()))
+		for _, currency := range h.nbk.Currencies() {
+			if rate, err := h.repo.GetExchangeRateByDate(currency, d); err == nil {
+				stored[currency] = rate.Rate
+			}
+		}
+		if len(stored) == len(h.nbk.Currencies()) {
+			day.Status = "exists"
+			day.Rates = stored
+		} else {
+			rates, err := h.nbk.FetchRatesForDate(d)
+			switch {
+			case err != nil:
+				day.Status = "error"
+				day.Error = err.Error()
+			case len(rates) == 0:
+				day.Status = "missing"
+			default:
+				day.Status = "fetchable"
+				day.Rates = rates
+			}
+		}
+
+		summary[day.Status]++
+		days = append(days, day)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run": true,
+		"from":    fromDate.Format("2006-01-02"),
+		"to":      toDate.Format("2006-01-02"),
+		"summary": summary,
+		"days":    days,
+	})
+}
+
+// === Version ===
+
+// GetVersion возвращает версию сборки (задаётся через -ldflags)
+func (h *Handler) GetVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, version.Get())
+}
+
 // === Dashboard ===
 
+// parseModuleFilter разбирает необязательный фильтр ?module_id=. Без параметра — nil (все модули).
+func (h *Handler) parseModuleFilter(c *gin.Context) (*models.Module, error) {
+	idStr := c.Query("module_id")
+	if idStr == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil || id == 0 {
+		return nil, fmt.Errorf("неверный module_id: %s", idStr)
+	}
+	module, err := h.repo.GetModuleByID(uint(id))
+	if err != nil {
+		return nil, fmt.Errorf("модуль %d не найден", id)
+	}
+	return module, nil
+}
+
 // GetDashboard возвращает данные для дашборда
 func (h *Handler) GetDashboard(c *gin.Context) {
 	// Проверяем, нужна ли фильтрация по дилеру
@@ -718,20 +1389,55 @@ func (h *Handler) GetDashboard(c *gin.Context) {
 		}
 	}
 
-	// Парсим параметры периода (по умолчанию текущий месяц)
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	year, month := period.Year, period.Month
 
-	if yearStr := c.Query("year"); yearStr != "" {
-		if y, err := strconv.Atoi(yearStr); err == nil && y > 2000 && y < 2100 {
-			year = y
+	// Фильтр по модулю: только аккаунты, к которым он привязан, и только его стоимость
+	filterModule, err := h.parseModuleFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var moduleAccountIDs map[uint]bool
+	if filterModule != nil {
+		moduleAccountIDs = make(map[uint]bool)
+		var filtered []models.Account
+		for _, acc := range accounts {
+			for _, am := range acc.Modules {
+				if am.ModuleID == filterModule.ID {
+					moduleAccountIDs[acc.ID] = true
+					filtered = append(filtered, acc)
+					break
+				}
+			}
 		}
+		accounts = filtered
 	}
-	if monthStr := c.Query("month"); monthStr != "" {
-		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
-			month = m
+
+	// Фильтр по группе: только аккаунты группы и её подгрупп
+	filterGroup, groupIDs, err := h.parseGroupFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var groupAccountIDs map[uint]bool
+	if filterGroup != nil {
+		groupAccountIDs = make(map[uint]bool, len(groupIDs))
+		for _, id := range groupIDs {
+			groupAccountIDs[id] = true
+		}
+		var filtered []models.Account
+		for _, acc := range accounts {
+			if groupAccountIDs[acc.ID] {
+				filtered = append(filtered, acc)
+			}
 		}
+		accounts = filtered
 	}
 
 	// Получаем снимки за указанный период (с фильтрацией по дилеру если нужно)
@@ -749,6 +1455,20 @@ func (h *Handler) GetDashboard(c *gin.Context) {
 		return
 	}
 
+	if moduleAccountIDs != nil || groupAccountIDs != nil {
+		filtered := snapshots[:0]
+		for _, snap := range snapshots {
+			if moduleAccountIDs != nil && !moduleAccountIDs[snap.AccountID] {
+				continue
+			}
+			if groupAccountIDs != nil && !groupAccountIDs[snap.AccountID] {
+				continue
+			}
+			filtered = append(filtered, snap)
+		}
+		snapshots = filtered
+	}
+
 	// settings больше не нужен — цены из модулей
 
 	// Группируем снимки по дате и считаем сумму АКТИВНЫХ объектов за каждый день
@@ -789,6 +1509,9 @@ func (h *Handler) GetDashboard(c *gin.Context) {
 		}
 
 		for _, am := range acc.Modules {
+			if filterModule != nil && am.ModuleID != filterModule.ID {
+				continue
+			}
 			module := am.Module
 			if module.ID == 0 || usedModules[module.ID] {
 				continue
@@ -814,6 +1537,8 @@ func (h *Handler) GetDashboard(c *gin.Context) {
 		"snapshots":        snapshots,
 		"year":             year,
 		"month":            month,
+		"module":           filterModule,
+		"group":            filterGroup,
 	})
 }
 
@@ -822,26 +1547,34 @@ func (h *Handler) GetDashboard(c *gin.Context) {
 // GetSnapshots возвращает список снимков с серверной пагинацией
 func (h *Handler) GetSnapshots(c *gin.Context) {
 	// Параметры пагинации
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
-	if page < 1 {
-		page = 1
-	}
-	if pageSize < 1 || pageSize > 5000 {
-		pageSize = 20
+	page, pageSize, err := h.parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	// Фильтр по дате
+	// Фильтр по дате (YYYY-MM-DD, DD.MM.YYYY или RFC3339 с переводом в часовой пояс tz)
+	loc, err := h.requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	var from, to *time.Time
 	if fromStr := c.Query("from"); fromStr != "" {
-		if t, err := time.Parse("2006-01-02", fromStr); err == nil {
-			from = &t
+		t, err := parseDateParam(fromStr, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
+		from = &t
 	}
 	if toStr := c.Query("to"); toStr != "" {
-		if t, err := time.Parse("2006-01-02", toStr); err == nil {
-			to = &t
+		t, err := parseDateParam(toStr, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
+		to = &t
 	}
 	// Фильтр по аккаунту
 	var accountID *uint
@@ -866,6 +1599,77 @@ func (h *Handler) GetSnapshots(c *gin.Context) {
 	})
 }
 
+// SearchSnapshotUnits ищет объекты в сохранённых снимках по подстроке названия (q)
+// или ID объекта Wialon (wialon_unit_id) — в каком аккаунте и снимке был объект.
+// Дилер и партнёр видят только объекты своего аккаунта.
+// GET /api/snapshot-units/search?q=&wialon_unit_id=&page=&page_size=
+func (h *Handler) SearchSnapshotUnits(c *gin.Context) {
+	page, pageSize, err := h.parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := repository.SnapshotUnitFilter{Query: strings.TrimSpace(c.Query("q"))}
+	if idStr := c.Query("wialon_unit_id"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный wialon_unit_id"})
+			return
+		}
+		filter.WialonUnitID = &id
+	}
+	if filter.Query == "" && filter.WialonUnitID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите q или wialon_unit_id"})
+		return
+	}
+	if len([]rune(filter.Query)) == 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Строка поиска q — не короче 2 символов"})
+		return
+	}
+
+	// Дилер и партнёр — только свой аккаунт
+	if wialonID, restricted := scopedWialonID(c); restricted {
+		if wialonID == nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Нет доступа"})
+			return
+		}
+		filter.AccountWialonID = wialonID
+	}
+
+	units, total, err := h.repo.SearchSnapshotUnits(filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      units,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// scopedWialonID возвращает Wialon ID аккаунта, которым ограничен дилер или партнёр
+// (нужны DealerContext и PartnerContext). restricted=false — роль без ограничений;
+// restricted=true и nil — привязки нет, доступа нет.
+func scopedWialonID(c *gin.Context) (wialonID *int64, restricted bool) {
+	role, _ := c.Get("role")
+	var scopeKey string
+	switch role {
+	case "dealer":
+		scopeKey = "dealerWialonID"
+	case "partner":
+		scopeKey = "partnerWialonID"
+	default:
+		return nil, false
+	}
+	scope, _ := c.Get(scopeKey)
+	wialonID, _ = scope.(*int64)
+	return wialonID, true
+}
+
 // CreateSnapshot создаёт ручной снимок
 func (h *Handler) CreateSnapshot(c *gin.Context) {
 	var req struct {
@@ -876,7 +1680,7 @@ func (h *Handler) CreateSnapshot(c *gin.Context) {
 		return
 	}
 
-	snapshot, err := h.snapshot.CreateManualSnapshot(req.AccountID)
+	snapshot, err := h.snapshot.CreateManualSnapshot(c.Request.Context(), req.AccountID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -902,7 +1706,7 @@ func (h *Handler) CreateSnapshotsForDate(c *gin.Context) {
 		return
 	}
 
-	snapshots, err := h.snapshot.CreateSnapshotsForDate(snapshotDate)
+	snapshots, err := h.snapshot.CreateSnapshotsForDate(c.Request.Context(), snapshotDate)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -952,7 +1756,7 @@ func (h *Handler) CreateSnapshotsForRange(c *gin.Context) {
 		return
 	}
 
-	snapshots, err := h.snapshot.CreateSnapshotsForRange(fromDate, toDate)
+	snapshots, err := h.snapshot.CreateSnapshotsForRange(c.Request.Context(), fromDate, toDate)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -966,41 +1770,236 @@ func (h *Handler) CreateSnapshotsForRange(c *gin.Context) {
 	})
 }
 
-// ClearAllSnapshots удаляет все снимки (с защитным кодом)
-func (h *Handler) ClearAllSnapshots(c *gin.Context) {
-	var req struct {
-		ConfirmCode string `json:"confirm_code" binding:"required"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите код подтверждения"})
+// maxBackfillMonths - максимальная длина диапазона досчёта начислений
+const maxBackfillMonths = 60
+
+// parseMonth разбирает месяц в одном из monthFormats
+func parseMonth(s string) (time.Time, error) {
+	for _, layout := range monthFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("неверный формат месяца: %s (ожидается YYYY-MM или MM.YYYY)", s)
+}
+
+// BackfillCharges пересчитывает начисления по месяцам from–to (включительно) для всех аккаунтов
+// в биллинге или только для account_ids — чтобы прошлые периоды после CreateSnapshotsForRange
+// попали в отчёты и счета. Выполняется синхронно, в ответе — итоговые счётчики.
+// POST /api/charges/backfill
+func (h *Handler) BackfillCharges(c *gin.Context) {
+	var req struct {
+		From       string `json:"from" binding:"required"` // формат: "2006-01"
+		To         string `json:"to" binding:"required"`   // формат: "2006-01"
+		AccountIDs []uint `json:"account_ids"`
+		Workers    int    `json:"workers"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите from и to в формате YYYY-MM"})
+		return
+	}
+
+	from, err := parseMonth(req.From)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	to, err := parseMonth(req.To)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from должен быть раньше to"})
+		return
+	}
+	months := (to.Year()-from.Year())*12 + int(to.Month()) - int(from.Month()) + 1
+	if months > maxBackfillMonths {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Диапазон не должен превышать %d месяцев", maxBackfillMonths)})
+		return
+	}
+	if req.Workers < 0 || req.Workers > 16 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workers должен быть от 1 до 16 (0 — по умолчанию)"})
+		return
+	}
+
+	accountIDs := uniqueIDs(req.AccountIDs)
+	for _, id := range accountIDs {
+		if account, err := h.repo.GetAccountByID(id); err != nil || account == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Аккаунт %d не найден", id)})
+			return
+		}
+	}
+
+	result, err := h.snapshot.BackfillDailyCharges(accountIDs, from, to, req.Workers)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// ClearAllSnapshots удаляет все снимки (с защитным кодом)
+func (h *Handler) ClearAllSnapshots(c *gin.Context) {
+	var req struct {
+		ConfirmCode string `json:"confirm_code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите код подтверждения"})
+		return
+	}
+
+	// Проверяем защитный код
+	if req.ConfirmCode != "220475" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Неверный код подтверждения"})
+		return
+	}
+
+	// Удаляем все снимки
+	result, err := h.repo.ClearAllSnapshots()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("Удалено %d снимков (объектов: %d, изменений: %d, начислений: %d)",
+		result.Snapshots, result.SnapshotUnits, result.Changes, result.DailyCharges)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Все снимки удалены",
+		"count":   result.Snapshots,
+		"deleted": result,
+	})
+}
+
+// DeleteSnapshots удаляет снимки за дату или по аккаунту за период (с защитным кодом)
+// DELETE /api/snapshots?date=YYYY-MM-DD
+// DELETE /api/snapshots?account_id=N&from=YYYY-MM-DD&to=YYYY-MM-DD
+func (h *Handler) DeleteSnapshots(c *gin.Context) {
+	var req struct {
+		ConfirmCode string `json:"confirm_code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите код подтверждения"})
+		return
+	}
+
+	if req.ConfirmCode != "220475" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Неверный код подтверждения"})
+		return
+	}
+
+	var accountID uint
+	var from, to time.Time
+
+	if dateStr := c.Query("date"); dateStr != "" {
+		date, err := time.Parse("2006-01-02", dateStr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат даты (YYYY-MM-DD)"})
+			return
+		}
+		from, to = date, date
+	}
+
+	if accountIDStr := c.Query("account_id"); accountIDStr != "" {
+		id, err := strconv.ParseUint(accountIDStr, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID аккаунта"})
+			return
+		}
+		accountID = uint(id)
+
+		if c.Query("date") == "" {
+			fromStr, toStr := c.Query("from"), c.Query("to")
+			if fromStr == "" || toStr == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите from и to (YYYY-MM-DD)"})
+				return
+			}
+			var errFrom, errTo error
+			from, errFrom = time.Parse("2006-01-02", fromStr)
+			to, errTo = time.Parse("2006-01-02", toStr)
+			if errFrom != nil || errTo != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат даты (YYYY-MM-DD)"})
+				return
+			}
+		}
+	}
+
+	if from.IsZero() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите date или account_id с from и to"})
+		return
+	}
+	if from.After(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Дата from не может быть позже to"})
+		return
+	}
+
+	result, err := h.repo.DeleteSnapshotsScoped(accountID, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	log.Printf("Удалено снимков: %d (аккаунт %d, %s — %s)", result.Snapshots, accountID,
+		from.Format("2006-01-02"), to.Format("2006-01-02"))
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Снимки удалены",
+		"deleted": result,
+	})
+}
+
+// GetAccountUsageBreakdown показывает, из чего складываются цифры снимка аккаунта:
+// собственный avl_unit.usage, объекты по владельцам (bact) и дочерние аккаунты дилера
+func (h *Handler) GetAccountUsageBreakdown(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
 		return
 	}
 
-	// Проверяем защитный код
-	if req.ConfirmCode != "220475" {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Неверный код подтверждения"})
+	if account, err := h.repo.GetAccountByID(uint(id)); err != nil || account == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
 		return
 	}
 
-	// Удаляем все снимки
-	count, err := h.repo.ClearAllSnapshots()
+	breakdown, err := h.snapshot.GetUsageBreakdown(c.Request.Context(), uint(id))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		log.Printf("GetAccountUsageBreakdown: аккаунт %d: %v", id, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("Удалено %d снимков", count)
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Все снимки удалены",
-		"count":   count,
-	})
+	c.JSON(http.StatusOK, breakdown)
 }
 
 // === Changes ===
 
-// GetChanges возвращает изменения
+// GetChanges возвращает последние изменения (постранично, если передан page или page_size);
+// ?type= — только изменения типа added, removed, deactivated, reactivated или renamed
 func (h *Handler) GetChanges(c *gin.Context) {
-	changes, err := h.repo.GetChanges(100)
+	changeType := c.Query("type")
+	if changeType != "" && !models.ChangeTypes[changeType] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "type: допустимые значения added, removed, deactivated, reactivated, renamed"})
+		return
+	}
+
+	if hasPagination(c) {
+		page, pageSize, err := h.parsePagination(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		changes, total, err := h.repo.GetChangesPaginated(page, pageSize, changeType)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": changes, "total": total, "page": page, "page_size": pageSize})
+		return
+	}
+
+	changes, err := h.repo.GetChanges(100, changeType)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1058,8 +2057,23 @@ func (h *Handler) InviteDealer(c *gin.Context) {
 
 // === Invoices ===
 
-// GetInvoices возвращает список счетов
+// GetInvoices возвращает последние счета (постранично, если передан page или page_size)
 func (h *Handler) GetInvoices(c *gin.Context) {
+	if hasPagination(c) {
+		page, pageSize, err := h.parsePagination(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		invoices, total, err := h.repo.GetInvoicesPaginated(page, pageSize)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"data": invoices, "total": total, "page": page, "page_size": pageSize})
+		return
+	}
+
 	invoices, err := h.repo.GetInvoices(100)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -1089,6 +2103,12 @@ func (h *Handler) GetInvoice(c *gin.Context) {
 		return
 	}
 
+	// Доставка писем по получателям: «отправлен» ещё не значит «доставлен»
+	if invoice.Deliveries, err = h.repo.GetInvoiceDeliveries(invoice.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, invoice)
 }
 
@@ -1145,24 +2165,82 @@ func (h *Handler) GetInvoicePDF(c *gin.Context) {
 		}
 	}
 
-	// Генерируем PDF
-	generator := invoicesvc.NewPDFGenerator()
-	pdfBytes, err := generator.GenerateInvoicePDF(inv, settings, account)
+	// Генерируем PDF (или 304, если у клиента актуальная версия)
+	pdfBytes, notModified, err := h.invoicePDF(c, inv, settings, account)
 	if err != nil {
 		log.Printf("Ошибка генерации PDF для счёта %d: %v", inv.ID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации PDF: " + err.Error()})
 		return
 	}
+	if notModified {
+		return
+	}
 
 	// Отправляем PDF
-	// Имя файла: используем номер счёта (заменяем / на _)
+	// Имя файла: используем номер счёта (небезопасные символы заменит setAttachment)
 	invoiceNum := inv.Number
 	if invoiceNum == "" {
 		invoiceNum = fmt.Sprintf("%d", inv.ID)
 	}
-	filename := fmt.Sprintf("invoice_%s.pdf", strings.ReplaceAll(invoiceNum, "/", "_"))
+	filename := fmt.Sprintf("invoice_%s.pdf", invoiceNum)
 	c.Header("Content-Type", "application/pdf")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	setAttachment(c, filename)
+	c.Data(http.StatusOK, "application/pdf", pdfBytes)
+}
+
+// PreviewInvoicePDF строит счёт аккаунта за период в памяти и отдаёт его PDF без записи в БД
+// POST /api/invoices/preview-pdf {"year": 2026, "month": 1, "account_id": 5}
+func (h *Handler) PreviewInvoicePDF(c *gin.Context) {
+	var req struct {
+		Year      int  `json:"year" binding:"required"`
+		Month     int  `json:"month" binding:"required,min=1,max=12"`
+		AccountID uint `json:"account_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.repo.GetAccountByID(req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+
+	settings, err := h.repo.GetSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения настроек"})
+		return
+	}
+
+	period := time.Date(req.Year, time.Month(req.Month), 1, 0, 0, 0, 0, time.Local)
+	inv, err := h.invoice.PreviewInvoice(account.ID, period)
+	var belowMin *invoicesvc.BelowMinimumError
+	switch {
+	case errors.As(err, &belowMin):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":         "Счёт не будет выставлен: " + err.Error(),
+			"below_minimum": belowMin.BelowMinimum,
+		})
+		return
+	case errors.Is(err, invoicesvc.ErrNothingToInvoice):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Счёт не будет выставлен: " + err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	pdfBytes, err := h.pdf.GenerateInvoicePDF(inv, settings, account, invoicesvc.DraftWatermark)
+	if err != nil {
+		log.Printf("Ошибка генерации PDF предпросмотра для %s: %v", account.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации PDF: " + err.Error()})
+		return
+	}
+
+	// Предпросмотр зависит от текущих снимков и курсов — не кэшируем
+	c.Header("Cache-Control", "no-store")
+	setAttachment(c, fmt.Sprintf("invoice_preview_%d_%s.pdf", account.ID, period.Format("2006-01")))
 	c.Data(http.StatusOK, "application/pdf", pdfBytes)
 }
 
@@ -1189,7 +2267,7 @@ func (h *Handler) GetInvoiceExcel(c *gin.Context) {
 	h.snapshot.CalculateDailyChargesForPeriod(inv.AccountID, year, month)
 
 	// Всегда генерируем Excel из актуальных DailyCharges
-	excelData, err := GenerateChargesExcelBytes(h.repo, inv.AccountID, year, month)
+	excelData, err := GenerateChargesExcelBytes(h.repo, h.invoice.Precision(), h.billing.DefaultBillingCurrency, inv.AccountID, year, month)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации Excel"})
 		return
@@ -1203,18 +2281,23 @@ func (h *Handler) GetInvoiceExcel(c *gin.Context) {
 	if invoiceNum == "" {
 		invoiceNum = fmt.Sprintf("%d", inv.ID)
 	}
-	filename := fmt.Sprintf("charges_%s.xlsx", strings.ReplaceAll(invoiceNum, "/", "_"))
+	filename := fmt.Sprintf("charges_%s.xlsx", invoiceNum)
 	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	setAttachment(c, filename)
 	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", excelData)
 }
 
 // GenerateInvoices генерирует счета за указанный период
 func (h *Handler) GenerateInvoices(c *gin.Context) {
 	var req struct {
-		Year      int   `json:"year"`
-		Month     int   `json:"month"`
-		AccountID *uint `json:"account_id,omitempty"` // опционально: для одного аккаунта
+		Year       int    `json:"year"`
+		Month      int    `json:"month"`
+		AccountID  *uint  `json:"account_id,omitempty"`  // опционально: для одного аккаунта
+		AccountIDs []uint `json:"account_ids,omitempty"` // опционально: для списка аккаунтов
+		// Опционально: только аккаунты группы и её подгрупп (как ежемесячная генерация)
+		GroupID *uint `json:"group_id,omitempty"`
+		// Выставить, даже если дней со снимками меньше min_snapshot_days_for_billing
+		Force bool `json:"force"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -1227,9 +2310,60 @@ func (h *Handler) GenerateInvoices(c *gin.Context) {
 
 	period := time.Date(req.Year, time.Month(req.Month), 1, 0, 0, 0, 0, time.Local)
 
+	// Если указан список аккаунтов — генерируем для них в одной транзакции
+	if len(req.AccountIDs) > 0 {
+		results, err := h.invoice.GenerateInvoicesForAccounts(req.AccountIDs, period, req.Force)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Счета не сгенерированы: " + err.Error(),
+				"period":  period.Format("01.2006"),
+				"results": results,
+			})
+			return
+		}
+
+		count := 0
+		for i := range results {
+			if results[i].Invoice != nil {
+				h.attachExcelToInvoice(results[i].Invoice)
+				count++
+			}
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Счета сгенерированы",
+			"count":   count,
+			"period":  period.Format("01.2006"),
+			"results": results,
+		})
+		return
+	}
+
 	// Если указан конкретный аккаунт — генерируем только для него
 	if req.AccountID != nil && *req.AccountID > 0 {
-		inv, err := h.invoice.GenerateInvoiceForSingleAccount(*req.AccountID, period)
+		inv, err := h.invoice.GenerateInvoiceForSingleAccount(*req.AccountID, period, req.Force)
+		var belowMin *invoicesvc.BelowMinimumError
+		if errors.As(err, &belowMin) {
+			c.JSON(http.StatusOK, gin.H{
+				"message":       "Счёт не выставлен: " + err.Error(),
+				"count":         0,
+				"period":        period.Format("01.2006"),
+				"invoices":      []models.Invoice{},
+				"below_minimum": []invoicesvc.BelowMinimum{belowMin.BelowMinimum},
+			})
+			return
+		}
+		var insufficient *invoicesvc.InsufficientDataError
+		if errors.As(err, &insufficient) {
+			c.JSON(http.StatusOK, gin.H{
+				"message":           "Счёт не выставлен: " + err.Error() + " (force — выставить всё равно)",
+				"count":             0,
+				"period":            period.Format("01.2006"),
+				"invoices":          []models.Invoice{},
+				"insufficient_data": []invoicesvc.InsufficientData{insufficient.InsufficientData},
+			})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -1253,23 +2387,37 @@ func (h *Handler) GenerateInvoices(c *gin.Context) {
 		return
 	}
 
-	// Генерация для всех аккаунтов
-	invoices, err := h.invoice.GenerateMonthlyInvoices(period)
+	// Генерация для всех аккаунтов или для группы
+	var result *invoicesvc.MonthlyInvoicesResult
+	var err error
+	if req.GroupID != nil && *req.GroupID > 0 {
+		_, groupAccountIDs, groupErr := h.resolveAccountGroup(*req.GroupID)
+		if groupErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": groupErr.Error()})
+			return
+		}
+		result, err = h.invoice.GenerateMonthlyInvoicesForAccounts(period, groupAccountIDs, req.Force)
+	} else {
+		result, err = h.invoice.GenerateMonthlyInvoices(period, req.Force)
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
 	// Генерируем Excel-отчёты для всех счетов
-	for i := range invoices {
-		h.attachExcelToInvoice(&invoices[i])
+	for i := range result.Invoices {
+		h.attachExcelToInvoice(&result.Invoices[i])
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message":  "Счета сгенерированы",
-		"count":    len(invoices),
-		"period":   period.Format("01.2006"),
-		"invoices": invoices,
+		"message":           "Счета сгенерированы",
+		"count":             len(result.Invoices),
+		"period":            period.Format("01.2006"),
+		"invoices":          result.Invoices,
+		"below_minimum":     result.BelowMinimum,
+		"blocked":           result.Blocked,
+		"insufficient_data": result.InsufficientData,
 	})
 }
 
@@ -1277,7 +2425,7 @@ func (h *Handler) GenerateInvoices(c *gin.Context) {
 func (h *Handler) attachExcelToInvoice(inv *models.Invoice) {
 	year := inv.Period.Year()
 	month := int(inv.Period.Month())
-	excelData, err := GenerateChargesExcelBytes(h.repo, inv.AccountID, year, month)
+	excelData, err := GenerateChargesExcelBytes(h.repo, h.invoice.Precision(), h.billing.DefaultBillingCurrency, inv.AccountID, year, month)
 	if err != nil {
 		log.Printf("[INVOICE] Ошибка генерации Excel для счёта %s: %v", inv.Number, err)
 		return
@@ -1299,6 +2447,8 @@ func (h *Handler) UpdateInvoiceStatus(c *gin.Context) {
 
 	var req struct {
 		Status string `json:"status" binding:"required"`
+		// Канал доставки при переводе в sent: email, manual, portal (по умолчанию manual)
+		SentVia string `json:"sent_via"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите статус"})
@@ -1311,6 +2461,16 @@ func (h *Handler) UpdateInvoiceStatus(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Недопустимый статус"})
 		return
 	}
+	if req.SentVia != "" {
+		if req.Status != "sent" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sent_via указывается только для статуса sent"})
+			return
+		}
+		if !models.IsValidSentVia(req.SentVia) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Недопустимый канал. Допустимые: email, manual, portal"})
+			return
+		}
+	}
 
 	invoice, err := h.repo.GetInvoiceByID(uint(id))
 	if err != nil || invoice == nil {
@@ -1324,6 +2484,14 @@ func (h *Handler) UpdateInvoiceStatus(c *gin.Context) {
 	if req.Status == "sent" && invoice.SentAt == nil {
 		invoice.SentAt = &now
 	}
+	// Отметка «отправлен» без письма — доставка вручную, если канал не указан
+	if req.Status == "sent" {
+		if req.SentVia != "" {
+			invoice.SentVia = req.SentVia
+		} else if invoice.SentVia == "" {
+			invoice.SentVia = models.SentViaManual
+		}
+	}
 	if req.Status == "paid" && invoice.PaidAt == nil {
 		invoice.PaidAt = &now
 	}
@@ -1333,9 +2501,29 @@ func (h *Handler) UpdateInvoiceStatus(c *gin.Context) {
 		return
 	}
 
+	recordInvoiceEvent(h.repo, c, invoice, "status", "", "")
+
 	c.JSON(http.StatusOK, invoice)
 }
 
+// GetInvoiceHistory возвращает историю счёта (отправки и смены статуса)
+func (h *Handler) GetInvoiceHistory(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+
+	events, err := h.repo.GetInvoiceEvents(uint(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, events)
+}
+
 // ClearAllInvoices удаляет все счета (с защитным кодом)
 func (h *Handler) ClearAllInvoices(c *gin.Context) {
 	var req struct {
@@ -1353,21 +2541,92 @@ func (h *Handler) ClearAllInvoices(c *gin.Context) {
 	}
 
 	// Удаляем все счета
-	count, err := h.repo.ClearAllInvoices()
+	result, err := h.repo.ClearAllInvoices()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	log.Printf("Удалено %d счетов", count)
+	log.Printf("Удалено %d счетов (строк: %d, событий: %d)", result.Invoices, result.InvoiceLines, result.InvoiceEvents)
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Все счета удалены",
-		"count":   count,
+		"count":   result.Invoices,
+		"deleted": result,
 	})
 }
 
 // === Массовая привязка модулей ===
 
+// SetAccountModulesBulk устанавливает аккаунтам ровно указанный набор модулей
+// (недостающие добавляются, лишние удаляются) и возвращает изменения по каждому аккаунту
+// POST /api/accounts/set-modules-bulk
+func (h *Handler) SetAccountModulesBulk(c *gin.Context) {
+	var req struct {
+		AccountIDs []uint `json:"account_ids" binding:"required"`
+		ModuleIDs  []uint `json:"module_ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Укажите account_ids и module_ids"})
+		return
+	}
+	if len(req.AccountIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Список account_ids пуст"})
+		return
+	}
+
+	accountIDs := uniqueIDs(req.AccountIDs)
+	moduleIDs := uniqueIDs(req.ModuleIDs)
+
+	// Все модули и аккаунты должны существовать, иначе ничего не меняем
+	for _, id := range moduleIDs {
+		if module, err := h.repo.GetModuleByID(id); err != nil || module == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Модуль %d не найден", id)})
+			return
+		}
+	}
+	for _, id := range accountIDs {
+		if account, err := h.repo.GetAccountByID(id); err != nil || account == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Аккаунт %d не найден", id)})
+			return
+		}
+	}
+
+	diffs, err := h.repo.SetAccountModulesBulk(accountIDs, moduleIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var changedIDs []uint
+	for _, diff := range diffs {
+		if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+			changedIDs = append(changedIDs, diff.AccountID)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":               "Модули установлены",
+		"total":                 len(diffs),
+		"changed":               len(changedIDs),
+		"accounts":              diffs,
+		"charges_recalculation": h.recalculateAfterModuleChange(changedIDs),
+	})
+}
+
+// uniqueIDs убирает повторы, сохраняя порядок
+func uniqueIDs(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	result := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if id == 0 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		result = append(result, id)
+	}
+	return result
+}
+
 // AssignModuleBulk привязывает модуль к нескольким аккаунтам
 func (h *Handler) AssignModuleBulk(c *gin.Context) {
 	moduleIDStr := c.Param("id")
@@ -1391,10 +2650,16 @@ func (h *Handler) AssignModuleBulk(c *gin.Context) {
 		return
 	}
 
+	recalculation := ""
+	if created > 0 {
+		recalculation = h.recalculateAfterModuleChange(req.AccountIDs)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Модуль привязан",
-		"created": created,
-		"total":   len(req.AccountIDs),
+		"message":               "Модуль привязан",
+		"created":               created,
+		"total":                 len(req.AccountIDs),
+		"charges_recalculation": recalculation,
 	})
 }
 
@@ -1421,10 +2686,16 @@ func (h *Handler) UnassignModuleBulk(c *gin.Context) {
 		return
 	}
 
+	recalculation := ""
+	if removed > 0 {
+		recalculation = h.recalculateAfterModuleChange(req.AccountIDs)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Модуль отвязан",
-		"removed": removed,
-		"total":   len(req.AccountIDs),
+		"message":               "Модуль отвязан",
+		"removed":               removed,
+		"total":                 len(req.AccountIDs),
+		"charges_recalculation": recalculation,
 	})
 }
 
@@ -1455,7 +2726,10 @@ func (h *Handler) RemoveModuleFromAccount(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Модуль отвязан"})
+	c.JSON(http.StatusOK, gin.H{
+		"message":               "Модуль отвязан",
+		"charges_recalculation": h.recalculateAfterModuleChange([]uint{uint(accountID)}),
+	})
 }
 
 // SetCurrencyBulk массово устанавливает валюту для аккаунтов
@@ -1471,9 +2745,8 @@ func (h *Handler) SetCurrencyBulk(c *gin.Context) {
 	}
 
 	// Проверка валюты
-	validCurrencies := map[string]bool{"EUR": true, "RUB": true, "KZT": true}
-	if !validCurrencies[req.Currency] {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверная валюта. Допустимые: EUR, RUB, KZT"})
+	if !h.currencies[req.Currency] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверная валюта. Допустимые: " + currencyList(h.currencies)})
 		return
 	}
 
@@ -1491,6 +2764,138 @@ func (h *Handler) SetCurrencyBulk(c *gin.Context) {
 
 // === Детализация начислений ===
 
+// chargeModuleSummary - итог ежедневных начислений по модулю за месяц
+type chargeModuleSummary struct {
+	ModuleID     uint    `json:"module_id"`
+	ModuleName   string  `json:"module_name"`
+	ModuleCode   string  `json:"module_code"`
+	ModuleUnit   string  `json:"module_unit"`
+	PricingType  string  `json:"pricing_type"`
+	UnitPrice    float64 `json:"unit_price"`
+	TotalCost    float64 `json:"total_cost"`
+	Currency     string  `json:"currency"`
+	DaysCount    int     `json:"days_count"`
+	DaysInMonth  int     `json:"days_in_month"`
+	TotalUnits   int     `json:"total_units"`
+	AvgUnits     float64 `json:"avg_units"`
+	AvgDailyCost float64 `json:"avg_daily_cost"` // средняя стоимость за день
+
+	// Доли недавно деактивированных объектов за месяц (льгота deactivation_grace_days)
+	GraceUnits float64 `json:"grace_units"`
+}
+
+// convertedChargeDetail - строка пересчёта модуля в валюту выставления
+type convertedChargeDetail struct {
+	ModuleName   string  `json:"module_name"`
+	Quantity     float64 `json:"quantity"`
+	UnitPriceKZT float64 `json:"unit_price_kzt"`
+	TotalKZT     float64 `json:"total_kzt"`
+}
+
+// chargesConversion - итоги месяца в валюте выставления по курсу на 1-е число следующего месяца
+type chargesConversion struct {
+	Rate            float64
+	RateDate        time.Time
+	BillingCurrency string
+	Total           float64
+	Details         []convertedChargeDetail
+}
+
+// summarizeCharges сводит ежедневные начисления по модулям и валютам (итоги округлены с точностью precision)
+func summarizeCharges(charges []models.DailyCharge, precision invoicesvc.Precision) ([]chargeModuleSummary, map[string]float64) {
+	moduleTotals := make(map[uint]*chargeModuleSummary)
+	costByCurrency := make(map[string]float64)
+
+	for _, ch := range charges {
+		mt, ok := moduleTotals[ch.ModuleID]
+		if !ok {
+			mt = &chargeModuleSummary{
+				ModuleID:    ch.ModuleID,
+				ModuleName:  ch.ModuleName,
+				ModuleCode:  ch.Module.Code,
+				ModuleUnit:  ch.Module.Unit,
+				PricingType: ch.PricingType,
+				UnitPrice:   ch.UnitPrice,
+				Currency:    ch.Currency,
+				DaysInMonth: ch.DaysInMonth,
+			}
+			moduleTotals[ch.ModuleID] = mt
+		}
+		mt.TotalCost += ch.DailyCost
+		mt.TotalUnits += ch.TotalUnits
+		mt.GraceUnits += ch.GraceUnits
+		mt.DaysCount++
+		costByCurrency[ch.Currency] += ch.DailyCost
+	}
+
+	// Округляем итоги
+	for k, v := range costByCurrency {
+		costByCurrency[k] = precision.RoundAmount(v, k)
+	}
+	var moduleSummaries []chargeModuleSummary
+	for _, mt := range moduleTotals {
+		mt.TotalCost = precision.RoundAmount(mt.TotalCost, mt.Currency)
+		mt.GraceUnits = math.Round(mt.GraceUnits*100) / 100
+		if mt.DaysCount > 0 {
+			mt.AvgUnits = math.Round((float64(mt.TotalUnits)+mt.GraceUnits)/float64(mt.DaysCount)*10) / 10
+			mt.AvgDailyCost = precision.RoundAmount(mt.TotalCost/float64(mt.DaysCount), mt.Currency)
+		}
+		moduleSummaries = append(moduleSummaries, *mt)
+	}
+	return moduleSummaries, costByCurrency
+}
+
+// convertChargeSummaries пересчитывает итоги месяца в валюту выставления аккаунта.
+// Формула-эталон 1С: round(avg_units) × round(eur_price × rate, 2) = sum_kzt.
+// nil — месяц не закрыт, валюта выставления EUR или курса за дату нет.
+func (h *Handler) convertChargeSummaries(account *models.Account, year, month int, moduleSummaries []chargeModuleSummary) *chargesConversion {
+	nowTime := time.Now()
+	reportEndDate := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+	isMonthClosed := nowTime.After(reportEndDate) || nowTime.Equal(reportEndDate)
+	billingCurrency := h.billing.DefaultBillingCurrency
+	if account != nil && account.BillingCurrency != "" {
+		billingCurrency = account.BillingCurrency
+	}
+	if !isMonthClosed || billingCurrency == "EUR" {
+		return nil
+	}
+
+	rateDate := reportEndDate
+	exchangeRate, err := h.repo.GetExchangeRateByDate("EUR", rateDate)
+	if err != nil || exchangeRate == nil {
+		return nil
+	}
+	rate := exchangeRate.Rate
+
+	// Считаем KZT-итог по формуле 1С: для каждого модуля отдельно
+	var totalKZT float64
+	var convertedDetails []convertedChargeDetail
+	for _, ms := range moduleSummaries {
+		qty := math.Round(ms.AvgUnits) // целое кол-во, как в 1С
+		if ms.PricingType == "fixed" {
+			qty = 1
+		}
+		priceKZT := h.invoice.RoundAmount(ms.UnitPrice*rate, "KZT") // цена за единицу в KZT
+		sumKZT := h.invoice.RoundAmount(qty*priceKZT, "KZT")        // Кол-во × Цена = Сумма
+		totalKZT += sumKZT
+
+		convertedDetails = append(convertedDetails, convertedChargeDetail{
+			ModuleName:   ms.ModuleName,
+			Quantity:     qty,
+			UnitPriceKZT: priceKZT,
+			TotalKZT:     sumKZT,
+		})
+	}
+
+	return &chargesConversion{
+		Rate:            rate,
+		RateDate:        rateDate,
+		BillingCurrency: billingCurrency,
+		Total:           h.invoice.RoundAmount(totalKZT, "KZT"),
+		Details:         convertedDetails,
+	}
+}
+
 // GetAccountCharges возвращает детализацию ежедневных начислений для аккаунта
 func (h *Handler) GetAccountCharges(c *gin.Context) {
 	idStr := c.Param("id")
@@ -1500,20 +2905,23 @@ func (h *Handler) GetAccountCharges(c *gin.Context) {
 		return
 	}
 
-	// Парсим период
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	year, month := period.Year, period.Month
 
-	if yearStr := c.Query("year"); yearStr != "" {
-		if y, err := strconv.Atoi(yearStr); err == nil && y > 2000 && y < 2100 {
-			year = y
-		}
+	// Фильтр по модулю (необязательный)
+	module, err := h.parseModuleFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	if monthStr := c.Query("month"); monthStr != "" {
-		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
-			month = m
-		}
+	var moduleID uint
+	if module != nil {
+		moduleID = module.ID
 	}
 
 	// Пересчитываем начисления (на случай если ещё не рассчитаны)
@@ -1522,7 +2930,7 @@ func (h *Handler) GetAccountCharges(c *gin.Context) {
 	}
 
 	// Получаем начисления из БД
-	charges, err := h.repo.GetDailyCharges(uint(accountID), year, month)
+	charges, err := h.repo.GetDailyCharges(uint(accountID), moduleID, year, month, true)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -1548,71 +2956,25 @@ func (h *Handler) GetAccountCharges(c *gin.Context) {
 	dayMap := make(map[string]*DayCharges)
 	var dayOrder []string
 
-	// Итоги по модулям
-	type ModuleSummary struct {
-		ModuleID     uint    `json:"module_id"`
-		ModuleName   string  `json:"module_name"`
-		PricingType  string  `json:"pricing_type"`
-		UnitPrice    float64 `json:"unit_price"`
-		TotalCost    float64 `json:"total_cost"`
-		Currency     string  `json:"currency"`
-		DaysCount    int     `json:"days_count"`
-		DaysInMonth  int     `json:"days_in_month"`
-		TotalUnits   int     `json:"total_units"`
-		AvgUnits     float64 `json:"avg_units"`
-		AvgDailyCost float64 `json:"avg_daily_cost"` // средняя стоимость за день
-	}
-	moduleTotals := make(map[uint]*ModuleSummary)
-	costByCurrency := make(map[string]float64)
-
 	for _, ch := range charges {
 		dateKey := ch.ChargeDate.Format("2006-01-02")
 
 		day, exists := dayMap[dateKey]
 		if !exists {
 			day = &DayCharges{
-				Date:               dateKey,
-				TotalUnits:         ch.TotalUnits,
-				DayTotalByCurrency: make(map[string]float64),
-			}
-			dayMap[dateKey] = day
-			dayOrder = append(dayOrder, dateKey)
-		}
-		day.Charges = append(day.Charges, ch)
-		day.DayTotalByCurrency[ch.Currency] += math.Round(ch.DailyCost*100) / 100
-
-		// Итоги по модулям
-		mt, ok := moduleTotals[ch.ModuleID]
-		if !ok {
-			mt = &ModuleSummary{
-				ModuleID:    ch.ModuleID,
-				ModuleName:  ch.ModuleName,
-				PricingType: ch.PricingType,
-				UnitPrice:   ch.UnitPrice,
-				Currency:    ch.Currency,
-				DaysInMonth: ch.DaysInMonth,
+				Date:               dateKey,
+				TotalUnits:         ch.TotalUnits,
+				DayTotalByCurrency: make(map[string]float64),
 			}
-			moduleTotals[ch.ModuleID] = mt
+			dayMap[dateKey] = day
+			dayOrder = append(dayOrder, dateKey)
 		}
-		mt.TotalCost += ch.DailyCost
-		mt.TotalUnits += ch.TotalUnits
-		mt.DaysCount++
-		costByCurrency[ch.Currency] += ch.DailyCost
+		day.Charges = append(day.Charges, ch)
+		day.DayTotalByCurrency[ch.Currency] += h.invoice.RoundAmount(ch.DailyCost, ch.Currency)
 	}
 
-	// Округляем итоги
-	for k, v := range costByCurrency {
-		costByCurrency[k] = math.Round(v*100) / 100
-	}
-	var moduleSummaries []ModuleSummary
-	for _, mt := range moduleTotals {
-		mt.TotalCost = math.Round(mt.TotalCost*100) / 100
-		if mt.DaysCount > 0 {
-			mt.AvgUnits = math.Round(float64(mt.TotalUnits)/float64(mt.DaysCount)*10) / 10
-			mt.AvgDailyCost = math.Round(mt.TotalCost/float64(mt.DaysCount)*100) / 100
-		}
-		moduleSummaries = append(moduleSummaries, *mt)
-	}
+	// Итоги по модулям
+	moduleSummaries, costByCurrency := summarizeCharges(charges, h.invoice.Precision())
 
 	// Собираем ответ в порядке дат
 	var dailyBreakdown []DayCharges
@@ -1623,76 +2985,32 @@ func (h *Handler) GetAccountCharges(c *gin.Context) {
 	daysInMonth := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
 
 	// Конвертация в валюту аккаунта (только для завершённых месяцев)
-	// Формула-эталон 1С: round(avg_units) × round(eur_price × rate, 2) = sum_kzt
 	var conversion gin.H
-	nowTime := time.Now()
-	reportEndDate := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
-	isMonthClosed := nowTime.After(reportEndDate) || nowTime.Equal(reportEndDate)
-	billingCurrency := "KZT"
-	if account != nil && account.BillingCurrency != "" {
-		billingCurrency = account.BillingCurrency
-	}
-
-	if isMonthClosed && billingCurrency != "EUR" {
-		rateDate := reportEndDate
-		exchangeRate, err := h.repo.GetExchangeRateByDate("EUR", rateDate)
-		if err == nil && exchangeRate != nil {
-			rate := exchangeRate.Rate
-
-			// Считаем KZT-итог по формуле 1С: для каждого модуля отдельно
-			var totalKZT float64
-			type ConvertedDetail struct {
-				ModuleName   string  `json:"module_name"`
-				Quantity     float64 `json:"quantity"`
-				UnitPriceKZT float64 `json:"unit_price_kzt"`
-				TotalKZT     float64 `json:"total_kzt"`
-			}
-			var convertedDetails []ConvertedDetail
-
-			for _, ms := range moduleSummaries {
-				qty := math.Round(ms.AvgUnits) // целое кол-во, как в 1С
-				if ms.PricingType == "fixed" {
-					qty = 1
-				}
-				priceKZT := math.Round(ms.UnitPrice*rate*100) / 100 // цена за единицу в KZT
-				sumKZT := math.Round(qty*priceKZT*100) / 100        // Кол-во × Цена = Сумма
-				totalKZT += sumKZT
-
-				convertedDetails = append(convertedDetails, ConvertedDetail{
-					ModuleName:   ms.ModuleName,
-					Quantity:     qty,
-					UnitPriceKZT: priceKZT,
-					TotalKZT:     sumKZT,
-				})
-			}
-
-			convertedTotals := map[string]float64{
-				billingCurrency: math.Round(totalKZT*100) / 100,
-			}
-
-			// Ежедневные KZT-значения: распределяем totalKZT по дням равномерно
-			if len(dailyBreakdown) > 0 {
-				baseDailyKZT := math.Floor(totalKZT/float64(daysInMonth)*100) / 100
-				distributedSum := baseDailyKZT * float64(len(dailyBreakdown)-1)
-				lastDayKZT := math.Round((totalKZT-distributedSum)*100) / 100
-
-				for i := range dailyBreakdown {
-					if i < len(dailyBreakdown)-1 {
-						dailyBreakdown[i].DayCostLocal = baseDailyKZT
-					} else {
-						dailyBreakdown[i].DayCostLocal = lastDayKZT
-					}
-					dailyBreakdown[i].LocalCurrency = billingCurrency
+	if conv := h.convertChargeSummaries(account, year, month, moduleSummaries); conv != nil {
+		totalKZT := conv.Total
+
+		// Ежедневные KZT-значения: распределяем totalKZT по дням равномерно
+		if len(dailyBreakdown) > 0 {
+			baseDailyKZT := math.Floor(totalKZT/float64(daysInMonth)*100) / 100
+			distributedSum := baseDailyKZT * float64(len(dailyBreakdown)-1)
+			lastDayKZT := math.Round((totalKZT-distributedSum)*100) / 100
+
+			for i := range dailyBreakdown {
+				if i < len(dailyBreakdown)-1 {
+					dailyBreakdown[i].DayCostLocal = baseDailyKZT
+				} else {
+					dailyBreakdown[i].DayCostLocal = lastDayKZT
 				}
+				dailyBreakdown[i].LocalCurrency = conv.BillingCurrency
 			}
+		}
 
-			conversion = gin.H{
-				"rate":              rate,
-				"rate_date":         rateDate.Format("2006-01-02"),
-				"billing_currency":  billingCurrency,
-				"converted_totals":  convertedTotals,
-				"converted_details": convertedDetails,
-			}
+		conversion = gin.H{
+			"rate":              conv.Rate,
+			"rate_date":         conv.RateDate.Format("2006-01-02"),
+			"billing_currency":  conv.BillingCurrency,
+			"converted_totals":  map[string]float64{conv.BillingCurrency: conv.Total},
+			"converted_details": conv.Details,
 		}
 	}
 
@@ -1713,12 +3031,42 @@ func (h *Handler) GetAccountCharges(c *gin.Context) {
 			"cost_details":     moduleSummaries,
 		},
 		"conversion": conversion,
+		"module":     module,
 	})
 }
 
+// GetAccountForecast возвращает прогноз счёта аккаунта на конец месяца
+// GET /api/accounts/:id/forecast?year=2026&month=2
+func (h *Handler) GetAccountForecast(c *gin.Context) {
+	idStr := c.Param("id")
+	accountID, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	year, month := period.Year, period.Month
+
+	forecast, err := h.invoice.ForecastForAccount(uint(accountID), year, month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, forecast)
+}
+
 // GenerateChargesExcelBytes генерирует Excel-отчёт начислений и возвращает байты
-func GenerateChargesExcelBytes(repo *repository.Repository, accountID uint, year, month int) ([]byte, error) {
-	charges, err := repo.GetDailyCharges(accountID, year, month)
+// (суммы округлены с точностью валют precision, как в счёте; defaultCurrency — валюта
+// счёта для аккаунта без billing_currency)
+func GenerateChargesExcelBytes(repo *repository.Repository, precision invoicesvc.Precision, defaultCurrency string, accountID uint, year, month int) ([]byte, error) {
+	charges, err := repo.GetDailyCharges(accountID, 0, year, month, false)
 	if err != nil {
 		return nil, err
 	}
@@ -1763,7 +3111,7 @@ func GenerateChargesExcelBytes(repo *repository.Repository, accountID uint, year
 		}
 		f.SetCellValue(sheet, fmt.Sprintf("D%d", row), pricingLabel)
 		f.SetCellValue(sheet, fmt.Sprintf("E%d", row), ch.UnitPrice)
-		cost := math.Round(ch.DailyCost*100) / 100
+		cost := precision.RoundAmount(ch.DailyCost, ch.Currency)
 		f.SetCellValue(sheet, fmt.Sprintf("F%d", row), cost)
 		f.SetCellValue(sheet, fmt.Sprintf("G%d", row), ch.Currency)
 		totalByCurrency[ch.Currency] += ch.DailyCost
@@ -1778,7 +3126,7 @@ func GenerateChargesExcelBytes(repo *repository.Repository, accountID uint, year
 	i := 0
 	for currency, total := range totalByCurrency {
 		f.SetCellValue(sheet, fmt.Sprintf("D%d", row+i), "ИТОГО:")
-		f.SetCellValue(sheet, fmt.Sprintf("F%d", row+i), math.Round(total*100)/100)
+		f.SetCellValue(sheet, fmt.Sprintf("F%d", row+i), precision.RoundAmount(total, currency))
 		f.SetCellValue(sheet, fmt.Sprintf("G%d", row+i), currency)
 		f.SetCellStyle(sheet, fmt.Sprintf("D%d", row+i), fmt.Sprintf("G%d", row+i), totalStyle)
 		i++
@@ -1787,7 +3135,7 @@ func GenerateChargesExcelBytes(repo *repository.Repository, accountID uint, year
 	nowTime := time.Now()
 	reportEndDate := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
 	isMonthClosed := nowTime.After(reportEndDate) || nowTime.Equal(reportEndDate)
-	billingCurrency := "KZT"
+	billingCurrency := defaultCurrency
 	if account != nil && account.BillingCurrency != "" {
 		billingCurrency = account.BillingCurrency
 	}
@@ -1827,11 +3175,11 @@ func GenerateChargesExcelBytes(repo *repository.Repository, accountID uint, year
 				if em.PricingType == "fixed" {
 					qty = 1
 				}
-				priceKZT := math.Round(em.UnitPrice*rate*100) / 100
-				sumKZT := math.Round(qty*priceKZT*100) / 100
+				priceKZT := precision.RoundAmount(em.UnitPrice*rate, "KZT")
+				sumKZT := precision.RoundAmount(qty*priceKZT, "KZT")
 				totalKZT += sumKZT
 			}
-			totalKZT = math.Round(totalKZT*100) / 100
+			totalKZT = precision.RoundAmount(totalKZT, "KZT")
 
 			row = row + i + 1
 
@@ -1878,23 +3226,17 @@ func (h *Handler) ExportAccountChargesExcel(c *gin.Context) {
 		return
 	}
 
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
-	if yearStr := c.Query("year"); yearStr != "" {
-		if y, err := strconv.Atoi(yearStr); err == nil {
-			year = y
-		}
-	}
-	if monthStr := c.Query("month"); monthStr != "" {
-		if m, err := strconv.Atoi(monthStr); err == nil {
-			month = m
-		}
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	year, month := period.Year, period.Month
 
 	h.snapshot.CalculateDailyChargesForPeriod(uint(accountID), year, month)
 
-	excelData, err := GenerateChargesExcelBytes(h.repo, uint(accountID), year, month)
+	excelData, err := GenerateChargesExcelBytes(h.repo, h.invoice.Precision(), h.billing.DefaultBillingCurrency, uint(accountID), year, month)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации Excel"})
 		return
@@ -1908,7 +3250,7 @@ func (h *Handler) ExportAccountChargesExcel(c *gin.Context) {
 
 	filename := fmt.Sprintf("charges_%s_%d-%02d.xlsx", accountName, year, month)
 	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	setAttachment(c, filename)
 	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", excelData)
 }
 
@@ -1931,7 +3273,7 @@ func (h *Handler) GetPartnerAccount(c *gin.Context) {
 
 	// Проверяем актуальный статус блокировки в Wialon API
 	if h.wialon != nil {
-		if accData, err := h.wialon.GetAccountData(*wialonID); err == nil && accData != nil && accData.Enabled != nil {
+		if accData, err := h.wialon.GetAccountData(c.Request.Context(), *wialonID); err == nil && accData != nil && accData.Enabled != nil {
 			newBlocked := *accData.Enabled == 0
 			if account.IsBlocked != newBlocked {
 				account.IsBlocked = newBlocked
@@ -1973,21 +3315,13 @@ func (h *Handler) GetPartnerCharges(c *gin.Context) {
 
 	wialonID := partnerWialonID.(*int64)
 
-	// Парсим параметры периода (по умолчанию текущий месяц)
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
-
-	if yearStr := c.Query("year"); yearStr != "" {
-		if y, err := strconv.Atoi(yearStr); err == nil && y > 2000 && y < 2100 {
-			year = y
-		}
-	}
-	if monthStr := c.Query("month"); monthStr != "" {
-		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
-			month = m
-		}
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	year, month := period.Year, period.Month
 
 	// Пересчитываем начисления (на случай если ещё не рассчитаны за текущий/выбранный месяц)
 	account, err := h.repo.GetAccountByWialonID(*wialonID)
@@ -1997,7 +3331,7 @@ func (h *Handler) GetPartnerCharges(c *gin.Context) {
 		}
 	}
 
-	charges, err := h.repo.GetDailyChargesByWialonID(*wialonID, year, month)
+	charges, err := h.repo.GetDailyChargesByWialonID(*wialonID, year, month, true)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -2010,6 +3344,65 @@ func (h *Handler) GetPartnerCharges(c *gin.Context) {
 	})
 }
 
+// GetPartnerChargesExcel выгружает детализацию начислений партнёра в Excel
+func (h *Handler) GetPartnerChargesExcel(c *gin.Context) {
+	partnerWialonID, exists := c.Get("partnerWialonID")
+	if !exists || partnerWialonID == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Нет привязки к аккаунту"})
+		return
+	}
+
+	wialonID := partnerWialonID.(*int64)
+
+	// Аккаунт определяется только по привязке партнёра — чужие аккаунты недоступны
+	account, err := h.repo.GetAccountByWialonID(*wialonID)
+	if err != nil || account == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now, year, month := period.Now, period.Year, period.Month
+
+	// Партнёру доступны только прошедшие месяцы и текущий
+	requestedPeriod := period.Start
+	currentPeriod := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if requestedPeriod.After(currentPeriod) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Период ещё не наступил"})
+		return
+	}
+
+	if calcErr := h.snapshot.CalculateDailyChargesForPeriod(account.ID, year, month); calcErr != nil {
+		log.Printf("GetPartnerChargesExcel: ошибка пересчёта начислений для аккаунта %d: %v", account.ID, calcErr)
+	}
+
+	// Для закрытого месяца подгружаем курс, чтобы в отчёте был блок конвертации
+	reportEndDate := requestedPeriod.AddDate(0, 1, 0)
+	if !now.Before(reportEndDate) && account.BillingCurrency != "EUR" {
+		if rate, err := h.repo.GetExchangeRateByDate("EUR", reportEndDate); err != nil || rate == nil {
+			if fetchErr := h.nbk.FetchExchangeRatesForDate(reportEndDate); fetchErr != nil {
+				log.Printf("GetPartnerChargesExcel: ошибка загрузки курсов за %s: %v", reportEndDate.Format("2006-01-02"), fetchErr)
+			}
+		}
+	}
+
+	excelData, err := GenerateChargesExcelBytes(h.repo, h.invoice.Precision(), h.billing.DefaultBillingCurrency, account.ID, year, month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации Excel"})
+		return
+	}
+
+	filename := fmt.Sprintf("charges_%d-%02d.xlsx", year, month)
+	c.Header("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	setAttachment(c, filename)
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", excelData)
+}
+
 // GetPartnerBalance возвращает сводку по балансу партнёра
 func (h *Handler) GetPartnerBalance(c *gin.Context) {
 	partnerWialonID, exists := c.Get("partnerWialonID")
@@ -2034,46 +3427,55 @@ func (h *Handler) GetPartnerBalance(c *gin.Context) {
 		return
 	}
 
-	// Считаем статистику по счетам
-	var totalInvoiced float64
-	var totalPaid float64
-	var pendingCount int
-	var paidCount int
-
-	for _, inv := range invoices {
-		totalInvoiced += inv.TotalAmount
-		if inv.Status == "paid" {
-			totalPaid += inv.TotalAmount
-			paidCount++
-		} else {
-			pendingCount++
-		}
+	currency := account.BillingCurrency
+	if currency == "" {
+		currency = h.billing.DefaultBillingCurrency
 	}
 
+	// Считаем статистику по счетам (суммы — в валютах счетов)
+	totals := summarizeInvoices(invoices)
+
 	// Получаем начисления за текущий месяц (с предварительным пересчётом)
 	now := time.Now()
 	if calcErr := h.snapshot.CalculateDailyChargesForPeriod(account.ID, now.Year(), int(now.Month())); calcErr != nil {
 		log.Printf("GetPartnerBalance: ошибка пересчёта начислений за текущий месяц для аккаунта %d: %v", account.ID, calcErr)
 	}
-	charges, _ := h.repo.GetDailyChargesByWialonID(*wialonID, now.Year(), int(now.Month()))
+	charges, _ := h.repo.GetDailyChargesByWialonID(*wialonID, now.Year(), int(now.Month()), false)
 
-	var currentMonthTotal float64
+	currentMonthByCurrency := make(map[string]float64)
 	for _, ch := range charges {
-		currentMonthTotal += ch.DailyCost
+		currentMonthByCurrency[ch.Currency] += ch.DailyCost
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	// Итоги в валюте биллинга — по последнему известному курсу
+	totalInvoiced, invoicedErrs := h.convertTotals(totals.Invoiced, currency, now)
+	totalPaid, paidErrs := h.convertTotals(totals.Paid, currency, now)
+	outstanding, outstandingErrs := h.convertTotals(totals.Outstanding(), currency, now)
+	currentMonthTotal, monthErrs := h.convertTotals(currentMonthByCurrency, currency, now)
+
+	response := gin.H{
 		"account_name":        account.Name,
 		"wialon_id":           account.WialonID,
-		"billing_currency":    account.BillingCurrency,
-		"total_invoiced":      math.Round(totalInvoiced*100) / 100,
-		"total_paid":          math.Round(totalPaid*100) / 100,
-		"outstanding_balance": math.Round((totalInvoiced-totalPaid)*100) / 100,
-		"current_month_total": math.Round(currentMonthTotal*100) / 100,
+		"billing_currency":    currency,
+		"total_invoiced":      h.invoice.RoundAmount(totalInvoiced, currency),
+		"total_paid":          h.invoice.RoundAmount(totalPaid, currency),
+		"outstanding_balance": h.invoice.RoundAmount(outstanding, currency),
+		"current_month_total": h.invoice.RoundAmount(currentMonthTotal, currency),
+		"rate_date":           now.Format("2006-01-02"),
 		"invoices_count":      len(invoices),
-		"pending_count":       pendingCount,
-		"paid_count":          paidCount,
-	})
+		"pending_count":       totals.PendingCount,
+		"paid_count":          totals.PaidCount,
+
+		"total_invoiced_by_currency":      roundByCurrency(totals.Invoiced, h.invoice.Precision()),
+		"total_paid_by_currency":          roundByCurrency(totals.Paid, h.invoice.Precision()),
+		"outstanding_balance_by_currency": roundByCurrency(totals.Outstanding(), h.invoice.Precision()),
+		"current_month_total_by_currency": roundByCurrency(currentMonthByCurrency, h.invoice.Precision()),
+	}
+	if errs := uniqueStrings(invoicedErrs, paidErrs, outstandingErrs, monthErrs); len(errs) > 0 {
+		response["conversion_errors"] = errs
+	}
+
+	c.JSON(http.StatusOK, response)
 }
 
 // GetPartnerSnapshots возвращает снимки (данные по дням) для партнёра
@@ -2086,21 +3488,13 @@ func (h *Handler) GetPartnerSnapshots(c *gin.Context) {
 
 	wialonID := partnerWialonID.(*int64)
 
-	// Парсим параметры периода (по умолчанию текущий месяц)
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
-
-	if yearStr := c.Query("year"); yearStr != "" {
-		if y, err := strconv.Atoi(yearStr); err == nil && y > 2000 && y < 2100 {
-			year = y
-		}
-	}
-	if monthStr := c.Query("month"); monthStr != "" {
-		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
-			month = m
-		}
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	year, month := period.Year, period.Month
 
 	snapshots, err := h.repo.GetSnapshotsByWialonID(*wialonID, year, month)
 	if err != nil {
@@ -2135,6 +3529,256 @@ func (h *Handler) GetPartnerSnapshots(c *gin.Context) {
 	})
 }
 
+// invoiceTotals - выставленные и оплаченные суммы по валютам счетов
+type invoiceTotals struct {
+	Invoiced     map[string]float64
+	Paid         map[string]float64
+	PendingCount int
+	PaidCount    int
+}
+
+// Outstanding возвращает неоплаченный остаток по валютам
+func (t invoiceTotals) Outstanding() map[string]float64 {
+	result := make(map[string]float64, len(t.Invoiced))
+	for cur, amount := range t.Invoiced {
+		result[cur] = amount - t.Paid[cur]
+	}
+	return result
+}
+
+// summarizeInvoices считает выставленную и оплаченную суммы по счетам в разрезе валют.
+// Нулевые счета оплачивать не нужно — они не считаются ожидающими оплаты.
+func summarizeInvoices(invoices []models.Invoice) invoiceTotals {
+	totals := invoiceTotals{Invoiced: make(map[string]float64), Paid: make(map[string]float64)}
+	for _, inv := range invoices {
+		totals.Invoiced[inv.Currency] += inv.TotalAmount
+		if inv.TotalAmount == 0 && inv.Status != "paid" {
+			continue
+		}
+		if inv.Status == "paid" {
+			totals.Paid[inv.Currency] += inv.TotalAmount
+			totals.PaidCount++
+		} else {
+			totals.PendingCount++
+		}
+	}
+	return totals
+}
+
+// convertTotals переводит суммы по валютам в валюту to по курсу на дату (или последнему известному).
+// Суммы, для которых курса нет, в итог не входят — они перечислены в ошибках.
+func (h *Handler) convertTotals(byCurrency map[string]float64, to string, date time.Time) (float64, []string) {
+	currencies := make([]string, 0, len(byCurrency))
+	for cur := range byCurrency {
+		currencies = append(currencies, cur)
+	}
+	sort.Strings(currencies)
+
+	var total float64
+	var errs []string
+	for _, cur := range currencies {
+		amount := byCurrency[cur]
+		if cur == to || amount == 0 {
+			total += amount
+			continue
+		}
+		conv, err := h.invoice.ConvertCurrency(amount, cur, to, date)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s → %s: %v", cur, to, err))
+			continue
+		}
+		total += conv.Result
+	}
+	return total, errs
+}
+
+// roundByCurrency округляет суммы по валютам до точности каждой валюты
+func roundByCurrency(byCurrency map[string]float64, precision invoicesvc.Precision) map[string]float64 {
+	result := make(map[string]float64, len(byCurrency))
+	for cur, amount := range byCurrency {
+		result[cur] = precision.RoundAmount(amount, cur)
+	}
+	return result
+}
+
+// uniqueStrings объединяет списки без повторов, сохраняя порядок
+func uniqueStrings(lists ...[]string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, s := range list {
+			if !seen[s] {
+				seen[s] = true
+				result = append(result, s)
+			}
+		}
+	}
+	return result
+}
+
+// GetPartnerDashboard возвращает сводку для главной страницы партнёра одним запросом:
+// активные объекты, начисления за месяц в валюте биллинга, баланс, последние счета и динамику по дням
+func (h *Handler) GetPartnerDashboard(c *gin.Context) {
+	partnerWialonID, exists := c.Get("partnerWialonID")
+	if !exists || partnerWialonID == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Нет привязки к аккаунту"})
+		return
+	}
+
+	wialonID := partnerWialonID.(*int64)
+
+	// Аккаунт определяется только по привязке партнёра
+	account, err := h.repo.GetAccountByWialonID(*wialonID)
+	if err != nil || account == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now, year, month := period.Now, period.Year, period.Month
+
+	currency := account.BillingCurrency
+	if currency == "" {
+		currency = h.billing.DefaultBillingCurrency
+	}
+
+	// Баланс по счетам
+	invoices, err := h.repo.GetInvoicesByWialonID(*wialonID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	totals := summarizeInvoices(invoices)
+
+	type RecentInvoice struct {
+		ID          uint    `json:"id"`
+		Number      string  `json:"number"`
+		Period      string  `json:"period"`
+		TotalAmount float64 `json:"total_amount"`
+		Currency    string  `json:"currency"`
+		Status      string  `json:"status"`
+	}
+	recent := []RecentInvoice{}
+	for i, inv := range invoices {
+		if i >= 5 {
+			break
+		}
+		recent = append(recent, RecentInvoice{
+			ID:          inv.ID,
+			Number:      inv.Number,
+			Period:      inv.Period.Format("2006-01"),
+			TotalAmount: inv.TotalAmount,
+			Currency:    inv.Currency,
+			Status:      inv.Status,
+		})
+	}
+
+	// Начисления за месяц (с предварительным пересчётом)
+	if calcErr := h.snapshot.CalculateDailyChargesForPeriod(account.ID, year, month); calcErr != nil {
+		log.Printf("GetPartnerDashboard: ошибка пересчёта начислений для аккаунта %d: %v", account.ID, calcErr)
+	}
+	charges, err := h.repo.GetDailyChargesByWialonID(*wialonID, year, month, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Суммы по валютам начислений
+	totalByCurrency := make(map[string]float64)
+	costByDayCurrency := make(map[string]map[string]float64)
+	for _, ch := range charges {
+		date := ch.ChargeDate.Format("2006-01-02")
+		if costByDayCurrency[date] == nil {
+			costByDayCurrency[date] = make(map[string]float64)
+		}
+		costByDayCurrency[date][ch.Currency] += ch.DailyCost
+		totalByCurrency[ch.Currency] += ch.DailyCost
+	}
+
+	// Пересчёт в валюту биллинга по курсу на сегодня (или на конец месяца, если он уже прошёл)
+	rateDate := now
+	if monthEnd := period.End.AddDate(0, 0, -1); monthEnd.Before(rateDate) {
+		rateDate = monthEnd
+	}
+	factors := make(map[string]float64)
+	var conversionErrors []string
+	var monthTotal float64
+	for cur, total := range totalByCurrency {
+		if cur == currency || total == 0 {
+			factors[cur] = 1
+			monthTotal += total
+			continue
+		}
+		conv, convErr := h.invoice.ConvertCurrency(total, cur, currency, rateDate)
+		if convErr != nil {
+			conversionErrors = append(conversionErrors, fmt.Sprintf("%s → %s: %v", cur, currency, convErr))
+			continue
+		}
+		factors[cur] = conv.Result / total
+		monthTotal += conv.Result
+	}
+
+	// Остаток по счетам в разных валютах — по тому же курсу
+	outstanding, outstandingErrs := h.convertTotals(totals.Outstanding(), currency, rateDate)
+	conversionErrors = uniqueStrings(conversionErrors, outstandingErrs)
+
+	costByDay := make(map[string]float64)
+	for date, byCurrency := range costByDayCurrency {
+		for cur, cost := range byCurrency {
+			costByDay[date] += cost * factors[cur]
+		}
+	}
+
+	// Динамика по дням: объекты из снимков и начисления в валюте биллинга
+	snapshots, err := h.repo.GetSnapshotsByWialonID(*wialonID, year, month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	type TrendPoint struct {
+		Date       string  `json:"date"`
+		TotalUnits int     `json:"total_units"`
+		Cost       float64 `json:"cost"`
+	}
+	trend := []TrendPoint{}
+	activeUnits := 0
+	for _, s := range snapshots {
+		date := s.SnapshotDate.Format("2006-01-02")
+		trend = append(trend, TrendPoint{
+			Date:       date,
+			TotalUnits: s.TotalUnits,
+			Cost:       h.invoice.RoundAmount(costByDay[date], currency),
+		})
+		activeUnits = s.TotalUnits
+	}
+
+	response := gin.H{
+		"account_name":        account.Name,
+		"wialon_id":           account.WialonID,
+		"year":                year,
+		"month":               month,
+		"currency":            currency,
+		"active_units":        activeUnits,
+		"month_to_date_total": h.invoice.RoundAmount(monthTotal, currency),
+		"rate_date":           rateDate.Format("2006-01-02"),
+		"outstanding_balance": h.invoice.RoundAmount(outstanding, currency),
+		"pending_count":       totals.PendingCount,
+		"recent_invoices":     recent,
+		"trend":               trend,
+	}
+	if len(conversionErrors) > 0 {
+		response["conversion_errors"] = conversionErrors
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
 // GetPartnerInvoicePDF возвращает PDF счёта партнёра
 func (h *Handler) GetPartnerInvoicePDF(c *gin.Context) {
 	partnerWialonID, exists := c.Get("partnerWialonID")
@@ -2173,23 +3817,25 @@ func (h *Handler) GetPartnerInvoicePDF(c *gin.Context) {
 		return
 	}
 
-	// Генерируем PDF
-	generator := invoicesvc.NewPDFGenerator()
-	pdfBytes, err := generator.GenerateInvoicePDF(inv, settings, account)
+	// Генерируем PDF (или 304, если у клиента актуальная версия)
+	pdfBytes, notModified, err := h.invoicePDF(c, inv, settings, account)
 	if err != nil {
 		log.Printf("Ошибка генерации PDF для партнёрского счёта %d: %v", inv.ID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации PDF"})
 		return
 	}
+	if notModified {
+		return
+	}
 
-	// Имя файла: используем номер счёта (заменяем / на _)
+	// Имя файла: используем номер счёта (небезопасные символы заменит setAttachment)
 	partnerInvoiceNum := inv.Number
 	if partnerInvoiceNum == "" {
 		partnerInvoiceNum = fmt.Sprintf("%d", inv.ID)
 	}
-	filename := fmt.Sprintf("invoice_%s.pdf", strings.ReplaceAll(partnerInvoiceNum, "/", "_"))
+	filename := fmt.Sprintf("invoice_%s.pdf", partnerInvoiceNum)
 	c.Header("Content-Type", "application/pdf")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	setAttachment(c, filename)
 	c.Data(http.StatusOK, "application/pdf", pdfBytes)
 }
 
@@ -2226,20 +3872,13 @@ func (h *Handler) GenerateAPIToken(c *gin.Context) {
 
 // Export1CInvoices массовая выгрузка счетов за период для 1С
 func (h *Handler) Export1CInvoices(c *gin.Context) {
-	now := time.Now()
-	year := now.Year()
-	month := int(now.Month())
-
-	if yearStr := c.Query("year"); yearStr != "" {
-		if y, err := strconv.Atoi(yearStr); err == nil && y > 2000 && y < 2100 {
-			year = y
-		}
-	}
-	if monthStr := c.Query("month"); monthStr != "" {
-		if m, err := strconv.Atoi(monthStr); err == nil && m >= 1 && m <= 12 {
-			month = m
-		}
+	// Период запроса (по умолчанию текущий месяц в часовом поясе tz)
+	period, err := h.parsePeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
+	year, month := period.Year, period.Month
 	status := c.Query("status")
 
 	invoices, err := h.repo.GetInvoicesByPeriod(year, month, status)
@@ -2328,21 +3967,18 @@ func (h *Handler) buildExport1CInvoice(inv *models.Invoice, settings *models.Bil
 			"name":         line.ModuleName,
 			"unit":         unit,
 			"quantity":     line.Quantity,
-			"unit_price":   math.Round(line.UnitPrice*100) / 100,
-			"total_price":  math.Round(line.TotalPrice*100) / 100,
+			"unit_price":   h.invoice.RoundAmount(line.UnitPrice, line.Currency),
+			"total_price":  h.invoice.RoundAmount(line.TotalPrice, line.Currency),
 			"pricing_type": line.PricingType,
 			"currency":     line.Currency,
+			"vat_exempt":   line.VATExempt,
 		})
 	}
 
-	// Расчёт НДС (включён в цену)
-	vatRate := settings.VATRate
-	if vatRate <= 0 {
-		vatRate = 16.0
-	}
-	subtotal := math.Round(inv.TotalAmount*100) / 100
-	vatAmount := math.Round(subtotal*vatRate/(100+vatRate)*100) / 100
-	totalWithoutVAT := math.Round((subtotal-vatAmount)*100) / 100
+	// Расчёт НДС (включён в цену или начислен сверху — по данным счёта)
+	vatRate := invoicesvc.ResolveVATRate(settings, &inv.Account)
+	totalWithoutVAT, vatAmount, subtotal := invoicesvc.VATBreakdown(inv, settings, h.invoice.Precision())
+	bank := invoicesvc.SelectBankAccount(settings, inv.Currency)
 
 	return gin.H{
 		"document_number": docNumber,
@@ -2356,11 +3992,11 @@ func (h *Handler) buildExport1CInvoice(inv *models.Invoice, settings *models.Bil
 			"bin":          settings.CompanyBIN,
 			"address":      settings.CompanyAddress,
 			"phone":        settings.CompanyPhone,
-			"bank_name":    settings.BankName,
-			"bank_iik":     settings.BankIIK,
-			"bank_bik":     settings.BankBIK,
-			"bank_kbe":     settings.BankKbe,
-			"payment_code": settings.PaymentCode,
+			"bank_name":    bank.BankName,
+			"bank_iik":     bank.IIK,
+			"bank_bik":     bank.BIK,
+			"bank_kbe":     bank.Kbe,
+			"payment_code": bank.PaymentCode,
 		},
 
 		"buyer": gin.H{
@@ -2376,12 +4012,13 @@ func (h *Handler) buildExport1CInvoice(inv *models.Invoice, settings *models.Bil
 		"lines": lines,
 
 		"totals": gin.H{
-			"subtotal":          subtotal,
-			"vat_rate":          vatRate,
-			"vat_amount":        vatAmount,
-			"total_with_vat":    subtotal,
-			"total_without_vat": totalWithoutVAT,
-			"currency":          inv.Currency,
+			"subtotal":           subtotal,
+			"vat_rate":           vatRate,
+			"vat_amount":         vatAmount,
+			"total_with_vat":     subtotal,
+			"total_without_vat":  totalWithoutVAT,
+			"prices_include_vat": !inv.VATOnTop,
+			"currency":           inv.Currency,
 		},
 	}
 }
@@ -2431,6 +4068,7 @@ func (h *Handler) Update1CInvoiceStatus(c *gin.Context) {
 		return
 	}
 
+	recordInvoiceEvent(h.repo, c, inv, "status", "", "1С")
 	log.Printf("[1С] Статус счёта #%s обновлён на '%s'", inv.Number, req.Status)
 	c.JSON(http.StatusOK, gin.H{
 		"message":         "Статус обновлён",
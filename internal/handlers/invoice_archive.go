@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/repository"
+	invoicesvc "github.com/user/wialon-billing-api/internal/services/invoice"
+)
+
+// Ограничения архива счетов: защита от генерации сотен PDF одним запросом
+const (
+	maxArchiveInvoices = 100
+	maxArchiveBytes    = 50 << 20 // 50 МБ несжатых PDF
+)
+
+// archiveEntry - PDF счёта для архива
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// buildInvoiceArchive готовит PDF счетов для ZIP: отправленные — в зафиксированном виде,
+// остальные генерируются. Превышение лимитов по количеству или размеру — ошибка (до записи ответа).
+func buildInvoiceArchive(repo *repository.Repository, generator *invoicesvc.PDFGenerator, invoices []models.Invoice, settings *models.BillingSettings, account *models.Account) ([]archiveEntry, error) {
+	if len(invoices) > maxArchiveInvoices {
+		return nil, fmt.Errorf("слишком много счетов для архива: %d (максимум %d)", len(invoices), maxArchiveInvoices)
+	}
+
+	entries := make([]archiveEntry, 0, len(invoices))
+	used := make(map[string]int, len(invoices))
+	total := 0
+	for i := range invoices {
+		inv := &invoices[i]
+		pdf, ok := storedInvoicePDF(repo, inv)
+		if !ok {
+			var err error
+			if pdf, err = generator.GenerateInvoicePDF(inv, settings, account, invoicesvc.WatermarkFor(inv)); err != nil {
+				return nil, fmt.Errorf("ошибка генерации PDF счёта %d: %w", inv.ID, err)
+			}
+		}
+		total += len(pdf)
+		if total > maxArchiveBytes {
+			return nil, fmt.Errorf("архив превышает %d МБ, выберите меньший период", maxArchiveBytes>>20)
+		}
+
+		// Имя файла по номеру счёта; совпадения (счета без номера) различаем по ID
+		number := inv.Number
+		if number == "" {
+			number = fmt.Sprintf("%d", inv.ID)
+		}
+		name := sanitizeFilename(fmt.Sprintf("invoice_%s.pdf", number))
+		if used[name]++; used[name] > 1 {
+			name = sanitizeFilename(fmt.Sprintf("invoice_%s_%d.pdf", number, inv.ID))
+		}
+		entries = append(entries, archiveEntry{name: name, data: pdf})
+	}
+	return entries, nil
+}
+
+// writeInvoiceArchive отправляет ZIP с PDF счетов потоком
+func writeInvoiceArchive(c *gin.Context, filename string, entries []archiveEntry) {
+	c.Header("Content-Type", "application/zip")
+	setAttachment(c, filename)
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	for _, entry := range entries {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			log.Printf("writeInvoiceArchive: ошибка записи %s: %v", entry.name, err)
+			return
+		}
+		if _, err := w.Write(entry.data); err != nil {
+			log.Printf("writeInvoiceArchive: ошибка записи %s: %v", entry.name, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("writeInvoiceArchive: ошибка завершения архива: %v", err)
+	}
+}
+
+// GetPartnerInvoicesArchive отдаёт ZIP с PDF всех выставленных счетов партнёра за год
+// (черновики не включаются)
+// GET /api/partner/invoices/archive?year=
+func (h *Handler) GetPartnerInvoicesArchive(c *gin.Context) {
+	partnerWialonID, exists := c.Get("partnerWialonID")
+	if !exists || partnerWialonID == nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Нет привязки к аккаунту"})
+		return
+	}
+
+	wialonID := partnerWialonID.(*int64)
+
+	year, err := queryInt(c, "year", time.Now().Year(), 2000, 2100)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.repo.GetAccountByWialonID(*wialonID)
+	if err != nil || account == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+
+	invoices, err := h.repo.GetIssuedInvoicesByWialonIDForYear(*wialonID, year)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(invoices) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Нет счетов за %d год", year)})
+		return
+	}
+
+	settings, err := h.repo.GetSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка получения настроек"})
+		return
+	}
+
+	entries, err := buildInvoiceArchive(h.repo, h.pdf, invoices, settings, account)
+	if err != nil {
+		log.Printf("GetPartnerInvoicesArchive: аккаунт %d, %d год: %v", account.ID, year, err)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	writeInvoiceArchive(c, fmt.Sprintf("invoices_%d.zip", year), entries)
+}
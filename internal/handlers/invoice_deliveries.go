@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// UpdateInvoiceDelivery отмечает доставку письма со счётом как вернувшуюся (bounced) или
+// не доставленную (failed) — вручную или по уведомлению почтового сервиса. Возврат письма
+// основному получателю переводит итог доставки счёта в bounced.
+// PUT /api/invoices/:id/deliveries/:deliveryId {"status": "bounced", "error": "..."}
+func (h *Handler) UpdateInvoiceDelivery(c *gin.Context) {
+	invoiceID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID счёта"})
+		return
+	}
+	deliveryID, err := strconv.ParseUint(c.Param("deliveryId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID доставки"})
+		return
+	}
+
+	var req struct {
+		Status string `json:"status" binding:"required"`
+		Error  string `json:"error"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Status != models.DeliveryBounced && req.Status != models.DeliveryFailed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status: допустимые значения bounced, failed"})
+		return
+	}
+	req.Error = strings.TrimSpace(req.Error)
+
+	invoice, err := h.repo.GetInvoiceByID(uint(invoiceID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if invoice == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Счёт не найден"})
+		return
+	}
+	delivery, err := h.repo.GetInvoiceDelivery(uint(deliveryID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if delivery == nil || delivery.InvoiceID != invoice.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Доставка не найдена"})
+		return
+	}
+
+	if err := h.repo.UpdateInvoiceDeliveryStatus(delivery.ID, req.Status, req.Error); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Копии и CC не влияют на итог: счёт считается недоставленным, только если письмо
+	// не дошло основному получателю
+	if delivery.Kind == models.DeliveryKindTo {
+		invoice.DeliveryStatus = req.Status
+		invoice.DeliveryError = delivery.Recipient
+		if req.Error != "" {
+			invoice.DeliveryError = fmt.Sprintf("%s: %s", delivery.Recipient, req.Error)
+		}
+		if err := h.repo.SetInvoiceDeliveryStatus(invoice.ID, invoice.DeliveryStatus, invoice.DeliveryError); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	recordInvoiceEvent(h.repo, c, invoice, "delivery", delivery.Recipient, strings.TrimSpace(req.Status+" "+req.Error))
+
+	deliveries, err := h.repo.GetInvoiceDeliveries(invoice.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"delivery_status": invoice.DeliveryStatus,
+		"delivery_error":  invoice.DeliveryError,
+		"deliveries":      deliveries,
+	})
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/services/invoice"
+)
+
+// InvoicePreferencesRequest - изменение настроек счетов аккаунта: nil — не менять,
+// "" — из настроек биллинга (для invoice_email — на buyer_email)
+type InvoicePreferencesRequest struct {
+	// Справочная валюта в счёте: "" — отключить
+	DisplayCurrency *string `json:"display_currency"`
+	// Email для счетов через запятую: "" — использовать buyer_email
+	InvoiceEmail *string `json:"invoice_email"`
+	// Шаблон PDF счёта
+	PDFTemplate *string `json:"pdf_template"`
+	// Язык и формат чисел в счёте (ru, en)
+	Locale *string `json:"locale"`
+	// Ставка НДС, % (0–100): отрицательное значение — из настроек биллинга
+	VATRate *float64 `json:"vat_rate"`
+}
+
+// applyInvoicePreferences проверяет запрос и переносит его в настройки счетов аккаунта.
+// Ошибка — текст для ответа 400; при ошибке prefs не меняются. currencies — поддерживаемые валюты.
+func applyInvoicePreferences(prefs *models.InvoicePreferences, req InvoicePreferencesRequest, currencies map[string]bool) error {
+	updated := *prefs
+
+	if req.DisplayCurrency != nil {
+		if *req.DisplayCurrency != "" && !currencies[*req.DisplayCurrency] {
+			return fmt.Errorf("Неверная валюта. Допустимые: %s", currencyList(currencies))
+		}
+		updated.DisplayCurrency = *req.DisplayCurrency
+	}
+	if req.PDFTemplate != nil {
+		if *req.PDFTemplate != "" && !invoice.IsValidPDFTemplate(*req.PDFTemplate) {
+			return fmt.Errorf("Неизвестный шаблон PDF")
+		}
+		updated.PDFTemplate = *req.PDFTemplate
+	}
+	if req.Locale != nil {
+		if *req.Locale != "" && !invoice.IsValidLocale(*req.Locale) {
+			return fmt.Errorf("Неизвестная локаль. Допустимые: ru, en")
+		}
+		updated.Locale = *req.Locale
+	}
+	if req.VATRate != nil {
+		switch rate := *req.VATRate; {
+		case rate < 0:
+			updated.VATRate = nil
+		case rate > 100:
+			return fmt.Errorf("Ставка НДС должна быть от 0 до 100%%")
+		default:
+			updated.VATRate = &rate
+		}
+	}
+	if req.InvoiceEmail != nil {
+		emails, err := parseEmailList(*req.InvoiceEmail)
+		if err != nil {
+			return err
+		}
+		if len(emails) > maxInvoiceEmails {
+			return fmt.Errorf("Максимум %d email для счетов", maxInvoiceEmails)
+		}
+		if len(emails) == 0 {
+			updated.InvoiceEmail = nil
+		} else {
+			joined := strings.Join(emails, ", ")
+			updated.InvoiceEmail = &joined
+		}
+	}
+
+	*prefs = updated
+	return nil
+}
+
+// invoicePreferencesResponse - сохранённые настройки счетов аккаунта и действующие значения
+// с учётом настроек биллинга
+func (h *Handler) invoicePreferencesResponse(account *models.Account) (gin.H, error) {
+	settings, err := h.repo.GetSettings()
+	if err != nil {
+		return nil, err
+	}
+	recipients := invoiceRecipients(account)
+	if recipients == nil {
+		recipients = []string{}
+	}
+	return gin.H{
+		"account_id":  account.ID,
+		"preferences": account.InvoicePreferences,
+		"effective":   invoice.ResolveInvoicePreferences(settings, account),
+		"recipients":  recipients,
+	}, nil
+}
+
+// GetInvoicePreferences возвращает настройки счетов аккаунта
+// GET /api/accounts/:id/invoice-preferences
+func (h *Handler) GetInvoicePreferences(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+
+	account, err := h.repo.GetAccountByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+
+	response, err := h.invoicePreferencesResponse(account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateInvoicePreferences меняет настройки счетов аккаунта (язык, справочная валюта,
+// шаблон PDF, получатели, ставка НДС) одним запросом
+// PUT /api/accounts/:id/invoice-preferences
+func (h *Handler) UpdateInvoicePreferences(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+
+	var req InvoicePreferencesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, err := h.repo.GetAccountByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+
+	if err := applyInvoicePreferences(&account.InvoicePreferences, req, h.currencies); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.repo.UpdateAccount(account); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	response, err := h.invoicePreferencesResponse(account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/services/invoice"
+)
+
+// ValidateInvoice сверяет количества в строках счёта со средним по снимкам за период и,
+// при check_wialon, с текущими активными объектами в Wialon. Счёт не изменяется —
+// проверка перед отправкой.
+// POST /api/invoices/:id/validate
+func (h *Handler) ValidateInvoice(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+
+	var req struct {
+		// Допустимое отклонение, % (по умолчанию invoice.DefaultValidationThreshold)
+		ThresholdPercent *float64 `json:"threshold_percent"`
+		// Сверить также с текущими данными Wialon
+		CheckWialon bool `json:"check_wialon"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	threshold := invoice.DefaultValidationThreshold
+	if req.ThresholdPercent != nil {
+		if *req.ThresholdPercent < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "threshold_percent не может быть отрицательным"})
+			return
+		}
+		threshold = *req.ThresholdPercent
+	}
+
+	inv, err := h.repo.GetInvoiceByID(uint(id))
+	if err != nil || inv == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Счёт не найден"})
+		return
+	}
+
+	// Текущие активные объекты — так же, как их посчитал бы снимок сейчас
+	var wialonActive *int
+	wialonError := ""
+	if req.CheckWialon {
+		breakdown, err := h.snapshot.GetUsageBreakdown(c.Request.Context(), inv.AccountID)
+		if err != nil {
+			log.Printf("ValidateInvoice: счёт %d: %v", inv.ID, err)
+			wialonError = err.Error()
+		} else {
+			active := max(breakdown.ComputedTotal-breakdown.ComputedDeactivate, 0)
+			wialonActive = &active
+		}
+	}
+
+	result, err := h.invoice.ValidateInvoice(inv, threshold, wialonActive)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"validation":   result,
+		"wialon_error": wialonError,
+	})
+}
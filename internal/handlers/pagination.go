@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/config"
+)
+
+// Значения пагинации, если конфигурация не задана
+const (
+	defaultPageSize = 20
+	maxPageSize     = 5000
+)
+
+// SetPagination задаёт размеры страниц из конфигурации
+func (h *Handler) SetPagination(pagination config.PaginationConfig) {
+	h.pagination = pagination
+}
+
+// hasPagination — клиент запросил постраничный ответ
+func hasPagination(c *gin.Context) bool {
+	return c.Query("page") != "" || c.Query("page_size") != ""
+}
+
+// parsePagination разбирает page и page_size; page_size сверх максимума — ошибка
+func (h *Handler) parsePagination(c *gin.Context) (page, pageSize int, err error) {
+	return parsePaginationConfig(c, h.pagination)
+}
+
+// parsePaginationConfig разбирает page и page_size по заданной конфигурации
+func parsePaginationConfig(c *gin.Context, pagination config.PaginationConfig) (page, pageSize int, err error) {
+	def, limit := pagination.DefaultPageSize, pagination.MaxPageSize
+	if def <= 0 {
+		def = defaultPageSize
+	}
+	if limit <= 0 {
+		limit = maxPageSize
+	}
+
+	if page, err = queryInt(c, "page", 1, 1, math.MaxInt32); err != nil {
+		return 0, 0, err
+	}
+	if pageSize, err = queryInt(c, "page_size", def, 1, math.MaxInt32); err != nil {
+		return 0, 0, err
+	}
+
+	if pageSize > limit {
+		return 0, 0, fmt.Errorf("page_size не может быть больше %d", limit)
+	}
+	return page, pageSize, nil
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/repository"
+	invoicesvc "github.com/user/wialon-billing-api/internal/services/invoice"
+	"github.com/user/wialon-billing-api/internal/version"
+)
+
+// pdfCacheSize - сколько сгенерированных PDF счетов держать в памяти
+const pdfCacheSize = 64
+
+// pdfCache - кэш PDF по ETag (хэш всех данных, из которых строится документ)
+type pdfCache struct {
+	mu    sync.Mutex
+	items map[string][]byte
+	order []string // порядок добавления для вытеснения старых
+}
+
+func newPDFCache() *pdfCache {
+	return &pdfCache{items: make(map[string][]byte)}
+}
+
+func (p *pdfCache) get(etag string) ([]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, ok := p.items[etag]
+	return data, ok
+}
+
+func (p *pdfCache) put(etag string, data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.items[etag]; ok {
+		return
+	}
+	if len(p.order) >= pdfCacheSize {
+		delete(p.items, p.order[0])
+		p.order = p.order[1:]
+	}
+	p.items[etag] = data
+	p.order = append(p.order, etag)
+}
+
+// invoicePDFETag считает ETag по счёту со строками, настройкам (реквизиты, подпись, печать),
+// аккаунту и версии сборки: любое изменение этих данных даёт новый ETag
+func invoicePDFETag(inv *models.Invoice, settings *models.BillingSettings, account *models.Account) (string, error) {
+	payload, err := json.Marshal(struct {
+		Invoice  *models.Invoice         `json:"invoice"`
+		Settings *models.BillingSettings `json:"settings"`
+		Account  *models.Account         `json:"account"`
+		Version  string                  `json:"version"`
+	}{inv, settings, account, version.Version + "/" + version.GitCommit})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(payload)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// etagMatches проверяет заголовок If-None-Match (список, слабые ETag и *)
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// invoicePDF возвращает PDF счёта с учётом ETag: при совпадении If-None-Match отвечает 304
+// (notModified = true), иначе берёт PDF из кэша обработчика или генерирует
+func (h *Handler) invoicePDF(c *gin.Context, inv *models.Invoice, settings *models.BillingSettings, account *models.Account) (pdf []byte, notModified bool, err error) {
+	// Отправленный счёт отдаём ровно в том виде, в каком его получил клиент
+	if stored, ok := storedInvoicePDF(h.repo, inv); ok {
+		etag := `"` + inv.SentPDFHash[:32] + `"`
+		c.Header("ETag", etag)
+		c.Header("Cache-Control", "private, no-cache")
+		if match := c.GetHeader("If-None-Match"); match != "" && etagMatches(match, etag) {
+			c.Status(http.StatusNotModified)
+			return nil, true, nil
+		}
+		return stored, false, nil
+	}
+
+	etag, err := invoicePDFETag(inv, settings, account)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "private, no-cache")
+	if match := c.GetHeader("If-None-Match"); match != "" && etagMatches(match, etag) {
+		c.Status(http.StatusNotModified)
+		return nil, true, nil
+	}
+
+	if data, ok := h.pdfCache.get(etag); ok {
+		return data, false, nil
+	}
+
+	data, err := h.pdf.GenerateInvoicePDF(inv, settings, account, invoicesvc.WatermarkFor(inv))
+	if err != nil {
+		return nil, false, err
+	}
+	h.pdfCache.put(etag, data)
+	return data, false, nil
+}
+
+// storedInvoicePDF возвращает PDF, зафиксированный при отправке; черновики всегда перегенерируются.
+// Документ читается из invoice_documents, только если у счёта есть хэш отправленного PDF.
+func storedInvoicePDF(repo *repository.Repository, inv *models.Invoice) ([]byte, bool) {
+	if inv.Status == "draft" || len(inv.SentPDFHash) < 32 {
+		return nil, false
+	}
+	doc, err := repo.GetInvoiceDocument(inv.ID)
+	if err != nil {
+		log.Printf("Ошибка чтения отправленного PDF счёта %d: %v", inv.ID, err)
+		return nil, false
+	}
+	if doc == nil || len(doc.PDF) == 0 || doc.SHA256 != inv.SentPDFHash {
+		return nil, false
+	}
+	return doc.PDF, true
+}
+
+// rememberSentPDF фиксирует отправленный клиенту PDF в invoice_documents, если действующего
+// ещё нет или счёт пересчитан после отправки (вызывать до смены статуса).
+// Возвращает true, если счёт нужно сохранить (новый хэш, снят ResendRequired).
+func rememberSentPDF(repo *repository.Repository, inv *models.Invoice, pdf []byte) bool {
+	if _, ok := storedInvoicePDF(repo, inv); ok && !inv.ResendRequired {
+		return false
+	}
+	sum := sha256.Sum256(pdf)
+	hash := hex.EncodeToString(sum[:])
+	if err := repo.SaveInvoiceDocument(&models.InvoiceDocument{InvoiceID: inv.ID, PDF: pdf, SHA256: hash}); err != nil {
+		log.Printf("Ошибка сохранения отправленного PDF счёта %d: %v", inv.ID, err)
+		return false
+	}
+	inv.SentPDFHash = hash
+	inv.ResendRequired = false
+	return true
+}
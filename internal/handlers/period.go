@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dateFormats - поддерживаемые форматы дат в query-параметрах
+var dateFormats = []string{"2006-01-02", "02.01.2006", time.RFC3339}
+
+// monthFormats - форматы параметра period (месяц)
+var monthFormats = []string{"2006-01", "01.2006"}
+
+// Period - месяц запроса, рассчитанный в часовом поясе клиента
+type Period struct {
+	Year     int
+	Month    int
+	Start    time.Time // 1-е число месяца (полночь UTC, как хранятся даты в БД)
+	End      time.Time // 1-е число следующего месяца
+	Now      time.Time // текущее время в часовом поясе запроса
+	Location *time.Location
+}
+
+// SetTimezone задаёт часовой пояс периодов по умолчанию (IANA); неизвестный — UTC
+func (h *Handler) SetTimezone(name string) {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		loc = time.UTC
+	}
+	h.location = loc
+}
+
+// requestLocation возвращает часовой пояс из ?tz= или часовой пояс сервера
+func (h *Handler) requestLocation(c *gin.Context) (*time.Location, error) {
+	if tz := c.Query("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("неизвестный часовой пояс: %s", tz)
+		}
+		return loc, nil
+	}
+	if h.location != nil {
+		return h.location, nil
+	}
+	return time.UTC, nil
+}
+
+// queryInt разбирает целочисленный query-параметр: без параметра — def,
+// не число или вне [min, max] — ошибка (400 у вызывающего)
+func queryInt(c *gin.Context, name string, def, min, max int) (int, error) {
+	str := c.Query(name)
+	if str == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(str))
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("неверный параметр %s: %s (ожидается целое число от %d до %d)", name, str, min, max)
+	}
+	return v, nil
+}
+
+// parsePeriod разбирает месяц из year и month (или period=YYYY-MM) с учётом tz.
+// Без параметров — текущий месяц в часовом поясе запроса; year вне 2000–2100 и month вне 1–12 — ошибка.
+func (h *Handler) parsePeriod(c *gin.Context) (*Period, error) {
+	loc, err := h.requestLocation(c)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().In(loc)
+	year := now.Year()
+	month := int(now.Month())
+
+	if periodStr := c.Query("period"); periodStr != "" {
+		parsed := false
+		for _, layout := range monthFormats {
+			if t, err := time.Parse(layout, periodStr); err == nil {
+				year, month = t.Year(), int(t.Month())
+				parsed = true
+				break
+			}
+		}
+		if !parsed {
+			return nil, fmt.Errorf("неверный формат period: %s (ожидается YYYY-MM или MM.YYYY)", periodStr)
+		}
+	}
+
+	if year, err = queryInt(c, "year", year, 2000, 2100); err != nil {
+		return nil, err
+	}
+	if month, err = queryInt(c, "month", month, 1, 12); err != nil {
+		return nil, err
+	}
+
+	return newPeriod(year, month, now, loc), nil
+}
+
+// parseMonthParam разбирает обязательный query-параметр месяца (YYYY-MM или MM.YYYY) с учётом tz
+func (h *Handler) parseMonthParam(c *gin.Context, name string) (*Period, error) {
+	loc, err := h.requestLocation(c)
+	if err != nil {
+		return nil, err
+	}
+	str := c.Query(name)
+	if str == "" {
+		return nil, fmt.Errorf("не указан параметр %s (YYYY-MM)", name)
+	}
+	t, err := parseMonth(str)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if t.Year() < 2000 || t.Year() > 2100 {
+		return nil, fmt.Errorf("неверный параметр %s: %s (год от 2000 до 2100)", name, str)
+	}
+	return newPeriod(t.Year(), int(t.Month()), time.Now().In(loc), loc), nil
+}
+
+// newPeriod собирает Period для месяца (даты — полночь UTC, как в БД)
+func newPeriod(year, month int, now time.Time, loc *time.Location) *Period {
+	start := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	return &Period{
+		Year:     year,
+		Month:    month,
+		Start:    start,
+		End:      start.AddDate(0, 1, 0),
+		Now:      now,
+		Location: loc,
+	}
+}
+
+// parseDateParam разбирает дату в одном из dateFormats. Время с зоной (RFC3339)
+// переводится в loc, результат — календарная дата (полночь UTC).
+func parseDateParam(value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			if layout == time.RFC3339 {
+				t = t.In(loc)
+			}
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("неверный формат даты: %s (ожидается YYYY-MM-DD или DD.MM.YYYY)", value)
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// requisiteFilled проверяет, заполнен ли реквизит покупателя (ключи — config.RequisiteFields)
+func requisiteFilled(account *models.Account, field string) bool {
+	switch field {
+	case "buyer_name":
+		return strings.TrimSpace(account.BuyerName) != ""
+	case "buyer_bin":
+		return strings.TrimSpace(account.BuyerBIN) != ""
+	case "buyer_address":
+		return strings.TrimSpace(account.BuyerAddress) != ""
+	case "buyer_email":
+		return strings.TrimSpace(account.BuyerEmail) != ""
+	case "buyer_phone":
+		return strings.TrimSpace(account.BuyerPhone) != ""
+	case "contract_number":
+		return strings.TrimSpace(account.ContractNumber) != ""
+	case "contract_date":
+		return account.ContractDate != nil
+	}
+	return true
+}
+
+// RequisitesCheckItem - аккаунт в биллинге с незаполненными обязательными реквизитами
+type RequisitesCheckItem struct {
+	ID       uint     `json:"id"`
+	WialonID int64    `json:"wialon_id"`
+	Name     string   `json:"name"`
+	Missing  []string `json:"missing"`
+}
+
+// CheckAccountRequisites возвращает аккаунты в биллинге, у которых не заполнены
+// обязательные реквизиты (billing.required_requisites) — проверка перед выставлением счетов
+// GET /api/accounts/requisites-check
+func (h *Handler) CheckAccountRequisites(c *gin.Context) {
+	accounts, err := h.repo.GetSelectedAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	required := h.billing.RequiredRequisites
+	items := make([]RequisitesCheckItem, 0)
+	for i := range accounts {
+		var missing []string
+		for _, field := range required {
+			if !requisiteFilled(&accounts[i], field) {
+				missing = append(missing, field)
+			}
+		}
+		if len(missing) > 0 {
+			items = append(items, RequisitesCheckItem{
+				ID:       accounts[i].ID,
+				WialonID: accounts[i].WialonID,
+				Name:     accounts[i].Name,
+				Missing:  missing,
+			})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"required_fields": required,
+		"total":           len(accounts),
+		"incomplete":      len(items),
+		"accounts":        items,
+	})
+}
@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"log"
@@ -15,6 +18,9 @@ import (
 	"github.com/user/wialon-billing-api/internal/services/invoice"
 )
 
+// emailPattern - проверка формата email получателя
+var emailPattern = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
+
 // SMTPHandler - обработчики для SMTP эндпоинтов
 type SMTPHandler struct {
 	repo           *repository.Repository
@@ -24,12 +30,12 @@ type SMTPHandler struct {
 }
 
 // NewSMTPHandler создаёт новый обработчик SMTP
-func NewSMTPHandler(repo *repository.Repository, emailService *email.Service, invoiceService *invoice.Service) *SMTPHandler {
+func NewSMTPHandler(repo *repository.Repository, emailService *email.Service, invoiceService *invoice.Service, pdfGenerator *invoice.PDFGenerator) *SMTPHandler {
 	return &SMTPHandler{
 		repo:           repo,
 		emailService:   emailService,
 		invoiceService: invoiceService,
-		pdfGenerator:   invoice.NewPDFGenerator(),
+		pdfGenerator:   pdfGenerator,
 	}
 }
 
@@ -54,6 +60,10 @@ func (h *SMTPHandler) GetSMTPSettings(c *gin.Context) {
 			"has_password": false,
 			"copy_email":   "",
 			"copy_enabled": false,
+			"tls_mode":     models.SMTPTLSAuto,
+			"implicit_tls": false,
+
+			"attach_excel_by_default": false,
 		})
 		return
 	}
@@ -71,6 +81,14 @@ func (h *SMTPHandler) GetSMTPSettings(c *gin.Context) {
 		"copy_email":   settings.CopyEmail,
 		"copy_enabled": settings.CopyEnabled,
 		"updated_at":   settings.UpdatedAt,
+
+		"last_test_at":    settings.LastTestAt,
+		"last_test_error": settings.LastTestError,
+
+		"tls_mode":     settings.TLSMode,
+		"implicit_tls": settings.ImplicitTLS(),
+
+		"attach_excel_by_default": settings.AttachExcelByDefault,
 	})
 }
 
@@ -87,12 +105,22 @@ func (h *SMTPHandler) UpdateSMTPSettings(c *gin.Context) {
 		UseTLS      bool   `json:"use_tls"`
 		CopyEmail   string `json:"copy_email"`
 		CopyEnabled bool   `json:"copy_enabled"`
+
+		// "" — по порту (465 — неявный TLS), "starttls" или "implicit"
+		TLSMode string `json:"tls_mode"`
+		// Прикладывать Excel-отчёт начислений к письмам со счётом по умолчанию
+		AttachExcelByDefault bool `json:"attach_excel_by_default"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	req.TLSMode = strings.ToLower(strings.TrimSpace(req.TLSMode))
+	if !models.SMTPTLSModes[req.TLSMode] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tls_mode: допустимые значения starttls, implicit или пусто (по порту)"})
+		return
+	}
 
 	settings, err := h.repo.GetSMTPSettings()
 	if err != nil {
@@ -112,6 +140,11 @@ func (h *SMTPHandler) UpdateSMTPSettings(c *gin.Context) {
 	settings.UseTLS = req.UseTLS
 	settings.CopyEmail = req.CopyEmail
 	settings.CopyEnabled = req.CopyEnabled
+	settings.TLSMode = req.TLSMode
+	settings.AttachExcelByDefault = req.AttachExcelByDefault
+	// Изменённые настройки нужно проверить заново
+	settings.LastTestAt = nil
+	settings.LastTestError = ""
 
 	// Шифруем пароль только если передан новый
 	if req.Password != "" {
@@ -133,20 +166,29 @@ func (h *SMTPHandler) UpdateSMTPSettings(c *gin.Context) {
 
 // TestSMTPConnection отправляет тестовое письмо
 func (h *SMTPHandler) TestSMTPConnection(c *gin.Context) {
-	if err := h.emailService.TestConnection(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+	testErr := h.emailService.TestConnection()
 
-	// Автоматически включаем SMTP после успешного теста
+	// Запоминаем результат проверки для сводки состояния (GET /api/admin/status)
 	settings, err := h.repo.GetSMTPSettings()
-	if err == nil && settings != nil && !settings.Enabled {
-		settings.Enabled = true
-		if saveErr := h.repo.SaveSMTPSettings(settings); saveErr != nil {
-			log.Printf("[SMTP] Ошибка автовключения: %v", saveErr)
-		} else {
+	if err == nil && settings != nil {
+		now := time.Now()
+		settings.LastTestAt = &now
+		settings.LastTestError = ""
+		if testErr != nil {
+			settings.LastTestError = testErr.Error()
+		} else if !settings.Enabled {
+			// Автоматически включаем SMTP после успешного теста
+			settings.Enabled = true
 			log.Printf("[SMTP] SMTP автоматически включён после успешного теста")
 		}
+		if saveErr := h.repo.SaveSMTPSettings(settings); saveErr != nil {
+			log.Printf("[SMTP] Ошибка сохранения результата проверки: %v", saveErr)
+		}
+	}
+
+	if testErr != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": testErr.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Тестовое письмо отправлено"})
@@ -177,15 +219,17 @@ func (h *SMTPHandler) GetEmailTemplate(c *gin.Context) {
 	c.JSON(http.StatusOK, tmpl)
 }
 
-// UpdateEmailTemplate обновляет шаблон письма
+// UpdateEmailTemplate обновляет шаблон письма. Поля, не переданные в запросе, не меняются —
+// например, {"is_active": false} только выключает письма этого типа.
 func (h *SMTPHandler) UpdateEmailTemplate(c *gin.Context) {
 	templateType := c.Param("type")
 
 	var req struct {
-		Name     string `json:"name"`
-		Subject  string `json:"subject"`
-		HTMLBody string `json:"html_body"`
-		IsActive bool   `json:"is_active"`
+		Name     *string `json:"name"`
+		Subject  *string `json:"subject"`
+		HTMLBody *string `json:"html_body"`
+		// false — письма этого типа не отправляются (OTP — ошибка, счета и уведомления — пропуск)
+		IsActive *bool `json:"is_active"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -203,10 +247,18 @@ func (h *SMTPHandler) UpdateEmailTemplate(c *gin.Context) {
 		return
 	}
 
-	tmpl.Name = req.Name
-	tmpl.Subject = req.Subject
-	tmpl.HTMLBody = req.HTMLBody
-	tmpl.IsActive = req.IsActive
+	if req.Name != nil {
+		tmpl.Name = *req.Name
+	}
+	if req.Subject != nil {
+		tmpl.Subject = *req.Subject
+	}
+	if req.HTMLBody != nil {
+		tmpl.HTMLBody = *req.HTMLBody
+	}
+	if req.IsActive != nil {
+		tmpl.IsActive = *req.IsActive
+	}
 
 	if err := h.repo.SaveEmailTemplate(tmpl); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -238,7 +290,46 @@ func (h *SMTPHandler) PreviewEmailTemplate(c *gin.Context) {
 	})
 }
 
+// invoiceDocument возвращает PDF для отправки: зафиксированный при первой отправке
+// (для отправленных и оплаченных счетов) или сгенерированный по текущим данным.
+// Счёт, пересчитанный после отправки (ResendRequired), отправляется по новым суммам.
+func (h *SMTPHandler) invoiceDocument(inv *models.Invoice, settings *models.BillingSettings) ([]byte, error) {
+	if stored, ok := storedInvoicePDF(h.repo, inv); ok && !inv.ResendRequired {
+		return stored, nil
+	}
+	// Без водяного знака: отправленный документ фиксируется как окончательный
+	return h.pdfGenerator.GenerateInvoicePDF(inv, settings, &inv.Account, "")
+}
+
+// invoiceAttachments возвращает дополнительные вложения письма со счётом: Excel-отчёт начислений
+// за период счёта, если он запрошен (attach — из запроса, nil — attach_excel_by_default настроек SMTP).
+// Отчёт строится тем же GenerateChargesExcelBytes по сохранённым начислениям, что и при выставлении счёта.
+func (h *SMTPHandler) invoiceAttachments(inv *models.Invoice, attach *bool, smtpSettings *models.SMTPSettings) ([]email.Attachment, error) {
+	withExcel := smtpSettings != nil && smtpSettings.AttachExcelByDefault
+	if attach != nil {
+		withExcel = *attach
+	}
+	if !withExcel {
+		return nil, nil
+	}
+
+	excelData, err := GenerateChargesExcelBytes(h.repo, h.invoiceService.Precision(), h.invoiceService.DefaultCurrency(), inv.AccountID, inv.Period.Year(), int(inv.Period.Month()))
+	if err != nil {
+		return nil, err
+	}
+	invoiceNum := inv.Number
+	if invoiceNum == "" {
+		invoiceNum = fmt.Sprintf("%d", inv.ID)
+	}
+	return []email.Attachment{{
+		Filename:    fmt.Sprintf("charges_%s.xlsx", strings.ReplaceAll(invoiceNum, "/", "_")),
+		ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Data:        excelData,
+	}}, nil
+}
+
 // SendInvoiceEmail отправляет счёт по email
+// POST /api/invoices/:id/send {"attach_excel": опционально — приложить Excel-отчёт начислений}
 func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 	idStr := c.Param("id")
 	var id uint
@@ -247,6 +338,16 @@ func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 		return
 	}
 
+	var req struct {
+		AttachExcel *bool `json:"attach_excel"` // не указан — attach_excel_by_default настроек SMTP
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	// Получаем счёт с аккаунтом
 	inv, err := h.repo.GetInvoiceByID(id)
 	if err != nil || inv == nil {
@@ -254,12 +355,19 @@ func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 		return
 	}
 
-	// Проверяем email покупателя
-	if inv.Account.BuyerEmail == "" {
+	// Получатели счёта: email для счетов или email покупателя
+	recipients := invoiceRecipients(&inv.Account)
+	if len(recipients) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Email покупателя не указан в реквизитах аккаунта"})
 		return
 	}
 
+	// Шаблон счёта выключен — письма со счетами не отправляются
+	if !h.emailService.IsTemplateActive("invoice") {
+		c.JSON(http.StatusConflict, gin.H{"error": "Отправка счетов отключена: шаблон письма invoice неактивен"})
+		return
+	}
+
 	// Получаем настройки биллинга
 	billingSettings, err := h.repo.GetSettings()
 	if err != nil || billingSettings == nil {
@@ -267,16 +375,40 @@ func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 		return
 	}
 
-	// Генерируем PDF
-	pdfData, err := h.pdfGenerator.GenerateInvoicePDF(inv, billingSettings, &inv.Account)
+	// PDF: уже отправленный клиенту вариант или новый
+	pdfData, err := h.invoiceDocument(inv, billingSettings)
 	if err != nil {
 		log.Printf("[EMAIL] Ошибка генерации PDF для счёта %d: %v", id, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации PDF"})
 		return
 	}
 
-	// Отправляем клиенту (только PDF, без Excel-отчёта)
-	if err := h.emailService.SendInvoice(inv.Account.BuyerEmail, inv, pdfData); err != nil {
+	// Excel-отчёт начислений — по запросу или настройке SMTP
+	smtpSettings, _ := h.repo.GetSMTPSettings()
+	attachments, err := h.invoiceAttachments(inv, req.AttachExcel, smtpSettings)
+	if err != nil {
+		log.Printf("[EMAIL] Ошибка генерации Excel для счёта %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации Excel"})
+		return
+	}
+
+	// Отправляем клиенту
+	sent, failed, err := sendToRecipients(recipients, func(addr string) error {
+		return h.trackDelivery(inv, addr, models.DeliveryKindTo, false, func(addr string) error {
+			return h.emailService.SendInvoice(addr, inv, pdfData, attachments...)
+		})
+	})
+	inv.DeliveryStatus, inv.DeliveryError = deliverySummary(failed, err)
+	if err != nil {
+		h.saveDeliveryStatus(inv)
+		if errors.Is(err, email.ErrAttachmentsTooLarge) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, email.ErrTemplateDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки: " + err.Error()})
 		return
 	}
@@ -284,8 +416,13 @@ func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 	// Отправляем копии на дополнительные email покупателя (бухгалтерия, администратор и т.д.)
 	ccEmails := parseJSONEmails(inv.Account.CcEmails)
 	for _, cc := range ccEmails {
+		if containsEmail(recipients, cc) {
+			continue
+		}
 		go func(addr string) {
-			if err := h.emailService.SendInvoice(addr, inv, pdfData); err != nil {
+			if err := h.trackDelivery(inv, addr, models.DeliveryKindCc, false, func(addr string) error {
+				return h.emailService.SendInvoice(addr, inv, pdfData, attachments...)
+			}); err != nil {
 				log.Printf("[EMAIL] Ошибка отправки CC на %s: %v", addr, err)
 			} else {
 				log.Printf("[EMAIL] Копия счёта отправлена на CC: %s", addr)
@@ -294,10 +431,11 @@ func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 	}
 
 	// Отправляем копию если включено (глобальная копия оператору)
-	smtpSettings, _ := h.repo.GetSMTPSettings()
 	if smtpSettings != nil && smtpSettings.CopyEnabled && smtpSettings.CopyEmail != "" {
 		go func() {
-			if err := h.emailService.SendInvoice(smtpSettings.CopyEmail, inv, pdfData); err != nil {
+			if err := h.trackDelivery(inv, smtpSettings.CopyEmail, models.DeliveryKindCopy, false, func(addr string) error {
+				return h.emailService.SendInvoice(addr, inv, pdfData, attachments...)
+			}); err != nil {
 				log.Printf("[EMAIL] Ошибка отправки копии на %s: %v", smtpSettings.CopyEmail, err)
 			} else {
 				log.Printf("[EMAIL] Копия счёта отправлена на %s", smtpSettings.CopyEmail)
@@ -305,8 +443,10 @@ func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 		}()
 	}
 
-	// Обновляем статус счёта на 'sent'
+	// Обновляем статус счёта на 'sent' и фиксируем отправленный PDF
+	rememberSentPDF(h.repo, inv, pdfData)
 	inv.Status = "sent"
+	inv.SentVia = models.SentViaEmail
 	now := time.Now()
 	if inv.SentAt == nil {
 		inv.SentAt = &now
@@ -315,7 +455,215 @@ func (h *SMTPHandler) SendInvoiceEmail(c *gin.Context) {
 		log.Printf("[EMAIL] Письмо отправлено, но ошибка обновления статуса счёта %d: %v", id, err)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Счёт отправлен на %s", inv.Account.BuyerEmail)})
+	recordInvoiceEvent(h.repo, c, inv, "send", strings.Join(sent, ", "), "")
+
+	response := gin.H{"message": fmt.Sprintf("Счёт отправлен на %s", strings.Join(sent, ", "))}
+	if len(failed) > 0 {
+		response["failed"] = failed
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ResendInvoiceEmail повторно отправляет счёт (статус и SentAt не меняются)
+// POST /api/invoices/:id/resend {"email": "опционально", "note": "опционально", "attach_excel": опционально}
+func (h *SMTPHandler) ResendInvoiceEmail(c *gin.Context) {
+	idStr := c.Param("id")
+	var id uint
+	if _, err := fmt.Sscanf(idStr, "%d", &id); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID счёта"})
+		return
+	}
+
+	var req struct {
+		Email string `json:"email"` // другой получатель вместо email покупателя
+		Note  string `json:"note"`  // примечание в начале письма
+		// Приложить Excel-отчёт начислений; не указан — attach_excel_by_default настроек SMTP
+		AttachExcel *bool `json:"attach_excel"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	inv, err := h.repo.GetInvoiceByID(id)
+	if err != nil || inv == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Счёт не найден"})
+		return
+	}
+
+	recipients := invoiceRecipients(&inv.Account)
+	if override := strings.TrimSpace(req.Email); override != "" {
+		recipients = []string{override}
+	}
+	if len(recipients) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email покупателя не указан в реквизитах аккаунта"})
+		return
+	}
+	for _, recipient := range recipients {
+		if !emailPattern.MatchString(recipient) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Некорректный email: %s", recipient)})
+			return
+		}
+	}
+
+	if !h.emailService.IsTemplateActive("invoice") {
+		c.JSON(http.StatusConflict, gin.H{"error": "Отправка счетов отключена: шаблон письма invoice неактивен"})
+		return
+	}
+
+	billingSettings, err := h.repo.GetSettings()
+	if err != nil || billingSettings == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Настройки биллинга не найдены"})
+		return
+	}
+
+	// При повторной отправке клиент получает тот же документ, что и в первый раз
+	pdfData, err := h.invoiceDocument(inv, billingSettings)
+	if err != nil {
+		log.Printf("[EMAIL] Ошибка генерации PDF для счёта %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации PDF"})
+		return
+	}
+
+	smtpSettings, _ := h.repo.GetSMTPSettings()
+	attachments, err := h.invoiceAttachments(inv, req.AttachExcel, smtpSettings)
+	if err != nil {
+		log.Printf("[EMAIL] Ошибка генерации Excel для счёта %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка генерации Excel"})
+		return
+	}
+
+	sent, failed, err := sendToRecipients(recipients, func(addr string) error {
+		return h.trackDelivery(inv, addr, models.DeliveryKindTo, true, func(addr string) error {
+			return h.emailService.SendInvoiceWithNote(addr, inv, pdfData, req.Note, attachments...)
+		})
+	})
+	inv.DeliveryStatus, inv.DeliveryError = deliverySummary(failed, err)
+	h.saveDeliveryStatus(inv)
+	if err != nil {
+		if errors.Is(err, email.ErrAttachmentsTooLarge) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, email.ErrTemplateDisabled) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка отправки: " + err.Error()})
+		return
+	}
+
+	// Копии — по тем же правилам, что и при первой отправке
+	for _, cc := range parseJSONEmails(inv.Account.CcEmails) {
+		if containsEmail(recipients, cc) {
+			continue
+		}
+		go func(addr string) {
+			if err := h.trackDelivery(inv, addr, models.DeliveryKindCc, true, func(addr string) error {
+				return h.emailService.SendInvoiceWithNote(addr, inv, pdfData, req.Note, attachments...)
+			}); err != nil {
+				log.Printf("[EMAIL] Ошибка повторной отправки CC на %s: %v", addr, err)
+			}
+		}(cc)
+	}
+
+	if smtpSettings != nil && smtpSettings.CopyEnabled && smtpSettings.CopyEmail != "" {
+		go func() {
+			if err := h.trackDelivery(inv, smtpSettings.CopyEmail, models.DeliveryKindCopy, true, func(addr string) error {
+				return h.emailService.SendInvoiceWithNote(addr, inv, pdfData, req.Note, attachments...)
+			}); err != nil {
+				log.Printf("[EMAIL] Ошибка отправки копии на %s: %v", smtpSettings.CopyEmail, err)
+			}
+		}()
+	}
+
+	if rememberSentPDF(h.repo, inv, pdfData) {
+		if err := h.repo.UpdateInvoice(inv); err != nil {
+			log.Printf("[EMAIL] Ошибка сохранения PDF счёта %d: %v", id, err)
+		}
+	}
+
+	recipient := strings.Join(sent, ", ")
+	recordInvoiceEvent(h.repo, c, inv, "resend", recipient, req.Note)
+	log.Printf("[EMAIL] Счёт %s повторно отправлен на %s", inv.Number, recipient)
+
+	response := gin.H{"message": fmt.Sprintf("Счёт повторно отправлен на %s", recipient)}
+	if len(failed) > 0 {
+		response["failed"] = failed
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// trackDelivery отправляет письмо со счётом одному получателю и фиксирует доставку:
+// запись создаётся в статусе queued и по итогу отправки переходит в sent или failed
+func (h *SMTPHandler) trackDelivery(inv *models.Invoice, addr, kind string, resend bool, send func(addr string) error) error {
+	delivery := &models.InvoiceDelivery{
+		InvoiceID: inv.ID,
+		Recipient: addr,
+		Kind:      kind,
+		Status:    models.DeliveryQueued,
+		Resend:    resend,
+	}
+	if err := h.repo.CreateInvoiceDelivery(delivery); err != nil {
+		log.Printf("[EMAIL] Ошибка записи доставки счёта %d на %s: %v", inv.ID, addr, err)
+	}
+
+	sendErr := send(addr)
+
+	if delivery.ID != 0 {
+		status, errText := models.DeliverySent, ""
+		if sendErr != nil {
+			status, errText = models.DeliveryFailed, sendErr.Error()
+		}
+		if err := h.repo.UpdateInvoiceDeliveryStatus(delivery.ID, status, errText); err != nil {
+			log.Printf("[EMAIL] Ошибка обновления доставки счёта %d на %s: %v", inv.ID, addr, err)
+		}
+	}
+	return sendErr
+}
+
+// deliverySummary сводит итог отправки основным получателям: failed — письмо не ушло
+// ни одному, иначе sent; не принятые адреса перечисляются в тексте ошибки
+func deliverySummary(failed []string, err error) (status, errText string) {
+	if err != nil {
+		return models.DeliveryFailed, err.Error()
+	}
+	if len(failed) > 0 {
+		return models.DeliverySent, "Не отправлено: " + strings.Join(failed, ", ")
+	}
+	return models.DeliverySent, ""
+}
+
+// saveDeliveryStatus сохраняет итог доставки счёта
+func (h *SMTPHandler) saveDeliveryStatus(inv *models.Invoice) {
+	if err := h.repo.SetInvoiceDeliveryStatus(inv.ID, inv.DeliveryStatus, inv.DeliveryError); err != nil {
+		log.Printf("[EMAIL] Ошибка сохранения статуса доставки счёта %d: %v", inv.ID, err)
+	}
+}
+
+// recordInvoiceEvent записывает событие в историю счёта (автор — из контекста авторизации)
+func recordInvoiceEvent(repo *repository.Repository, c *gin.Context, inv *models.Invoice, eventType, recipient, note string) {
+	event := &models.InvoiceEvent{
+		InvoiceID: inv.ID,
+		EventType: eventType,
+		Status:    inv.Status,
+		Recipient: recipient,
+		Note:      note,
+	}
+	// Для переводов в «отправлен» фиксируем канал доставки
+	if inv.Status == "sent" && (eventType == "send" || eventType == "status") {
+		event.SentVia = inv.SentVia
+	}
+	if userID, ok := c.Get("userID"); ok {
+		if id, ok := userID.(uint); ok {
+			event.UserID = &id
+		}
+	}
+	if err := repo.CreateInvoiceEvent(event); err != nil {
+		log.Printf("Ошибка записи истории счёта %d: %v", inv.ID, err)
+	}
 }
 
 // parseJSONEmails десериализует JSON-массив email из строки
@@ -330,3 +678,71 @@ func parseJSONEmails(jsonStr string) []string {
 	}
 	return emails
 }
+
+// maxInvoiceEmails - максимум адресов в email для счетов
+const maxInvoiceEmails = 5
+
+// parseEmailList разбирает список email через запятую (или точку с запятой):
+// обрезает пробелы, приводит к нижнему регистру, убирает дубли и проверяет формат
+func parseEmailList(value string) ([]string, error) {
+	var emails []string
+	seen := make(map[string]bool)
+	for _, e := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" || seen[e] {
+			continue
+		}
+		if !emailPattern.MatchString(e) {
+			return nil, fmt.Errorf("Некорректный email: %s", e)
+		}
+		seen[e] = true
+		emails = append(emails, e)
+	}
+	return emails, nil
+}
+
+// invoiceRecipients возвращает получателей счёта: email для счетов аккаунта,
+// а если он не задан — email покупателя
+func invoiceRecipients(account *models.Account) []string {
+	if account.InvoiceEmail != nil {
+		if emails, err := parseEmailList(*account.InvoiceEmail); err == nil && len(emails) > 0 {
+			return emails
+		}
+	}
+	if account.BuyerEmail != "" {
+		return []string{account.BuyerEmail}
+	}
+	return nil
+}
+
+// containsEmail проверяет наличие адреса в списке без учёта регистра
+func containsEmail(list []string, email string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendToRecipients отправляет письмо каждому получателю по очереди.
+// Ошибка возвращается, только если не удалось отправить ни одному;
+// иначе — списки успешных и неудачных адресов.
+func sendToRecipients(recipients []string, send func(addr string) error) (sent, failed []string, err error) {
+	var firstErr error
+	for _, addr := range recipients {
+		if sendErr := send(addr); sendErr != nil {
+			log.Printf("[EMAIL] Ошибка отправки на %s: %v", addr, sendErr)
+			if firstErr == nil {
+				firstErr = sendErr
+			}
+			failed = append(failed, addr)
+			continue
+		}
+		sent = append(sent, addr)
+	}
+	if len(sent) == 0 {
+		return nil, failed, firstErr
+	}
+	return sent, failed, nil
+}
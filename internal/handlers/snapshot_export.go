@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/repository"
+)
+
+// snapshotExportBatch - снимков, читаемых из БД за один запрос при выгрузке
+const snapshotExportBatch = 1000
+
+// ExportSnapshots выгружает в CSV все снимки по фильтрам (from, to, account_id — как в GetSnapshots).
+// Снимки читаются порциями по курсору (snapshot_date, id) и сразу пишутся в ответ,
+// поэтому выгрузка всей истории не упирается в max_page_size и не держит её в памяти.
+// GET /api/snapshots/export
+func (h *Handler) ExportSnapshots(c *gin.Context) {
+	loc, err := h.requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var filter repository.SnapshotFilter
+	if fromStr := c.Query("from"); fromStr != "" {
+		t, err := parseDateParam(fromStr, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.From = &t
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		t, err := parseDateParam(toStr, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filter.To = &t
+	}
+	if accStr := c.Query("account_id"); accStr != "" {
+		id, err := strconv.ParseUint(accStr, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный account_id"})
+			return
+		}
+		aid := uint(id)
+		filter.AccountID = &aid
+	}
+
+	// Первая порция — до заголовков, чтобы ошибку БД можно было вернуть как JSON
+	snapshots, err := h.repo.GetSnapshotsAfter(nil, snapshotExportBatch, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	setAttachment(c, fmt.Sprintf("snapshots_%s.csv", time.Now().Format("2006-01-02")))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{
+		"snapshot_id", "snapshot_date", "account_id", "wialon_id", "account_name", "connection",
+		"total_units", "units_created", "units_deleted", "units_deactivated", "active_units",
+	})
+
+	rows := 0
+	for len(snapshots) > 0 {
+		for _, snap := range snapshots {
+			active := snap.TotalUnits - snap.UnitsDeactivated
+			if active < 0 {
+				active = 0
+			}
+			w.Write([]string{
+				strconv.FormatUint(uint64(snap.ID), 10),
+				snap.SnapshotDate.Format("2006-01-02"),
+				strconv.FormatUint(uint64(snap.AccountID), 10),
+				strconv.FormatInt(snap.Account.WialonID, 10),
+				snap.Account.Name,
+				snap.Account.ConnectionName,
+				strconv.Itoa(snap.TotalUnits),
+				strconv.Itoa(snap.UnitsCreated),
+				strconv.Itoa(snap.UnitsDeleted),
+				strconv.Itoa(snap.UnitsDeactivated),
+				strconv.Itoa(active),
+			})
+		}
+		rows += len(snapshots)
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Printf("ExportSnapshots: запись прервана после %d снимков: %v", rows, err)
+			return
+		}
+		c.Writer.Flush()
+
+		// Клиент отключился или истёк лимит времени запроса
+		if err := c.Request.Context().Err(); err != nil {
+			log.Printf("ExportSnapshots: выгрузка прервана после %d снимков: %v", rows, err)
+			return
+		}
+		if len(snapshots) < snapshotExportBatch {
+			break
+		}
+
+		snapshots, err = h.repo.GetSnapshotsAfter(repository.NextSnapshotCursor(snapshots), snapshotExportBatch, filter)
+		if err != nil {
+			// Заголовки уже отправлены — остаётся только оборвать выгрузку
+			log.Printf("ExportSnapshots: ошибка чтения после %d снимков: %v", rows, err)
+			return
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/services/snapshot"
+)
+
+// maxSnapshotGapDays - максимальная длина периода поиска пропусков снимков
+const maxSnapshotGapDays = 366
+
+// snapshotGapRange разбирает период поиска пропусков (parseDateParam в часовом поясе loc).
+// По умолчанию from — начало месяца вчерашнего дня, to — вчера (yesterday — последние
+// завершённые сутки в часовом поясе снимков). За текущие сутки снимка ещё быть не должно,
+// поэтому to позже yesterday — ошибка.
+func snapshotGapRange(fromStr, toStr string, loc *time.Location, yesterday time.Time) (time.Time, time.Time, error) {
+	from := time.Date(yesterday.Year(), yesterday.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if fromStr != "" {
+		parsed, err := parseDateParam(fromStr, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("from: %w", err)
+		}
+		from = parsed
+	}
+	to := yesterday
+	if toStr != "" {
+		parsed, err := parseDateParam(toStr, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("to: %w", err)
+		}
+		to = parsed
+	}
+
+	if to.After(yesterday) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to не может быть позже %s: снимки за текущие сутки ещё не созданы", yesterday.Format("2006-01-02"))
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("from должен быть не позже to")
+	}
+	if to.Sub(from) >= maxSnapshotGapDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("период не больше %d дней", maxSnapshotGapDays)
+	}
+	return from, to, nil
+}
+
+// GetSnapshotGaps возвращает дни без снимков по аккаунтам, участвующим в биллинге
+// GET /api/snapshots/gaps?from=YYYY-MM-DD&to=YYYY-MM-DD&account_id=
+func (h *Handler) GetSnapshotGaps(c *gin.Context) {
+	loc, err := h.requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to, err := snapshotGapRange(c.Query("from"), c.Query("to"), loc, h.snapshot.LastCompleteDay())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	accountID, err := queryInt(c, "account_id", 0, 0, math.MaxInt32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	gaps, err := h.snapshot.FindSnapshotGaps(from, to, uint(accountID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":          from.Format("2006-01-02"),
+		"to":            to.Format("2006-01-02"),
+		"missing_total": countMissingDates(gaps),
+		"gaps":          gaps,
+	})
+}
+
+// FillSnapshotGaps создаёт снимки обратным расчётом только за дни без снимков
+// POST /api/snapshots/fill-gaps {"from": "YYYY-MM-DD", "to": "YYYY-MM-DD", "account_id": 0}
+func (h *Handler) FillSnapshotGaps(c *gin.Context) {
+	var req struct {
+		From      string `json:"from"`
+		To        string `json:"to"`
+		AccountID uint   `json:"account_id"` // 0 — все аккаунты
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный формат запроса"})
+			return
+		}
+	}
+
+	loc, err := h.requestLocation(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to, err := snapshotGapRange(req.From, req.To, loc, h.snapshot.LastCompleteDay())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := h.snapshot.FillSnapshotGaps(c.Request.Context(), from, to, req.AccountID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	missing := countMissingDates(result.Found)
+	remaining := countMissingDates(result.Remaining)
+	var message string
+	switch {
+	case missing == 0:
+		message = "Пропусков нет"
+	case remaining == 0:
+		message = "Пропуски заполнены обратным расчётом"
+	case remaining < missing:
+		message = fmt.Sprintf("Пропуски заполнены частично: осталось %d из %d дней", remaining, missing)
+	default:
+		message = "Пропуски не заполнены"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":        message,
+		"from":           from.Format("2006-01-02"),
+		"to":             to.Format("2006-01-02"),
+		"missing":        missing,
+		"count":          len(result.Snapshots),
+		"gaps":           result.Found,
+		"remaining":      remaining,
+		"remaining_gaps": result.Remaining,
+		"failures":       result.Failures,
+	})
+}
+
+// countMissingDates считает дни без снимков по всем аккаунтам
+func countMissingDates(gaps []snapshot.SnapshotGap) int {
+	missing := 0
+	for _, gap := range gaps {
+		missing += len(gap.MissingDates)
+	}
+	return missing
+}
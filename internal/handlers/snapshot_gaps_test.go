@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotGapRange(t *testing.T) {
+	yesterday := time.Date(2026, time.March, 15, 0, 0, 0, 0, time.UTC)
+	date := func(d int) time.Time { return time.Date(2026, time.March, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		from, to string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{"", "", date(1), date(15), false},
+		{"2026-03-05", "2026-03-10", date(5), date(10), false},
+		{"05.03.2026", "15.03.2026", date(5), date(15), false},
+		{"2026-03-05", "2026-03-16", time.Time{}, time.Time{}, true},
+		{"2026-03-10", "2026-03-05", time.Time{}, time.Time{}, true},
+		{"2025-01-01", "", time.Time{}, time.Time{}, true},
+		{"2026-3-5", "", time.Time{}, time.Time{}, true},
+	}
+	for _, tt := range tests {
+		from, to, err := snapshotGapRange(tt.from, tt.to, time.UTC, yesterday)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("snapshotGapRange(%q, %q): ошибка %v, ожидалась ошибка: %v", tt.from, tt.to, err, tt.wantErr)
+			continue
+		}
+		if !from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo) {
+			t.Errorf("snapshotGapRange(%q, %q) = %s — %s, ожидалось %s — %s", tt.from, tt.to,
+				from.Format("2006-01-02"), to.Format("2006-01-02"), tt.wantFrom.Format("2006-01-02"), tt.wantTo.Format("2006-01-02"))
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staleSnapshotDays - через сколько дней без новых снимков ежедневный снимок считается сбойным
+const staleSnapshotDays = 2
+
+// staleRateDays - через сколько дней без нового курса НБК загрузка курсов считается сбойной
+// (курсы не публикуются в выходные)
+const staleRateDays = 4
+
+// ConnectionStatus - состояние подключения Wialon по последнему снимку
+type ConnectionStatus struct {
+	ID               uint   `json:"id"`
+	Name             string `json:"name"`
+	Host             string `json:"host"`
+	BilledAccounts   int    `json:"billed_accounts"`
+	MissingSnapshots int    `json:"missing_snapshots"` // аккаунты без снимка за последнюю дату
+	Failing          bool   `json:"failing"`           // ни у одного аккаунта подключения нет снимка
+}
+
+// RateStatus - последний курс НБК по валюте
+type RateStatus struct {
+	Currency string     `json:"currency"`
+	RateDate *time.Time `json:"rate_date"`
+	DaysOld  int        `json:"days_old"`
+	Stale    bool       `json:"stale"`
+}
+
+// GetAdminStatus возвращает сводку состояния системы для администратора: снимки, курсы,
+// подключения Wialon, SMTP, AI и аккаунты в биллинге без реквизитов или снимков.
+// problems — список того, что требует внимания (пустой — всё в порядке).
+// GET /api/admin/status
+func (h *Handler) GetAdminStatus(c *gin.Context) {
+	now := time.Now().UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	problems := make([]string, 0)
+
+	// Снимки
+	lastSnapshot, err := h.repo.LastSnapshotDate()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	snapshotStale := lastSnapshot == nil || today.Sub(*lastSnapshot) > staleSnapshotDays*24*time.Hour
+	if lastSnapshot == nil {
+		problems = append(problems, "Нет ни одного снимка")
+	} else if snapshotStale {
+		problems = append(problems, fmt.Sprintf("Последний снимок за %s", lastSnapshot.Format("02.01.2006")))
+	}
+
+	// Курсы НБК по валютам биллинга (кроме тенге)
+	latestRates, err := h.repo.GetLatestExchangeRates()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	rateDates := make(map[string]time.Time, len(latestRates))
+	for _, rate := range latestRates {
+		rateDates[rate.CurrencyFrom] = rate.RateDate
+	}
+	currencies := make([]string, 0, len(h.currencies))
+	for currency := range h.currencies {
+		if currency != "KZT" {
+			currencies = append(currencies, currency)
+		}
+	}
+	sort.Strings(currencies)
+	rates := make([]RateStatus, 0, len(currencies))
+	var lastRateDate *time.Time
+	for _, currency := range currencies {
+		status := RateStatus{Currency: currency, Stale: true}
+		if date, ok := rateDates[currency]; ok {
+			d := date
+			status.RateDate = &d
+			status.DaysOld = int(today.Sub(date).Hours() / 24)
+			status.Stale = status.DaysOld > staleRateDays
+			if lastRateDate == nil || d.After(*lastRateDate) {
+				lastRateDate = &d
+			}
+		}
+		if status.Stale {
+			problems = append(problems, fmt.Sprintf("Нет актуального курса %s", currency))
+		}
+		rates = append(rates, status)
+	}
+
+	// Аккаунты в биллинге: реквизиты и снимки за последнюю дату
+	accounts, err := h.repo.GetSelectedAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	withSnapshot := map[uint]bool{}
+	if lastSnapshot != nil {
+		if withSnapshot, err = h.repo.AccountIDsWithSnapshotOn(*lastSnapshot); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var missingRequisites, missingSnapshots int
+	byConnection := make(map[uint]*ConnectionStatus)
+	for i := range accounts {
+		for _, field := range h.billing.RequiredRequisites {
+			if !requisiteFilled(&accounts[i], field) {
+				missingRequisites++
+				break
+			}
+		}
+
+		var connID uint
+		if accounts[i].ConnectionID != nil {
+			connID = *accounts[i].ConnectionID
+		}
+		status, ok := byConnection[connID]
+		if !ok {
+			status = &ConnectionStatus{ID: connID}
+			byConnection[connID] = status
+		}
+		status.BilledAccounts++
+		if !withSnapshot[accounts[i].ID] {
+			status.MissingSnapshots++
+			missingSnapshots++
+		}
+	}
+	if missingRequisites > 0 {
+		problems = append(problems, fmt.Sprintf("Не заполнены реквизиты у %d аккаунтов", missingRequisites))
+	}
+	if missingSnapshots > 0 && lastSnapshot != nil {
+		problems = append(problems, fmt.Sprintf("Нет снимка за %s у %d аккаунтов",
+			lastSnapshot.Format("02.01.2006"), missingSnapshots))
+	}
+
+	// Подключения: сбойное — у всех его аккаунтов нет снимка за последнюю дату
+	connections, err := h.repo.GetAllConnections()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	connectionStatuses := make([]ConnectionStatus, 0, len(connections))
+	failingConnections := 0
+	for _, conn := range connections {
+		status := ConnectionStatus{ID: conn.ID, Name: conn.Name, Host: conn.WialonHost}
+		if counted, ok := byConnection[conn.ID]; ok {
+			status.BilledAccounts = counted.BilledAccounts
+			status.MissingSnapshots = counted.MissingSnapshots
+		}
+		status.Failing = status.BilledAccounts > 0 && status.MissingSnapshots == status.BilledAccounts
+		if status.Failing {
+			failingConnections++
+			problems = append(problems, fmt.Sprintf("Подключение «%s»: нет снимков ни по одному аккаунту", conn.Name))
+		}
+		connectionStatuses = append(connectionStatuses, status)
+	}
+
+	// SMTP
+	smtp := gin.H{"enabled": false, "configured": false, "last_test_at": nil, "last_test_error": ""}
+	smtpSettings, err := h.repo.GetSMTPSettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if smtpSettings != nil {
+		smtp["enabled"] = smtpSettings.Enabled
+		smtp["configured"] = smtpSettings.Host != "" && smtpSettings.FromEmail != ""
+		smtp["last_test_at"] = smtpSettings.LastTestAt
+		smtp["last_test_error"] = smtpSettings.LastTestError
+	}
+	switch {
+	case smtpSettings == nil || !smtpSettings.Enabled:
+		problems = append(problems, "SMTP выключен — счета не отправляются")
+	case smtpSettings.LastTestError != "":
+		problems = append(problems, "Последняя проверка SMTP завершилась ошибкой")
+	case smtpSettings.LastTestAt == nil:
+		problems = append(problems, "SMTP не проверен после изменения настроек")
+	}
+
+	// AI
+	ai := gin.H{"enabled": false, "daily_token_budget": 0, "tokens_today": 0, "budget_exceeded": false}
+	aiSettings, err := h.repo.GetAISettings()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if aiSettings != nil && aiSettings.Enabled {
+		tokensToday, err := h.repo.SumAITokensSince(today)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		exceeded := aiSettings.DailyTokenBudget > 0 && tokensToday >= aiSettings.DailyTokenBudget
+		ai["enabled"] = true
+		ai["daily_token_budget"] = aiSettings.DailyTokenBudget
+		ai["tokens_today"] = tokensToday
+		ai["budget_exceeded"] = exceeded
+		if exceeded {
+			problems = append(problems, "Суточный бюджет токенов AI исчерпан")
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ok":       len(problems) == 0,
+		"problems": problems,
+		"snapshots": gin.H{
+			"last_date": lastSnapshot,
+			"stale":     snapshotStale,
+		},
+		"exchange_rates": gin.H{
+			"last_date":  lastRateDate,
+			"currencies": rates,
+		},
+		"connections": gin.H{
+			"failing": failingConnections,
+			"items":   connectionStatuses,
+		},
+		"smtp": smtp,
+		"ai":   ai,
+		"accounts": gin.H{
+			"billed":             len(accounts),
+			"missing_requisites": missingRequisites,
+			"missing_snapshots":  missingSnapshots,
+		},
+	})
+}
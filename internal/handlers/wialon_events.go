@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/repository"
+)
+
+// Ограничения приёма событий Wialon
+const (
+	maxWialonEventsBody  = 1 << 20 // 1 МБ
+	maxWialonEventsBatch = 1000
+)
+
+// wialonEventRequest - событие об объекте в теле POST /api/wialon/events
+type wialonEventRequest struct {
+	UnitID    int64  `json:"unit_id"`
+	UnitName  string `json:"unit_name"`
+	AccountID int64  `json:"account_id"` // bact объекта; 0 — определить по последнему снимку
+	Type      string `json:"type"`       // created, deleted, activated, deactivated
+	Time      int64  `json:"time"`       // unix-время события; 0 — время приёма
+}
+
+// IngestWialonEvents принимает события об объектах от Wialon (уведомления, avl_evts) —
+// одно событие, массив или {"events": [...]}. События сохраняются как пришли и сверяются
+// со следующим снимком аккаунта. Некорректные события не сохраняются и перечисляются в rejected.
+// POST /api/wialon/events (общий секрет wialon.events_secret)
+func (h *Handler) IngestWialonEvents(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWialonEventsBody))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Тело запроса больше 1 МБ"})
+		return
+	}
+
+	// Массив событий, {"events": [...]} или одно событие
+	var raw []json.RawMessage
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(body, &raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный JSON: " + err.Error()})
+			return
+		}
+	} else {
+		var batch struct {
+			Events []json.RawMessage `json:"events"`
+		}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный JSON: " + err.Error()})
+			return
+		}
+		raw = batch.Events
+		if raw == nil {
+			raw = []json.RawMessage{body}
+		}
+	}
+	if len(raw) > maxWialonEventsBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Не больше %d событий за запрос", maxWialonEventsBatch)})
+		return
+	}
+
+	type rejectedEvent struct {
+		Index int    `json:"index"`
+		Error string `json:"error"`
+	}
+	rejected := make([]rejectedEvent, 0)
+	events := make([]models.WialonUnitEvent, 0, len(raw))
+	indexes := make([]int, 0, len(raw)) // индекс события в запросе (для отказа без account_id)
+	var unknownAccount []int64          // объекты без account_id — bact ищется по снимкам
+	now := time.Now().UTC()
+
+	for i, item := range raw {
+		var req wialonEventRequest
+		if err := json.Unmarshal(item, &req); err != nil {
+			rejected = append(rejected, rejectedEvent{Index: i, Error: "неверный JSON события"})
+			continue
+		}
+		req.Type = strings.ToLower(strings.TrimSpace(req.Type))
+		if req.UnitID <= 0 {
+			rejected = append(rejected, rejectedEvent{Index: i, Error: "не указан unit_id"})
+			continue
+		}
+		if !models.UnitEventTypes[req.Type] {
+			rejected = append(rejected, rejectedEvent{Index: i, Error: "неизвестный type: " + req.Type})
+			continue
+		}
+
+		occurredAt := now
+		if req.Time > 0 {
+			occurredAt = time.Unix(req.Time, 0).UTC()
+		}
+
+		if req.AccountID == 0 {
+			unknownAccount = append(unknownAccount, req.UnitID)
+		}
+
+		events = append(events, models.WialonUnitEvent{
+			WialonUnitID:    req.UnitID,
+			UnitName:        req.UnitName,
+			AccountWialonID: req.AccountID,
+			EventType:       req.Type,
+			OccurredAt:      occurredAt,
+			Payload:         string(item),
+		})
+		indexes = append(indexes, i)
+	}
+
+	// bact объектов без account_id — одним запросом по последним снимкам
+	if len(unknownAccount) > 0 {
+		accountIDs, err := h.repo.GetUnitAccountWialonIDs(unknownAccount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resolved := events[:0]
+		for n, event := range events {
+			if event.AccountWialonID == 0 {
+				event.AccountWialonID = accountIDs[event.WialonUnitID]
+				if event.AccountWialonID == 0 {
+					rejected = append(rejected, rejectedEvent{Index: indexes[n], Error: "не указан account_id, объекта нет в снимках"})
+					continue
+				}
+			}
+			resolved = append(resolved, event)
+		}
+		events = resolved
+		sort.Slice(rejected, func(a, b int) bool { return rejected[a].Index < rejected[b].Index })
+	}
+
+	if err := h.repo.CreateUnitEvents(events); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(rejected) > 0 {
+		log.Printf("IngestWialonEvents: принято %d, отклонено %d", len(events), len(rejected))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"accepted": len(events),
+		"rejected": rejected,
+	})
+}
+
+// GetWialonEvents возвращает принятые события Wialon с фильтрами account_id (ID аккаунта),
+// wialon_unit_id и status (pending, reconciled, mismatch)
+// GET /api/wialon/events
+func (h *Handler) GetWialonEvents(c *gin.Context) {
+	page, pageSize, err := h.parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var filter repository.UnitEventFilter
+	if accStr := c.Query("account_id"); accStr != "" {
+		id, err := strconv.ParseUint(accStr, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный account_id"})
+			return
+		}
+		account, err := h.repo.GetAccountByID(uint(id))
+		if err != nil || account == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+			return
+		}
+		filter.AccountWialonID = &account.WialonID
+	}
+	if unitStr := c.Query("wialon_unit_id"); unitStr != "" {
+		id, err := strconv.ParseInt(unitStr, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный wialon_unit_id"})
+			return
+		}
+		filter.WialonUnitID = &id
+	}
+	switch status := c.Query("status"); status {
+	case "", repository.UnitEventStatusPending, repository.UnitEventStatusReconciled, repository.UnitEventStatusMismatch:
+		filter.Status = status
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status: допустимые значения pending, reconciled, mismatch"})
+		return
+	}
+
+	events, total, err := h.repo.GetUnitEventsPaginated(page, pageSize, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":      events,
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+	})
+}
+
+// GetAccountUnitTally возвращает оценку объектов аккаунта на текущий момент:
+// последний снимок плюс ещё не сверенные события Wialon
+// GET /api/accounts/:id/unit-tally
+func (h *Handler) GetAccountUnitTally(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Неверный ID"})
+		return
+	}
+	account, err := h.repo.GetAccountByID(uint(id))
+	if err != nil || account == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Аккаунт не найден"})
+		return
+	}
+
+	tally, err := h.snapshot.GetUnitTally(account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, tally)
+}
@@ -1,22 +1,69 @@
 package middleware
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/user/wialon-billing-api/internal/config"
 	"github.com/user/wialon-billing-api/internal/models"
 	"github.com/user/wialon-billing-api/internal/services/auth"
 	"gorm.io/gorm"
 )
 
-// CORS middleware для кроссдоменных запросов
-func CORS() gin.HandlerFunc {
+// defaultCORSMethods - методы, разрешённые для кроссдоменных запросов по умолчанию
+var defaultCORSMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+
+// CORS middleware для кроссдоменных запросов: заголовки CORS получают только источники
+// из cfg.AllowedOrigins ("*" — любой), запросы с других источников отклоняются с 403.
+// Запросы без Origin и с того же хоста пропускаются как есть.
+func CORS(cfg config.CORSConfig) gin.HandlerFunc {
+	allowAny := false
+	allowed := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+		if origin == "*" {
+			allowAny = true
+		} else if origin != "" {
+			allowed[origin] = true
+		}
+	}
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	allowMethods := strings.ToUpper(strings.Join(methods, ", "))
+
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Token, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		origin := c.GetHeader("Origin")
+		if origin == "" || sameOrigin(origin, c.Request.Host) {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		if !allowAny && !allowed[strings.ToLower(strings.TrimRight(origin, "/"))] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Источник запроса не разрешён"})
+			return
+		}
+
+		// "*" несовместим с credentials — в этом случае возвращаем сам источник
+		if allowAny && !cfg.AllowCredentials {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if cfg.AllowCredentials {
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-API-Token, accept, origin, Cache-Control, X-Requested-With, If-None-Match")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag, Content-Disposition")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", allowMethods)
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
@@ -27,6 +74,47 @@ func CORS() gin.HandlerFunc {
 	}
 }
 
+// sameOrigin проверяет, что Origin указывает на тот же хост, что и запрос
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, host)
+}
+
+// Timeout ограничивает время обработки запроса: ставит дедлайн в c.Request.Context()
+// и отвечает 504, если дедлайн истёк, а обработчик так ничего и не записал.
+// overrides — увеличенные лимиты для медленных маршрутов (ключ — префикс шаблона маршрута, c.FullPath()).
+// Обработчики и клиенты (Wialon, БД) должны использовать c.Request.Context(), чтобы прерываться по дедлайну.
+func Timeout(defaultTimeout time.Duration, overrides map[string]time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timeout := defaultTimeout
+		path := c.FullPath()
+		matched := ""
+		for prefix, d := range overrides {
+			// Самый длинный подходящий префикс побеждает
+			if strings.HasPrefix(path, prefix) && len(prefix) > len(matched) {
+				matched = prefix
+				timeout = d
+			}
+		}
+		if timeout <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && !c.Writer.Written() {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{
+				"error": "Превышено время обработки запроса",
+			})
+		}
+	}
+}
+
 // Auth middleware для проверки JWT авторизации
 func Auth() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -139,6 +227,33 @@ func RequirePartner() gin.HandlerFunc {
 	}
 }
 
+// SharedSecretAuth проверяет общий секрет входящих уведомлений (события Wialon).
+// Секрет передаётся через заголовок X-Wialon-Secret или query-параметр ?secret=;
+// пустой secret в конфигурации — приём выключен
+func SharedSecretAuth(secret string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if secret == "" {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"error": "Приём событий не настроен (wialon.events_secret)",
+			})
+			return
+		}
+
+		provided := c.GetHeader("X-Wialon-Secret")
+		if provided == "" {
+			provided = c.Query("secret")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(secret)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Неверный секрет",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
 // APITokenAuth проверяет API-токен для внешних интеграций (1С)
 // Токен передаётся через query-параметр ?token= или заголовок X-API-Token
 func APITokenAuth(db *gorm.DB) gin.HandlerFunc {
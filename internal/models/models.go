@@ -25,8 +25,43 @@ type BillingSettings struct {
 	PaymentCode string `gorm:"size:10" json:"payment_code"` // Код назначения платежа
 
 	// Исполнитель и НДС
-	ExecutorName string  `gorm:"size:255" json:"executor_name"` // ФИО исполнителя
-	VATRate      float64 `gorm:"default:16" json:"vat_rate"`    // Ставка НДС (%)
+	ExecutorName     string  `gorm:"size:255" json:"executor_name"`                   // ФИО исполнителя
+	VATRate          float64 `gorm:"default:16" json:"vat_rate"`                      // Ставка НДС (%)
+	PricesIncludeVAT bool    `gorm:"not null;default:true" json:"prices_include_vat"` // true — НДС включён в цены модулей, false — начисляется сверху
+
+	// Счета с нулевой суммой (все объекты деактивированы) — создавать для непрерывности учёта
+	GenerateZeroInvoices bool `gorm:"default:false" json:"generate_zero_invoices"`
+
+	// Минимальная сумма счёта (0 — без порога): счёт с суммой ниже порога не выставляется
+	// (skip) или доводится до минимума строкой доплаты (round_up)
+	MinimumInvoiceAmount   float64 `gorm:"default:0" json:"minimum_invoice_amount"`
+	MinimumInvoiceCurrency string  `gorm:"size:3;default:'KZT'" json:"minimum_invoice_currency"` // валюта порога
+	OnBelowMinimum         string  `gorm:"size:20;default:'skip'" json:"on_below_minimum"`       // skip или round_up
+
+	// Заблокированные в Wialon аккаунты: выставлять ли им ежемесячные счета и обновлять ли
+	// статус блокировки из Wialon перед генерацией
+	BillBlockedAccounts  bool `gorm:"default:false" json:"bill_blocked_accounts"`
+	RefreshBlockedStatus bool `gorm:"default:false" json:"refresh_blocked_status"`
+
+	// Минимум дней со снимками в расчётном периоде для выставления счёта (0 — без проверки).
+	// При меньшем числе (например, сервер простаивал) счёт не выставляется без явного force
+	MinSnapshotDaysForBilling int `gorm:"default:0" json:"min_snapshot_days_for_billing"`
+
+	// Льгота для недавно деактивированных объектов (0 — выключена): объект, деактивированный
+	// меньше N дней назад, в дне снимка учитывается долей активного (см. DeactivationGraceWeight),
+	// а не целиком активным или целиком спящим
+	DeactivationGraceDays int `gorm:"default:0" json:"deactivation_grace_days"`
+
+	// Сутки снимка — в этом часовом поясе (IANA, пусто — UTC): снимок за вчера снимается
+	// не раньше snapshot_hour (0–23) местного времени и не раньше wialon.snapshot_delay_hours
+	SnapshotTimezone string `gorm:"size:64" json:"snapshot_timezone"`
+	SnapshotHour     int    `gorm:"default:0" json:"snapshot_hour"`
+
+	// Шаблон PDF счёта по умолчанию (см. invoice.PDFTemplates), у учётной записи может быть свой
+	PDFTemplate string `gorm:"size:20;default:'full'" json:"pdf_template"`
+
+	// Формат чисел в счёте (см. invoice.NumberLocales): ru — 1 234,56, en — 1,234.56
+	Locale string `gorm:"size:5;default:'ru'" json:"locale"`
 
 	// API-токен для внешних интеграций (1С)
 	APIToken string `gorm:"size:64" json:"api_token,omitempty"` // SHA-256 hex токен
@@ -41,9 +76,32 @@ type BillingSettings struct {
 	StampY         float64 `gorm:"default:5" json:"stamp_y"`         // Y смещение печати (мм)
 	StampW         float64 `gorm:"default:30" json:"stamp_w"`        // Ширина печати (мм)
 
+	// Дополнительные счета поставщика по валютам (отдельная таблица, заполняется при чтении настроек)
+	BankAccounts []SupplierBankAccount `gorm:"-" json:"bank_accounts,omitempty"`
+
 	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
 }
 
+// SupplierBankAccount - банковский счёт поставщика для счетов в определённой валюте
+type SupplierBankAccount struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	Currency    string    `gorm:"size:3;not null;index" json:"currency"`
+	BankName    string    `gorm:"size:255" json:"bank_name"`   // Название банка
+	IIK         string    `gorm:"size:50;not null" json:"iik"` // ИИК (расчётный счёт)
+	BIK         string    `gorm:"size:20" json:"bik"`          // БИК
+	Kbe         string    `gorm:"size:10" json:"kbe"`          // Кбе
+	PaymentCode string    `gorm:"size:10" json:"payment_code"` // Код назначения платежа
+	IsDefault   bool      `gorm:"default:false" json:"is_default"`
+	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt   time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// Режимы обработки счёта с суммой ниже минимальной
+const (
+	OnBelowMinimumSkip    = "skip"     // не выставлять счёт
+	OnBelowMinimumRoundUp = "round_up" // довести сумму до минимальной
+)
+
 // Module - модуль (услуга)
 type Module struct {
 	ID              uint      `gorm:"primaryKey" json:"id"`
@@ -56,6 +114,7 @@ type Module struct {
 	Currency        string    `gorm:"size:3;not null" json:"currency"`                // "EUR", "RUB", "KZT"
 	PricingType     string    `gorm:"size:20;default:'per_unit'" json:"pricing_type"` // "per_unit" или "fixed"
 	BillingType     string    `gorm:"size:20;not null" json:"billing_type"`           // "monthly" или "one_time"
+	VATExempt       bool      `gorm:"default:false" json:"vat_exempt"`                // не облагается НДС (транзитные сборы и т.п.)
 	CreatedAt       time.Time `gorm:"autoCreateTime" json:"created_at"`
 }
 
@@ -83,10 +142,91 @@ type Account struct {
 	ContractNumber string     `gorm:"size:50" json:"contract_number"` // Номер договора
 	ContractDate   *time.Time `json:"contract_date"`                  // Дата договора
 
+	// Настройки счетов (язык, валюта, шаблон, получатели, НДС); поля хранятся в колонках accounts
+	// и в JSON аккаунта остаются на верхнем уровне
+	InvoicePreferences `gorm:"embedded"`
+
+	// Письмо с итогами закрытого месяца на buyer_email (по умолчанию выключено)
+	MonthlySummaryEnabled bool `gorm:"default:false" json:"monthly_summary_enabled"`
+
+	// Прекращение биллинга: дни после BillingEndDate не начисляются (пусто — без ограничения)
+	BillingEndDate       *time.Time `gorm:"type:date" json:"billing_end_date"`
+	BillingDisableReason string     `gorm:"type:text" json:"billing_disable_reason"`
+
+	// День начала расчётного цикла: 0 или 1 — календарный месяц; 2–28 — цикл с этого числа
+	// прошлого месяца по предыдущее число месяца счёта (15 — с 15.01 по 14.02 для счёта за февраль)
+	BillingCycleDay int `gorm:"default:1" json:"billing_cycle_day"`
+
+	// Группа (суббренд реселлера) для отчётов и массовых операций (пусто — вне групп)
+	GroupID *uint `gorm:"index" json:"group_id"`
+
+	// Подключение Wialon аккаунта (заполняется репозиторием, токен не отдаётся)
+	ConnectionName string `gorm:"-" json:"connection_name,omitempty"`
+	WialonHost     string `gorm:"-" json:"wialon_host,omitempty"`
+
 	CreatedAt time.Time       `gorm:"autoCreateTime" json:"created_at"`
 	Modules   []AccountModule `gorm:"foreignKey:AccountID" json:"modules,omitempty"`
 }
 
+// InvoicePreferences - настройки счетов учётной записи; пустые значения берутся из настроек биллинга
+type InvoicePreferences struct {
+	DisplayCurrency string   `gorm:"size:3" json:"display_currency"` // справочная валюта в счёте (пусто — не показывать)
+	InvoiceEmail    *string  `gorm:"size:500" json:"invoice_email"`  // email для счетов через запятую (пусто — BuyerEmail)
+	PDFTemplate     string   `gorm:"size:20" json:"pdf_template"`    // шаблон PDF счёта
+	Locale          string   `gorm:"size:5" json:"locale"`           // язык и формат чисел в счёте (ru, en)
+	VATRate         *float64 `json:"vat_rate"`                       // ставка НДС, % (пусто — из настроек биллинга)
+}
+
+// IsBilledOn проверяет, начисляется ли день: не позже BillingEndDate (день окончания включительно)
+func (a *Account) IsBilledOn(day time.Time) bool {
+	if a.BillingEndDate == nil {
+		return true
+	}
+	end := *a.BillingEndDate
+	return !time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC).
+		After(time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC))
+}
+
+// MaxBillingCycleDay - последний допустимый день начала расчётного цикла (есть в любом месяце)
+const MaxBillingCycleDay = 28
+
+// BillingPeriodRange возвращает расчётный период счёта за месяц period (границы включительно)
+func (a *Account) BillingPeriodRange(period time.Time) (start, end time.Time) {
+	if a.BillingCycleDay <= 1 || a.BillingCycleDay > MaxBillingCycleDay {
+		return MonthRange(period)
+	}
+	month := time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.UTC)
+	start = month.AddDate(0, -1, a.BillingCycleDay-1)
+	end = month.AddDate(0, 0, a.BillingCycleDay-2)
+	return start, end
+}
+
+// MonthRange возвращает первый и последний день календарного месяца
+func MonthRange(period time.Time) (start, end time.Time) {
+	start = time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, -1)
+}
+
+// IsCalendarMonth проверяет, что период — ровно один календарный месяц
+func IsCalendarMonth(start, end time.Time) bool {
+	monthStart, monthEnd := MonthRange(start)
+	return start.Day() == monthStart.Day() &&
+		end.Year() == monthEnd.Year() && end.Month() == monthEnd.Month() && end.Day() == monthEnd.Day()
+}
+
+// AccountGroup - группа учётных записей (суббренд, папка реселлера). Группы могут быть вложенными:
+// фильтр по группе охватывает и аккаунты её подгрупп.
+type AccountGroup struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Name      string    `gorm:"size:255;not null" json:"name"`
+	ParentID  *uint     `gorm:"index" json:"parent_id"` // родительская группа (пусто — верхний уровень)
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+
+	// Аккаунтов непосредственно в группе (заполняется репозиторием)
+	Accounts int64 `gorm:"-" json:"accounts"`
+}
+
 // AccountModule - привязка модуля к учётной записи
 type AccountModule struct {
 	ID          uint      `gorm:"primaryKey" json:"id"`
@@ -103,7 +243,9 @@ type Invoice struct {
 	AccountID   uint          `gorm:"not null" json:"account_id"`
 	Number      string        `gorm:"size:100" json:"number"`                // номер счёта: {договор}/{порядковый}
 	Period      time.Time     `gorm:"type:date;not null" json:"period"`      // 1-е число месяца (за какой период)
-	TotalAmount float64       `gorm:"not null" json:"total_amount"`          // итоговая сумма
+	TotalAmount float64       `gorm:"not null" json:"total_amount"`          // итоговая сумма к оплате (всегда с НДС)
+	VATAmount   float64       `gorm:"default:0" json:"vat_amount"`           // сумма НДС (0 — не зафиксирована, считается как включённая)
+	VATOnTop    bool          `gorm:"default:false" json:"vat_on_top"`       // НДС начислен сверху суммы строк
 	Currency    string        `gorm:"size:3;not null" json:"currency"`       // валюта
 	Status      string        `gorm:"size:20;default:'draft'" json:"status"` // "draft", "sent", "paid", "overdue"
 	ExcelReport []byte        `gorm:"type:bytea" json:"-"`                   // предгенерированный Excel-отчёт
@@ -112,6 +254,63 @@ type Invoice struct {
 	PaidAt      *time.Time    `json:"paid_at,omitempty"` // когда оплачен
 	Account     Account       `gorm:"foreignKey:AccountID" json:"account,omitempty"`
 	Lines       []InvoiceLine `gorm:"foreignKey:InvoiceID" json:"lines,omitempty"`
+
+	// Справочная сумма в валюте отображения (не влияет на сумму к оплате)
+	ReferenceAmount   float64    `gorm:"default:0" json:"reference_amount,omitempty"`
+	ReferenceCurrency string     `gorm:"size:3" json:"reference_currency,omitempty"`
+	ReferenceRateDate *time.Time `gorm:"type:date" json:"reference_rate_date,omitempty"`
+
+	// Счёт выставлен без курса НБК — пересчитать, когда курс будет опубликован
+	NeedsRateReissue bool `gorm:"default:false;index" json:"needs_rate_reissue"`
+
+	// SHA-256 (hex) PDF в том виде, в каком он отправлен клиенту (фиксируется при первой отправке):
+	// для отправленных и оплаченных счетов отдаётся он, а не перегенерированный.
+	// Сам документ хранится отдельно в InvoiceDocument, чтобы не читать его в списках счетов.
+	SentPDFHash string `gorm:"size:64" json:"sent_pdf_hash,omitempty"`
+
+	// Счёт пересчитан после отправки: клиент получил прежний PDF, он сохраняется до
+	// повторной отправки, при которой фиксируется документ по новым суммам
+	ResendRequired bool `gorm:"default:false" json:"resend_required"`
+
+	// Канал доставки счёта клиенту (SentViaEmail, SentViaManual, SentViaPortal)
+	SentVia string `gorm:"size:20" json:"sent_via,omitempty"`
+
+	// Расчётный период (включительно); пусто у счетов, выставленных до расчётных циклов, —
+	// календарный месяц Period. Period остаётся меткой месяца счёта.
+	PeriodStart *time.Time `gorm:"type:date" json:"period_start,omitempty"`
+	PeriodEnd   *time.Time `gorm:"type:date" json:"period_end,omitempty"`
+
+	// Итог последней отправки письмом (DeliveryQueued, DeliverySent, DeliveryFailed, DeliveryBounced):
+	// status=sent означает «пытались отправить», доставку показывает это поле
+	DeliveryStatus string `gorm:"size:20" json:"delivery_status,omitempty"`
+	DeliveryError  string `gorm:"type:text" json:"delivery_error,omitempty"`
+
+	// Доставки по получателям — только в карточке счёта
+	Deliveries []InvoiceDelivery `gorm:"-" json:"deliveries,omitempty"`
+}
+
+// PeriodRange возвращает расчётный период счёта (границы включительно)
+func (inv *Invoice) PeriodRange() (start, end time.Time) {
+	if inv.PeriodStart == nil || inv.PeriodEnd == nil {
+		return MonthRange(inv.Period)
+	}
+	return *inv.PeriodStart, *inv.PeriodEnd
+}
+
+// Каналы доставки счёта
+const (
+	SentViaEmail  = "email"  // отправлен письмом из системы
+	SentViaManual = "manual" // передан вручную (нарочно, через другую систему)
+	SentViaPortal = "portal" // опубликован в кабинете партнёра
+)
+
+// IsValidSentVia проверяет канал доставки счёта
+func IsValidSentVia(channel string) bool {
+	switch channel {
+	case SentViaEmail, SentViaManual, SentViaPortal:
+		return true
+	}
+	return false
 }
 
 // InvoiceLine - строка счёта (детализация)
@@ -127,6 +326,94 @@ type InvoiceLine struct {
 	TotalPrice  float64 `gorm:"not null" json:"total_price"`          // итого по строке
 	Currency    string  `gorm:"size:3;not null" json:"currency"`
 	PricingType string  `gorm:"size:20;not null" json:"pricing_type"` // "per_unit" или "fixed"
+	VATExempt   bool    `gorm:"default:false" json:"vat_exempt"`      // не входит в базу НДС
+}
+
+// InvoiceEvent - запись истории счёта (отправки и смены статуса)
+type InvoiceEvent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	InvoiceID uint      `gorm:"not null;index" json:"invoice_id"`
+	EventType string    `gorm:"size:20;not null" json:"event_type"` // "send", "resend", "status", "delivery"
+	Status    string    `gorm:"size:20" json:"status"`              // статус счёта после события
+	Recipient string    `gorm:"size:255" json:"recipient,omitempty"`
+	Note      string    `gorm:"type:text" json:"note,omitempty"`
+	UserID    *uint     `json:"user_id,omitempty"` // кто выполнил (nil — система/1С)
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+
+	// Канал доставки для событий перевода в «отправлен»
+	SentVia string `gorm:"size:20" json:"sent_via,omitempty"`
+}
+
+// InvoiceDocument - PDF счёта, зафиксированный при первой отправке клиенту
+type InvoiceDocument struct {
+	InvoiceID uint      `gorm:"primaryKey;autoIncrement:false" json:"invoice_id"`
+	PDF       []byte    `gorm:"column:pdf;type:bytea;not null" json:"-"`
+	SHA256    string    `gorm:"column:sha256;size:64;not null" json:"sha256"`
+	CreatedAt time.Time `gorm:"autoCreateTime" json:"created_at"`
+}
+
+// InvoiceDelivery - доставка письма со счётом одному получателю
+type InvoiceDelivery struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	InvoiceID uint       `gorm:"not null;index" json:"invoice_id"`
+	Recipient string     `gorm:"size:255;not null" json:"recipient"`
+	Kind      string     `gorm:"size:10;not null" json:"kind"`   // DeliveryKindTo, DeliveryKindCc, DeliveryKindCopy
+	Status    string     `gorm:"size:20;not null" json:"status"` // DeliveryQueued, DeliverySent, DeliveryFailed, DeliveryBounced
+	Error     string     `gorm:"type:text" json:"error,omitempty"`
+	Resend    bool       `gorm:"default:false" json:"resend"` // повторная отправка
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	CreatedAt time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	UpdatedAt time.Time  `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// Статусы доставки письма со счётом
+const (
+	DeliveryQueued  = "queued"  // письмо поставлено в отправку
+	DeliverySent    = "sent"    // SMTP-сервер принял письмо
+	DeliveryFailed  = "failed"  // SMTP-сервер отклонил письмо или недоступен
+	DeliveryBounced = "bounced" // письмо вернулось от сервера получателя
+)
+
+// Виды получателей письма со счётом
+const (
+	DeliveryKindTo   = "to"   // email для счетов / покупателя
+	DeliveryKindCc   = "cc"   // дополнительные email покупателя
+	DeliveryKindCopy = "copy" // копия оператору
+)
+
+// InvoiceSequence - счётчик номеров счетов по области нумерации (префиксу)
+type InvoiceSequence struct {
+	Scope     string    `gorm:"primaryKey;size:50" json:"scope"`
+	LastValue int64     `gorm:"not null;default:0" json:"last_value"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+}
+
+// Статусы ежемесячной генерации счетов
+const (
+	InvoiceRunPending   = "pending"   // ждёт курсов НБК или выполняется; продолжается после перезапуска
+	InvoiceRunCompleted = "completed" // счета сгенерированы
+	InvoiceRunFailed    = "failed"    // генерация завершилась ошибкой
+)
+
+// InvoiceRun - автоматическая генерация счетов за месяц (cron 1-го числа). Сохраняется,
+// чтобы ожидание курсов НБК (до суток) пережило перезапуск сервера
+type InvoiceRun struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	Period        time.Time  `gorm:"type:date;uniqueIndex;not null" json:"period"` // 1-е число месяца счетов
+	RateDate      time.Time  `gorm:"type:date;not null" json:"rate_date"`          // дата курса НБК
+	Status        string     `gorm:"size:20;not null;index" json:"status"`
+	Attempt       int        `gorm:"default:0" json:"attempt"`  // выполненных проверок курсов
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"` // следующая проверка курсов
+	WithoutRates  bool       `gorm:"default:false" json:"without_rates"`
+	InvoicesCount int        `gorm:"default:0" json:"invoices_count"`
+	LastError     string     `gorm:"type:text" json:"last_error,omitempty"`
+	CreatedAt     time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	CompletedAt   *time.Time `json:"completed_at,omitempty"`
+
+	// Процесс, ведущий генерацию, и срок его захвата: продолжить генерацию может только
+	// захвативший её процесс, после истечения срока (процесс упал) — любой другой
+	ClaimedBy    string     `gorm:"size:100" json:"claimed_by,omitempty"`
+	ClaimedUntil *time.Time `json:"claimed_until,omitempty"`
 }
 
 // ExchangeRate - курс валюты НБК
@@ -151,13 +438,16 @@ type Snapshot struct {
 	CreatedAt        time.Time      `gorm:"autoCreateTime" json:"created_at"`
 	Account          Account        `gorm:"foreignKey:AccountID" json:"account,omitempty"`
 	Units            []SnapshotUnit `gorm:"foreignKey:SnapshotID" json:"units,omitempty"`
+
+	// Время последнего пересоздания (upsert) снимка
+	UpdatedAt *time.Time `gorm:"autoUpdateTime" json:"updated_at,omitempty"`
 }
 
 // SnapshotUnit - объект в снимке
 type SnapshotUnit struct {
 	ID            uint       `gorm:"primaryKey" json:"id"`
 	SnapshotID    uint       `gorm:"not null" json:"snapshot_id"`
-	WialonUnitID  int64      `gorm:"not null" json:"wialon_unit_id"`
+	WialonUnitID  int64      `gorm:"not null;index" json:"wialon_unit_id"`
 	UnitName      string     `gorm:"size:255" json:"unit_name"`
 	AccountID     int64      `json:"account_id"`
 	CreatorID     int64      `json:"creator_id"`
@@ -165,6 +455,22 @@ type SnapshotUnit struct {
 	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`      // Время деактивации
 }
 
+// DeactivationGraceWeight - доля активного объекта, деактивированного в deactivatedAt, в дне
+// снимка snapshotDate при льготе graceDays: 1 в момент деактивации, далее линейно до 0 через
+// graceDays дней (прошедшее время считается до конца дня снимка). Деактивирован уже после
+// этого дня (снимок снят утром следующего) — весь день был активен, доля 1.
+func DeactivationGraceWeight(snapshotDate, deactivatedAt time.Time, graceDays int) float64 {
+	if graceDays <= 0 {
+		return 0
+	}
+	dayEnd := time.Date(snapshotDate.Year(), snapshotDate.Month(), snapshotDate.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+	elapsedDays := dayEnd.Sub(deactivatedAt).Hours() / 24
+	if elapsedDays <= 0 {
+		return 1
+	}
+	return max(1-elapsedDays/float64(graceDays), 0)
+}
+
 // Change - изменение между снимками
 type Change struct {
 	ID             uint      `gorm:"primaryKey" json:"id"`
@@ -172,8 +478,86 @@ type Change struct {
 	CurrSnapshotID uint      `gorm:"not null" json:"curr_snapshot_id"`
 	WialonUnitID   int64     `gorm:"not null" json:"wialon_unit_id"`
 	UnitName       string    `gorm:"size:255" json:"unit_name"`
-	ChangeType     string    `gorm:"size:10;not null" json:"change_type"` // "added" или "removed"
+	ChangeType     string    `gorm:"size:20;not null" json:"change_type"` // ChangeAdded, ChangeRemoved, ChangeDeactivated, ChangeReactivated, ChangeRenamed
 	DetectedAt     time.Time `gorm:"autoCreateTime" json:"detected_at"`
+
+	// Переименование (ChangeRenamed): название в предыдущем и текущем снимке
+	OldName string `gorm:"size:255" json:"old_name,omitempty"`
+	NewName string `gorm:"size:255" json:"new_name,omitempty"`
+}
+
+// Типы изменений объектов между снимками
+const (
+	ChangeAdded       = "added"       // объект появился
+	ChangeRemoved     = "removed"     // объект пропал
+	ChangeDeactivated = "deactivated" // объект деактивирован
+	ChangeReactivated = "reactivated" // деактивированный объект снова активен
+	ChangeRenamed     = "renamed"     // объект переименован (тот же WialonUnitID)
+)
+
+// ChangeTypes - допустимые типы изменений (фильтр /api/changes)
+var ChangeTypes = map[string]bool{
+	ChangeAdded: true, ChangeRemoved: true, ChangeDeactivated: true, ChangeReactivated: true,
+	ChangeRenamed: true,
+}
+
+// Типы событий об объектах, присылаемых Wialon (POST /api/wialon/events)
+const (
+	UnitEventCreated     = "created"     // объект создан
+	UnitEventDeleted     = "deleted"     // объект удалён
+	UnitEventActivated   = "activated"   // объект активирован
+	UnitEventDeactivated = "deactivated" // объект деактивирован
+)
+
+// UnitEventTypes - допустимые типы событий об объектах
+var UnitEventTypes = map[string]bool{
+	UnitEventCreated:     true,
+	UnitEventDeleted:     true,
+	UnitEventActivated:   true,
+	UnitEventDeactivated: true,
+}
+
+// WialonUnitEvent - событие об объекте от Wialon. Хранится как пришло и сверяется
+// со следующим снимком аккаунта (SnapshotID, ReconciledAt, Mismatch)
+type WialonUnitEvent struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	WialonUnitID    int64      `gorm:"not null;index" json:"wialon_unit_id"`
+	UnitName        string     `gorm:"size:255" json:"unit_name"`
+	AccountWialonID int64      `gorm:"index:idx_unit_event_pending" json:"account_wialon_id"` // bact объекта
+	EventType       string     `gorm:"size:20;not null" json:"event_type"`
+	OccurredAt      time.Time  `gorm:"not null;index:idx_unit_event_pending" json:"occurred_at"`
+	ReceivedAt      time.Time  `gorm:"autoCreateTime" json:"received_at"`
+	Payload         string     `gorm:"type:text" json:"payload"` // событие в исходном виде
+	SnapshotID      *uint      `json:"snapshot_id"`              // снимок, с которым сверено
+	ReconciledAt    *time.Time `gorm:"index" json:"reconciled_at"`
+	Mismatch        bool       `gorm:"default:false" json:"mismatch"` // снимок не подтвердил событие
+	Note            string     `gorm:"size:255" json:"note,omitempty"`
+}
+
+// Статусы фоновой синхронизации аккаунтов
+const (
+	SyncJobPending   = "pending"   // создана, ещё не запущена
+	SyncJobRunning   = "running"   // выполняется
+	SyncJobCompleted = "completed" // завершена (возможно, с ошибками отдельных подключений)
+	SyncJobFailed    = "failed"    // прервана (например, перезапуском сервера)
+)
+
+// SyncJob - фоновая синхронизация учётных записей с Wialon по подключениям пользователя
+type SyncJob struct {
+	ID                uint       `gorm:"primaryKey" json:"id"`
+	UserID            uint       `gorm:"not null;index" json:"user_id"`
+	Status            string     `gorm:"size:20;not null;index" json:"status"`
+	ConnectionsTotal  int        `gorm:"default:0" json:"connections_total"`
+	ConnectionsDone   int        `gorm:"default:0" json:"connections_done"`
+	CurrentConnection string     `gorm:"size:255" json:"current_connection,omitempty"` // обрабатываемое подключение
+	Total             int        `gorm:"default:0" json:"total"`                       // учётных записей получено из Wialon
+	Synced            int        `gorm:"default:0" json:"synced"`
+	DealersFound      int        `gorm:"default:0" json:"dealers_found"`
+	Errors            string     `gorm:"type:text" json:"-"`               // JSON массив ошибок подключений
+	Error             string     `gorm:"type:text" json:"error,omitempty"` // причина прерывания всей синхронизации
+	CreatedAt         time.Time  `gorm:"autoCreateTime" json:"created_at"`
+	StartedAt         *time.Time `json:"started_at,omitempty"`
+	FinishedAt        *time.Time `json:"finished_at,omitempty"`
 }
 
 // DailyCharge - ежедневное начисление по модулю для аккаунта
@@ -193,6 +577,9 @@ type DailyCharge struct {
 	CreatedAt   time.Time `gorm:"autoCreateTime" json:"created_at"`
 	Account     Account   `gorm:"foreignKey:AccountID" json:"account,omitempty"`
 	Module      Module    `gorm:"foreignKey:ModuleID" json:"module,omitempty"`
+
+	// Доли недавно деактивированных объектов (льгота deactivation_grace_days) сверх TotalUnits
+	GraceUnits float64 `gorm:"default:0" json:"grace_units"`
 }
 
 // === AI Analytics ===
@@ -209,6 +596,14 @@ type AISettings struct {
 	CacheTTLHours    int       `gorm:"default:24" json:"cache_ttl_hours"`                         // время жизни кэша инсайтов
 	PrivacyMode      bool      `gorm:"default:false" json:"privacy_mode"`                         // заменять названия на ID
 	UpdatedAt        time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+
+	// Суточный бюджет токенов для пакетного анализа (0 — без ограничения)
+	DailyTokenBudget int `gorm:"default:0" json:"daily_token_budget"`
+
+	// Пакетный анализ только аккаунтов с изменениями: добавлено/удалено/деактивировано
+	// в последнем снимке или разница с количеством 7 дней назад не меньше порога (объектов)
+	AnalyzeOnlyChanged   bool `gorm:"default:false" json:"analyze_only_changed"`
+	ChangeThresholdUnits int  `gorm:"default:1" json:"change_threshold_units"`
 }
 
 // AIUsageLog - лог использования AI (для контроля токенов)
@@ -257,12 +652,37 @@ type SMTPSettings struct {
 	CopyEmail         string    `gorm:"size:255" json:"copy_email"`        // адрес для копии
 	CopyEnabled       bool      `gorm:"default:false" json:"copy_enabled"` // отправлять копию
 	UpdatedAt         time.Time `gorm:"autoUpdateTime" json:"updated_at"`
+
+	// Результат последней проверки (POST /api/smtp/test); сбрасывается при изменении настроек
+	LastTestAt    *time.Time `json:"last_test_at,omitempty"`
+	LastTestError string     `gorm:"type:text" json:"last_test_error,omitempty"`
+
+	// Режим TLS: SMTPTLSAuto, SMTPTLSStartTLS или SMTPTLSImplicit
+	TLSMode string `gorm:"size:20" json:"tls_mode"`
+
+	// Прикладывать к письму со счётом Excel-отчёт начислений, если в запросе не указан attach_excel
+	AttachExcelByDefault bool `gorm:"default:false" json:"attach_excel_by_default"`
+}
+
+// Режимы TLS подключения к SMTP
+const (
+	SMTPTLSAuto     = ""         // порт 465 — неявный TLS, иначе STARTTLS при use_tls
+	SMTPTLSStartTLS = "starttls" // открытое подключение, затем STARTTLS при use_tls (обычно 587)
+	SMTPTLSImplicit = "implicit" // TLS сразу при подключении (SMTPS, обычно 465)
+)
+
+// SMTPTLSModes - допустимые режимы TLS
+var SMTPTLSModes = map[string]bool{SMTPTLSAuto: true, SMTPTLSStartTLS: true, SMTPTLSImplicit: true}
+
+// ImplicitTLS сообщает, нужно ли подключаться сразу по TLS: режим implicit или порт 465 в режиме auto
+func (s *SMTPSettings) ImplicitTLS() bool {
+	return s.TLSMode == SMTPTLSImplicit || (s.TLSMode == SMTPTLSAuto && s.Port == 465)
 }
 
 // EmailTemplate - шаблон письма для разных типов рассылок
 type EmailTemplate struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
-	Type      string    `gorm:"size:50;uniqueIndex;not null" json:"type"` // "otp", "invoice", "notification"
+	Type      string    `gorm:"size:50;uniqueIndex;not null" json:"type"` // "otp", "invoice", "notification", "monthly_summary"
 	Name      string    `gorm:"size:255;not null" json:"name"`            // "Код авторизации"
 	Subject   string    `gorm:"size:500;not null" json:"subject"`         // "Ваш код: {{code}}"
 	HTMLBody  string    `gorm:"type:text;not null" json:"html_body"`      // HTML из TipTap-редактора
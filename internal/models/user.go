@@ -37,4 +37,26 @@ type WialonConnection struct {
 	AccountName  string    `gorm:"size:255" json:"account_name"`  // Имя аккаунта Wialon
 	CreatedAt    time.Time `gorm:"autoCreateTime" json:"created_at"`
 	User         User      `gorm:"foreignKey:UserID" json:"-"`
+
+	// Способ подсчёта активных объектов для снимков: auto, usage_api, enumerate_units
+	SnapshotStrategy string `gorm:"size:20;default:'auto'" json:"snapshot_strategy"`
+
+	// Ограничение запросов к Wialon, запросов/сек (0 — wialon.requests_per_second из конфигурации)
+	RequestsPerSecond float64 `gorm:"default:0" json:"requests_per_second"`
+}
+
+// Стратегии подсчёта объектов в снимках
+const (
+	SnapshotStrategyAuto           = "auto"            // avl_unit.usage, при ошибке — перебор объектов
+	SnapshotStrategyUsageAPI       = "usage_api"       // только avl_unit.usage (GetAccountsDataBatch)
+	SnapshotStrategyEnumerateUnits = "enumerate_units" // только перебор объектов (GetAllUnitsWithStatus)
+)
+
+// ValidSnapshotStrategy проверяет значение стратегии снимков
+func ValidSnapshotStrategy(strategy string) bool {
+	switch strategy {
+	case SnapshotStrategyAuto, SnapshotStrategyUsageAPI, SnapshotStrategyEnumerateUnits:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"github.com/user/wialon-billing-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// === Группы учётных записей ===
+
+// GetAccountGroups возвращает все группы с числом аккаунтов в каждой
+func (r *Repository) GetAccountGroups() ([]models.AccountGroup, error) {
+	var groups []models.AccountGroup
+	if err := r.db.Order("name ASC, id ASC").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		GroupID  uint
+		Accounts int64
+	}
+	if err := r.db.Model(&models.Account{}).
+		Select("group_id, COUNT(*) AS accounts").
+		Where("group_id IS NOT NULL").
+		Group("group_id").
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	byGroup := make(map[uint]int64, len(counts))
+	for _, row := range counts {
+		byGroup[row.GroupID] = row.Accounts
+	}
+	for i := range groups {
+		groups[i].Accounts = byGroup[groups[i].ID]
+	}
+	return groups, nil
+}
+
+// GetAccountGroupByID возвращает группу по ID (nil — не найдена)
+func (r *Repository) GetAccountGroupByID(id uint) (*models.AccountGroup, error) {
+	var group models.AccountGroup
+	if err := r.db.First(&group, id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &group, nil
+}
+
+// CreateAccountGroup создаёт группу
+func (r *Repository) CreateAccountGroup(group *models.AccountGroup) error {
+	return r.db.Create(group).Error
+}
+
+// UpdateAccountGroup сохраняет название и родителя группы
+func (r *Repository) UpdateAccountGroup(group *models.AccountGroup) error {
+	return r.db.Save(group).Error
+}
+
+// DeleteAccountGroup удаляет группу: её аккаунты остаются без группы,
+// подгруппы переходят к родителю удалённой группы
+func (r *Repository) DeleteAccountGroup(group *models.AccountGroup) error {
+	defer r.InvalidateSelectedAccounts()
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Account{}).Where("group_id = ?", group.ID).
+			Update("group_id", nil).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.AccountGroup{}).Where("parent_id = ?", group.ID).
+			Update("parent_id", group.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.AccountGroup{}, group.ID).Error
+	})
+}
+
+// GetAccountGroupTreeIDs возвращает ID группы и всех её подгрупп
+func (r *Repository) GetAccountGroupTreeIDs(groupID uint) ([]uint, error) {
+	var ids []uint
+	if err := r.db.Raw(`WITH RECURSIVE tree AS (
+			SELECT id FROM account_groups WHERE id = ?
+			UNION
+			SELECT g.id FROM account_groups g JOIN tree t ON g.parent_id = t.id
+		) SELECT id FROM tree`, groupID).Scan(&ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// GetAccountIDsInGroup возвращает ID аккаунтов группы и её подгрупп
+func (r *Repository) GetAccountIDsInGroup(groupID uint) ([]uint, error) {
+	groupIDs, err := r.GetAccountGroupTreeIDs(groupID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint, 0)
+	if len(groupIDs) == 0 {
+		return ids, nil
+	}
+	if err := r.db.Model(&models.Account{}).
+		Where("group_id IN ?", groupIDs).
+		Order("id").
+		Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// SetAccountsGroup переносит аккаунты в группу (nil — убрать из групп)
+func (r *Repository) SetAccountsGroup(accountIDs []uint, groupID *uint) (int64, error) {
+	defer r.InvalidateSelectedAccounts()
+	res := r.db.Model(&models.Account{}).Where("id IN ?", accountIDs).Update("group_id", groupID)
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"sync"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// defaultSelectedAccountsTTL — время жизни кэша аккаунтов в биллинге по умолчанию
+const defaultSelectedAccountsTTL = 60 * time.Second
+
+// selectedAccountsCache — кэш результата GetSelectedAccounts с коротким TTL.
+// Сбрасывается при любых изменениях аккаунтов и привязок модулей.
+type selectedAccountsCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	accounts []models.Account
+	loadedAt time.Time
+	hits     int64
+	misses   int64
+}
+
+// SelectedAccountsCacheStats - статистика кэша аккаунтов
+type SelectedAccountsCacheStats struct {
+	TTLSeconds int   `json:"ttl_seconds"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+}
+
+// SetSelectedAccountsTTL задаёт время жизни кэша аккаунтов (0 — кэш отключён)
+func (r *Repository) SetSelectedAccountsTTL(ttl time.Duration) {
+	r.selected.mu.Lock()
+	defer r.selected.mu.Unlock()
+	r.selected.ttl = ttl
+	r.selected.accounts = nil
+}
+
+// GetSelectedAccounts возвращает учётные записи, участвующие в биллинге (из кэша, если он свежий)
+func (r *Repository) GetSelectedAccounts() ([]models.Account, error) {
+	r.selected.mu.Lock()
+	defer r.selected.mu.Unlock()
+
+	if r.selected.accounts != nil && time.Since(r.selected.loadedAt) < r.selected.ttl {
+		r.selected.hits++
+		return copyAccounts(r.selected.accounts), nil
+	}
+
+	r.selected.misses++
+	accounts, err := r.loadSelectedAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if r.selected.ttl > 0 {
+		r.selected.accounts = accounts
+		r.selected.loadedAt = time.Now()
+	}
+	return copyAccounts(accounts), nil
+}
+
+// GetSelectedAccountsFresh читает аккаунты из БД в обход кэша и обновляет кэш.
+// Для операций, где важна точность (генерация счетов).
+func (r *Repository) GetSelectedAccountsFresh() ([]models.Account, error) {
+	r.selected.mu.Lock()
+	defer r.selected.mu.Unlock()
+
+	r.selected.misses++
+	accounts, err := r.loadSelectedAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if r.selected.ttl > 0 {
+		r.selected.accounts = accounts
+		r.selected.loadedAt = time.Now()
+	}
+	return copyAccounts(accounts), nil
+}
+
+// InvalidateSelectedAccounts сбрасывает кэш аккаунтов
+func (r *Repository) InvalidateSelectedAccounts() {
+	r.selected.mu.Lock()
+	r.selected.accounts = nil
+	r.selected.mu.Unlock()
+}
+
+// SelectedAccountsCacheStats возвращает статистику попаданий в кэш
+func (r *Repository) SelectedAccountsCacheStats() SelectedAccountsCacheStats {
+	r.selected.mu.Lock()
+	defer r.selected.mu.Unlock()
+	return SelectedAccountsCacheStats{
+		TTLSeconds: int(r.selected.ttl.Seconds()),
+		Hits:       r.selected.hits,
+		Misses:     r.selected.misses,
+	}
+}
+
+// loadSelectedAccounts читает аккаунты в биллинге из БД
+func (r *Repository) loadSelectedAccounts() ([]models.Account, error) {
+	var accounts []models.Account
+	if err := r.db.Where("is_billing_enabled = ?", true).Preload("Modules.Module").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// copyAccounts копирует срез, чтобы вызывающий код не портил кэш
+func copyAccounts(accounts []models.Account) []models.Account {
+	result := make([]models.Account, len(accounts))
+	copy(result, accounts)
+	for i := range result {
+		if accounts[i].Modules != nil {
+			result[i].Modules = append([]models.AccountModule(nil), accounts[i].Modules...)
+		}
+	}
+	return result
+}
@@ -43,6 +43,18 @@ func (r *Repository) UpdateUser(user *models.User) error {
 	return r.db.Save(user).Error
 }
 
+// GetAdminEmails возвращает email администраторов (для служебных уведомлений)
+func (r *Repository) GetAdminEmails() ([]string, error) {
+	var emails []string
+	if err := r.db.Model(&models.User{}).
+		Where("role = ? OR is_admin = ?", "admin", true).
+		Order("id").
+		Pluck("email", &emails).Error; err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
 // === OTP Codes ===
 
 // CreateOTPCode создаёт новый OTP код
@@ -0,0 +1,50 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// === Доставка писем со счетами ===
+
+// CreateInvoiceDelivery добавляет запись о доставке письма получателю
+func (r *Repository) CreateInvoiceDelivery(delivery *models.InvoiceDelivery) error {
+	return r.db.Create(delivery).Error
+}
+
+// UpdateInvoiceDeliveryStatus меняет статус доставки; при переходе в «отправлено» фиксирует время
+func (r *Repository) UpdateInvoiceDeliveryStatus(id uint, status, errText string) error {
+	updates := map[string]interface{}{"status": status, "error": errText}
+	if status == models.DeliverySent {
+		updates["sent_at"] = time.Now()
+	}
+	return r.db.Model(&models.InvoiceDelivery{}).Where("id = ?", id).Updates(updates).Error
+}
+
+// GetInvoiceDelivery возвращает доставку по ID (nil — не найдена)
+func (r *Repository) GetInvoiceDelivery(id uint) (*models.InvoiceDelivery, error) {
+	var deliveries []models.InvoiceDelivery
+	if err := r.db.Where("id = ?", id).Limit(1).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, nil
+	}
+	return &deliveries[0], nil
+}
+
+// GetInvoiceDeliveries возвращает доставки счёта (сначала новые)
+func (r *Repository) GetInvoiceDeliveries(invoiceID uint) ([]models.InvoiceDelivery, error) {
+	var deliveries []models.InvoiceDelivery
+	if err := r.db.Where("invoice_id = ?", invoiceID).Order("created_at DESC, id DESC").Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// SetInvoiceDeliveryStatus сохраняет итог доставки счёта, не трогая остальные поля
+func (r *Repository) SetInvoiceDeliveryStatus(invoiceID uint, status, errText string) error {
+	return r.db.Model(&models.Invoice{}).Where("id = ?", invoiceID).
+		Updates(map[string]interface{}{"delivery_status": status, "delivery_error": errText}).Error
+}
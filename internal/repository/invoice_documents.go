@@ -0,0 +1,26 @@
+package repository
+
+import (
+	"github.com/user/wialon-billing-api/internal/models"
+	"gorm.io/gorm/clause"
+)
+
+// GetInvoiceDocument возвращает PDF, зафиксированный при отправке счёта (nil — не зафиксирован)
+func (r *Repository) GetInvoiceDocument(invoiceID uint) (*models.InvoiceDocument, error) {
+	var docs []models.InvoiceDocument
+	if err := r.db.Where("invoice_id = ?", invoiceID).Limit(1).Find(&docs).Error; err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	return &docs[0], nil
+}
+
+// SaveInvoiceDocument сохраняет PDF счёта, заменяя прежний
+func (r *Repository) SaveInvoiceDocument(doc *models.InvoiceDocument) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "invoice_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"pdf", "sha256", "created_at"}),
+	}).Create(doc).Error
+}
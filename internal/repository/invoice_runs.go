@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"gorm.io/gorm/clause"
+)
+
+// === Ежемесячная генерация счетов ===
+
+// StartInvoiceRun создаёт запись генерации счетов за период, если её ещё нет, и возвращает
+// запись за период (существующую — в том состоянии, в каком она сохранена)
+func (r *Repository) StartInvoiceRun(period, rateDate time.Time) (*models.InvoiceRun, error) {
+	run := models.InvoiceRun{
+		Period:   period,
+		RateDate: rateDate,
+		Status:   models.InvoiceRunPending,
+	}
+	if err := r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&run).Error; err != nil {
+		return nil, err
+	}
+	var stored models.InvoiceRun
+	if err := r.db.Where("period = ?", period).First(&stored).Error; err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// GetPendingInvoiceRuns возвращает незавершённые генерации счетов (для продолжения после перезапуска)
+func (r *Repository) GetPendingInvoiceRuns() ([]models.InvoiceRun, error) {
+	var runs []models.InvoiceRun
+	if err := r.db.Where("status = ?", models.InvoiceRunPending).
+		Order("period ASC").Find(&runs).Error; err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// ClaimInvoiceRun захватывает незавершённую генерацию для owner до until условным UPDATE:
+// захват удаётся, если генерация свободна, уже принадлежит owner (продление) или срок
+// прежнего захвата истёк. Возвращает false, если генерацию ведёт другой процесс.
+func (r *Repository) ClaimInvoiceRun(run *models.InvoiceRun, owner string, until time.Time) (bool, error) {
+	res := r.db.Model(&models.InvoiceRun{}).
+		Where("id = ? AND status = ?", run.ID, models.InvoiceRunPending).
+		Where("claimed_by IS NULL OR claimed_by = '' OR claimed_by = ? OR claimed_until IS NULL OR claimed_until < ?", owner, time.Now()).
+		Updates(map[string]interface{}{"claimed_by": owner, "claimed_until": until})
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	run.ClaimedBy = owner
+	run.ClaimedUntil = &until
+	return true, nil
+}
+
+// ReleaseInvoiceRun снимает захват генерации процессом owner (при остановке сервера),
+// чтобы после перезапуска её можно было продолжить сразу
+func (r *Repository) ReleaseInvoiceRun(run *models.InvoiceRun, owner string) error {
+	if err := r.db.Model(&models.InvoiceRun{}).
+		Where("id = ? AND claimed_by = ?", run.ID, owner).
+		Updates(map[string]interface{}{"claimed_by": "", "claimed_until": nil}).Error; err != nil {
+		return err
+	}
+	run.ClaimedBy = ""
+	run.ClaimedUntil = nil
+	return nil
+}
+
+// UpdateInvoiceRun сохраняет состояние генерации счетов
+func (r *Repository) UpdateInvoiceRun(run *models.InvoiceRun) error {
+	return r.db.Save(run).Error
+}
@@ -1,10 +1,13 @@
 package repository
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/user/wialon-billing-api/internal/config"
 	"github.com/user/wialon-billing-api/internal/models"
 	"gorm.io/driver/postgres"
@@ -14,9 +17,13 @@ import (
 
 // Repository - интерфейс для работы с БД
 type Repository struct {
-	db *gorm.DB
+	db       *gorm.DB
+	selected selectedAccountsCache
 }
 
+// ErrInvoiceExists - счёт за этот период у аккаунта уже существует
+var ErrInvoiceExists = errors.New("счёт за период уже существует")
+
 // NewPostgresDB создаёт подключение к PostgreSQL
 func NewPostgresDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
 	dsn := fmt.Sprintf(
@@ -34,21 +41,45 @@ func NewPostgresDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
 		SELECT MAX(id) FROM snapshots GROUP BY account_id, snapshot_date
 	)`)
 
+	// Удаление дублей счетов (для unique index на invoices): при ошибке не запускаемся,
+	// иначе индекс не создастся и дубли останутся
+	if err := dedupInvoices(db); err != nil {
+		return nil, fmt.Errorf("удаление дублей счетов: %w", err)
+	}
+
+	// Удаление дублей привязок модулей (для unique index на account_modules)
+	if db.Migrator().HasTable("account_modules") {
+		if err := db.Exec(`DELETE FROM account_modules WHERE id NOT IN (
+			SELECT MIN(id) FROM account_modules GROUP BY account_id, module_id
+		)`).Error; err != nil {
+			return nil, fmt.Errorf("удаление дублей привязок модулей: %w", err)
+		}
+	}
+
 	// Автомиграция моделей
 	if err := db.AutoMigrate(
 		&models.User{},
 		&models.OTPCode{},
 		&models.WialonConnection{},
 		&models.BillingSettings{},
+		&models.SupplierBankAccount{},
 		&models.Module{},
 		&models.Account{},
+		&models.AccountGroup{},
 		&models.AccountModule{},
 		&models.Invoice{},
 		&models.InvoiceLine{},
+		&models.InvoiceEvent{},
+		&models.InvoiceDelivery{},
+		&models.InvoiceDocument{},
+		&models.InvoiceSequence{},
+		&models.InvoiceRun{},
 		&models.ExchangeRate{},
 		&models.Snapshot{},
 		&models.SnapshotUnit{},
 		&models.Change{},
+		&models.WialonUnitEvent{},
+		&models.SyncJob{},
 		// Детализация начислений
 		&models.DailyCharge{},
 		// AI Analytics
@@ -62,12 +93,59 @@ func NewPostgresDB(cfg config.DatabaseConfig) (*gorm.DB, error) {
 		return nil, err
 	}
 
+	// Один счёт на аккаунт и период (индекс создаётся вручную, чтобы при появлении
+	// кредит-нот его можно было сделать частичным через WHERE). Без индекса не запускаемся:
+	// на нём держится защита от повторного выставления счёта за период
+	if err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_invoice_account_period
+		ON invoices (account_id, period)`).Error; err != nil {
+		return nil, fmt.Errorf("создание индекса idx_invoice_account_period: %w", err)
+	}
+
+	// Модуль привязывается к аккаунту не более одного раза
+	if err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_account_module
+		ON account_modules (account_id, module_id)`).Error; err != nil {
+		return nil, fmt.Errorf("создание индекса idx_account_module: %w", err)
+	}
+
 	// Миграция: перенумерация существующих счетов в формат WH-N
 	migrateInvoiceNumbers(db)
 
 	return db, nil
 }
 
+// dedupInvoices оставляет один счёт на аккаунт и период: приоритет у оплаченных,
+// затем у отправленных, затем у самого нового. Строки, история, доставки и PDF лишних счетов
+// удаляются в одной транзакции; таблицы, которых ещё нет (первый запуск), пропускаются.
+func dedupInvoices(db *gorm.DB) error {
+	if !db.Migrator().HasTable("invoices") {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		var ids []uint
+		if err := tx.Raw(`SELECT id FROM invoices WHERE id NOT IN (
+			SELECT DISTINCT ON (account_id, period) id FROM invoices
+			ORDER BY account_id, period, (status = 'paid') DESC, (status = 'sent') DESC, id DESC
+		)`).Scan(&ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		log.Printf("[МИГРАЦИЯ] Удаление %d дублирующихся счетов (account_id, period)...", len(ids))
+		for _, table := range []string{"invoice_lines", "invoice_events", "invoice_deliveries", "invoice_documents"} {
+			if !tx.Migrator().HasTable(table) {
+				continue
+			}
+			if err := tx.Exec("DELETE FROM "+table+" WHERE invoice_id IN ?", ids).Error; err != nil {
+				return fmt.Errorf("%s: %w", table, err)
+			}
+		}
+		return tx.Exec("DELETE FROM invoices WHERE id IN ?", ids).Error
+	})
+}
+
 // migrateInvoiceNumbers перенумеровывает существующие счета в формат WH-N (одноразовая миграция)
 func migrateInvoiceNumbers(db *gorm.DB) {
 	// Проверяем, есть ли счета со старым форматом (не начинающиеся с WH-)
@@ -94,7 +172,21 @@ func migrateInvoiceNumbers(db *gorm.DB) {
 
 // NewRepository создаёт новый репозиторий
 func NewRepository(db *gorm.DB) *Repository {
-	return &Repository{db: db}
+	return &Repository{db: db, selected: selectedAccountsCache{ttl: defaultSelectedAccountsTTL}}
+}
+
+// WithTransaction выполняет fn в одной транзакции: все методы переданного репозитория
+// работают через неё, ошибка fn откатывает изменения. Кэш аккаунтов внутри транзакции
+// отключён, после фиксации кэш основного репозитория сбрасывается.
+func (r *Repository) WithTransaction(fn func(*Repository) error) error {
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&Repository{db: tx})
+	})
+	if err != nil {
+		return err
+	}
+	r.InvalidateSelectedAccounts()
+	return nil
 }
 
 // === Accounts ===
@@ -105,16 +197,60 @@ func (r *Repository) GetAllAccounts() ([]models.Account, error) {
 	if err := r.db.Preload("Modules.Module").Find(&accounts).Error; err != nil {
 		return nil, err
 	}
+	if err := r.attachConnections(accountPtrs(accounts)); err != nil {
+		return nil, err
+	}
 	return accounts, nil
 }
 
-// GetSelectedAccounts возвращает учётные записи, участвующие в биллинге
-func (r *Repository) GetSelectedAccounts() ([]models.Account, error) {
-	var accounts []models.Account
-	if err := r.db.Where("is_billing_enabled = ?", true).Preload("Modules.Module").Find(&accounts).Error; err != nil {
-		return nil, err
+// accountPtrs возвращает указатели на элементы среза аккаунтов
+func accountPtrs(accounts []models.Account) []*models.Account {
+	ptrs := make([]*models.Account, len(accounts))
+	for i := range accounts {
+		ptrs[i] = &accounts[i]
 	}
-	return accounts, nil
+	return ptrs
+}
+
+// attachConnections заполняет название подключения и хост Wialon у аккаунтов одним запросом
+func (r *Repository) attachConnections(accounts []*models.Account) error {
+	ids := make([]uint, 0, len(accounts))
+	for _, account := range accounts {
+		if account.ConnectionID != nil {
+			ids = append(ids, *account.ConnectionID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var conns []models.WialonConnection
+	if err := r.db.Select("id", "name", "wialon_host").Where("id IN ?", ids).Find(&conns).Error; err != nil {
+		return err
+	}
+	byID := make(map[uint]models.WialonConnection, len(conns))
+	for _, conn := range conns {
+		byID[conn.ID] = conn
+	}
+	for _, account := range accounts {
+		if account.ConnectionID == nil {
+			continue
+		}
+		if conn, ok := byID[*account.ConnectionID]; ok {
+			account.ConnectionName = conn.Name
+			account.WialonHost = conn.WialonHost
+		}
+	}
+	return nil
+}
+
+// snapshotAccounts возвращает указатели на аккаунты снимков
+func snapshotAccounts(snapshots []models.Snapshot) []*models.Account {
+	ptrs := make([]*models.Account, len(snapshots))
+	for i := range snapshots {
+		ptrs[i] = &snapshots[i].Account
+	}
+	return ptrs
 }
 
 // GetAccountByID возвращает учётную запись по ID
@@ -128,12 +264,20 @@ func (r *Repository) GetAccountByID(id uint) (*models.Account, error) {
 
 // ToggleAccountBilling переключает участие в биллинге
 func (r *Repository) ToggleAccountBilling(id uint) error {
+	defer r.InvalidateSelectedAccounts()
 	return r.db.Model(&models.Account{}).Where("id = ?", id).
 		Update("is_billing_enabled", gorm.Expr("NOT is_billing_enabled")).Error
 }
 
+// SetAccountBlocked обновляет статус блокировки аккаунта в Wialon
+func (r *Repository) SetAccountBlocked(id uint, blocked bool) error {
+	defer r.InvalidateSelectedAccounts()
+	return r.db.Model(&models.Account{}).Where("id = ?", id).Update("is_blocked", blocked).Error
+}
+
 // UpsertAccount создаёт или обновляет учётную запись
 func (r *Repository) UpsertAccount(account *models.Account) error {
+	defer r.InvalidateSelectedAccounts()
 	return r.db.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "wialon_id"}},
 		DoUpdates: clause.AssignmentColumns([]string{"name", "is_dealer", "is_active", "is_blocked", "parent_id"}),
@@ -142,11 +286,13 @@ func (r *Repository) UpsertAccount(account *models.Account) error {
 
 // DeleteAllAccounts удаляет все учётные записи (для полной пересинхронизации)
 func (r *Repository) DeleteAllAccounts() error {
+	defer r.InvalidateSelectedAccounts()
 	return r.db.Exec("DELETE FROM accounts").Error
 }
 
 // DeactivateMissingAccounts помечает аккаунты как неактивные, если их WialonID нет в списке activeIDs
 func (r *Repository) DeactivateMissingAccounts(activeIDs []int64) error {
+	defer r.InvalidateSelectedAccounts()
 	if len(activeIDs) == 0 {
 		// Если список пуст, деактивируем все
 		return r.db.Model(&models.Account{}).Where("1 = 1").Update("is_active", false).Error
@@ -205,6 +351,7 @@ func (r *Repository) GetSnapshotsByDealerAll(dealerWialonID int64, limit int) ([
 
 // UpdateAccount обновляет учётную запись
 func (r *Repository) UpdateAccount(account *models.Account) error {
+	defer r.InvalidateSelectedAccounts()
 	return r.db.Save(account).Error
 }
 
@@ -219,6 +366,15 @@ func (r *Repository) GetAllModules() ([]models.Module, error) {
 	return modules, nil
 }
 
+// GetModuleByID возвращает модуль по ID
+func (r *Repository) GetModuleByID(id uint) (*models.Module, error) {
+	var module models.Module
+	if err := r.db.First(&module, id).Error; err != nil {
+		return nil, err
+	}
+	return &module, nil
+}
+
 // CreateModule создаёт новый модуль
 func (r *Repository) CreateModule(module *models.Module) error {
 	return r.db.Create(module).Error
@@ -226,21 +382,32 @@ func (r *Repository) CreateModule(module *models.Module) error {
 
 // UpdateModule обновляет модуль
 func (r *Repository) UpdateModule(module *models.Module) error {
+	defer r.InvalidateSelectedAccounts()
 	return r.db.Save(module).Error
 }
 
 // DeleteModule удаляет модуль
 func (r *Repository) DeleteModule(id uint) error {
+	defer r.InvalidateSelectedAccounts()
 	return r.db.Delete(&models.Module{}, id).Error
 }
 
-// AssignModuleToAccount привязывает модуль к учётной записи
-func (r *Repository) AssignModuleToAccount(accountID, moduleID uint) error {
+// AssignModuleToAccount привязывает модуль к учётной записи.
+// Повторная привязка не создаёт дубль: created = false, если модуль уже был привязан.
+func (r *Repository) AssignModuleToAccount(accountID, moduleID uint) (bool, error) {
+	defer r.InvalidateSelectedAccounts()
 	am := models.AccountModule{
 		AccountID: accountID,
 		ModuleID:  moduleID,
 	}
-	return r.db.Create(&am).Error
+	result := r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "account_id"}, {Name: "module_id"}},
+		DoNothing: true,
+	}).Create(&am)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
 }
 
 // === Settings ===
@@ -254,12 +421,66 @@ func (r *Repository) GetSettings() (*models.BillingSettings, error) {
 		}
 		return nil, err
 	}
+	bankAccounts, err := r.GetSupplierBankAccounts()
+	if err != nil {
+		return nil, err
+	}
+	settings.BankAccounts = bankAccounts
 	return &settings, nil
 }
 
 // SaveSettings сохраняет настройки биллинга
 func (r *Repository) SaveSettings(settings *models.BillingSettings) error {
-	return r.db.Save(settings).Error
+	// При первом создании gorm подставляет default:true вместо false — фиксируем явно
+	includeVAT := settings.PricesIncludeVAT
+	if err := r.db.Save(settings).Error; err != nil {
+		return err
+	}
+	if settings.PricesIncludeVAT != includeVAT {
+		settings.PricesIncludeVAT = includeVAT
+		return r.db.Model(settings).Update("prices_include_vat", includeVAT).Error
+	}
+	return nil
+}
+
+// === Supplier Bank Accounts ===
+
+// GetSupplierBankAccounts возвращает банковские счета поставщика (счёт по умолчанию первым)
+func (r *Repository) GetSupplierBankAccounts() ([]models.SupplierBankAccount, error) {
+	var accounts []models.SupplierBankAccount
+	if err := r.db.Order("is_default DESC, currency, id").Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// GetSupplierBankAccountByID возвращает банковский счёт поставщика по ID
+func (r *Repository) GetSupplierBankAccountByID(id uint) (*models.SupplierBankAccount, error) {
+	var account models.SupplierBankAccount
+	if err := r.db.First(&account, id).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// SaveSupplierBankAccount создаёт или обновляет банковский счёт поставщика.
+// Счёт по умолчанию может быть только один — у остальных флаг снимается.
+func (r *Repository) SaveSupplierBankAccount(account *models.SupplierBankAccount) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if account.IsDefault {
+			if err := tx.Model(&models.SupplierBankAccount{}).
+				Where("is_default = ? AND id <> ?", true, account.ID).
+				Update("is_default", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(account).Error
+	})
+}
+
+// DeleteSupplierBankAccount удаляет банковский счёт поставщика
+func (r *Repository) DeleteSupplierBankAccount(id uint) error {
+	return r.db.Delete(&models.SupplierBankAccount{}, id).Error
 }
 
 // === Exchange Rates ===
@@ -289,6 +510,30 @@ func (r *Repository) GetExchangeRateByDate(currencyFrom string, date time.Time)
 	return &rate, nil
 }
 
+// GetUsedCurrencies возвращает валюты цен модулей, счетов аккаунтов и справочных сумм
+func (r *Repository) GetUsedCurrencies() ([]string, error) {
+	var currencies []string
+	if err := r.db.Raw(`SELECT currency FROM modules WHERE currency <> ''
+		UNION SELECT billing_currency FROM accounts WHERE billing_currency <> ''
+		UNION SELECT display_currency FROM accounts WHERE display_currency <> ''
+		ORDER BY 1`).Scan(&currencies).Error; err != nil {
+		return nil, err
+	}
+	return currencies, nil
+}
+
+// GetExchangeRateOnOrBefore возвращает последний известный курс на дату или раньше (перенос курса)
+func (r *Repository) GetExchangeRateOnOrBefore(currencyFrom string, date time.Time) (*models.ExchangeRate, error) {
+	var rate models.ExchangeRate
+	dateOnly := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	if err := r.db.Where("currency_from = ? AND rate_date <= ?", currencyFrom, dateOnly).
+		Order("rate_date DESC").
+		First(&rate).Error; err != nil {
+		return nil, err
+	}
+	return &rate, nil
+}
+
 // === Snapshots ===
 
 // GetSnapshots возвращает снимки (legacy, для обратной совместимости)
@@ -297,6 +542,9 @@ func (r *Repository) GetSnapshots(limit int) ([]models.Snapshot, error) {
 	if err := r.db.Order("snapshot_date DESC").Limit(limit).Preload("Account").Find(&snapshots).Error; err != nil {
 		return nil, err
 	}
+	if err := r.attachConnections(snapshotAccounts(snapshots)); err != nil {
+		return nil, err
+	}
 	return snapshots, nil
 }
 
@@ -334,9 +582,66 @@ func (r *Repository) GetSnapshotsPaginated(page, pageSize int, from, to *time.Ti
 		return nil, 0, err
 	}
 
+	if err := r.attachConnections(snapshotAccounts(snapshots)); err != nil {
+		return nil, 0, err
+	}
 	return snapshots, total, nil
 }
 
+// GetChangesPaginated возвращает изменения постранично (новые первыми); changeType — фильтр по типу (пусто — все)
+func (r *Repository) GetChangesPaginated(page, pageSize int, changeType string) ([]models.Change, int64, error) {
+	var changes []models.Change
+	var total int64
+	query := r.db.Model(&models.Change{})
+	if changeType != "" {
+		query = query.Where("change_type = ?", changeType)
+	}
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := query.Order("detected_at DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&changes).Error; err != nil {
+		return nil, 0, err
+	}
+	return changes, total, nil
+}
+
+// GetInvoicesPaginated возвращает счета постранично (новые первыми)
+func (r *Repository) GetInvoicesPaginated(page, pageSize int) ([]models.Invoice, int64, error) {
+	var invoices []models.Invoice
+	var total int64
+	if err := r.db.Model(&models.Invoice{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := r.db.Preload("Account").Preload("Lines").
+		Order("created_at DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&invoices).Error; err != nil {
+		return nil, 0, err
+	}
+	return invoices, total, nil
+}
+
+// GetAccountsPaginated возвращает учётные записи с модулями постранично (по имени)
+func (r *Repository) GetAccountsPaginated(page, pageSize int) ([]models.Account, int64, error) {
+	var accounts []models.Account
+	var total int64
+	if err := r.db.Model(&models.Account{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := r.db.Preload("Modules.Module").
+		Order("name ASC, id ASC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&accounts).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := r.attachConnections(accountPtrs(accounts)); err != nil {
+		return nil, 0, err
+	}
+	return accounts, total, nil
+}
+
 // GetSnapshotsByPeriod возвращает снимки за указанный месяц и год
 func (r *Repository) GetSnapshotsByPeriod(year, month int) ([]models.Snapshot, error) {
 	var snapshots []models.Snapshot
@@ -349,6 +654,9 @@ func (r *Repository) GetSnapshotsByPeriod(year, month int) ([]models.Snapshot, e
 		Order("snapshot_date DESC").Preload("Account").Find(&snapshots).Error; err != nil {
 		return nil, err
 	}
+	if err := r.attachConnections(snapshotAccounts(snapshots)); err != nil {
+		return nil, err
+	}
 	return snapshots, nil
 }
 
@@ -365,7 +673,7 @@ func (r *Repository) UpsertSnapshot(snapshot *models.Snapshot) error {
 			{Name: "snapshot_date"},
 		},
 		DoUpdates: clause.AssignmentColumns([]string{
-			"total_units", "units_created", "units_deleted", "units_deactivated",
+			"total_units", "units_created", "units_deleted", "units_deactivated", "updated_at",
 		}),
 	}).Create(snapshot).Error
 }
@@ -375,6 +683,11 @@ func (r *Repository) CreateSnapshotUnit(unit *models.SnapshotUnit) error {
 	return r.db.Create(unit).Error
 }
 
+// DeleteSnapshotUnits удаляет объекты снимка (для пересоздания снимка за ту же дату)
+func (r *Repository) DeleteSnapshotUnits(snapshotID uint) error {
+	return r.db.Where("snapshot_id = ?", snapshotID).Delete(&models.SnapshotUnit{}).Error
+}
+
 // GetLastSnapshot возвращает последний снимок для аккаунта
 func (r *Repository) GetLastSnapshot(accountID uint) (*models.Snapshot, error) {
 	var snapshot models.Snapshot
@@ -388,6 +701,61 @@ func (r *Repository) GetLastSnapshot(accountID uint) (*models.Snapshot, error) {
 	return &snapshot, nil
 }
 
+// SnapshotUnitFilter - условия поиска объектов в снимках (пустые поля не применяются)
+type SnapshotUnitFilter struct {
+	Query           string // подстрока названия объекта (без учёта регистра)
+	WialonUnitID    *int64
+	AccountWialonID *int64 // только снимки аккаунта (дилер, партнёр)
+}
+
+// SnapshotUnitMatch - найденный объект снимка с аккаунтом и датой снимка
+type SnapshotUnitMatch struct {
+	ID              uint       `json:"id"`
+	SnapshotID      uint       `json:"snapshot_id"`
+	SnapshotDate    time.Time  `json:"snapshot_date"`
+	WialonUnitID    int64      `json:"wialon_unit_id"`
+	UnitName        string     `json:"unit_name"`
+	IsActive        bool       `json:"is_active"`
+	DeactivatedAt   *time.Time `json:"deactivated_at,omitempty"`
+	AccountID       uint       `json:"account_id"`
+	AccountName     string     `json:"account_name"`
+	AccountWialonID int64      `json:"account_wialon_id"`
+}
+
+// SearchSnapshotUnits ищет объекты в снимках по названию или ID Wialon (новые снимки первыми)
+func (r *Repository) SearchSnapshotUnits(filter SnapshotUnitFilter, page, pageSize int) ([]SnapshotUnitMatch, int64, error) {
+	query := r.db.Table("snapshot_units").
+		Joins("JOIN snapshots ON snapshots.id = snapshot_units.snapshot_id").
+		Joins("JOIN accounts ON accounts.id = snapshots.account_id")
+	if filter.Query != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(filter.Query)
+		query = query.Where("snapshot_units.unit_name ILIKE ?", "%"+escaped+"%")
+	}
+	if filter.WialonUnitID != nil {
+		query = query.Where("snapshot_units.wialon_unit_id = ?", *filter.WialonUnitID)
+	}
+	if filter.AccountWialonID != nil {
+		query = query.Where("accounts.wialon_id = ?", *filter.AccountWialonID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	matches := make([]SnapshotUnitMatch, 0)
+	if err := query.Select(`snapshot_units.id, snapshot_units.snapshot_id, snapshots.snapshot_date,
+			snapshot_units.wialon_unit_id, snapshot_units.unit_name, snapshot_units.is_active,
+			snapshot_units.deactivated_at, accounts.id AS account_id, accounts.name AS account_name,
+			accounts.wialon_id AS account_wialon_id`).
+		Order("snapshots.snapshot_date DESC, snapshot_units.unit_name ASC, snapshot_units.id ASC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Scan(&matches).Error; err != nil {
+		return nil, 0, err
+	}
+	return matches, total, nil
+}
+
 // HasSnapshotsForDate проверяет, существуют ли снимки за указанную дату
 func (r *Repository) HasSnapshotsForDate(date time.Time) (bool, error) {
 	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
@@ -402,28 +770,126 @@ func (r *Repository) HasSnapshotsForDate(date time.Time) (bool, error) {
 	return count > 0, nil
 }
 
+// LastSnapshotTimeForDate возвращает время последнего создания/обновления снимков за дату
+// (nil — снимков нет)
+func (r *Repository) LastSnapshotTimeForDate(date time.Time) (*time.Time, error) {
+	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	endOfDay := startOfDay.AddDate(0, 0, 1)
+
+	var last struct{ Taken *time.Time }
+	if err := r.db.Model(&models.Snapshot{}).
+		Select("MAX(COALESCE(updated_at, created_at)) AS taken").
+		Where("snapshot_date >= ? AND snapshot_date < ?", startOfDay, endOfDay).
+		Scan(&last).Error; err != nil {
+		return nil, err
+	}
+	return last.Taken, nil
+}
+
 // ClearAllSnapshots удаляет все снимки и связанные данные
-func (r *Repository) ClearAllSnapshots() (int64, error) {
-	// Сначала удаляем SnapshotUnits
-	r.db.Exec("DELETE FROM snapshot_units")
+// одной транзакцией: при ошибке ничего не удаляется
+func (r *Repository) ClearAllSnapshots() (*SnapshotDeleteResult, error) {
+	result := &SnapshotDeleteResult{}
+	err := r.WithTransaction(func(tx *Repository) error {
+		// Сначала зависимые таблицы: объекты снимков, начисления, изменения
+		steps := []struct {
+			table string
+			count *int64
+		}{
+			{"snapshot_units", &result.SnapshotUnits},
+			{"daily_charges", &result.DailyCharges},
+			{"changes", &result.Changes},
+			{"snapshots", &result.Snapshots},
+		}
+		for _, step := range steps {
+			res := tx.db.Exec("DELETE FROM " + step.table)
+			if res.Error != nil {
+				return fmt.Errorf("очистка %s: %w", step.table, res.Error)
+			}
+			*step.count = res.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SnapshotDeleteResult - количество удалённых записей по таблицам
+type SnapshotDeleteResult struct {
+	Snapshots     int64 `json:"snapshots"`
+	SnapshotUnits int64 `json:"snapshot_units"`
+	Changes       int64 `json:"changes"`
+	DailyCharges  int64 `json:"daily_charges"`
+}
 
-	// Удаляем DailyCharges
-	r.db.Exec("DELETE FROM daily_charges")
+// DeleteSnapshotsScoped удаляет снимки за период (и опционально по аккаунту) вместе со связанными данными.
+// from и to включительно; accountID = 0 — для всех аккаунтов.
+func (r *Repository) DeleteSnapshotsScoped(accountID uint, from, to time.Time) (*SnapshotDeleteResult, error) {
+	result := &SnapshotDeleteResult{}
 
-	// Удаляем Changes
-	r.db.Exec("DELETE FROM changes")
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&models.Snapshot{}).Where("snapshot_date >= ? AND snapshot_date <= ?", from, to)
+		if accountID > 0 {
+			query = query.Where("account_id = ?", accountID)
+		}
 
-	// Удаляем Snapshots
-	result := r.db.Exec("DELETE FROM snapshots")
-	return result.RowsAffected, result.Error
+		var ids []uint
+		if err := query.Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		res := tx.Where("snapshot_id IN ?", ids).Delete(&models.SnapshotUnit{})
+		if res.Error != nil {
+			return res.Error
+		}
+		result.SnapshotUnits = res.RowsAffected
+
+		res = tx.Where("snapshot_id IN ?", ids).Delete(&models.DailyCharge{})
+		if res.Error != nil {
+			return res.Error
+		}
+		result.DailyCharges = res.RowsAffected
+
+		res = tx.Where("curr_snapshot_id IN ?", ids).Delete(&models.Change{})
+		if res.Error != nil {
+			return res.Error
+		}
+		result.Changes = res.RowsAffected
+
+		// Изменения следующих снимков теряют ссылку на удалённый предыдущий
+		if err := tx.Model(&models.Change{}).Where("prev_snapshot_id IN ?", ids).
+			Update("prev_snapshot_id", nil).Error; err != nil {
+			return err
+		}
+
+		res = tx.Where("id IN ?", ids).Delete(&models.Snapshot{})
+		if res.Error != nil {
+			return res.Error
+		}
+		result.Snapshots = res.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // === Changes ===
 
-// GetChanges возвращает изменения
-func (r *Repository) GetChanges(limit int) ([]models.Change, error) {
+// GetChanges возвращает изменения (changeType — фильтр по типу, пусто — все)
+func (r *Repository) GetChanges(limit int, changeType string) ([]models.Change, error) {
 	var changes []models.Change
-	if err := r.db.Order("detected_at DESC").Limit(limit).Find(&changes).Error; err != nil {
+	query := r.db.Order("detected_at DESC").Limit(limit)
+	if changeType != "" {
+		query = query.Where("change_type = ?", changeType)
+	}
+	if err := query.Find(&changes).Error; err != nil {
 		return nil, err
 	}
 	return changes, nil
@@ -434,6 +900,11 @@ func (r *Repository) CreateChange(change *models.Change) error {
 	return r.db.Create(change).Error
 }
 
+// DeleteChangesBySnapshot удаляет изменения, обнаруженные при создании снимка
+func (r *Repository) DeleteChangesBySnapshot(snapshotID uint) error {
+	return r.db.Where("curr_snapshot_id = ?", snapshotID).Delete(&models.Change{}).Error
+}
+
 // === Invoices ===
 
 // GetInvoices возвращает список счетов
@@ -472,7 +943,24 @@ func (r *Repository) GetInvoiceByAccountAndPeriod(accountID uint, period time.Ti
 
 // CreateInvoice создаёт счёт
 func (r *Repository) CreateInvoice(invoice *models.Invoice) error {
-	return r.db.Create(invoice).Error
+	if err := r.db.Create(invoice).Error; err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "idx_invoice_account_period" {
+			return fmt.Errorf("%w: аккаунт %d, период %s", ErrInvoiceExists, invoice.AccountID, invoice.Period.Format("2006-01"))
+		}
+		return err
+	}
+	return nil
+}
+
+// GetInvoicesNeedingRateReissue возвращает счета, выставленные без курса НБК
+func (r *Repository) GetInvoicesNeedingRateReissue() ([]models.Invoice, error) {
+	var invoices []models.Invoice
+	if err := r.db.Preload("Account").Where("needs_rate_reissue = ?", true).
+		Order("period, id").Find(&invoices).Error; err != nil {
+		return nil, err
+	}
+	return invoices, nil
 }
 
 // UpdateInvoice обновляет счёт
@@ -480,9 +968,28 @@ func (r *Repository) UpdateInvoice(invoice *models.Invoice) error {
 	return r.db.Save(invoice).Error
 }
 
-// DeleteInvoice удаляет счёт
+// DeleteInvoice удаляет счёт вместе с зафиксированным PDF
 func (r *Repository) DeleteInvoice(invoiceID uint) error {
-	return r.db.Delete(&models.Invoice{}, invoiceID).Error
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("invoice_id = ?", invoiceID).Delete(&models.InvoiceDocument{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Invoice{}, invoiceID).Error
+	})
+}
+
+// CreateInvoiceEvent добавляет запись в историю счёта
+func (r *Repository) CreateInvoiceEvent(event *models.InvoiceEvent) error {
+	return r.db.Create(event).Error
+}
+
+// GetInvoiceEvents возвращает историю счёта (сначала новые)
+func (r *Repository) GetInvoiceEvents(invoiceID uint) ([]models.InvoiceEvent, error) {
+	var events []models.InvoiceEvent
+	if err := r.db.Where("invoice_id = ?", invoiceID).Order("created_at DESC").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
 }
 
 // CreateInvoiceLine создаёт строку счёта
@@ -506,27 +1013,93 @@ func (r *Repository) CountInvoicesByAccount(accountID uint) (int64, error) {
 
 // GetMaxInvoiceSequence возвращает максимальный глобальный порядковый номер счёта (из формата WH-N)
 func (r *Repository) GetMaxInvoiceSequence() (int64, error) {
+	return maxInvoiceSequence(r.db, "WH"), nil
+}
+
+// maxInvoiceSequence возвращает максимальный номер среди счетов формата {scope}-N
+func maxInvoiceSequence(db *gorm.DB, scope string) int64 {
 	var maxNum int64
-	// Извлекаем число после "WH-" и находим максимум
-	err := r.db.Model(&models.Invoice{}).
-		Select("COALESCE(MAX(CAST(REPLACE(number, 'WH-', '') AS INTEGER)), 0)").
-		Where("number LIKE 'WH-%'").
+	prefix := scope + "-"
+	// Извлекаем число после префикса и находим максимум
+	err := db.Model(&models.Invoice{}).
+		Select(fmt.Sprintf("COALESCE(MAX(CAST(SUBSTRING(number FROM %d) AS INTEGER)), 0)", len(prefix)+1)).
+		Where("number LIKE ?", prefix+"%").
 		Scan(&maxNum).Error
 	if err != nil {
 		// Фоллбэк: считаем общее количество счетов
-		r.db.Model(&models.Invoice{}).Count(&maxNum)
+		db.Model(&models.Invoice{}).Count(&maxNum)
+	}
+	return maxNum
+}
+
+// NextInvoiceSeq атомарно выдаёт следующий номер в области нумерации (строка счётчика
+// блокируется FOR UPDATE до конца транзакции). Первый номер продолжает существующие счета {scope}-N.
+// Номера удалённых счетов повторно не выдаются.
+func (r *Repository) NextInvoiceSeq(scope string) (int64, error) {
+	var next int64
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var seq models.InvoiceSequence
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("scope = ?", scope).First(&seq).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			seq = models.InvoiceSequence{Scope: scope, LastValue: maxInvoiceSequence(tx, scope)}
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&seq).Error; err != nil {
+				return err
+			}
+			// Параллельная транзакция могла создать счётчик раньше — перечитываем под блокировкой
+			err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("scope = ?", scope).First(&seq).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		next = seq.LastValue + 1
+		return tx.Model(&models.InvoiceSequence{}).Where("scope = ?", scope).Update("last_value", next).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+// ClearAllInvoices удаляет все счета вместе со строками и историей
+// одной транзакцией: при ошибке ничего не удаляется
+func (r *Repository) ClearAllInvoices() (*InvoiceDeleteResult, error) {
+	result := &InvoiceDeleteResult{}
+	err := r.WithTransaction(func(tx *Repository) error {
+		// Сначала строки, история, доставки и отправленные PDF счетов
+		steps := []struct {
+			table string
+			count *int64
+		}{
+			{"invoice_lines", &result.InvoiceLines},
+			{"invoice_events", &result.InvoiceEvents},
+			{"invoice_deliveries", &result.InvoiceDeliveries},
+			{"invoice_documents", &result.InvoiceDocuments},
+			{"invoices", &result.Invoices},
+		}
+		for _, step := range steps {
+			res := tx.db.Exec("DELETE FROM " + step.table)
+			if res.Error != nil {
+				return fmt.Errorf("очистка %s: %w", step.table, res.Error)
+			}
+			*step.count = res.RowsAffected
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return maxNum, nil
+	return result, nil
 }
 
-// ClearAllInvoices удаляет все счета и связанные строки
-func (r *Repository) ClearAllInvoices() (int64, error) {
-	// Сначала удаляем строки счетов
-	r.db.Exec("DELETE FROM invoice_lines")
+// InvoiceDeleteResult - количество удалённых записей по таблицам счетов
+type InvoiceDeleteResult struct {
+	Invoices      int64 `json:"invoices"`
+	InvoiceLines  int64 `json:"invoice_lines"`
+	InvoiceEvents int64 `json:"invoice_events"`
 
-	// Удаляем счета
-	result := r.db.Exec("DELETE FROM invoices")
-	return result.RowsAffected, result.Error
+	InvoiceDeliveries int64 `json:"invoice_deliveries"`
+	InvoiceDocuments  int64 `json:"invoice_documents"` // отправленные PDF
 }
 
 // GetInvoicesByPeriod возвращает счета за указанный месяц с опциональной фильтрацией по статусу
@@ -550,16 +1123,58 @@ func (r *Repository) GetInvoicesByPeriod(year, month int, status string) ([]mode
 // GetSnapshotsByAccountAndPeriod возвращает снимки аккаунта за месяц
 func (r *Repository) GetSnapshotsByAccountAndPeriod(accountID uint, year, month int) ([]models.Snapshot, error) {
 	startOfMonth := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
-	endOfMonth := startOfMonth.AddDate(0, 1, 0)
+	return r.GetSnapshotsByAccountAndRange(accountID, startOfMonth, startOfMonth.AddDate(0, 1, -1))
+}
+
+// GetSnapshotsByAccountAndRange возвращает снимки аккаунта с from по to (включительно)
+func (r *Repository) GetSnapshotsByAccountAndRange(accountID uint, from, to time.Time) ([]models.Snapshot, error) {
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
 
 	var snapshots []models.Snapshot
 	if err := r.db.Where("account_id = ? AND snapshot_date >= ? AND snapshot_date < ?",
-		accountID, startOfMonth, endOfMonth).Order("snapshot_date ASC").Find(&snapshots).Error; err != nil {
+		accountID, start, end).Order("snapshot_date ASC").Find(&snapshots).Error; err != nil {
 		return nil, err
 	}
 	return snapshots, nil
 }
 
+// GetDeactivationGraceUnits возвращает по ID снимка сумму долей недавно деактивированных
+// объектов (models.DeactivationGraceWeight) при льготе graceDays. Снимки без детализации
+// объектов (очищена по retention) льготы не получают.
+func (r *Repository) GetDeactivationGraceUnits(snapshots []models.Snapshot, graceDays int) (map[uint]float64, error) {
+	result := make(map[uint]float64)
+	if graceDays <= 0 || len(snapshots) == 0 {
+		return result, nil
+	}
+
+	dates := make(map[uint]time.Time, len(snapshots))
+	ids := make([]uint, 0, len(snapshots))
+	earliest := snapshots[0].SnapshotDate
+	for _, snap := range snapshots {
+		dates[snap.ID] = snap.SnapshotDate
+		ids = append(ids, snap.ID)
+		if snap.SnapshotDate.Before(earliest) {
+			earliest = snap.SnapshotDate
+		}
+	}
+
+	var units []models.SnapshotUnit
+	if err := r.db.Select("snapshot_id, deactivated_at").
+		Where("snapshot_id IN ? AND is_active = ? AND deactivated_at >= ?",
+			ids, false, earliest.AddDate(0, 0, -graceDays)).
+		Find(&units).Error; err != nil {
+		return nil, err
+	}
+	for _, u := range units {
+		if u.DeactivatedAt == nil {
+			continue
+		}
+		result[u.SnapshotID] += models.DeactivationGraceWeight(dates[u.SnapshotID], *u.DeactivatedAt, graceDays)
+	}
+	return result, nil
+}
+
 // GetAccountModules возвращает модули аккаунта
 func (r *Repository) GetAccountModules(accountID uint) ([]models.AccountModule, error) {
 	var modules []models.AccountModule
@@ -573,6 +1188,7 @@ func (r *Repository) GetAccountModules(accountID uint) ([]models.AccountModule,
 
 // AssignModuleBulk привязывает модуль к нескольким аккаунтам
 func (r *Repository) AssignModuleBulk(moduleID uint, accountIDs []uint) (int, error) {
+	defer r.InvalidateSelectedAccounts()
 	var created int
 	for _, accountID := range accountIDs {
 		// Проверяем, не привязан ли уже
@@ -593,14 +1209,91 @@ func (r *Repository) AssignModuleBulk(moduleID uint, accountIDs []uint) (int, er
 	return created, nil
 }
 
+// AccountIDsWithModule возвращает ID аккаунтов, к которым привязан модуль
+func (r *Repository) AccountIDsWithModule(moduleID uint) ([]uint, error) {
+	var ids []uint
+	if err := r.db.Model(&models.AccountModule{}).
+		Where("module_id = ?", moduleID).
+		Pluck("account_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 // UnassignModuleBulk отвязывает модуль от нескольких аккаунтов
 func (r *Repository) UnassignModuleBulk(moduleID uint, accountIDs []uint) (int, error) {
+	defer r.InvalidateSelectedAccounts()
 	result := r.db.Where("module_id = ? AND account_id IN ?", moduleID, accountIDs).Delete(&models.AccountModule{})
 	return int(result.RowsAffected), result.Error
 }
 
+// AccountModulesDiff - изменения модулей аккаунта при массовой установке
+type AccountModulesDiff struct {
+	AccountID uint   `json:"account_id"`
+	Added     []uint `json:"added"`
+	Removed   []uint `json:"removed"`
+	Kept      []uint `json:"kept"`
+}
+
+// SetAccountModulesBulk приводит модули каждого аккаунта ровно к moduleIDs (добавляет недостающие,
+// удаляет лишние) одной транзакцией. Повторный вызов с теми же данными ничего не меняет.
+func (r *Repository) SetAccountModulesBulk(accountIDs, moduleIDs []uint) ([]AccountModulesDiff, error) {
+	wanted := make(map[uint]bool, len(moduleIDs))
+	for _, id := range moduleIDs {
+		wanted[id] = true
+	}
+
+	diffs := make([]AccountModulesDiff, 0, len(accountIDs))
+	err := r.WithTransaction(func(tx *Repository) error {
+		for _, accountID := range accountIDs {
+			var current []models.AccountModule
+			if err := tx.db.Where("account_id = ?", accountID).Order("id ASC").Find(&current).Error; err != nil {
+				return err
+			}
+
+			diff := AccountModulesDiff{AccountID: accountID, Added: []uint{}, Removed: []uint{}, Kept: []uint{}}
+			present := make(map[uint]bool, len(current))
+			var extra []uint // лишние и дубли привязок
+			for _, am := range current {
+				if wanted[am.ModuleID] && !present[am.ModuleID] {
+					present[am.ModuleID] = true
+					diff.Kept = append(diff.Kept, am.ModuleID)
+					continue
+				}
+				extra = append(extra, am.ID)
+				if !wanted[am.ModuleID] {
+					diff.Removed = append(diff.Removed, am.ModuleID)
+				}
+			}
+			if len(extra) > 0 {
+				if err := tx.db.Where("id IN ?", extra).Delete(&models.AccountModule{}).Error; err != nil {
+					return err
+				}
+			}
+
+			for _, moduleID := range moduleIDs {
+				if present[moduleID] {
+					continue
+				}
+				present[moduleID] = true
+				if err := tx.db.Create(&models.AccountModule{AccountID: accountID, ModuleID: moduleID}).Error; err != nil {
+					return err
+				}
+				diff.Added = append(diff.Added, moduleID)
+			}
+			diffs = append(diffs, diff)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
+
 // SetCurrencyBulk устанавливает валюту для нескольких аккаунтов
 func (r *Repository) SetCurrencyBulk(accountIDs []uint, currency string) (int, error) {
+	defer r.InvalidateSelectedAccounts()
 	result := r.db.Model(&models.Account{}).Where("id IN ?", accountIDs).Update("billing_currency", currency)
 	return int(result.RowsAffected), result.Error
 }
@@ -639,6 +1332,44 @@ func (r *Repository) GetAIUsageLogs(days int) ([]models.AIUsageLog, error) {
 	return logs, nil
 }
 
+// AIUsageLogFilter - фильтры логов использования AI (пустые поля не применяются)
+type AIUsageLogFilter struct {
+	Success     *bool
+	RequestType string
+	From        *time.Time // включительно
+	To          *time.Time // не включительно
+}
+
+// GetAIUsageLogsPaginated возвращает логи использования AI постранично (новые первыми)
+func (r *Repository) GetAIUsageLogsPaginated(filter AIUsageLogFilter, page, pageSize int) ([]models.AIUsageLog, int64, error) {
+	query := r.db.Model(&models.AIUsageLog{})
+	if filter.Success != nil {
+		query = query.Where("success = ?", *filter.Success)
+	}
+	if filter.RequestType != "" {
+		query = query.Where("request_type = ?", filter.RequestType)
+	}
+	if filter.From != nil {
+		query = query.Where("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("created_at < ?", *filter.To)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var logs []models.AIUsageLog
+	if err := query.Order("created_at DESC, id DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&logs).Error; err != nil {
+		return nil, 0, err
+	}
+	return logs, total, nil
+}
+
 // CreateAIInsight создаёт AI инсайт
 func (r *Repository) CreateAIInsight(insight *models.AIInsight) error {
 	return r.db.Create(insight).Error
@@ -699,6 +1430,63 @@ func (r *Repository) GetSnapshotForDate(accountID uint, date time.Time) (*models
 	return &snapshot, nil
 }
 
+// GetLatestSnapshotsByAccounts возвращает последний снимок каждого аккаунта
+// одним запросом (без объектов)
+func (r *Repository) GetLatestSnapshotsByAccounts(accountIDs []uint) (map[uint]models.Snapshot, error) {
+	result := make(map[uint]models.Snapshot, len(accountIDs))
+	if len(accountIDs) == 0 {
+		return result, nil
+	}
+
+	var snapshots []models.Snapshot
+	if err := r.db.Raw(`SELECT DISTINCT ON (account_id) * FROM snapshots
+		WHERE account_id IN ? ORDER BY account_id, created_at DESC`, accountIDs).
+		Scan(&snapshots).Error; err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		result[snapshot.AccountID] = snapshot
+	}
+	return result, nil
+}
+
+// GetSnapshotTotalsAsOf возвращает количество объектов по последнему снимку
+// каждого аккаунта не позже указанного дня (одним запросом на все аккаунты)
+func (r *Repository) GetSnapshotTotalsAsOf(accountIDs []uint, date time.Time) (map[uint]int, error) {
+	result := make(map[uint]int, len(accountIDs))
+	if len(accountIDs) == 0 {
+		return result, nil
+	}
+
+	endOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location()).AddDate(0, 0, 1)
+
+	var rows []struct {
+		AccountID  uint
+		TotalUnits int
+	}
+	if err := r.db.Raw(`SELECT DISTINCT ON (account_id) account_id, total_units FROM snapshots
+		WHERE account_id IN ? AND snapshot_date < ? ORDER BY account_id, snapshot_date DESC`,
+		accountIDs, endOfDay).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		result[row.AccountID] = row.TotalUnits
+	}
+	return result, nil
+}
+
+// SumAITokensSince возвращает количество токенов, потраченных с указанного момента
+func (r *Repository) SumAITokensSince(since time.Time) (int, error) {
+	var total int
+	if err := r.db.Model(&models.AIUsageLog{}).
+		Where("created_at >= ?", since).
+		Select("COALESCE(SUM(total_tokens), 0)").
+		Scan(&total).Error; err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
 // CleanupExpiredAIInsights удаляет истёкшие инсайты
 func (r *Repository) CleanupExpiredAIInsights() (int64, error) {
 	result := r.db.Where("expires_at < ?", time.Now()).Delete(&models.AIInsight{})
@@ -725,15 +1513,23 @@ func (r *Repository) SaveDailyCharges(charges []models.DailyCharge) error {
 	}).Create(&charges).Error
 }
 
-// GetDailyCharges возвращает начисления аккаунта за месяц
-func (r *Repository) GetDailyCharges(accountID uint, year, month int) ([]models.DailyCharge, error) {
+// GetDailyCharges возвращает начисления аккаунта за месяц (moduleID > 0 — только по этому модулю).
+// preload — подгрузить модуль и аккаунт (код/единица модуля, реквизиты договора)
+func (r *Repository) GetDailyCharges(accountID, moduleID uint, year, month int, preload bool) ([]models.DailyCharge, error) {
 	startOfMonth := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
 	endOfMonth := startOfMonth.AddDate(0, 1, 0)
 
+	query := r.db.Where("account_id = ? AND charge_date >= ? AND charge_date < ?",
+		accountID, startOfMonth, endOfMonth)
+	if moduleID > 0 {
+		query = query.Where("module_id = ?", moduleID)
+	}
+	if preload {
+		query = query.Preload("Module").Preload("Account")
+	}
+
 	var charges []models.DailyCharge
-	if err := r.db.Where("account_id = ? AND charge_date >= ? AND charge_date < ?",
-		accountID, startOfMonth, endOfMonth).
-		Order("charge_date ASC, module_name ASC").
+	if err := query.Order("charge_date ASC, module_name ASC").
 		Find(&charges).Error; err != nil {
 		return nil, err
 	}
@@ -747,6 +1543,93 @@ func (r *Repository) DeleteDailyCharges(accountID uint, from, to time.Time) erro
 		Delete(&models.DailyCharge{}).Error
 }
 
+// ModuleStats - охват и выручка модуля за месяц
+type ModuleStats struct {
+	ModuleID uint               `json:"module_id"`
+	Name     string             `json:"name"`
+	Code     string             `json:"code"`
+	Accounts int                `json:"accounts"` // аккаунтов с назначенным модулем
+	Units    int                `json:"units"`    // объектов по последнему дню начислений месяца
+	Charges  map[string]float64 `json:"charges"`  // начислено за месяц по валютам
+}
+
+// GetModuleStats возвращает статистику по всем модулям за месяц: назначения из account_modules,
+// объекты и суммы — группировкой daily_charges (без обхода аккаунтов).
+// accountIDs — учитывать только эти аккаунты (nil — все).
+func (r *Repository) GetModuleStats(year, month int, accountIDs []uint) ([]ModuleStats, error) {
+	startOfMonth := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	endOfMonth := startOfMonth.AddDate(0, 1, 0)
+
+	// Фильтр по аккаунтам (группа): (? OR account_id IN ?), пустой список — ни одного аккаунта
+	allAccounts := accountIDs == nil
+	filterIDs := accountIDs
+	if len(filterIDs) == 0 {
+		filterIDs = []uint{0}
+	}
+
+	modules, err := r.GetAllModules()
+	if err != nil {
+		return nil, err
+	}
+
+	var assigned []struct {
+		ModuleID uint
+		Accounts int
+	}
+	if err := r.db.Raw(`SELECT module_id, COUNT(DISTINCT account_id) AS accounts
+		FROM account_modules WHERE (? OR account_id IN ?) GROUP BY module_id`,
+		allAccounts, filterIDs).Scan(&assigned).Error; err != nil {
+		return nil, err
+	}
+
+	// Объекты: последнее начисление месяца по каждой паре аккаунт/модуль, сумма по модулю
+	var units []struct {
+		ModuleID uint
+		Units    int
+	}
+	if err := r.db.Raw(`SELECT module_id, SUM(total_units) AS units FROM (
+			SELECT DISTINCT ON (account_id, module_id) module_id, total_units FROM daily_charges
+			WHERE charge_date >= ? AND charge_date < ? AND (? OR account_id IN ?)
+			ORDER BY account_id, module_id, charge_date DESC
+		) last_charges GROUP BY module_id`, startOfMonth, endOfMonth, allAccounts, filterIDs).Scan(&units).Error; err != nil {
+		return nil, err
+	}
+
+	var charges []struct {
+		ModuleID uint
+		Currency string
+		Total    float64
+	}
+	if err := r.db.Raw(`SELECT module_id, currency, ROUND(SUM(daily_cost)::numeric, 2) AS total
+		FROM daily_charges WHERE charge_date >= ? AND charge_date < ? AND (? OR account_id IN ?)
+		GROUP BY module_id, currency`, startOfMonth, endOfMonth, allAccounts, filterIDs).Scan(&charges).Error; err != nil {
+		return nil, err
+	}
+
+	index := make(map[uint]int, len(modules))
+	stats := make([]ModuleStats, len(modules))
+	for i, m := range modules {
+		index[m.ID] = i
+		stats[i] = ModuleStats{ModuleID: m.ID, Name: m.Name, Code: m.Code, Charges: map[string]float64{}}
+	}
+	for _, row := range assigned {
+		if i, ok := index[row.ModuleID]; ok {
+			stats[i].Accounts = row.Accounts
+		}
+	}
+	for _, row := range units {
+		if i, ok := index[row.ModuleID]; ok {
+			stats[i].Units = row.Units
+		}
+	}
+	for _, row := range charges {
+		if i, ok := index[row.ModuleID]; ok {
+			stats[i].Charges[row.Currency] = row.Total
+		}
+	}
+	return stats, nil
+}
+
 // === Partner Portal ===
 
 // GetAccountByBuyerEmail находит аккаунт по buyer_email
@@ -788,16 +1671,39 @@ func (r *Repository) GetInvoicesByWialonID(wialonID int64) ([]models.Invoice, er
 	return invoices, nil
 }
 
-// GetDailyChargesByWialonID возвращает начисления аккаунта по Wialon ID за месяц
-func (r *Repository) GetDailyChargesByWialonID(wialonID int64, year, month int) ([]models.DailyCharge, error) {
+// GetIssuedInvoicesByWialonIDForYear возвращает выставленные (не черновики) счета аккаунта
+// по Wialon ID за год по периоду счёта
+func (r *Repository) GetIssuedInvoicesByWialonIDForYear(wialonID int64, year int) ([]models.Invoice, error) {
+	start := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, 0)
+
+	var invoices []models.Invoice
+	if err := r.db.Joins("JOIN accounts ON accounts.id = invoices.account_id").
+		Where("accounts.wialon_id = ? AND invoices.status <> ? AND invoices.period >= ? AND invoices.period < ?",
+			wialonID, "draft", start, end).
+		Preload("Account").Preload("Lines").
+		Order("invoices.period ASC, invoices.id ASC").
+		Find(&invoices).Error; err != nil {
+		return nil, err
+	}
+	return invoices, nil
+}
+
+// GetDailyChargesByWialonID возвращает начисления аккаунта по Wialon ID за месяц.
+// preload — подгрузить модуль и аккаунт
+func (r *Repository) GetDailyChargesByWialonID(wialonID int64, year, month int, preload bool) ([]models.DailyCharge, error) {
 	startOfMonth := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
 	endOfMonth := startOfMonth.AddDate(0, 1, 0)
 
-	var charges []models.DailyCharge
-	if err := r.db.Joins("JOIN accounts ON accounts.id = daily_charges.account_id").
+	query := r.db.Joins("JOIN accounts ON accounts.id = daily_charges.account_id").
 		Where("accounts.wialon_id = ? AND daily_charges.charge_date >= ? AND daily_charges.charge_date < ?",
-			wialonID, startOfMonth, endOfMonth).
-		Order("daily_charges.charge_date ASC, daily_charges.module_name ASC").
+			wialonID, startOfMonth, endOfMonth)
+	if preload {
+		query = query.Preload("Module").Preload("Account")
+	}
+
+	var charges []models.DailyCharge
+	if err := query.Order("daily_charges.charge_date ASC, daily_charges.module_name ASC").
 		Find(&charges).Error; err != nil {
 		return nil, err
 	}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// === Retention (очистка устаревших данных) ===
+
+// PurgeSnapshotUnitsBefore удаляет детализацию объектов у снимков раньше cutoff.
+// Сами снимки (агрегаты) остаются.
+func (r *Repository) PurgeSnapshotUnitsBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("snapshot_id IN (?)",
+		r.db.Model(&models.Snapshot{}).Select("id").Where("snapshot_date < ?", cutoff)).
+		Delete(&models.SnapshotUnit{})
+	return result.RowsAffected, result.Error
+}
+
+// PurgeChangesBefore удаляет изменения, обнаруженные раньше cutoff
+func (r *Repository) PurgeChangesBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("detected_at < ?", cutoff).Delete(&models.Change{})
+	return result.RowsAffected, result.Error
+}
+
+// PurgeUnitEventsBefore удаляет события Wialon об объектах, полученные раньше cutoff
+func (r *Repository) PurgeUnitEventsBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("received_at < ?", cutoff).Delete(&models.WialonUnitEvent{})
+	return result.RowsAffected, result.Error
+}
+
+// PurgeAIUsageLogsBefore удаляет логи использования AI раньше cutoff
+func (r *Repository) PurgeAIUsageLogsBefore(cutoff time.Time) (int64, error) {
+	result := r.db.Where("created_at < ?", cutoff).Delete(&models.AIUsageLog{})
+	return result.RowsAffected, result.Error
+}
+
+// PurgeSnapshotsBefore удаляет снимки раньше cutoff вместе с объектами, изменениями и начислениями
+func (r *Repository) PurgeSnapshotsBefore(cutoff time.Time) (*SnapshotDeleteResult, error) {
+	return r.DeleteSnapshotsScoped(0, time.Time{}, cutoff.AddDate(0, 0, -1))
+}
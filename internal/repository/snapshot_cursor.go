@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// === Постраничный обход снимков по курсору ===
+
+// SnapshotCursor - позиция последнего прочитанного снимка: (snapshot_date, id)
+type SnapshotCursor struct {
+	Date time.Time
+	ID   uint
+}
+
+// SnapshotFilter - фильтры выборки снимков (nil — без ограничения)
+type SnapshotFilter struct {
+	From      *time.Time
+	To        *time.Time
+	AccountID *uint
+}
+
+// GetSnapshotsAfter возвращает до limit снимков после курсора (nil — с начала) в порядке
+// (snapshot_date, id). В отличие от GetSnapshotsPaginated не использует OFFSET, поэтому
+// одинаково быстр на любой глубине — для выгрузки и синхронизации всей истории.
+func (r *Repository) GetSnapshotsAfter(cursor *SnapshotCursor, limit int, filter SnapshotFilter) ([]models.Snapshot, error) {
+	query := r.db.Model(&models.Snapshot{})
+	if filter.From != nil {
+		query = query.Where("snapshot_date >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		query = query.Where("snapshot_date <= ?", *filter.To)
+	}
+	if filter.AccountID != nil {
+		query = query.Where("account_id = ?", *filter.AccountID)
+	}
+	if cursor != nil {
+		query = query.Where("(snapshot_date, id) > (?::date, ?)", cursor.Date.Format("2006-01-02"), cursor.ID)
+	}
+
+	var snapshots []models.Snapshot
+	if err := query.Order("snapshot_date ASC, id ASC").
+		Limit(limit).
+		Preload("Account").
+		Find(&snapshots).Error; err != nil {
+		return nil, err
+	}
+
+	if err := r.attachConnections(snapshotAccounts(snapshots)); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// NextSnapshotCursor возвращает курсор для продолжения после последнего снимка страницы (nil — страница пуста)
+func NextSnapshotCursor(snapshots []models.Snapshot) *SnapshotCursor {
+	if len(snapshots) == 0 {
+		return nil
+	}
+	last := snapshots[len(snapshots)-1]
+	return &SnapshotCursor{Date: last.SnapshotDate, ID: last.ID}
+}
@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// GetSnapshotDatesByAccounts возвращает даты (YYYY-MM-DD) существующих снимков аккаунтов за период
+// from..to включительно, сгруппированные по ID аккаунта
+func (r *Repository) GetSnapshotDatesByAccounts(accountIDs []uint, from, to time.Time) (map[uint]map[string]bool, error) {
+	result := make(map[uint]map[string]bool, len(accountIDs))
+	if len(accountIDs) == 0 {
+		return result, nil
+	}
+
+	var rows []struct {
+		AccountID    uint
+		SnapshotDate time.Time
+	}
+	if err := r.db.Model(&models.Snapshot{}).
+		Select("account_id, snapshot_date").
+		Where("account_id IN ? AND snapshot_date >= ? AND snapshot_date <= ?", accountIDs, from, to).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if result[row.AccountID] == nil {
+			result[row.AccountID] = make(map[string]bool)
+		}
+		result[row.AccountID][row.SnapshotDate.UTC().Format("2006-01-02")] = true
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// === Сводка состояния системы ===
+
+// LastSnapshotDate возвращает дату последнего снимка (nil — снимков нет)
+func (r *Repository) LastSnapshotDate() (*time.Time, error) {
+	var last struct{ Date *time.Time }
+	if err := r.db.Model(&models.Snapshot{}).
+		Select("MAX(snapshot_date) AS date").
+		Scan(&last).Error; err != nil {
+		return nil, err
+	}
+	return last.Date, nil
+}
+
+// AccountIDsWithSnapshotOn возвращает множество аккаунтов, у которых есть снимок за дату
+func (r *Repository) AccountIDsWithSnapshotOn(date time.Time) (map[uint]bool, error) {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	var ids []uint
+	if err := r.db.Model(&models.Snapshot{}).
+		Where("snapshot_date = ?", day).
+		Pluck("account_id", &ids).Error; err != nil {
+		return nil, err
+	}
+	result := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		result[id] = true
+	}
+	return result, nil
+}
+
+// GetLatestExchangeRates возвращает последний сохранённый курс по каждой валюте
+func (r *Repository) GetLatestExchangeRates() ([]models.ExchangeRate, error) {
+	var rates []models.ExchangeRate
+	if err := r.db.Raw(`SELECT DISTINCT ON (currency_from) *
+		FROM exchange_rates
+		ORDER BY currency_from, rate_date DESC, id DESC`).
+		Scan(&rates).Error; err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
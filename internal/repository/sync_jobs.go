@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// === Фоновая синхронизация аккаунтов ===
+
+// CreateSyncJob создаёт задачу синхронизации
+func (r *Repository) CreateSyncJob(job *models.SyncJob) error {
+	return r.db.Create(job).Error
+}
+
+// UpdateSyncJob сохраняет прогресс и итог задачи синхронизации
+func (r *Repository) UpdateSyncJob(job *models.SyncJob) error {
+	return r.db.Save(job).Error
+}
+
+// GetSyncJob возвращает задачу синхронизации по ID
+func (r *Repository) GetSyncJob(id uint) (*models.SyncJob, error) {
+	var job models.SyncJob
+	if err := r.db.First(&job, id).Error; err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetActiveSyncJob возвращает незавершённую задачу синхронизации (nil — такой нет)
+func (r *Repository) GetActiveSyncJob() (*models.SyncJob, error) {
+	var job models.SyncJob
+	err := r.db.Where("status IN ?", []string{models.SyncJobPending, models.SyncJobRunning}).
+		Order("id DESC").First(&job).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FailInterruptedSyncJobs помечает прерванными задачи, оставшиеся незавершёнными после
+// перезапуска сервера (горутина синхронизации жила только в прошлом процессе)
+func (r *Repository) FailInterruptedSyncJobs() (int64, error) {
+	now := time.Now()
+	res := r.db.Model(&models.SyncJob{}).
+		Where("status IN ?", []string{models.SyncJobPending, models.SyncJobRunning}).
+		Updates(map[string]interface{}{
+			"status":      models.SyncJobFailed,
+			"error":       "Синхронизация прервана перезапуском сервера",
+			"finished_at": now,
+		})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// === События Wialon об объектах ===
+
+// Статусы сверки событий для фильтра списка
+const (
+	UnitEventStatusPending    = "pending"    // ещё не сверено со снимком
+	UnitEventStatusReconciled = "reconciled" // снимок подтвердил событие
+	UnitEventStatusMismatch   = "mismatch"   // снимок не подтвердил событие
+)
+
+// UnitEventFilter - фильтры списка событий (пустые поля не применяются)
+type UnitEventFilter struct {
+	AccountWialonID *int64
+	WialonUnitID    *int64
+	Status          string
+}
+
+// CreateUnitEvents сохраняет принятые события одной вставкой
+func (r *Repository) CreateUnitEvents(events []models.WialonUnitEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return r.db.Create(&events).Error
+}
+
+// GetPendingUnitEvents возвращает несверенные события аккаунта (по bact) до until в порядке наступления
+func (r *Repository) GetPendingUnitEvents(accountWialonID int64, until time.Time) ([]models.WialonUnitEvent, error) {
+	var events []models.WialonUnitEvent
+	if err := r.db.Where("account_wialon_id = ? AND reconciled_at IS NULL AND occurred_at <= ?", accountWialonID, until).
+		Order("occurred_at ASC, id ASC").
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// MarkUnitEventsReconciled отмечает события сверенными со снимком; mismatches — ID событий,
+// не подтверждённых снимком, с пояснением
+func (r *Repository) MarkUnitEventsReconciled(snapshotID uint, eventIDs []uint, mismatches map[uint]string) error {
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.WialonUnitEvent{}).Where("id IN ?", eventIDs).
+			Updates(map[string]interface{}{"snapshot_id": snapshotID, "reconciled_at": now}).Error; err != nil {
+			return err
+		}
+		for id, note := range mismatches {
+			if err := tx.Model(&models.WialonUnitEvent{}).Where("id = ?", id).
+				Updates(map[string]interface{}{"mismatch": true, "note": note}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetUnitEventsPaginated возвращает события по фильтрам, новые сверху
+func (r *Repository) GetUnitEventsPaginated(page, pageSize int, filter UnitEventFilter) ([]models.WialonUnitEvent, int64, error) {
+	query := r.db.Model(&models.WialonUnitEvent{})
+	if filter.AccountWialonID != nil {
+		query = query.Where("account_wialon_id = ?", *filter.AccountWialonID)
+	}
+	if filter.WialonUnitID != nil {
+		query = query.Where("wialon_unit_id = ?", *filter.WialonUnitID)
+	}
+	switch filter.Status {
+	case UnitEventStatusPending:
+		query = query.Where("reconciled_at IS NULL")
+	case UnitEventStatusReconciled:
+		query = query.Where("reconciled_at IS NOT NULL AND mismatch = ?", false)
+	case UnitEventStatusMismatch:
+		query = query.Where("mismatch = ?", true)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var events []models.WialonUnitEvent
+	if err := query.Order("occurred_at DESC, id DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&events).Error; err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
+
+// GetUnitAccountWialonIDs возвращает bact объектов по последнему снимку, в котором каждый был,
+// одним запросом. Объектов, не встречавшихся в снимках, в карте нет.
+func (r *Repository) GetUnitAccountWialonIDs(wialonUnitIDs []int64) (map[int64]int64, error) {
+	result := make(map[int64]int64, len(wialonUnitIDs))
+	if len(wialonUnitIDs) == 0 {
+		return result, nil
+	}
+
+	var units []models.SnapshotUnit
+	if err := r.db.Raw(`SELECT DISTINCT ON (wialon_unit_id) wialon_unit_id, account_id
+		FROM snapshot_units WHERE wialon_unit_id IN ?
+		ORDER BY wialon_unit_id, id DESC`, wialonUnitIDs).Scan(&units).Error; err != nil {
+		return nil, err
+	}
+	for _, u := range units {
+		result[u.WialonUnitID] = u.AccountID
+	}
+	return result, nil
+}
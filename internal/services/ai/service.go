@@ -2,15 +2,19 @@ package ai
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/user/wialon-billing-api/internal/models"
 	"github.com/user/wialon-billing-api/internal/repository"
 	"golang.org/x/time/rate"
+	"gorm.io/gorm"
 )
 
 // escapeJSON экранирует строку для безопасной вставки в JSON
@@ -30,8 +34,28 @@ type Service struct {
 	rateLimiter *rate.Limiter
 	settings    *models.AISettings
 	mu          sync.RWMutex
+
+	// Признак выполняющегося пакетного анализа (защита от параллельных запусков)
+	analysisRunning atomic.Bool
 }
 
+// ErrAnalysisRunning - пакетный анализ уже выполняется
+var ErrAnalysisRunning = errors.New("анализ уже выполняется")
+
+// Ошибки анализа одного аккаунта
+var (
+	ErrAIDisabled      = errors.New("AI сервис отключён")
+	ErrRateLimited     = errors.New("превышен лимит запросов к AI")
+	ErrBudgetExceeded  = errors.New("исчерпан суточный бюджет токенов AI")
+	ErrAccountNotFound = errors.New("аккаунт не найден")
+	ErrNoSnapshot      = errors.New("у аккаунта нет снимков для анализа")
+	ErrInvalidResponse = errors.New("не удалось разобрать ответ AI")
+)
+
+// maxAnalysisDuration - предельная длительность пакетного анализа,
+// если вызывающий не задал свой дедлайн (меньше интервала между запусками cron)
+const maxAnalysisDuration = 20 * time.Hour
+
 // NewService создаёт новый сервис AI
 func NewService(repo *repository.Repository) *Service {
 	return &Service{
@@ -94,10 +118,20 @@ func (s *Service) updateRateLimiter(requestsPerHour int) {
 	}
 	interval := time.Hour / time.Duration(requestsPerHour)
 	// Burst = requestsPerHour чтобы сразу можно было делать запросы
-	s.rateLimiter = rate.NewLimiter(rate.Every(interval), requestsPerHour)
+	limiter := rate.NewLimiter(rate.Every(interval), requestsPerHour)
+	s.mu.Lock()
+	s.rateLimiter = limiter
+	s.mu.Unlock()
 	log.Printf("[AI] Rate limiter обновлён: %d запросов/час", requestsPerHour)
 }
 
+// limiter возвращает текущий лимитер запросов
+func (s *Service) limiter() *rate.Limiter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rateLimiter
+}
+
 // IsEnabled проверяет, активен ли AI сервис
 func (s *Service) IsEnabled() bool {
 	s.mu.RLock()
@@ -163,38 +197,98 @@ func (s *Service) GetSupportModel() string {
 	return ModelChatV3
 }
 
-// AnalyzeAccount анализирует изменения для одного аккаунта
+// AnalyzeAccount анализирует изменения для одного аккаунта с учётом суточного бюджета
+// токенов и лимита запросов (ErrBudgetExceeded, ErrRateLimited)
 func (s *Service) AnalyzeAccount(ctx context.Context, account *models.Account, currentSnapshot *models.Snapshot) (*models.AIInsight, error) {
 	if !s.IsEnabled() {
-		return nil, fmt.Errorf("AI сервис отключён")
+		return nil, ErrAIDisabled
+	}
+
+	// Суточный бюджет токенов (UTC)
+	if settings := s.GetSettings(); settings != nil && settings.DailyTokenBudget > 0 {
+		now := time.Now().UTC()
+		spent, err := s.repo.SumAITokensSince(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			return nil, err
+		}
+		if spent >= settings.DailyTokenBudget {
+			return nil, fmt.Errorf("%w (%d из %d)", ErrBudgetExceeded, spent, settings.DailyTokenBudget)
+		}
 	}
 
 	// Проверяем rate limit
-	if !s.rateLimiter.Allow() {
-		return nil, fmt.Errorf("превышен лимит запросов к AI")
+	if !s.limiter().Allow() {
+		return nil, ErrRateLimited
 	}
 
 	// Получаем данные для сравнения
-	snapshot7dAgo, _ := s.repo.GetSnapshotForDate(account.ID, time.Now().AddDate(0, 0, -7))
-	snapshot30dAgo, _ := s.repo.GetSnapshotForDate(account.ID, time.Now().AddDate(0, 0, -30))
+	history := accountHistory{}
+	if snapshot7dAgo, _ := s.repo.GetSnapshotForDate(account.ID, time.Now().AddDate(0, 0, -7)); snapshot7dAgo != nil {
+		history.units7dAgo = snapshot7dAgo.TotalUnits
+	}
+	if snapshot30dAgo, _ := s.repo.GetSnapshotForDate(account.ID, time.Now().AddDate(0, 0, -30)); snapshot30dAgo != nil {
+		history.units30dAgo = snapshot30dAgo.TotalUnits
+	}
+
+	insight, _, err := s.analyzeAccount(ctx, account, currentSnapshot, history, s.loadPricing())
+	return insight, err
+}
+
+// AnalyzeAccountByID синхронно анализирует один аккаунт по его последнему снимку
+// (ручной запуск для отладки промптов): возвращает созданный инсайт или точную ошибку
+func (s *Service) AnalyzeAccountByID(ctx context.Context, accountID uint) (*models.AIInsight, error) {
+	if !s.IsEnabled() {
+		return nil, ErrAIDisabled
+	}
+
+	account, err := s.repo.GetAccountByID(accountID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	units7dAgo := 0
-	units30dAgo := 0
-	if snapshot7dAgo != nil {
-		units7dAgo = snapshot7dAgo.TotalUnits
+	latest, err := s.repo.GetLatestSnapshotsByAccounts([]uint{account.ID})
+	if err != nil {
+		return nil, err
 	}
-	if snapshot30dAgo != nil {
-		units30dAgo = snapshot30dAgo.TotalUnits
+	snapshot, ok := latest[account.ID]
+	if !ok {
+		return nil, ErrNoSnapshot
 	}
 
-	// Получаем настройки биллинга для цены
-	billingSettings, _ := s.repo.GetSettings()
-	unitPrice := 1.0
-	currency := "EUR"
-	if billingSettings != nil {
-		unitPrice = billingSettings.UnitPrice
-		currency = billingSettings.Currency
+	return s.AnalyzeAccount(ctx, account, &snapshot)
+}
+
+// accountHistory - количество объектов аккаунта 7 и 30 дней назад
+type accountHistory struct {
+	units7dAgo  int
+	units30dAgo int
+}
+
+// analysisPricing - цена объекта для промпта
+type analysisPricing struct {
+	unitPrice float64
+	currency  string
+}
+
+// loadPricing получает цену объекта из настроек биллинга
+func (s *Service) loadPricing() analysisPricing {
+	pricing := analysisPricing{unitPrice: 1.0, currency: "EUR"}
+	if billingSettings, _ := s.repo.GetSettings(); billingSettings != nil {
+		pricing.unitPrice = billingSettings.UnitPrice
+		pricing.currency = billingSettings.Currency
 	}
+	return pricing
+}
+
+// analyzeAccount запрашивает AI по подготовленным данным и сохраняет инсайт.
+// Возвращает инсайт и количество потраченных токенов; rate limit проверяет вызывающий.
+func (s *Service) analyzeAccount(ctx context.Context, account *models.Account, currentSnapshot *models.Snapshot,
+	history accountHistory, pricing analysisPricing) (*models.AIInsight, int, error) {
+	units7dAgo, units30dAgo := history.units7dAgo, history.units30dAgo
+	unitPrice, currency := pricing.unitPrice, pricing.currency
 
 	// Формируем промпт
 	userPrompt := fmt.Sprintf(AnalyticsUserPromptTemplate,
@@ -214,7 +308,7 @@ func (s *Service) AnalyzeAccount(ctx context.Context, account *models.Account, c
 	if err != nil {
 		// Логируем ошибку
 		s.logUsage("analyze", 0, 0, 0, false, err.Error())
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Логируем успешный запрос
@@ -229,7 +323,7 @@ func (s *Service) AnalyzeAccount(ctx context.Context, account *models.Account, c
 		}
 		if err != nil {
 			log.Printf("[AI] Не удалось распарсить JSON для %s: %v", account.Name, err)
-			return nil, err
+			return nil, result.TotalTokens, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
 		}
 	}
 
@@ -263,10 +357,10 @@ func (s *Service) AnalyzeAccount(ctx context.Context, account *models.Account, c
 
 	// Сохраняем инсайт
 	if err := s.repo.CreateAIInsight(insight); err != nil {
-		return nil, err
+		return nil, result.TotalTokens, err
 	}
 
-	return insight, nil
+	return insight, result.TotalTokens, nil
 }
 
 // GetActiveInsights возвращает активные инсайты
@@ -284,6 +378,11 @@ func (s *Service) SendFeedback(insightID uint, helpful bool, comment string) err
 	return s.repo.UpdateAIInsightFeedback(insightID, helpful, comment)
 }
 
+// CleanupExpiredInsights удаляет истёкшие инсайты и возвращает их количество
+func (s *Service) CleanupExpiredInsights() (int64, error) {
+	return s.repo.CleanupExpiredAIInsights()
+}
+
 // GetUsageStats возвращает статистику использования
 func (s *Service) GetUsageStats(days int) (*UsageStats, error) {
 	logs, err := s.repo.GetAIUsageLogs(days)
@@ -307,6 +406,11 @@ func (s *Service) GetUsageStats(days int) (*UsageStats, error) {
 	return stats, nil
 }
 
+// GetUsageLogs возвращает отдельные записи лога использования (с текстом ошибок)
+func (s *Service) GetUsageLogs(filter repository.AIUsageLogFilter, page, pageSize int) ([]models.AIUsageLog, int64, error) {
+	return s.repo.GetAIUsageLogsPaginated(filter, page, pageSize)
+}
+
 // UsageStats - статистика использования AI
 type UsageStats struct {
 	TotalRequests      int `json:"total_requests"`
@@ -332,10 +436,40 @@ func (s *Service) logUsage(requestType string, input, output, total int, success
 	}
 }
 
-// AnalyzeLatestSnapshots анализирует последние снимки (вызывается из cron)
-func (s *Service) AnalyzeLatestSnapshots(ctx context.Context) error {
+// AnalysisSummary - итог пакетного анализа аккаунтов
+type AnalysisSummary struct {
+	Total      int       `json:"total"`
+	Analyzed   int       `json:"analyzed"`
+	Skipped    int       `json:"skipped"`  // нет снимков
+	Failed     int       `json:"failed"`   // ошибка AI или сохранения
+	Deferred   int       `json:"deferred"` // не хватило лимита запросов, токенов или времени
+	TokensUsed int       `json:"tokens_used"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// Без заметных изменений — не анализировались (analyze_only_changed)
+	Unchanged int `json:"unchanged"`
+}
+
+// AnalyzeLatestSnapshots анализирует последние снимки (вызывается из cron).
+// Аккаунты обрабатываются пакетами по подключению Wialon: данные за 7/30 дней
+// для пакета выбираются заранее, инсайты сохраняются по мере анализа.
+// При исчерпании лимита запросов анализ ждёт, пока не выйдет время или бюджет токенов.
+func (s *Service) AnalyzeLatestSnapshots(ctx context.Context) (*AnalysisSummary, error) {
+	summary := &AnalysisSummary{StartedAt: time.Now()}
 	if !s.IsEnabled() {
-		return nil
+		return summary, nil
+	}
+
+	if !s.analysisRunning.CompareAndSwap(false, true) {
+		return nil, ErrAnalysisRunning
+	}
+	defer s.analysisRunning.Store(false)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxAnalysisDuration)
+		defer cancel()
 	}
 
 	log.Println("[AI] Запуск анализа последних снимков...")
@@ -343,34 +477,150 @@ func (s *Service) AnalyzeLatestSnapshots(ctx context.Context) error {
 	// Получаем аккаунты с биллингом
 	accounts, err := s.repo.GetSelectedAccounts()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	summary.Total = len(accounts)
 
-	analyzed := 0
-	for _, account := range accounts {
-		// Проверяем rate limit
-		if !s.rateLimiter.Allow() {
-			log.Printf("[AI] Rate limit достигнут, проанализировано %d аккаунтов", analyzed)
-			break
+	// Бюджет токенов на сутки (UTC) и отбор аккаунтов с изменениями
+	budget := 0
+	onlyChanged, threshold := false, 1
+	if settings := s.GetSettings(); settings != nil {
+		budget = settings.DailyTokenBudget
+		onlyChanged = settings.AnalyzeOnlyChanged
+		if settings.ChangeThresholdUnits > 0 {
+			threshold = settings.ChangeThresholdUnits
+		}
+	}
+	spent := 0
+	if budget > 0 {
+		now := time.Now().UTC()
+		spent, err = s.repo.SumAITokensSince(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	pricing := s.loadPricing()
+	batches := groupAccountsByConnection(accounts)
+	stopped := false
 
-		// Получаем последний снимок
-		snapshot, err := s.repo.GetLastSnapshot(account.ID)
-		if err != nil || snapshot == nil {
+	for _, batch := range batches {
+		if stopped {
+			summary.Deferred += len(batch)
 			continue
 		}
 
-		// Анализируем
-		_, err = s.AnalyzeAccount(ctx, &account, snapshot)
+		ids := make([]uint, len(batch))
+		for i, account := range batch {
+			ids[i] = account.ID
+		}
+
+		// Данные пакета одним проходом: последний снимок и объекты 7/30 дней назад
+		latest, err := s.repo.GetLatestSnapshotsByAccounts(ids)
 		if err != nil {
-			log.Printf("[AI] Ошибка анализа аккаунта %s: %v", account.Name, err)
-			continue
+			return summary, err
+		}
+		now := time.Now()
+		totals7d, err := s.repo.GetSnapshotTotalsAsOf(ids, now.AddDate(0, 0, -7))
+		if err != nil {
+			return summary, err
+		}
+		totals30d, err := s.repo.GetSnapshotTotalsAsOf(ids, now.AddDate(0, 0, -30))
+		if err != nil {
+			return summary, err
+		}
+
+		for i := range batch {
+			account := &batch[i]
+			if stopped {
+				summary.Deferred++
+				continue
+			}
+
+			snapshot, ok := latest[account.ID]
+			if !ok {
+				summary.Skipped++
+				continue
+			}
+
+			history := accountHistory{units7dAgo: totals7d[account.ID], units30dAgo: totals30d[account.ID]}
+			if onlyChanged && !hasNotableChange(&snapshot, history, threshold) {
+				summary.Unchanged++
+				continue
+			}
+
+			if budget > 0 && spent >= budget {
+				log.Printf("[AI] Исчерпан суточный бюджет токенов (%d из %d)", spent, budget)
+				stopped = true
+				summary.Deferred++
+				continue
+			}
+
+			if err := s.limiter().Wait(ctx); err != nil {
+				log.Printf("[AI] Анализ остановлен по лимиту запросов: %v", err)
+				stopped = true
+				summary.Deferred++
+				continue
+			}
+
+			_, tokens, err := s.analyzeAccount(ctx, account, &snapshot, history, pricing)
+			spent += tokens
+			summary.TokensUsed += tokens
+			if err != nil {
+				log.Printf("[AI] Ошибка анализа аккаунта %s: %v", account.Name, err)
+				summary.Failed++
+				continue
+			}
+			summary.Analyzed++
 		}
-		analyzed++
 	}
 
-	log.Printf("[AI] Анализ завершён, обработано %d аккаунтов", analyzed)
-	return nil
+	summary.FinishedAt = time.Now()
+	log.Printf("[AI] Анализ завершён: проанализировано %d, пропущено %d, без изменений %d, ошибок %d, отложено %d из %d (токенов: %d)",
+		summary.Analyzed, summary.Skipped, summary.Unchanged, summary.Failed, summary.Deferred, summary.Total, summary.TokensUsed)
+	return summary, nil
+}
+
+// hasNotableChange проверяет, есть ли у аккаунта изменения не меньше порога: добавленные,
+// удалённые или деактивированные объекты в последнем снимке либо разница с количеством 7 дней назад
+func hasNotableChange(snapshot *models.Snapshot, history accountHistory, threshold int) bool {
+	if snapshot.UnitsCreated >= threshold || snapshot.UnitsDeleted >= threshold || snapshot.UnitsDeactivated >= threshold {
+		return true
+	}
+	delta := snapshot.TotalUnits - history.units7dAgo
+	if delta < 0 {
+		delta = -delta
+	}
+	return delta >= threshold
+}
+
+// IsAnalysisRunning сообщает, выполняется ли сейчас пакетный анализ
+func (s *Service) IsAnalysisRunning() bool {
+	return s.analysisRunning.Load()
+}
+
+// groupAccountsByConnection разбивает аккаунты на пакеты по подключению Wialon
+func groupAccountsByConnection(accounts []models.Account) [][]models.Account {
+	groups := make(map[uint][]models.Account)
+	for _, account := range accounts {
+		var connectionID uint
+		if account.ConnectionID != nil {
+			connectionID = *account.ConnectionID
+		}
+		groups[connectionID] = append(groups[connectionID], account)
+	}
+
+	keys := make([]uint, 0, len(groups))
+	for id := range groups {
+		keys = append(keys, id)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	batches := make([][]models.Account, 0, len(keys))
+	for _, id := range keys {
+		batches = append(batches, groups[id])
+	}
+	return batches
 }
 
 // === Анализ трендов флота ===
@@ -569,7 +819,7 @@ func (s *Service) AnalyzeFleetTrends(ctx context.Context, days int) (*FleetAnaly
 	}
 
 	// Проверяем rate limit
-	if !s.rateLimiter.Allow() {
+	if !s.limiter().Allow() {
 		// Возвращаем данные без AI анализа
 		return result, nil
 	}
@@ -6,11 +6,14 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net"
 	"net/smtp"
-	"net/textproto"
+	"sort"
 	"strings"
 	"time"
 
@@ -53,20 +56,84 @@ type Attachment struct {
 	Data        []byte
 }
 
+// DefaultMaxAttachmentsSize - лимит суммарного размера вложений по умолчанию (20 МБ)
+const DefaultMaxAttachmentsSize = 20 << 20
+
+// ErrAttachmentsTooLarge - суммарный размер вложений превышает лимит
+var ErrAttachmentsTooLarge = errors.New("суммарный размер вложений превышает лимит")
+
+// ErrTemplateDisabled - шаблон письма выключен (is_active = false): письма этого типа не отправляются
+var ErrTemplateDisabled = errors.New("шаблон письма отключён")
+
 // Service - сервис отправки email
 type Service struct {
-	repo *repository.Repository
+	repo               *repository.Repository
+	maxAttachmentsSize int64  // байт, <= 0 — без лимита
+	testRecipient      string // тестовый режим: все письма уходят на этот адрес (пусто — выключен)
 }
 
 // NewService создаёт новый email-сервис
 func NewService(repo *repository.Repository) *Service {
-	return &Service{repo: repo}
+	return &Service{repo: repo, maxAttachmentsSize: DefaultMaxAttachmentsSize}
 }
 
-// SendOTP отправляет OTP-код на email используя шаблон "otp"
-func (s *Service) SendOTP(to, code string) error {
-	tmpl, err := s.repo.GetEmailTemplateByType("otp")
+// SetMaxAttachmentsSize задаёт лимит суммарного размера вложений в байтах (<= 0 — без лимита)
+func (s *Service) SetMaxAttachmentsSize(size int64) {
+	s.maxAttachmentsSize = size
+}
+
+// SetTestMode включает тестовый режим: все письма перенаправляются на recipient,
+// в теме указывается исходный получатель. Пустой recipient — режим выключен.
+func (s *Service) SetTestMode(recipient string) {
+	s.testRecipient = recipient
+	if recipient != "" {
+		log.Printf("[EMAIL] Тестовый режим: все письма будут отправляться на %s", recipient)
+	}
+}
+
+// checkAttachmentsSize проверяет суммарный размер вложений до подключения к SMTP
+func (s *Service) checkAttachmentsSize(attachments []Attachment) error {
+	if s.maxAttachmentsSize <= 0 {
+		return nil
+	}
+	var total int64
+	for _, att := range attachments {
+		total += int64(len(att.Data))
+	}
+	if total > s.maxAttachmentsSize {
+		return fmt.Errorf("%w: %.1f МБ при допустимых %.1f МБ (%d влож.)", ErrAttachmentsTooLarge,
+			float64(total)/(1<<20), float64(s.maxAttachmentsSize)/(1<<20), len(attachments))
+	}
+	return nil
+}
+
+// activeTemplate возвращает шаблон письма по типу. nil без ошибки — шаблона нет или он не
+// загрузился (используется текст по умолчанию); выключенный шаблон — ErrTemplateDisabled.
+func (s *Service) activeTemplate(templateType string) (*models.EmailTemplate, error) {
+	tmpl, err := s.repo.GetEmailTemplateByType(templateType)
 	if err != nil || tmpl == nil {
+		return nil, nil
+	}
+	if !tmpl.IsActive {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateDisabled, templateType)
+	}
+	return tmpl, nil
+}
+
+// IsTemplateActive сообщает, отправляются ли письма типа templateType (шаблон не выключен)
+func (s *Service) IsTemplateActive(templateType string) bool {
+	_, err := s.activeTemplate(templateType)
+	return err == nil
+}
+
+// SendOTP отправляет OTP-код на email используя шаблон "otp".
+// Выключенный шаблон — ErrTemplateDisabled (код не отправляется).
+func (s *Service) SendOTP(to, code string) error {
+	tmpl, err := s.activeTemplate("otp")
+	if err != nil {
+		return err
+	}
+	if tmpl == nil {
 		// Если шаблон не найден — используем простой текст
 		subject := fmt.Sprintf("Код авторизации: %s", code)
 		body := fmt.Sprintf("<p>Ваш код авторизации: <strong>%s</strong></p><p>Код действителен 5 минут.</p>", code)
@@ -84,18 +151,28 @@ func (s *Service) SendOTP(to, code string) error {
 	return s.send(to, subject, body)
 }
 
-// formatPeriodRu форматирует дату как "за февраль 2026"
-func formatPeriodRu(t time.Time) string {
+// formatPeriodRu форматирует период как "февраль 2026" (календарный месяц)
+// или "15.01.2026 — 14.02.2026" (расчётный цикл не по месяцу)
+func formatPeriodRu(start, end time.Time) string {
+	if !models.IsCalendarMonth(start, end) {
+		return fmt.Sprintf("%s — %s", start.Format("02.01.2006"), end.Format("02.01.2006"))
+	}
 	months := []string{
 		"", "январь", "февраль", "март", "апрель", "май", "июнь",
 		"июль", "август", "сентябрь", "октябрь", "ноябрь", "декабрь",
 	}
-	return fmt.Sprintf("%s %d", months[t.Month()], t.Year())
+	return fmt.Sprintf("%s %d", months[start.Month()], start.Year())
 }
 
-// SendInvoice отправляет счёт с PDF-вложением и дополнительными вложениями
+// SendInvoice отправляет счёт с PDF-вложением и дополнительными вложениями.
+// Выключенный шаблон "invoice" — ErrTemplateDisabled, письмо не отправляется.
 func (s *Service) SendInvoice(to string, invoice *models.Invoice, pdfData []byte, extraAttachments ...Attachment) error {
-	periodStr := formatPeriodRu(invoice.Period)
+	return s.SendInvoiceWithNote(to, invoice, pdfData, "", extraAttachments...)
+}
+
+// SendInvoiceWithNote отправляет счёт с примечанием над текстом письма (например, при повторной отправке)
+func (s *Service) SendInvoiceWithNote(to string, invoice *models.Invoice, pdfData []byte, note string, extraAttachments ...Attachment) error {
+	periodStr := formatPeriodRu(invoice.PeriodRange())
 
 	// Номер счёта: если есть Number — используем его, иначе ID
 	invoiceNumber := invoice.Number
@@ -121,12 +198,15 @@ func (s *Service) SendInvoice(to string, invoice *models.Invoice, pdfData []byte
 	allAttachments := []Attachment{pdfAttachment}
 	allAttachments = append(allAttachments, extraAttachments...)
 
-	tmpl, err := s.repo.GetEmailTemplateByType("invoice")
-	if err != nil || tmpl == nil {
+	tmpl, err := s.activeTemplate("invoice")
+	if err != nil {
+		return err
+	}
+	if tmpl == nil {
 		// Фоллбэк без шаблона
 		subject := fmt.Sprintf("Счёт на оплату №%s за %s", invoiceNumber, periodStr)
 		body := fmt.Sprintf("<p>Во вложении счёт на оплату на сумму %.2f %s.</p>", invoice.TotalAmount, invoice.Currency)
-		return s.sendWithAttachments(to, subject, body, allAttachments...)
+		return s.sendWithAttachments(to, subject, noteHTML(note)+body, allAttachments...)
 	}
 
 	vars := map[string]string{
@@ -141,13 +221,75 @@ func (s *Service) SendInvoice(to string, invoice *models.Invoice, pdfData []byte
 
 	subject := renderTemplate(tmpl.Subject, vars)
 	body := renderTemplate(tmpl.HTMLBody, vars)
-	return s.sendWithAttachments(to, subject, body, allAttachments...)
+	return s.sendWithAttachments(to, subject, noteHTML(note)+body, allAttachments...)
+}
+
+// noteHTML оформляет примечание к письму (пустое — пустая строка)
+func noteHTML(note string) string {
+	note = strings.TrimSpace(note)
+	if note == "" {
+		return ""
+	}
+	return fmt.Sprintf("<p><i>%s</i></p>", strings.ReplaceAll(html.EscapeString(note), "\n", "<br>"))
+}
+
+// SendMonthlySummary отправляет партнёру итоги закрытого месяца по шаблону "monthly_summary":
+// среднее активных объектов и начисления по валютам; сам счёт приходит отдельным письмом.
+// Выключенный шаблон — ErrTemplateDisabled, письмо не отправляется.
+func (s *Service) SendMonthlySummary(to string, account *models.Account, period time.Time, avgUnits float64, charges map[string]float64) error {
+	periodStr := formatPeriodRu(models.MonthRange(period))
+
+	currencies := make([]string, 0, len(charges))
+	for currency := range charges {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	totals := make([]string, 0, len(currencies))
+	for _, currency := range currencies {
+		totals = append(totals, fmt.Sprintf("%.2f %s", charges[currency], currency))
+	}
+	chargesTotal := strings.Join(totals, ", ")
+	if chargesTotal == "" {
+		chargesTotal = "0.00"
+	}
+
+	senderCompanyName := ""
+	if settings, err := s.repo.GetSettings(); err == nil && settings != nil {
+		senderCompanyName = settings.CompanyName
+	}
+
+	tmpl, err := s.activeTemplate("monthly_summary")
+	if err != nil {
+		return err
+	}
+	if tmpl == nil {
+		subject := fmt.Sprintf("Итоги за %s", periodStr)
+		body := fmt.Sprintf("<p>Среднее активных объектов: %.2f</p><p>Начислено: %s</p><p>Счёт за период будет направлен отдельным письмом.</p>",
+			avgUnits, html.EscapeString(chargesTotal))
+		return s.send(to, subject, body)
+	}
+
+	vars := map[string]string{
+		"company_name":        account.Name,
+		"sender_company_name": senderCompanyName,
+		"period":              periodStr,
+		"avg_units":           fmt.Sprintf("%.2f", avgUnits),
+		"charges_total":       chargesTotal,
+	}
+
+	subject := renderTemplate(tmpl.Subject, vars)
+	body := renderTemplate(tmpl.HTMLBody, vars)
+	return s.send(to, subject, body)
 }
 
-// SendNotification отправляет уведомление
+// SendNotification отправляет уведомление.
+// Выключенный шаблон "notification" — ErrTemplateDisabled, письмо не отправляется.
 func (s *Service) SendNotification(to, title, message string) error {
-	tmpl, err := s.repo.GetEmailTemplateByType("notification")
-	if err != nil || tmpl == nil {
+	tmpl, err := s.activeTemplate("notification")
+	if err != nil {
+		return err
+	}
+	if tmpl == nil {
 		return s.send(to, title, fmt.Sprintf("<p>%s</p>", message))
 	}
 
@@ -249,11 +391,25 @@ func (s *Service) connectAndAuth(settings *models.SMTPSettings, password string)
 	return client, nil
 }
 
-// dial устанавливает TCP-соединение, создаёт SMTP-клиент и делает STARTTLS
+// dial устанавливает соединение и создаёт SMTP-клиент: при неявном TLS (порт 465 или
+// tls_mode implicit) подключается сразу по TLS, иначе по TCP с последующим STARTTLS
 func (s *Service) dial(addr string, settings *models.SMTPSettings) (*smtp.Client, error) {
-	conn, err := net.DialTimeout("tcp", addr, 10e9)
-	if err != nil {
-		return nil, fmt.Errorf("не удалось подключиться к SMTP %s: %w", addr, err)
+	implicit := settings.ImplicitTLS()
+	tlsConfig := &tls.Config{ServerName: settings.Host}
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if implicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось подключиться к SMTP %s по TLS: %w", addr, err)
+		}
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("не удалось подключиться к SMTP %s: %w", addr, err)
+		}
 	}
 
 	client, err := smtp.NewClient(conn, settings.Host)
@@ -262,8 +418,7 @@ func (s *Service) dial(addr string, settings *models.SMTPSettings) (*smtp.Client
 		return nil, fmt.Errorf("ошибка SMTP клиента: %w", err)
 	}
 
-	if settings.UseTLS {
-		tlsConfig := &tls.Config{ServerName: settings.Host}
+	if !implicit && settings.UseTLS {
 		if err := client.StartTLS(tlsConfig); err != nil {
 			client.Close()
 			return nil, fmt.Errorf("ошибка STARTTLS: %w", err)
@@ -275,6 +430,10 @@ func (s *Service) dial(addr string, settings *models.SMTPSettings) (*smtp.Client
 
 // sendWithAttachments отправляет письмо с опциональными вложениями
 func (s *Service) sendWithAttachments(to, subject, htmlBody string, attachments ...Attachment) error {
+	if err := s.checkAttachmentsSize(attachments); err != nil {
+		return err
+	}
+
 	settings, err := s.repo.GetSMTPSettings()
 	if err != nil || settings == nil {
 		return fmt.Errorf("SMTP не настроен")
@@ -302,6 +461,13 @@ func (s *Service) sendWithAttachments(to, subject, htmlBody string, attachments
 func (s *Service) sendMessage(client *smtp.Client, settings *models.SMTPSettings, to, subject, htmlBody string, attachments []Attachment) error {
 	from := settings.FromEmail
 
+	// Тестовый режим: реальные получатели письма не получают
+	if s.testRecipient != "" {
+		log.Printf("[EMAIL] Тестовый режим: письмо для %s перенаправлено на %s", to, s.testRecipient)
+		subject = fmt.Sprintf("[TEST → %s] %s", to, subject)
+		to = s.testRecipient
+	}
+
 	if err := client.Mail(from); err != nil {
 		return fmt.Errorf("ошибка MAIL FROM: %w", err)
 	}
@@ -315,71 +481,88 @@ func (s *Service) sendMessage(client *smtp.Client, settings *models.SMTPSettings
 	}
 	defer w.Close()
 
+	message := buildMessage(settings.FromName, from, to, subject, htmlBody, attachments)
+
+	_, err = w.Write(message)
+	if err != nil {
+		return fmt.Errorf("ошибка записи данных: %w", err)
+	}
+
+	log.Printf("[EMAIL] Письмо отправлено на %s: %s", to, subject)
+	return nil
+}
+
+// buildMessage формирует MIME-сообщение: простое HTML-письмо
+// или multipart/mixed с HTML-частью и вложениями
+func buildMessage(fromName, from, to, subject, htmlBody string, attachments []Attachment) []byte {
 	var buf bytes.Buffer
 
+	buf.WriteString(fmt.Sprintf("From: %s <%s>\r\n", fromName, from))
+	buf.WriteString(fmt.Sprintf("To: %s\r\n", to))
+	buf.WriteString(fmt.Sprintf("Subject: =?utf-8?B?%s?=\r\n", base64.StdEncoding.EncodeToString([]byte(subject))))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
 	if len(attachments) == 0 {
 		// Простое HTML-письмо
-		buf.WriteString(fmt.Sprintf("From: %s <%s>\r\n", settings.FromName, from))
-		buf.WriteString(fmt.Sprintf("To: %s\r\n", to))
-		buf.WriteString(fmt.Sprintf("Subject: =?utf-8?B?%s?=\r\n", base64.StdEncoding.EncodeToString([]byte(subject))))
-		buf.WriteString("MIME-Version: 1.0\r\n")
 		buf.WriteString("Content-Type: text/html; charset=\"utf-8\"\r\n")
 		buf.WriteString("\r\n")
 		buf.WriteString(htmlBody)
-	} else {
-		// MIME с вложениями
-		writer := multipart.NewWriter(&buf)
-		boundary := writer.Boundary()
-
-		buf.Reset()
-		buf.WriteString(fmt.Sprintf("From: %s <%s>\r\n", settings.FromName, from))
-		buf.WriteString(fmt.Sprintf("To: %s\r\n", to))
-		buf.WriteString(fmt.Sprintf("Subject: =?utf-8?B?%s?=\r\n", base64.StdEncoding.EncodeToString([]byte(subject))))
-		buf.WriteString("MIME-Version: 1.0\r\n")
-		buf.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary))
-		buf.WriteString("\r\n")
+		return buf.Bytes()
+	}
+
+	// MIME с вложениями
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	buf.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\r\n", boundary))
+	buf.WriteString("\r\n")
 
-		// HTML-часть
+	// HTML-часть
+	buf.WriteString(fmt.Sprintf("--%s\r\n", boundary))
+	buf.WriteString("Content-Type: text/html; charset=\"utf-8\"\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(htmlBody)
+	buf.WriteString("\r\n")
+
+	// Вложения — заголовки в фиксированном порядке
+	for _, att := range attachments {
+		filename := encodeFilename(att.Filename)
 		buf.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-		buf.WriteString("Content-Type: text/html; charset=\"utf-8\"\r\n")
-		buf.WriteString("\r\n")
-		buf.WriteString(htmlBody)
+		buf.WriteString(fmt.Sprintf("Content-Type: %s; name=\"%s\"\r\n", att.ContentType, filename))
+		buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+		buf.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=\"%s\"\r\n", filename))
 		buf.WriteString("\r\n")
+		writeBase64Lines(&buf, att.Data)
+	}
 
-		// Вложения
-		for _, att := range attachments {
-			header := make(textproto.MIMEHeader)
-			header.Set("Content-Type", att.ContentType)
-			header.Set("Content-Transfer-Encoding", "base64")
-			header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", att.Filename))
-
-			buf.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-			for k, v := range header {
-				buf.WriteString(fmt.Sprintf("%s: %s\r\n", k, v[0]))
-			}
-			buf.WriteString("\r\n")
-			// RFC 2045: base64 строки должны быть не длиннее 76 символов
-			encoded := base64.StdEncoding.EncodeToString(att.Data)
-			for i := 0; i < len(encoded); i += 76 {
-				end := i + 76
-				if end > len(encoded) {
-					end = len(encoded)
-				}
-				buf.WriteString(encoded[i:end])
-				buf.WriteString("\r\n")
-			}
-		}
+	buf.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
+	return buf.Bytes()
+}
 
-		buf.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
-	}
+// encodeFilename готовит имя вложения для заголовка: кавычки и переводы строк заменяются,
+// не-ASCII имя (кириллица) кодируется по RFC 2047 (=?utf-8?b?...?=) — так его понимают почтовые клиенты
+func encodeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '"', '\\', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+	return mime.BEncoding.Encode("utf-8", name)
+}
 
-	_, err = w.Write(buf.Bytes())
-	if err != nil {
-		return fmt.Errorf("ошибка записи данных: %w", err)
+// writeBase64Lines пишет данные в base64 строками по 76 символов с CRLF (RFC 2045) —
+// строгие SMTP-серверы отклоняют более длинные строки и одиночные LF
+func writeBase64Lines(buf *bytes.Buffer, data []byte) {
+	const lineLen = 76
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for i := 0; i < len(encoded); i += lineLen {
+		end := i + lineLen
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		buf.WriteString(encoded[i:end])
+		buf.WriteString("\r\n")
 	}
-
-	log.Printf("[EMAIL] Письмо отправлено на %s: %s", to, subject)
-	return nil
 }
 
 // renderTemplate заменяет {{переменные}} в шаблоне на значения
@@ -0,0 +1,139 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestBuildMessageMultipart(t *testing.T) {
+	pdf := bytes.Repeat([]byte("%PDF-1.4 счёт "), 200)
+	excel := bytes.Repeat([]byte{0x50, 0x4b, 0x03, 0x04, 0xff}, 300)
+	attachments := []Attachment{
+		{Filename: "invoice_WH-1.pdf", ContentType: "application/pdf", Data: pdf},
+		{Filename: "Начисления ТОО «Тест».xlsx", ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Data: excel},
+	}
+	htmlBody := "<p>Во вложении счёт на оплату.</p>"
+
+	raw := buildMessage("Биллинг", "billing@example.kz", "client@example.kz", "Счёт №WH-1", htmlBody, attachments)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	var dec mime.WordDecoder
+	if subject, err := dec.DecodeHeader(msg.Header.Get("Subject")); err != nil || subject != "Счёт №WH-1" {
+		t.Errorf("Subject = %q (%v)", subject, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q (%v)", mediaType, err)
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		t.Fatal("нет boundary")
+	}
+	if !bytes.Contains(raw, []byte("\r\n--"+boundary+"--\r\n")) {
+		t.Error("нет закрывающего boundary")
+	}
+
+	reader := multipart.NewReader(msg.Body, boundary)
+
+	// HTML-часть
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("HTML-часть: %v", err)
+	}
+	if ct := part.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type HTML-части = %q", ct)
+	}
+	if body, _ := io.ReadAll(part); strings.TrimSpace(string(body)) != htmlBody {
+		t.Errorf("HTML = %q", body)
+	}
+
+	// Вложения в исходном порядке
+	for i, want := range attachments {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("вложение %d: %v", i, err)
+		}
+		if enc := part.Header.Get("Content-Transfer-Encoding"); enc != "base64" {
+			t.Errorf("вложение %d: Content-Transfer-Encoding = %q", i, enc)
+		}
+		ct, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || ct != want.ContentType {
+			t.Errorf("вложение %d: Content-Type = %q (%v)", i, ct, err)
+		}
+
+		filename, err := dec.DecodeHeader(part.FileName())
+		if err != nil || filename != want.Filename {
+			t.Errorf("вложение %d: filename = %q (%v), ожидалось %q", i, filename, err, want.Filename)
+		}
+		if want.Filename != "invoice_WH-1.pdf" && !strings.HasPrefix(part.FileName(), "=?utf-8?b?") {
+			t.Errorf("вложение %d: кириллическое имя не закодировано по RFC 2047: %q", i, part.FileName())
+		}
+
+		encoded, _ := io.ReadAll(part)
+		lines := strings.Split(strings.TrimSuffix(string(encoded), "\r\n"), "\r\n")
+		for n, line := range lines {
+			if len(line) > 76 || strings.Contains(line, "\n") {
+				t.Errorf("вложение %d: строка %d длиной %d или с одиночным LF", i, n, len(line))
+				break
+			}
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+		if err != nil {
+			t.Fatalf("вложение %d: base64: %v", i, err)
+		}
+		if !bytes.Equal(data, want.Data) {
+			t.Errorf("вложение %d: данные не совпадают (%d байт вместо %d)", i, len(data), len(want.Data))
+		}
+	}
+
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("лишняя часть после вложений: %v", err)
+	}
+}
+
+func TestBuildMessageWithoutAttachments(t *testing.T) {
+	raw := buildMessage("Биллинг", "billing@example.kz", "client@example.kz", "Код", "<p>1234</p>", nil)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if ct, _, _ := mime.ParseMediaType(msg.Header.Get("Content-Type")); ct != "text/html" {
+		t.Errorf("Content-Type = %q, ожидалось text/html", ct)
+	}
+	if body, _ := io.ReadAll(msg.Body); string(body) != "<p>1234</p>" {
+		t.Errorf("тело = %q", body)
+	}
+}
+
+func TestCheckAttachmentsSize(t *testing.T) {
+	attachments := []Attachment{
+		{Filename: "a.pdf", Data: make([]byte, 600)},
+		{Filename: "b.xlsx", Data: make([]byte, 500)},
+	}
+
+	s := &Service{}
+	s.SetMaxAttachmentsSize(1000)
+	if err := s.checkAttachmentsSize(attachments); !errors.Is(err, ErrAttachmentsTooLarge) {
+		t.Errorf("1100 байт при лимите 1000: %v, ожидалась ErrAttachmentsTooLarge", err)
+	}
+	if err := s.checkAttachmentsSize(attachments[:1]); err != nil {
+		t.Errorf("600 байт при лимите 1000: %v", err)
+	}
+
+	s.SetMaxAttachmentsSize(0)
+	if err := s.checkAttachmentsSize(attachments); err != nil {
+		t.Errorf("без лимита: %v", err)
+	}
+}
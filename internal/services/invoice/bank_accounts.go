@@ -0,0 +1,33 @@
+package invoice
+
+import "github.com/user/wialon-billing-api/internal/models"
+
+// SelectBankAccount выбирает банковские реквизиты для счёта в валюте currency:
+// счёт поставщика в этой валюте → счёт по умолчанию → реквизиты банка из настроек
+func SelectBankAccount(settings *models.BillingSettings, currency string) models.SupplierBankAccount {
+	var byCurrency, fallback *models.SupplierBankAccount
+	for i := range settings.BankAccounts {
+		acc := &settings.BankAccounts[i]
+		if acc.Currency == currency && (byCurrency == nil || acc.IsDefault) {
+			byCurrency = acc
+		}
+		if acc.IsDefault && fallback == nil {
+			fallback = acc
+		}
+	}
+	if byCurrency != nil {
+		return *byCurrency
+	}
+	if fallback != nil {
+		return *fallback
+	}
+
+	return models.SupplierBankAccount{
+		Currency:    currency,
+		BankName:    settings.BankName,
+		IIK:         settings.BankIIK,
+		BIK:         settings.BankBIK,
+		Kbe:         settings.BankKbe,
+		PaymentCode: settings.PaymentCode,
+	}
+}
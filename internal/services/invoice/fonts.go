@@ -0,0 +1,53 @@
+package invoice
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pdfFonts - шрифты счёта с кириллицей: стиль fpdf → файл в папке шрифтов
+var pdfFonts = []struct{ Style, File string }{
+	{"", "Arial.ttf"},
+	{"B", "Arial Bold.ttf"},
+	{"I", "Arial Italic.ttf"},
+}
+
+// resolveFontsDir возвращает абсолютный путь к папке шрифтов. Пустой dir — fonts рядом
+// с бинарником, а если её нет (go run) — fonts в рабочей папке.
+func resolveFontsDir(dir string) (string, error) {
+	if dir == "" {
+		dir = "fonts"
+		if exe, err := os.Executable(); err == nil {
+			if exe, err = filepath.EvalSymlinks(exe); err == nil {
+				if candidate := filepath.Join(filepath.Dir(exe), "fonts"); isDir(candidate) {
+					dir = candidate
+				}
+			}
+		}
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("папка шрифтов PDF %s: %w", dir, err)
+	}
+
+	var missing []string
+	for _, f := range pdfFonts {
+		if info, err := os.Stat(filepath.Join(abs, f.File)); err != nil || info.IsDir() {
+			missing = append(missing, f.File)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("в папке шрифтов PDF %s нет файлов: %s (задайте pdf.fonts_dir или FONTS_DIR)",
+			abs, strings.Join(missing, ", "))
+	}
+	return abs, nil
+}
+
+// isDir проверяет, что путь существует и это папка
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
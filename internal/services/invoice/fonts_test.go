@@ -0,0 +1,74 @@
+package invoice
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// copyFonts копирует шрифты счёта из fonts/ репозитория в dir
+func copyFonts(t *testing.T, dir string) {
+	t.Helper()
+	for _, f := range pdfFonts {
+		data, err := os.ReadFile(filepath.Join("..", "..", "..", "fonts", f.File))
+		if err != nil {
+			t.Fatalf("чтение шрифта %s: %v", f.File, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.File), data, 0o644); err != nil {
+			t.Fatalf("запись шрифта %s: %v", f.File, err)
+		}
+	}
+}
+
+func TestGenerateInvoicePDFFromTempFontsDir(t *testing.T) {
+	dir := t.TempDir()
+	copyFonts(t, dir)
+
+	resolved, err := resolveFontsDir(dir)
+	if err != nil {
+		t.Fatalf("resolveFontsDir: %v", err)
+	}
+	if resolved != dir {
+		t.Errorf("resolveFontsDir = %q, ожидалось %q", resolved, dir)
+	}
+
+	generator := NewPDFGenerator(dir, nil)
+	invoice := &models.Invoice{
+		Number:      "WH-0001",
+		Period:      time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		TotalAmount: 1000,
+		Currency:    "KZT",
+		Status:      "draft",
+	}
+	pdf, err := generator.GenerateInvoicePDF(invoice, &models.BillingSettings{}, &models.Account{Name: "ТОО Тест"}, WatermarkFor(invoice))
+	if err != nil {
+		t.Fatalf("GenerateInvoicePDF: %v", err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF")) {
+		t.Errorf("результат не PDF: %q", pdf[:min(len(pdf), 16)])
+	}
+}
+
+func TestResolveFontsDirMissingFonts(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := resolveFontsDir(dir); err == nil {
+		t.Fatal("resolveFontsDir: ожидалась ошибка для папки без шрифтов")
+	} else {
+		for _, f := range pdfFonts {
+			if !strings.Contains(err.Error(), f.File) {
+				t.Errorf("ошибка не называет %s: %v", f.File, err)
+			}
+		}
+	}
+
+	generator := NewPDFGenerator(dir, nil)
+	if _, err := generator.GenerateInvoicePDF(&models.Invoice{}, &models.BillingSettings{}, &models.Account{}, ""); err == nil {
+		t.Error("GenerateInvoicePDF: ожидалась ошибка без шрифтов")
+	}
+}
@@ -0,0 +1,99 @@
+package invoice
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// Forecast - прогноз счёта на конец месяца по снимкам
+type Forecast struct {
+	AccountID      uint                 `json:"account_id"`
+	Year           int                  `json:"year"`
+	Month          int                  `json:"month"`
+	Currency       string               `json:"currency"`
+	DaysWithData   int                  `json:"days_with_data"`
+	DaysInMonth    int                  `json:"days_in_month"`
+	AvgActiveUnits float64              `json:"avg_active_units"`
+	RateDate       string               `json:"rate_date"`
+	Lines          []models.InvoiceLine `json:"lines"`
+	Subtotal       float64              `json:"subtotal"`
+	VATAmount      float64              `json:"vat_amount"`
+	ProjectedTotal float64              `json:"projected_total"`
+	Confidence     string               `json:"confidence"` // low, medium, high
+	Note           string               `json:"note"`
+}
+
+// ForecastForAccount прогнозирует сумму счёта за месяц: среднее активных объектов
+// по имеющимся снимкам экстраполируется на весь месяц, цены — по последнему известному курсу
+func (s *Service) ForecastForAccount(accountID uint, year, month int) (*Forecast, error) {
+	account, err := s.repo.GetAccountByID(accountID)
+	if err != nil {
+		return nil, fmt.Errorf("аккаунт %d не найден: %w", accountID, err)
+	}
+
+	accountModules, err := s.repo.GetAccountModules(account.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	avgUnits, daysWithData, err := s.calculateAverageUnitsWithDays(account.ID, account.BillingEndDate, year, month, true)
+	if err != nil {
+		return nil, err
+	}
+
+	targetCurrency := account.BillingCurrency
+	if targetCurrency == "" {
+		targetCurrency = s.defaultCurrency
+	}
+
+	// Последний известный курс на сегодня (или на конец месяца, если он уже прошёл)
+	daysInMonth := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	rateDate := time.Now().UTC()
+	if monthEnd := time.Date(year, time.Month(month), daysInMonth, 0, 0, 0, 0, time.UTC); monthEnd.Before(rateDate) {
+		rateDate = monthEnd
+	}
+
+	lines, subtotal := s.buildInvoiceLines(accountModules, avgUnits, targetCurrency,
+		func(amount float64, from, to string) (float64, error) {
+			result, _, _, err := s.convertWithRates(amount, from, to, rateDate, true)
+			return result, err
+		})
+
+	vatAmount, total, _ := s.applyVAT(lines, subtotal, account)
+
+	forecast := &Forecast{
+		AccountID:      account.ID,
+		Year:           year,
+		Month:          month,
+		Currency:       targetCurrency,
+		DaysWithData:   daysWithData,
+		DaysInMonth:    daysInMonth,
+		AvgActiveUnits: math.Round(avgUnits*100) / 100,
+		RateDate:       rateDate.Format("2006-01-02"),
+		Lines:          lines,
+		Subtotal:       s.RoundAmount(subtotal, targetCurrency),
+		VATAmount:      vatAmount,
+		ProjectedTotal: total,
+	}
+
+	// Оценка надёжности прогноза по доле дней с данными
+	switch {
+	case daysWithData == 0:
+		forecast.Confidence = "low"
+		forecast.Note = "Нет снимков за период — прогноз учитывает только фиксированные модули"
+	case daysWithData*3 < daysInMonth:
+		forecast.Confidence = "low"
+		forecast.Note = fmt.Sprintf("Данные за %d из %d дней — прогноз ориентировочный", daysWithData, daysInMonth)
+	case daysWithData*3 < daysInMonth*2:
+		forecast.Confidence = "medium"
+		forecast.Note = fmt.Sprintf("Данные за %d из %d дней", daysWithData, daysInMonth)
+	default:
+		forecast.Confidence = "high"
+		forecast.Note = fmt.Sprintf("Данные за %d из %d дней", daysWithData, daysInMonth)
+	}
+
+	return forecast, nil
+}
@@ -0,0 +1,67 @@
+package invoice
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/png"
+	"strings"
+)
+
+// Ограничения изображений подписи и печати в настройках
+const (
+	MaxSignatureImageBytes = 1 << 20 // 1 МБ после декодирования
+	MaxSignatureImageSide  = 2000    // пикселей по ширине и высоте
+)
+
+// pngSignature - первые 8 байт любого PNG-файла
+var pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+// decodeBase64PNG декодирует Base64 (с data URI префиксом или без) и проверяет,
+// что это PNG, который сможет вставить генератор PDF
+func decodeBase64PNG(base64Data string) ([]byte, error) {
+	// Убираем data URI префикс если есть (data:image/png;base64,...)
+	if idx := strings.Index(base64Data, ","); idx >= 0 {
+		base64Data = base64Data[idx+1:]
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(base64Data))
+	if err != nil {
+		return nil, errors.New("некорректный Base64")
+	}
+	if len(data) > MaxSignatureImageBytes {
+		return nil, fmt.Errorf("размер %d КБ превышает %d КБ", len(data)/1024, MaxSignatureImageBytes/1024)
+	}
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("файл не является PNG")
+	}
+
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("повреждённый PNG: %v", err)
+	}
+	if cfg.Width > MaxSignatureImageSide || cfg.Height > MaxSignatureImageSide {
+		return nil, fmt.Errorf("размер %dx%d превышает %dx%d пикселей",
+			cfg.Width, cfg.Height, MaxSignatureImageSide, MaxSignatureImageSide)
+	}
+
+	// IHDR: байт 24 — глубина цвета, байт 28 — чересстрочность; fpdf поддерживает
+	// только 8 бит без чересстрочной развёртки
+	if len(data) > 28 {
+		if data[24] > 8 {
+			return nil, fmt.Errorf("глубина цвета %d бит не поддерживается, сохраните PNG с 8 битами", data[24])
+		}
+		if data[28] != 0 {
+			return nil, errors.New("чересстрочный PNG не поддерживается, сохраните без interlace")
+		}
+	}
+
+	return data, nil
+}
+
+// ValidateBase64PNG проверяет изображение подписи или печати перед сохранением
+func ValidateBase64PNG(base64Data string) error {
+	_, err := decodeBase64PNG(base64Data)
+	return err
+}
@@ -0,0 +1,125 @@
+package invoice
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// NumberLocale - разделители чисел в счёте
+type NumberLocale struct {
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+	Thousands string `json:"thousands"` // разделитель разрядов
+	Decimal   string `json:"decimal"`   // десятичный разделитель
+}
+
+// DefaultLocale - русский/казахский формат: 1 234,56
+const DefaultLocale = "ru"
+
+// NumberLocales - доступные форматы чисел, первый — по умолчанию
+var NumberLocales = []NumberLocale{
+	{Code: DefaultLocale, Name: "Русский (1 234,56)", Thousands: " ", Decimal: ","},
+	{Code: "en", Name: "English (1,234.56)", Thousands: ",", Decimal: "."},
+}
+
+// IsValidLocale проверяет код локали
+func IsValidLocale(code string) bool {
+	for _, l := range NumberLocales {
+		if l.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveLocale выбирает формат чисел: учётная запись → настройки биллинга → русский.
+// Неизвестный код считается пустым.
+func ResolveLocale(settings *models.BillingSettings, account *models.Account) NumberLocale {
+	var codes []string
+	if account != nil {
+		codes = append(codes, account.Locale)
+	}
+	if settings != nil {
+		codes = append(codes, settings.Locale)
+	}
+	for _, code := range codes {
+		for _, l := range NumberLocales {
+			if code != "" && l.Code == code {
+				return l
+			}
+		}
+	}
+	return NumberLocales[0]
+}
+
+// formatNumber форматирует число с decimals знаками после разделителя и группировкой разрядов
+func formatNumber(value float64, decimals int, loc NumberLocale) string {
+	sign := ""
+	if value < 0 {
+		sign = "-"
+		value = -value
+	}
+
+	scale := int64(math.Pow10(decimals))
+	scaled := roundScaled(value, decimals)
+	whole := scaled / scale
+	frac := scaled % scale
+	if scaled == 0 {
+		sign = ""
+	}
+
+	str := fmt.Sprintf("%d", whole)
+	var b strings.Builder
+	n := len(str)
+	for i, c := range str {
+		if i > 0 && (n-i)%3 == 0 {
+			b.WriteString(loc.Thousands)
+		}
+		b.WriteRune(c)
+	}
+	if decimals <= 0 {
+		return sign + b.String()
+	}
+	return fmt.Sprintf("%s%s%s%0*d", sign, b.String(), loc.Decimal, decimals, frac)
+}
+
+// roundScaled округляет неотрицательное value до decimals знаков и возвращает его в единицах
+// последнего знака (1234.565, 2 → 123457). Половина округляется вверх по десятичной записи числа:
+// 999.995 в двоичном виде чуть меньше 999.995, и math.Round(value*100) дал бы 999.99.
+func roundScaled(value float64, decimals int) int64 {
+	str := strconv.FormatFloat(value, 'f', -1, 64)
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	if len(intPart)+decimals > 18 {
+		// За пределами int64 десятичная запись не нужна — такие суммы не выставляются
+		return int64(math.Round(value * math.Pow10(decimals)))
+	}
+
+	roundUp := len(fracPart) > decimals && fracPart[decimals] >= '5'
+	if len(fracPart) > decimals {
+		fracPart = fracPart[:decimals]
+	}
+	fracPart += strings.Repeat("0", decimals-len(fracPart))
+
+	scaled, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return int64(math.Round(value * math.Pow10(decimals)))
+	}
+	if roundUp {
+		scaled++
+	}
+	return scaled
+}
+
+// formatQuantity форматирует количество (например: 970,350 или 1 000,000)
+func formatQuantity(qty float64, loc NumberLocale) string {
+	return formatNumber(qty, 3, loc)
+}
+
+// formatMoney форматирует сумму с точностью валюты (например: 1 234,56 или 1,234.56)
+func (g *PDFGenerator) formatMoney(amount float64, currency string, loc NumberLocale) string {
+	return formatNumber(amount, g.precision.CurrencyPrecision(currency), loc)
+}
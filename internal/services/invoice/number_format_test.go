@@ -0,0 +1,56 @@
+package invoice
+
+import "testing"
+
+func TestFormatNumber(t *testing.T) {
+	ru := NumberLocales[0]
+	en := NumberLocales[1]
+
+	tests := []struct {
+		value    float64
+		decimals int
+		loc      NumberLocale
+		want     string
+	}{
+		// Русский формат: пробел между разрядами, запятая
+		{0, 2, ru, "0,00"},
+		{1234.56, 2, ru, "1 234,56"},
+		{-1234.56, 2, ru, "-1 234,56"},
+		{999.995, 2, ru, "1 000,00"},
+		{-999.995, 2, ru, "-1 000,00"},
+		{0.004, 2, ru, "0,00"},
+		{-0.004, 2, ru, "0,00"},
+		{1234567.891, 2, ru, "1 234 567,89"},
+		{-12345678.9, 2, ru, "-12 345 678,90"},
+		{1234567, 0, ru, "1 234 567"},
+		{970.35, 3, ru, "970,350"},
+
+		// Английский формат: запятая между разрядами, точка
+		{0, 2, en, "0.00"},
+		{1234.56, 2, en, "1,234.56"},
+		{-1234.56, 2, en, "-1,234.56"},
+		{999.995, 2, en, "1,000.00"},
+		{9999999.999, 2, en, "10,000,000.00"},
+		{1234567.891, 2, en, "1,234,567.89"},
+		{-1234567, 0, en, "-1,234,567"},
+		{1234.5, 0, en, "1,235"},
+		{0.0005, 3, en, "0.001"},
+	}
+	for _, tt := range tests {
+		if got := formatNumber(tt.value, tt.decimals, tt.loc); got != tt.want {
+			t.Errorf("formatNumber(%v, %d, %s) = %q, ожидалось %q", tt.value, tt.decimals, tt.loc.Code, got, tt.want)
+		}
+	}
+}
+
+func TestFormatMoneyUsesCurrencyPrecision(t *testing.T) {
+	g := &PDFGenerator{precision: NewPrecision(map[string]int{"JPY": 0})}
+	ru := NumberLocales[0]
+
+	if got := g.formatMoney(1234567.5, "jpy", ru); got != "1 234 568" {
+		t.Errorf("formatMoney JPY = %q, ожидалось %q", got, "1 234 568")
+	}
+	if got := g.formatMoney(1234567.5, "KZT", ru); got != "1 234 567,50" {
+		t.Errorf("formatMoney KZT = %q, ожидалось %q", got, "1 234 567,50")
+	}
+}
@@ -2,10 +2,9 @@ package invoice
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"io"
-	"math"
+	"log"
 	"strings"
 	"time"
 
@@ -14,17 +13,23 @@ import (
 )
 
 // PDFGenerator - генератор PDF счетов
-type PDFGenerator struct{}
+type PDFGenerator struct {
+	fontsDir  string    // абсолютный путь к папке шрифтов
+	fontsErr  error     // папка не найдена или в ней нет шрифтов
+	precision Precision // знаков после запятой в суммах по валютам
+}
 
-// NewPDFGenerator создаёт новый генератор
-func NewPDFGenerator() *PDFGenerator {
-	return &PDFGenerator{}
+// NewPDFGenerator создаёт генератор со шрифтами из fontsDir (pdf.fonts_dir / FONTS_DIR; пусто —
+// папка по умолчанию) и точностью сумм precision (как у сервиса счетов).
+// Папка проверяется один раз; без шрифтов генерация возвращает ошибку.
+func NewPDFGenerator(fontsDir string, precision Precision) *PDFGenerator {
+	dir, err := resolveFontsDir(fontsDir)
+	return &PDFGenerator{fontsDir: dir, fontsErr: err, precision: precision}
 }
 
-// getFontsPath возвращает путь к папке шрифтов
-func getFontsPath() string {
-	// Библиотека fpdf обрезает первый слеш, добавляем два
-	return "//Users/com/bill_wialon/wialon-billing-api/fonts"
+// FontsDir возвращает папку шрифтов или ошибку, если шрифтов нет
+func (g *PDFGenerator) FontsDir() (string, error) {
+	return g.fontsDir, g.fontsErr
 }
 
 // russianMonth возвращает название месяца на русском в родительном падеже
@@ -70,25 +75,57 @@ func formatDateRussian(t time.Time) string {
 	return fmt.Sprintf("%d %s %d г.", t.Day(), russianMonth(t.Month()), t.Year())
 }
 
-// GenerateInvoicePDF генерирует PDF счёта по образцу казахстанского «Счёт на оплату»
-func (g *PDFGenerator) GenerateInvoicePDF(invoice *models.Invoice, settings *models.BillingSettings, account *models.Account) ([]byte, error) {
-	pdf := fpdf.New("P", "mm", "A4", "")
+// DraftWatermark - водяной знак неокончательного счёта (черновик, предпросмотр)
+const DraftWatermark = "ЧЕРНОВИК"
+
+// WatermarkFor возвращает водяной знак для счёта: черновик помечается DraftWatermark,
+// выставленные счета выводятся без знака
+func WatermarkFor(invoice *models.Invoice) string {
+	if invoice.Status == "draft" {
+		return DraftWatermark
+	}
+	return ""
+}
+
+// GenerateInvoicePDF генерирует PDF счёта по образцу казахстанского «Счёт на оплату».
+// Непустой watermark выводится на каждой странице светлой надписью по диагонали.
+// Без шрифтов возвращается ошибка — PDF без кириллицы не формируется.
+func (g *PDFGenerator) GenerateInvoicePDF(invoice *models.Invoice, settings *models.BillingSettings, account *models.Account, watermark string) ([]byte, error) {
+	dir, err := g.FontsDir()
+	if err != nil {
+		return nil, err
+	}
+	pdf := fpdf.New("P", "mm", "A4", dir)
 	pdf.SetMargins(10, 10, 10)
-	pdf.AddPage()
 
 	// Шрифты с поддержкой кириллицы — Arial как в образце
-	fontRegular := "./fonts/Arial.ttf"
-	fontBold := "./fonts/Arial Bold.ttf"
-	fontItalic := "./fonts/Arial Italic.ttf"
-	pdf.AddUTF8Font("Arial", "", fontRegular)
-	pdf.AddUTF8Font("Arial", "B", fontBold)
-	pdf.AddUTF8Font("Arial", "I", fontItalic)
+	for _, f := range pdfFonts {
+		pdf.AddUTF8Font("Arial", f.Style, f.File)
+	}
+	if err := pdf.Error(); err != nil {
+		return nil, fmt.Errorf("ошибка загрузки шрифтов PDF из %s: %w", dir, err)
+	}
+
+	// Водяной знак рисуется при открытии каждой страницы — под содержимым
+	if watermark != "" {
+		pdf.SetHeaderFuncMode(func() { g.drawWatermark(pdf, watermark) }, true)
+	}
+	pdf.AddPage()
+
+	// Необязательные блоки определяются шаблоном учётной записи или настроек
+	tmpl := ResolvePDFTemplate(settings, account)
+	// Разделители чисел — по локали учётной записи или настроек
+	loc := ResolveLocale(settings, account)
 
 	// Предупреждение об условиях оплаты
-	g.drawPaymentNotice(pdf)
+	if tmpl.PaymentNotice {
+		g.drawPaymentNotice(pdf)
+	}
 
 	// Блок «Образец платёжного поручения»
-	g.drawPaymentOrder(pdf, settings)
+	if tmpl.PaymentOrder {
+		g.drawPaymentOrder(pdf, settings, SelectBankAccount(settings, invoice.Currency))
+	}
 
 	// Заголовок счёта
 	g.drawHeader(pdf, invoice, settings)
@@ -103,16 +140,18 @@ func (g *PDFGenerator) GenerateInvoicePDF(invoice *models.Invoice, settings *mod
 	g.drawContract(pdf, account)
 
 	// Таблица позиций
-	g.drawItemsTable(pdf, invoice)
+	g.drawItemsTable(pdf, invoice, loc)
 
 	// Итоги
-	g.drawTotals(pdf, invoice, settings)
+	g.drawTotals(pdf, invoice, settings, loc)
 
 	// Сумма прописью
-	g.drawAmountInWords(pdf, invoice)
+	g.drawAmountInWords(pdf, invoice, loc)
 
 	// Подпись
-	g.drawSignature(pdf, settings)
+	if tmpl.Signature {
+		g.drawSignature(pdf, settings)
+	}
 
 	// Генерируем PDF в буфер
 	var buf bytes.Buffer
@@ -123,6 +162,22 @@ func (g *PDFGenerator) GenerateInvoicePDF(invoice *models.Invoice, settings *mod
 	return buf.Bytes(), nil
 }
 
+// drawWatermark — полупрозрачная надпись по диагонали через центр страницы
+func (g *PDFGenerator) drawWatermark(pdf *fpdf.Fpdf, text string) {
+	pageW, pageH := pdf.GetPageSize()
+	cx, cy := pageW/2, pageH/2
+
+	pdf.SetFont("Arial", "B", 80)
+	pdf.SetTextColor(200, 200, 200)
+	pdf.SetAlpha(0.35, "Normal")
+	pdf.TransformBegin()
+	pdf.TransformRotate(45, cx, cy)
+	pdf.Text(cx-pdf.GetStringWidth(text)/2, cy+10, text)
+	pdf.TransformEnd()
+	pdf.SetAlpha(1, "Normal")
+	pdf.SetTextColor(0, 0, 0)
+}
+
 // drawPaymentNotice — предупреждение об условиях оплаты (верх документа, курсив, по центру)
 func (g *PDFGenerator) drawPaymentNotice(pdf *fpdf.Fpdf) {
 	pdf.SetFont("Arial", "I", 7)
@@ -133,7 +188,7 @@ func (g *PDFGenerator) drawPaymentNotice(pdf *fpdf.Fpdf) {
 
 // drawPaymentOrder — блок «Образец платёжного поручения» с банковскими реквизитами
 // Разметка повторяет казахстанский стандарт: таблица с бенефициаром, ИИК, Кбе, БИК, КНП
-func (g *PDFGenerator) drawPaymentOrder(pdf *fpdf.Fpdf, settings *models.BillingSettings) {
+func (g *PDFGenerator) drawPaymentOrder(pdf *fpdf.Fpdf, settings *models.BillingSettings, bank models.SupplierBankAccount) {
 	marginL := 10.0 // левый отступ страницы
 	pageW := 190.0  // ширина рабочей области (210 - 10 - 10)
 
@@ -182,11 +237,11 @@ func (g *PDFGenerator) drawPaymentOrder(pdf *fpdf.Fpdf, settings *models.Billing
 	// ИИК значение
 	pdf.SetFont("Arial", "B", 8)
 	pdf.SetXY(marginL+leftW, dataY)
-	pdf.CellFormat(midW, dataRowH, settings.BankIIK, "", 0, "C", false, 0, "")
+	pdf.CellFormat(midW, dataRowH, bank.IIK, "", 0, "C", false, 0, "")
 
 	// Кбе значение
 	pdf.SetXY(marginL+leftW+midW, dataY)
-	pdf.CellFormat(rightW, dataRowH, settings.BankKbe, "", 0, "C", false, 0, "")
+	pdf.CellFormat(rightW, dataRowH, bank.Kbe, "", 0, "C", false, 0, "")
 
 	// --- Строка БИН (продолжение левой колонки) ---
 	binY := dataY + dataRowH
@@ -215,9 +270,9 @@ func (g *PDFGenerator) drawPaymentOrder(pdf *fpdf.Fpdf, settings *models.Billing
 	pdf.SetFont("Arial", "", 8)
 	bankDataY := pdf.GetY()
 	pdf.SetXY(marginL, bankDataY)
-	pdf.CellFormat(bankLeftW, 5, settings.BankName, "LB", 0, "L", false, 0, "")
-	pdf.CellFormat(bankMidW, 5, settings.BankBIK, "LB", 0, "C", false, 0, "")
-	pdf.CellFormat(bankRightW, 5, settings.PaymentCode, "LBR", 1, "C", false, 0, "")
+	pdf.CellFormat(bankLeftW, 5, bank.BankName, "LB", 0, "L", false, 0, "")
+	pdf.CellFormat(bankMidW, 5, bank.BIK, "LB", 0, "C", false, 0, "")
+	pdf.CellFormat(bankRightW, 5, bank.PaymentCode, "LBR", 1, "C", false, 0, "")
 
 	pdf.Ln(5)
 }
@@ -233,7 +288,15 @@ func (g *PDFGenerator) drawHeader(pdf *fpdf.Fpdf, invoice *models.Invoice, setti
 	if invoiceNumber == "" {
 		invoiceNumber = fmt.Sprintf("%d", invoice.ID)
 	}
-	title := fmt.Sprintf("Счет на оплату № %s от %s", invoiceNumber, formatDateRussian(invoice.CreatedAt))
+	// Предпросмотр: счёт ещё не сохранён — ни номера, ни даты создания
+	if invoice.ID == 0 && invoice.Number == "" {
+		invoiceNumber = "ПРОЕКТ"
+	}
+	invoiceDate := invoice.CreatedAt
+	if invoiceDate.IsZero() {
+		invoiceDate = time.Now()
+	}
+	title := fmt.Sprintf("Счет на оплату № %s от %s", invoiceNumber, formatDateRussian(invoiceDate))
 	pdf.CellFormat(190, 10, title, "", 1, "L", false, 0, "")
 
 	// Нижняя тонкая линия-разделитель
@@ -338,7 +401,7 @@ func (g *PDFGenerator) drawContract(pdf *fpdf.Fpdf, account *models.Account) {
 }
 
 // drawItemsTable — таблица позиций с 7 колонками
-func (g *PDFGenerator) drawItemsTable(pdf *fpdf.Fpdf, invoice *models.Invoice) {
+func (g *PDFGenerator) drawItemsTable(pdf *fpdf.Fpdf, invoice *models.Invoice, loc NumberLocale) {
 	// Ширины колонок (всего 190mm)
 	colNum := 10.0   // №
 	colCode := 25.0  // Код
@@ -371,8 +434,11 @@ func (g *PDFGenerator) drawItemsTable(pdf *fpdf.Fpdf, invoice *models.Invoice) {
 	pdf.SetFont("Arial", "", 8)
 	lineHeight := 5.0
 
-	// Определяем месяц периода для описания позиций
+	// Определяем период для описания позиций: месяц или диапазон расчётного цикла
 	periodMonth := russianMonthForPeriod(invoice.Period.Month())
+	periodStart, periodEnd := invoice.PeriodRange()
+	calendarMonth := models.IsCalendarMonth(periodStart, periodEnd)
+	periodRange := fmt.Sprintf("%s — %s", periodStart.Format("02.01.2006"), periodEnd.Format("02.01.2006"))
 
 	for i, line := range invoice.Lines {
 		startY := pdf.GetY()
@@ -384,9 +450,15 @@ func (g *PDFGenerator) drawItemsTable(pdf *fpdf.Fpdf, invoice *models.Invoice) {
 		itemName = strings.TrimSuffix(itemName, " /месяц")
 		itemName = strings.TrimSuffix(itemName, "/месяц")
 		// Добавляем " / месяц за {Месяц}" если ещё нет
-		if !strings.Contains(strings.ToLower(itemName), "за "+strings.ToLower(periodMonth)) {
+		if !calendarMonth {
+			itemName = fmt.Sprintf("%s за период %s", itemName, periodRange)
+		} else if !strings.Contains(strings.ToLower(itemName), "за "+strings.ToLower(periodMonth)) {
 			itemName = fmt.Sprintf("%s / месяц за %s", itemName, periodMonth)
 		}
+		// Позиции вне базы НДС помечаем явно
+		if line.VATExempt {
+			itemName += " (без НДС)"
+		}
 
 		// Код модуля из настроек
 		moduleCode := line.ModuleCode
@@ -410,8 +482,8 @@ func (g *PDFGenerator) drawItemsTable(pdf *fpdf.Fpdf, invoice *models.Invoice) {
 		// Возвращаемся и рисуем оставшиеся колонки
 		pdf.SetXY(startX+colNum+colCode+colName, startY)
 
-		// Кол-во — формат с тремя знаками через запятую
-		qtyStr := formatQuantity(line.Quantity)
+		// Кол-во — формат с тремя знаками после разделителя
+		qtyStr := formatQuantity(line.Quantity, loc)
 		pdf.CellFormat(colQty, cellHeight, qtyStr, "1", 0, "R", false, 0, "")
 
 		// Единица измерения
@@ -423,10 +495,10 @@ func (g *PDFGenerator) drawItemsTable(pdf *fpdf.Fpdf, invoice *models.Invoice) {
 		pdf.CellFormat(colUnit, cellHeight, unitName, "1", 0, "C", false, 0, "")
 
 		// Цена
-		pdf.CellFormat(colPrice, cellHeight, formatMoney(line.UnitPrice), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(colPrice, cellHeight, g.formatMoney(line.UnitPrice, invoice.Currency, loc), "1", 0, "R", false, 0, "")
 
 		// Сумма
-		pdf.CellFormat(colTotal, cellHeight, formatMoney(line.TotalPrice), "1", 1, "R", false, 0, "")
+		pdf.CellFormat(colTotal, cellHeight, g.formatMoney(line.TotalPrice, invoice.Currency, loc), "1", 1, "R", false, 0, "")
 	}
 
 	// Нижняя толстая линия таблицы
@@ -438,39 +510,49 @@ func (g *PDFGenerator) drawItemsTable(pdf *fpdf.Fpdf, invoice *models.Invoice) {
 }
 
 // drawTotals — итоги: Итого и НДС
-func (g *PDFGenerator) drawTotals(pdf *fpdf.Fpdf, invoice *models.Invoice, settings *models.BillingSettings) {
+func (g *PDFGenerator) drawTotals(pdf *fpdf.Fpdf, invoice *models.Invoice, settings *models.BillingSettings, loc NumberLocale) {
 	// Ширины колонок (выравниваем с таблицей)
 	labelW := 165.0
 	valueW := 25.0
 
 	pdf.SetFont("Arial", "B", 9)
 
-	// Итого
-	pdf.CellFormat(labelW, 6, "Итого:", "", 0, "R", false, 0, "")
-	pdf.CellFormat(valueW, 6, formatMoney(invoice.TotalAmount), "", 1, "R", false, 0, "")
+	net, vatAmount, total := VATBreakdown(invoice, settings, g.precision)
+
+	if invoice.VATOnTop {
+		// НДС сверху: Итого без НДС, НДС, Всего с НДС
+		pdf.CellFormat(labelW, 6, "Итого без НДС:", "", 0, "R", false, 0, "")
+		pdf.CellFormat(valueW, 6, g.formatMoney(net, invoice.Currency, loc), "", 1, "R", false, 0, "")
+
+		pdf.CellFormat(labelW, 6, "НДС:", "", 0, "R", false, 0, "")
+		pdf.CellFormat(valueW, 6, g.formatMoney(vatAmount, invoice.Currency, loc), "", 1, "R", false, 0, "")
 
-	// НДС
-	vatRate := settings.VATRate
-	if vatRate == 0 {
-		vatRate = 16 // по умолчанию 16% для Казахстана
+		pdf.CellFormat(labelW, 6, "Всего с НДС:", "", 0, "R", false, 0, "")
+		pdf.CellFormat(valueW, 6, g.formatMoney(total, invoice.Currency, loc), "", 1, "R", false, 0, "")
+
+		pdf.Ln(3)
+		return
 	}
-	vatAmount := invoice.TotalAmount * vatRate / (100 + vatRate)
 
-	pdf.SetFont("Arial", "B", 9)
-	pdf.CellFormat(labelW, 6, fmt.Sprintf("В том числе НДС:"), "", 0, "R", false, 0, "")
-	pdf.CellFormat(valueW, 6, formatMoney(vatAmount), "", 1, "R", false, 0, "")
+	// Итого
+	pdf.CellFormat(labelW, 6, "Итого:", "", 0, "R", false, 0, "")
+	pdf.CellFormat(valueW, 6, g.formatMoney(total, invoice.Currency, loc), "", 1, "R", false, 0, "")
+
+	// НДС (включён в цену)
+	pdf.CellFormat(labelW, 6, "В том числе НДС:", "", 0, "R", false, 0, "")
+	pdf.CellFormat(valueW, 6, g.formatMoney(vatAmount, invoice.Currency, loc), "", 1, "R", false, 0, "")
 
 	pdf.Ln(3)
 }
 
 // drawAmountInWords — сумма прописью
-func (g *PDFGenerator) drawAmountInWords(pdf *fpdf.Fpdf, invoice *models.Invoice) {
+func (g *PDFGenerator) drawAmountInWords(pdf *fpdf.Fpdf, invoice *models.Invoice, loc NumberLocale) {
 	lineCount := len(invoice.Lines)
 
 	// «Всего наименований N, на сумму XXX KZT»
 	pdf.SetFont("Arial", "", 9)
 	summary := fmt.Sprintf("Всего наименований %d, на сумму %s %s",
-		lineCount, formatMoney(invoice.TotalAmount), invoice.Currency)
+		lineCount, g.formatMoney(invoice.TotalAmount, invoice.Currency, loc), invoice.Currency)
 	pdf.CellFormat(190, 5, summary, "", 1, "L", false, 0, "")
 
 	// «Всего к оплате: Сумма прописью»
@@ -478,6 +560,15 @@ func (g *PDFGenerator) drawAmountInWords(pdf *fpdf.Fpdf, invoice *models.Invoice
 	amountWords := AmountToWords(invoice.TotalAmount, invoice.Currency)
 	pdf.MultiCell(190, 5, fmt.Sprintf("Всего к оплате: %s", amountWords), "", "L", false)
 
+	// Справочная сумма в валюте отображения
+	if invoice.ReferenceCurrency != "" && invoice.ReferenceRateDate != nil {
+		pdf.SetFont("Arial", "", 8)
+		reference := fmt.Sprintf("справочно: ≈ %s %s по курсу на %s",
+			g.formatMoney(invoice.ReferenceAmount, invoice.ReferenceCurrency, loc), invoice.ReferenceCurrency,
+			invoice.ReferenceRateDate.Format("02.01.2006"))
+		pdf.CellFormat(190, 5, reference, "", 1, "L", false, 0, "")
+	}
+
 	// Горизонтальная линия-разделитель
 	pdf.Ln(2)
 	y := pdf.GetY()
@@ -540,79 +631,23 @@ func (g *PDFGenerator) drawSignature(pdf *fpdf.Fpdf, settings *models.BillingSet
 	}
 }
 
-// insertBase64Image декодирует Base64 PNG и вставляет в PDF по координатам
+// insertBase64Image декодирует Base64 PNG и вставляет в PDF по координатам.
+// Изображения проверяются при сохранении настроек; здесь некорректные данные
+// пропускаются с предупреждением, чтобы не ломать генерацию счёта.
 func insertBase64Image(pdf *fpdf.Fpdf, base64Data string, name string, x, y, w float64) {
-	// Убираем data URI префикс если есть (data:image/png;base64,...)
-	if idx := strings.Index(base64Data, ","); idx >= 0 {
-		base64Data = base64Data[idx+1:]
-	}
-
-	data, err := base64.StdEncoding.DecodeString(base64Data)
+	data, err := decodeBase64PNG(base64Data)
 	if err != nil {
-		return // Тихо пропускаем — не ломаем генерацию
+		log.Printf("[PDF] Изображение %s пропущено: %v", name, err)
+		return
 	}
 
 	reader := io.Reader(bytes.NewReader(data))
 	opts := fpdf.ImageOptions{ImageType: "PNG", ReadDpi: true}
 	pdf.RegisterImageOptionsReader(name, opts, reader)
-	pdf.ImageOptions(name, x, y, w, 0, false, opts, 0, "")
-}
-
-// formatQuantity форматирует количество (например: 970,350 или 1,000)
-func formatQuantity(qty float64) string {
-	// Формат с тремя знаками после запятой
-	whole := int64(qty)
-	frac := int64(math.Round((qty - float64(whole)) * 1000))
-	if frac < 0 {
-		frac = -frac
-	}
-
-	sign := ""
-	if whole < 0 {
-		sign = "-"
-		whole = -whole
-	}
-
-	str := fmt.Sprintf("%d", whole)
-	n := len(str)
-	if n > 3 {
-		var result []byte
-		for i, c := range str {
-			if i > 0 && (n-i)%3 == 0 {
-				result = append(result, ' ')
-			}
-			result = append(result, byte(c))
-		}
-		return fmt.Sprintf("%s%s,%03d", sign, string(result), frac)
-	}
-	return fmt.Sprintf("%s%s,%03d", sign, str, frac)
-}
-
-func formatMoney(amount float64) string {
-	// Форматируем с разделителем тысяч (пробел) и десятичной запятой
-	whole := int64(amount)
-	frac := int64(math.Round((amount - float64(whole)) * 100))
-	if frac < 0 {
-		frac = -frac
-	}
-
-	// Форматируем целую часть с пробелами
-	sign := ""
-	if whole < 0 {
-		sign = "-"
-		whole = -whole
-	}
-	str := fmt.Sprintf("%d", whole)
-	n := len(str)
-	if n > 3 {
-		var result []byte
-		for i, c := range str {
-			if i > 0 && (n-i)%3 == 0 {
-				result = append(result, ' ')
-			}
-			result = append(result, byte(c))
-		}
-		return fmt.Sprintf("%s%s,%02d", sign, string(result), frac)
+	if pdf.Err() {
+		log.Printf("[PDF] Изображение %s пропущено: %v", name, pdf.Error())
+		pdf.ClearError()
+		return
 	}
-	return fmt.Sprintf("%s%s,%02d", sign, str, frac)
+	pdf.ImageOptions(name, x, y, w, 0, false, opts, 0, "")
 }
@@ -0,0 +1,54 @@
+package invoice
+
+import "github.com/user/wialon-billing-api/internal/models"
+
+// PDFTemplate - вариант макета счёта: какие необязательные блоки выводить
+type PDFTemplate struct {
+	Code          string `json:"code"`
+	Name          string `json:"name"`
+	PaymentNotice bool   `json:"payment_notice"` // Предупреждение об условиях оплаты
+	PaymentOrder  bool   `json:"payment_order"`  // Образец платёжного поручения
+	Signature     bool   `json:"signature"`      // Подпись исполнителя и печать
+}
+
+// DefaultPDFTemplate - полный макет по образцу «Счёт на оплату»
+const DefaultPDFTemplate = "full"
+
+// PDFTemplates - доступные шаблоны счёта, первый — по умолчанию
+var PDFTemplates = []PDFTemplate{
+	{Code: DefaultPDFTemplate, Name: "Полный", PaymentNotice: true, PaymentOrder: true, Signature: true},
+	{Code: "no_payment_order", Name: "Без платёжного поручения", PaymentNotice: true, PaymentOrder: false, Signature: true},
+	{Code: "no_notice", Name: "Без предупреждения об оплате", PaymentNotice: false, PaymentOrder: true, Signature: true},
+	{Code: "compact", Name: "Компактный", PaymentNotice: false, PaymentOrder: false, Signature: true},
+	{Code: "unsigned", Name: "Без подписи", PaymentNotice: true, PaymentOrder: true, Signature: false},
+}
+
+// IsValidPDFTemplate проверяет код шаблона
+func IsValidPDFTemplate(code string) bool {
+	for _, t := range PDFTemplates {
+		if t.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolvePDFTemplate выбирает шаблон: учётная запись → настройки биллинга → полный.
+// Неизвестный код считается пустым, чтобы устаревшая настройка не ломала генерацию.
+func ResolvePDFTemplate(settings *models.BillingSettings, account *models.Account) PDFTemplate {
+	var codes []string
+	if account != nil {
+		codes = append(codes, account.PDFTemplate)
+	}
+	if settings != nil {
+		codes = append(codes, settings.PDFTemplate)
+	}
+	for _, code := range codes {
+		for _, t := range PDFTemplates {
+			if code != "" && t.Code == code {
+				return t
+			}
+		}
+	}
+	return PDFTemplates[0]
+}
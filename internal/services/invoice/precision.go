@@ -0,0 +1,66 @@
+package invoice
+
+import (
+	"math"
+	"strings"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// DefaultCurrencyPrecision - знаков после запятой в суммах по умолчанию
+const DefaultCurrencyPrecision = 2
+
+// Precision - число знаков после запятой в суммах по валютам (billing.currency_precision).
+// Валюты не из списка (и нулевое значение Precision) — DefaultCurrencyPrecision.
+type Precision map[string]int
+
+// NewPrecision создаёт точность по валютам из конфигурации; коды валют без учёта регистра
+func NewPrecision(precision map[string]int) Precision {
+	p := make(Precision, len(precision))
+	for currency, digits := range precision {
+		p[strings.ToUpper(currency)] = digits
+	}
+	return p
+}
+
+// CurrencyPrecision возвращает число знаков после запятой для валюты
+func (p Precision) CurrencyPrecision(currency string) int {
+	if digits, ok := p[strings.ToUpper(currency)]; ok {
+		return digits
+	}
+	return DefaultCurrencyPrecision
+}
+
+// RoundAmount округляет сумму до точности валюты — так же, как она выводится в PDF
+// (половина — от нуля по десятичной записи суммы)
+func (p Precision) RoundAmount(amount float64, currency string) float64 {
+	digits := p.CurrencyPrecision(currency)
+	rounded := float64(roundScaled(math.Abs(amount), digits)) / math.Pow10(digits)
+	if amount < 0 && rounded != 0 {
+		return -rounded
+	}
+	return rounded
+}
+
+// SetCurrencyPrecision задаёт точность сумм по валютам (billing.currency_precision)
+func (s *Service) SetCurrencyPrecision(precision map[string]int) {
+	s.precision = NewPrecision(precision)
+}
+
+// Precision возвращает точность сумм по валютам — для отчётов и PDF, чтобы суммы совпадали со счётом
+func (s *Service) Precision() Precision {
+	return s.precision
+}
+
+// RoundAmount округляет сумму до точности валюты
+func (s *Service) RoundAmount(amount float64, currency string) float64 {
+	return s.precision.RoundAmount(amount, currency)
+}
+
+// linesCurrency возвращает валюту строк счёта (все строки в валюте счёта)
+func linesCurrency(lines []models.InvoiceLine) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return lines[0].Currency
+}
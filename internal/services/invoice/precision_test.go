@@ -0,0 +1,74 @@
+package invoice
+
+import "testing"
+
+func TestCurrencyPrecision(t *testing.T) {
+	p := NewPrecision(map[string]int{"jpy": 0, "KZT": 2, "Kwd": 3})
+
+	tests := []struct {
+		currency string
+		want     int
+	}{
+		{"JPY", 0},
+		{"jpy", 0},
+		{"KZT", 2},
+		{"kzt", 2},
+		{"KWD", 3},
+		{"kWd", 3},
+		{"EUR", DefaultCurrencyPrecision},
+		{"", DefaultCurrencyPrecision},
+	}
+	for _, tt := range tests {
+		if got := p.CurrencyPrecision(tt.currency); got != tt.want {
+			t.Errorf("CurrencyPrecision(%q) = %d, ожидалось %d", tt.currency, got, tt.want)
+		}
+	}
+
+	// Без настройки все валюты — по умолчанию
+	var empty Precision
+	if got := empty.CurrencyPrecision("JPY"); got != DefaultCurrencyPrecision {
+		t.Errorf("пустая Precision: CurrencyPrecision(JPY) = %d, ожидалось %d", got, DefaultCurrencyPrecision)
+	}
+}
+
+func TestRoundAmount(t *testing.T) {
+	p := NewPrecision(map[string]int{"JPY": 0, "KWD": 3})
+
+	tests := []struct {
+		amount   float64
+		currency string
+		want     float64
+	}{
+		{1234.565, "KZT", 1234.57},
+		{1234.564, "KZT", 1234.56},
+		{1234.564, "kzt", 1234.56},
+		{-10.005, "KZT", -10.01},
+		{0, "KZT", 0},
+		{1234.5, "JPY", 1235},
+		{1234.4, "jpy", 1234},
+		{-0.5, "JPY", -1},
+		{1.2345, "KWD", 1.235},
+		{1.2345, "Kwd", 1.235},
+		{99.999, "EUR", 100},
+	}
+	for _, tt := range tests {
+		if got := p.RoundAmount(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("RoundAmount(%v, %q) = %v, ожидалось %v", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestServicePrecision(t *testing.T) {
+	s := &Service{}
+	if got := s.RoundAmount(1234.567, "JPY"); got != 1234.57 {
+		t.Errorf("без настройки: RoundAmount(1234.567, JPY) = %v, ожидалось 1234.57", got)
+	}
+
+	s.SetCurrencyPrecision(map[string]int{"jpy": 0})
+	if got := s.RoundAmount(1234.5, "JPY"); got != 1235 {
+		t.Errorf("RoundAmount(1234.5, JPY) = %v, ожидалось 1235", got)
+	}
+	if got := s.Precision().CurrencyPrecision("Jpy"); got != 0 {
+		t.Errorf("Precision().CurrencyPrecision(Jpy) = %d, ожидалось 0", got)
+	}
+}
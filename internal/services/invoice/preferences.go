@@ -0,0 +1,39 @@
+package invoice
+
+import "github.com/user/wialon-billing-api/internal/models"
+
+// defaultVATRate - ставка НДС по умолчанию для Казахстана, %
+const defaultVATRate = 16.0
+
+// EffectiveInvoicePreferences - настройки счетов аккаунта после подстановки значений
+// из настроек биллинга и значений по умолчанию
+type EffectiveInvoicePreferences struct {
+	DisplayCurrency string  `json:"display_currency"` // "" — справочная сумма не выводится
+	PDFTemplate     string  `json:"pdf_template"`
+	Locale          string  `json:"locale"`
+	VATRate         float64 `json:"vat_rate"`
+}
+
+// ResolveInvoicePreferences собирает действующие настройки счетов: учётная запись → настройки биллинга → по умолчанию
+func ResolveInvoicePreferences(settings *models.BillingSettings, account *models.Account) EffectiveInvoicePreferences {
+	effective := EffectiveInvoicePreferences{
+		PDFTemplate: ResolvePDFTemplate(settings, account).Code,
+		Locale:      ResolveLocale(settings, account).Code,
+		VATRate:     ResolveVATRate(settings, account),
+	}
+	if account != nil && account.DisplayCurrency != account.BillingCurrency {
+		effective.DisplayCurrency = account.DisplayCurrency
+	}
+	return effective
+}
+
+// ResolveVATRate выбирает ставку НДС: учётная запись (в том числе 0%) → настройки биллинга → 16%
+func ResolveVATRate(settings *models.BillingSettings, account *models.Account) float64 {
+	if account != nil && account.VATRate != nil {
+		return *account.VATRate
+	}
+	if settings != nil && settings.VATRate > 0 {
+		return settings.VATRate
+	}
+	return defaultVATRate
+}
@@ -0,0 +1,170 @@
+package invoice
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"gorm.io/gorm"
+)
+
+// ReissueResult - результат пересчёта счёта, выставленного без курса
+type ReissueResult struct {
+	InvoiceID   uint    `json:"invoice_id"`
+	Number      string  `json:"number"`
+	AccountName string  `json:"account_name"`
+	Currency    string  `json:"currency"`
+	OldTotal    float64 `json:"old_total"`
+	NewTotal    float64 `json:"new_total"`
+	Delta       float64 `json:"delta"`
+	Reissued    bool    `json:"reissued"`
+	Error       string  `json:"error,omitempty"`
+
+	// Счёт уже был отправлен клиенту — нужна повторная отправка
+	ResendRequired bool `json:"resend_required,omitempty"`
+}
+
+// ReissueInvoicesAwaitingRates пересчитывает счета с флагом NeedsRateReissue,
+// для периода которых курс НБК уже опубликован. Номер и статус счёта сохраняются,
+// оплаченные счета не пересчитываются. Флаг снимается после успешного пересчёта,
+// а у оплаченных счетов — сразу, чтобы они не возвращались в каждый прогон.
+func (s *Service) ReissueInvoicesAwaitingRates() ([]ReissueResult, error) {
+	invoices, err := s.repo.GetInvoicesNeedingRateReissue()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ReissueResult
+	fetched := make(map[string]bool)
+
+	for i := range invoices {
+		inv := &invoices[i]
+		result := ReissueResult{
+			InvoiceID:   inv.ID,
+			Number:      inv.Number,
+			AccountName: inv.Account.Name,
+			Currency:    inv.Currency,
+			OldTotal:    inv.TotalAmount,
+		}
+
+		if inv.Status == "paid" {
+			result.Error = "счёт оплачен — пересчёт запрещён"
+			log.Printf("[Пересчёт] Счёт %s оплачен, пересчёт по курсу пропущен", inv.Number)
+			if err := s.db.Model(&models.Invoice{}).Where("id = ?", inv.ID).
+				Update("needs_rate_reissue", false).Error; err != nil {
+				log.Printf("[Пересчёт] Ошибка снятия флага пересчёта счёта %s: %v", inv.Number, err)
+			}
+			results = append(results, result)
+			continue
+		}
+
+		period := time.Date(inv.Period.Year(), inv.Period.Month(), 1, 0, 0, 0, 0, time.Local)
+		rateDate := period.AddDate(0, 1, 0)
+
+		// Курсы за дату загружаем один раз на прогон
+		if key := rateDate.Format("2006-01-02"); !fetched[key] {
+			fetched[key] = true
+			if err := s.nbk.FetchExchangeRatesForDate(rateDate); err != nil {
+				log.Printf("[Пересчёт] Ошибка загрузки курсов за %s: %v", rateDate.Format("02.01.2006"), err)
+			}
+		}
+
+		newTotal, reissued, err := s.reissueInvoice(inv, rateDate)
+		if err != nil {
+			result.Error = err.Error()
+			log.Printf("[Пересчёт] Ошибка пересчёта счёта %s: %v", inv.Number, err)
+			results = append(results, result)
+			continue
+		}
+		if !reissued {
+			// Курс ещё не опубликован — попробуем в следующий раз
+			continue
+		}
+
+		result.Reissued = true
+		result.ResendRequired = inv.Status != "draft"
+		result.NewTotal = newTotal
+		result.Delta = s.RoundAmount(newTotal-inv.TotalAmount, inv.Currency)
+		log.Printf("[Пересчёт] Счёт %s для %s пересчитан по курсу: %.2f → %.2f %s",
+			inv.Number, inv.Account.Name, inv.TotalAmount, newTotal, inv.Currency)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// reissueInvoice пересчитывает строки и суммы счёта по курсу на rateDate.
+// Если курс всё ещё недоступен, счёт не меняется (reissued = false).
+func (s *Service) reissueInvoice(inv *models.Invoice, rateDate time.Time) (newTotal float64, reissued bool, err error) {
+	accountModules, err := s.repo.GetAccountModules(inv.AccountID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	periodStart, periodEnd := inv.PeriodRange()
+	avgUnits, err := s.calculateAverageUnits(inv.AccountID, inv.Account.BillingEndDate, periodStart, periodEnd)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Тот же расчёт, что и при выставлении: строки, НДС и минимальная сумма счёта
+	amounts, err := s.calculateInvoiceAmounts(&inv.Account, accountModules, avgUnits, inv.Currency, rateDate)
+	if err != nil {
+		return 0, false, err
+	}
+	if amounts.RateMissing {
+		return 0, false, nil
+	}
+	lines, total := amounts.Lines, amounts.Total
+
+	updates := map[string]interface{}{
+		"total_amount":       total,
+		"vat_amount":         amounts.VAT,
+		"vat_on_top":         amounts.VATOnTop,
+		"needs_rate_reissue": false,
+	}
+
+	// Отправленный PDF не трогаем — это документ, который получил клиент.
+	// Новый документ фиксируется при повторной отправке.
+	note := fmt.Sprintf("Пересчёт по курсу НБК за %s: %.2f → %.2f %s",
+		rateDate.Format("02.01.2006"), inv.TotalAmount, total, inv.Currency)
+	if inv.Status != "draft" {
+		updates["resend_required"] = true
+		note += " — счёт уже отправлен, требуется повторная отправка"
+	}
+
+	// Справочная сумма — по тому же курсу
+	if inv.ReferenceCurrency != "" {
+		if converted, err := s.convertCurrency(total, inv.Currency, inv.ReferenceCurrency, rateDate); err == nil {
+			updates["reference_amount"] = s.RoundAmount(converted, inv.ReferenceCurrency)
+			updates["reference_rate_date"] = rateDate
+		}
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("invoice_id = ?", inv.ID).Delete(&models.InvoiceLine{}).Error; err != nil {
+			return err
+		}
+		for i := range lines {
+			lines[i].InvoiceID = inv.ID
+			if err := tx.Create(&lines[i]).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&models.Invoice{}).Where("id = ?", inv.ID).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.InvoiceEvent{
+			InvoiceID: inv.ID,
+			EventType: "reissue",
+			Status:    inv.Status,
+			Note:      note,
+		}).Error
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	return total, true, nil
+}
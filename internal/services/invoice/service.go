@@ -1,6 +1,7 @@
 package invoice
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -12,20 +13,78 @@ import (
 	"gorm.io/gorm"
 )
 
+// invoiceNumberScope - префикс номеров счетов и область счётчика InvoiceSequence
+const invoiceNumberScope = "WH"
+
 // Service - сервис для работы со счетами
 type Service struct {
 	db   *gorm.DB
 	repo *repository.Repository
 	nbk  *nbk.Service
+
+	refreshBlocked BlockStatusRefresher // обновление статуса блокировки из Wialon (nil — не обновлять)
+	precision      Precision            // знаков после запятой по валютам
+
+	// Валюта счёта для аккаунтов без billing_currency (billing.default_billing_currency)
+	defaultCurrency string
+}
+
+// NewService создаёт новый сервис; defaultCurrency — валюта счёта по умолчанию из конфигурации
+func NewService(db *gorm.DB, repo *repository.Repository, nbkService *nbk.Service, defaultCurrency string) *Service {
+	return &Service{db: db, repo: repo, nbk: nbkService, defaultCurrency: defaultCurrency}
+}
+
+// DefaultCurrency возвращает валюту счёта для аккаунтов без billing_currency
+func (s *Service) DefaultCurrency() string {
+	return s.defaultCurrency
+}
+
+// MonthlyInvoicesResult - итог ежемесячной генерации счетов
+type MonthlyInvoicesResult struct {
+	Invoices     []models.Invoice `json:"invoices"`
+	BelowMinimum []BelowMinimum   `json:"below_minimum"` // счёт не выставлен: сумма ниже минимальной
+	Blocked      []SkippedAccount `json:"blocked"`       // счёт не выставлен: аккаунт заблокирован в Wialon
+
+	// Счёт не выставлен: дней со снимками меньше min_snapshot_days_for_billing
+	InsufficientData []InsufficientData `json:"insufficient_data"`
+}
+
+// SkippedAccount - аккаунт, пропущенный при генерации счетов
+type SkippedAccount struct {
+	AccountID   uint   `json:"account_id"`
+	WialonID    int64  `json:"wialon_id"`
+	AccountName string `json:"account_name"`
 }
 
-// NewService создаёт новый сервис
-func NewService(db *gorm.DB, repo *repository.Repository, nbkService *nbk.Service) *Service {
-	return &Service{db: db, repo: repo, nbk: nbkService}
+// BlockStatusRefresher обновляет IsBlocked аккаунтов по данным Wialon (на месте и в БД)
+type BlockStatusRefresher func(accounts []models.Account) error
+
+// SetBlockStatusRefresher задаёт обновление статуса блокировки перед генерацией
+// (используется при включённой настройке refresh_blocked_status)
+func (s *Service) SetBlockStatusRefresher(refresh BlockStatusRefresher) {
+	s.refreshBlocked = refresh
+}
+
+// GenerateMonthlyInvoices генерирует счета за указанный месяц для всех аккаунтов.
+// Заблокированные в Wialon аккаунты пропускаются, если в настройках не включено bill_blocked_accounts.
+// В итоге также перечислены аккаунты, счёт которым не выставлен из-за суммы ниже минимальной
+// или нехватки снимков (force — выставить, несмотря на min_snapshot_days_for_billing).
+func (s *Service) GenerateMonthlyInvoices(period time.Time, force bool) (*MonthlyInvoicesResult, error) {
+	return s.generateMonthlyInvoices(period, force, nil)
 }
 
-// GenerateMonthlyInvoices генерирует счета за указанный месяц для всех аккаунтов
-func (s *Service) GenerateMonthlyInvoices(period time.Time) ([]models.Invoice, error) {
+// GenerateMonthlyInvoicesForAccounts генерирует счета за месяц по тем же правилам, что и
+// GenerateMonthlyInvoices, но только для аккаунтов из accountIDs (например, группы)
+func (s *Service) GenerateMonthlyInvoicesForAccounts(period time.Time, accountIDs []uint, force bool) (*MonthlyInvoicesResult, error) {
+	only := make(map[uint]bool, len(accountIDs))
+	for _, id := range accountIDs {
+		only[id] = true
+	}
+	return s.generateMonthlyInvoices(period, force, only)
+}
+
+// generateMonthlyInvoices - ежемесячная генерация; only — ограничить аккаунтами (nil — все в биллинге)
+func (s *Service) generateMonthlyInvoices(period time.Time, force bool, only map[uint]bool) (*MonthlyInvoicesResult, error) {
 	// Нормализуем период до 1-го числа месяца
 	period = time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.Local)
 
@@ -38,30 +97,76 @@ func (s *Service) GenerateMonthlyInvoices(period time.Time) ([]models.Invoice, e
 	}
 
 	// Получаем все аккаунты с включённым биллингом
-	accounts, err := s.repo.GetSelectedAccounts()
+	accounts, err := s.repo.GetSelectedAccountsFresh()
 	if err != nil {
 		return nil, err
 	}
+	if only != nil {
+		filtered := accounts[:0]
+		for _, account := range accounts {
+			if only[account.ID] {
+				filtered = append(filtered, account)
+			}
+		}
+		accounts = filtered
+	}
 
-	var invoices []models.Invoice
+	billBlocked := false
+	if settings, _ := s.repo.GetSettings(); settings != nil {
+		billBlocked = settings.BillBlockedAccounts
+		if !billBlocked && settings.RefreshBlockedStatus && s.refreshBlocked != nil {
+			if err := s.refreshBlocked(accounts); err != nil {
+				log.Printf("Предупреждение: статус блокировки обновлён не полностью: %v", err)
+			}
+		}
+	}
+
+	result := &MonthlyInvoicesResult{}
 
 	for _, account := range accounts {
-		invoice, err := s.generateInvoiceForAccount(account, period, rateDate)
+		if start, _ := account.BillingPeriodRange(period); account.BillingEndDate != nil && !account.IsBilledOn(start) {
+			log.Printf("Биллинг аккаунта %s прекращён с %s, счёт не выставляем",
+				account.Name, account.BillingEndDate.Format("02.01.2006"))
+			continue
+		}
+		if account.IsBlocked && !billBlocked {
+			log.Printf("Аккаунт %s заблокирован в Wialon, счёт не выставляем", account.Name)
+			result.Blocked = append(result.Blocked, SkippedAccount{
+				AccountID:   account.ID,
+				WialonID:    account.WialonID,
+				AccountName: account.Name,
+			})
+			continue
+		}
+
+		invoice, err := s.generateInvoiceForAccount(account, period, rateDate, !force)
+		var belowMin *BelowMinimumError
+		if errors.As(err, &belowMin) {
+			result.BelowMinimum = append(result.BelowMinimum, belowMin.BelowMinimum)
+			continue
+		}
+		var insufficient *InsufficientDataError
+		if errors.As(err, &insufficient) {
+			result.InsufficientData = append(result.InsufficientData, insufficient.InsufficientData)
+			continue
+		}
 		if err != nil {
 			log.Printf("Ошибка генерации счёта для %s: %v", account.Name, err)
 			continue
 		}
 		if invoice != nil {
-			invoices = append(invoices, *invoice)
+			result.Invoices = append(result.Invoices, *invoice)
 		}
 	}
 
-	log.Printf("Сгенерировано %d счетов за %s", len(invoices), period.Format("01.2006"))
-	return invoices, nil
+	log.Printf("Сгенерировано %d счетов за %s (заблокированных пропущено: %d, без достаточных снимков: %d)",
+		len(result.Invoices), period.Format("01.2006"), len(result.Blocked), len(result.InsufficientData))
+	return result, nil
 }
 
 // GenerateInvoiceForSingleAccount генерирует счёт для одного аккаунта
-func (s *Service) GenerateInvoiceForSingleAccount(accountID uint, period time.Time) (*models.Invoice, error) {
+// (force — выставить, несмотря на min_snapshot_days_for_billing)
+func (s *Service) GenerateInvoiceForSingleAccount(accountID uint, period time.Time, force bool) (*models.Invoice, error) {
 	period = time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.Local)
 	rateDate := period.AddDate(0, 1, 0)
 
@@ -75,21 +180,129 @@ func (s *Service) GenerateInvoiceForSingleAccount(accountID uint, period time.Ti
 		return nil, fmt.Errorf("аккаунт %d не найден: %w", accountID, err)
 	}
 
-	return s.generateInvoiceForAccount(account, period, rateDate)
+	return s.generateInvoiceForAccount(account, period, rateDate, !force)
+}
+
+// AccountInvoiceResult - результат генерации счёта для аккаунта из списка
+type AccountInvoiceResult struct {
+	AccountID uint            `json:"account_id"`
+	Invoice   *models.Invoice `json:"invoice,omitempty"`
+	Skipped   bool            `json:"skipped,omitempty"` // нет модулей, нулевая сумма или ниже минимальной
+	Error     string          `json:"error,omitempty"`
+
+	BelowMinimum     *BelowMinimum     `json:"below_minimum,omitempty"`     // сумма ниже минимальной (режим skip)
+	InsufficientData *InsufficientData `json:"insufficient_data,omitempty"` // мало дней со снимками
+
+	// Счёт за период уже выставлен (не черновик) — не пересоздаётся без force
+	Issued *IssuedInvoice `json:"issued,omitempty"`
+}
+
+// IssuedInvoice - уже выставленный счёт, пропущенный при генерации по списку
+type IssuedInvoice struct {
+	InvoiceID uint   `json:"invoice_id"`
+	Number    string `json:"number"`
+	Status    string `json:"status"`
+}
+
+// GenerateInvoicesForAccounts генерирует счета за период для списка аккаунтов в одной транзакции:
+// при ошибке по любому аккаунту счета не сохраняются ни для кого. Курсы загружаются один раз.
+// Отправленные и оплаченные счета за период пропускаются (Issued), пересоздаются только черновики.
+// force — выставить, несмотря на min_snapshot_days_for_billing, и пересоздать выставленные счета.
+func (s *Service) GenerateInvoicesForAccounts(accountIDs []uint, period time.Time, force bool) ([]AccountInvoiceResult, error) {
+	period = time.Date(period.Year(), period.Month(), 1, 0, 0, 0, 0, time.Local)
+	rateDate := period.AddDate(0, 1, 0)
+
+	if err := s.nbk.FetchExchangeRatesForDate(rateDate); err != nil {
+		log.Printf("Предупреждение: ошибка загрузки курсов за %s: %v", rateDate.Format("02.01.2006"), err)
+	}
+
+	results := make([]AccountInvoiceResult, 0, len(accountIDs))
+	seen := make(map[uint]bool)
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		txService := *s
+		txService.db = tx
+		txService.repo = repository.NewRepository(tx)
+
+		for _, accountID := range accountIDs {
+			if seen[accountID] {
+				continue
+			}
+			seen[accountID] = true
+			result := AccountInvoiceResult{AccountID: accountID}
+
+			var account models.Account
+			if err := tx.Preload("Modules.Module").First(&account, accountID).Error; err != nil {
+				result.Error = fmt.Sprintf("аккаунт %d не найден", accountID)
+				results = append(results, result)
+				return fmt.Errorf("аккаунт %d не найден: %w", accountID, err)
+			}
+
+			// Выставленный счёт не удаляем: с ним связаны события, доставки и отправленный PDF
+			if !force {
+				if existing, _ := txService.repo.GetInvoiceByAccountAndPeriod(account.ID, period); existing != nil && existing.Status != "draft" {
+					result.Skipped = true
+					result.Issued = &IssuedInvoice{InvoiceID: existing.ID, Number: existing.Number, Status: existing.Status}
+					results = append(results, result)
+					continue
+				}
+			}
+
+			inv, err := txService.generateInvoiceForAccount(account, period, rateDate, !force)
+			var belowMin *BelowMinimumError
+			if errors.As(err, &belowMin) {
+				result.Skipped = true
+				result.BelowMinimum = &belowMin.BelowMinimum
+				results = append(results, result)
+				continue
+			}
+			var insufficient *InsufficientDataError
+			if errors.As(err, &insufficient) {
+				result.Skipped = true
+				result.InsufficientData = &insufficient.InsufficientData
+				results = append(results, result)
+				continue
+			}
+			if err != nil {
+				result.Error = err.Error()
+				results = append(results, result)
+				return fmt.Errorf("счёт для %s: %w", account.Name, err)
+			}
+			if inv == nil {
+				result.Skipped = true
+			}
+			result.Invoice = inv
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		// Транзакция откатана — созданные счета не сохранены
+		for i := range results {
+			results[i].Invoice = nil
+		}
+		return results, err
+	}
+
+	log.Printf("Сгенерировано счетов по списку из %d аккаунтов за %s", len(results), period.Format("01.2006"))
+	return results, nil
 }
 
-// CheckRatesAvailable проверяет наличие курсов за указанную дату
+// CheckRatesAvailable проверяет наличие курсов всех отслеживаемых валют НБК за указанную дату
 func (s *Service) CheckRatesAvailable(date time.Time) bool {
-	// Проверяем наличие курса EUR за дату
-	rate, err := s.repo.GetExchangeRateByDate("EUR", date)
-	if err != nil || rate == nil {
-		return false
+	for _, currency := range s.nbk.Currencies() {
+		rate, err := s.repo.GetExchangeRateByDate(currency, date)
+		if err != nil || rate == nil {
+			return false
+		}
 	}
 	return true
 }
 
-// generateInvoiceForAccount создаёт счёт для одного аккаунта
-func (s *Service) generateInvoiceForAccount(account models.Account, period, rateDate time.Time) (*models.Invoice, error) {
+// generateInvoiceForAccount создаёт счёт для одного аккаунта. checkSnapshots — проверить
+// min_snapshot_days_for_billing (InsufficientDataError). Существующий счёт за период заменяется,
+// только если новый действительно выставляется (не ниже минимальной суммы и не нулевой).
+func (s *Service) generateInvoiceForAccount(account models.Account, period, rateDate time.Time, checkSnapshots bool) (*models.Invoice, error) {
 	// Получаем модули аккаунта
 	accountModules, err := s.repo.GetAccountModules(account.ID)
 	if err != nil {
@@ -101,23 +314,22 @@ func (s *Service) generateInvoiceForAccount(account models.Account, period, rate
 		return nil, nil
 	}
 
-	// Получаем среднее количество объектов за месяц
-	avgUnits, err := s.calculateAverageUnits(account.ID, period.Year(), int(period.Month()))
-	if err != nil {
-		log.Printf("Ошибка расчёта среднего для %s: %v", account.Name, err)
-		avgUnits = 0
+	if checkSnapshots {
+		if err := s.checkSnapshotCoverage(&account, period); err != nil {
+			return nil, err
+		}
 	}
 
-	// Определяем целевую валюту аккаунта
-	targetCurrency := account.BillingCurrency
-	if targetCurrency == "" {
-		targetCurrency = "KZT"
+	// Сначала рассчитываем новый счёт: ниже минимальной суммы или нулевой счёт не выставляется,
+	// и тогда существующий счёт за период остаётся как есть
+	invoice, err := s.buildInvoice(account, accountModules, period, rateDate)
+	if err != nil || invoice == nil {
+		return nil, err
 	}
 
-	// Проверяем, есть ли уже счёт за этот период
+	// Замена есть — удаляем старый счёт за этот период (пересчёт)
 	existingInvoice, _ := s.repo.GetInvoiceByAccountAndPeriod(account.ID, period)
 	if existingInvoice != nil {
-		// Удаляем старый счёт (пересчёт)
 		if err := s.repo.DeleteInvoiceLines(existingInvoice.ID); err != nil {
 			return nil, err
 		}
@@ -126,8 +338,284 @@ func (s *Service) generateInvoiceForAccount(account models.Account, period, rate
 		}
 		log.Printf("Удалён старый счёт #%d для %s", existingInvoice.ID, account.Name)
 	}
+	// Строки создаём отдельно, чтобы gorm не сохранил их вместе со счётом
+	lines := invoice.Lines
+	invoice.Lines = nil
+
+	// Глобальный порядковый номер (общий для всех аккаунтов) из счётчика в БД
+	globalSeqNum, err := s.repo.NextInvoiceSeq(invoiceNumberScope)
+	if err != nil {
+		return nil, fmt.Errorf("не удалось получить номер счёта: %w", err)
+	}
+
+	// Формат: WH-{глобальный_номер}
+	invoice.Number = fmt.Sprintf("%s-%d", invoiceNumberScope, globalSeqNum)
+
+	if invoice.NeedsRateReissue {
+		log.Printf("Счёт %s для %s выставлен без курса за %s — помечен для пересчёта",
+			invoice.Number, account.Name, rateDate.Format("02.01.2006"))
+	}
+
+	if err := s.repo.CreateInvoice(invoice); err != nil {
+		return nil, err
+	}
+
+	// Создаём строки счёта
+	for i := range lines {
+		lines[i].InvoiceID = invoice.ID
+		if err := s.repo.CreateInvoiceLine(&lines[i]); err != nil {
+			log.Printf("Ошибка создания строки счёта: %v", err)
+		}
+	}
+
+	invoice.Lines = lines
+	log.Printf("Создан счёт %s для %s: %.2f %s", invoice.Number, account.Name, invoice.TotalAmount, invoice.Currency)
+
+	return invoice, nil
+}
+
+// buildInvoice рассчитывает счёт со строками в памяти, без номера и записи в БД.
+// nil без ошибки — счёт не нужен (нулевая сумма без generate_zero_invoices).
+func (s *Service) buildInvoice(account models.Account, accountModules []models.AccountModule, period, rateDate time.Time) (*models.Invoice, error) {
+	// Получаем среднее количество объектов за расчётный период (по умолчанию — календарный месяц)
+	periodStart, periodEnd := account.BillingPeriodRange(period)
+	avgUnits, err := s.calculateAverageUnits(account.ID, account.BillingEndDate, periodStart, periodEnd)
+	if err != nil {
+		log.Printf("Ошибка расчёта среднего для %s: %v", account.Name, err)
+		avgUnits = 0
+	}
+
+	// Определяем целевую валюту аккаунта
+	targetCurrency := account.BillingCurrency
+	if targetCurrency == "" {
+		targetCurrency = s.defaultCurrency
+	}
+
+	// Строки по модулям, НДС и минимальная сумма счёта
+	amounts, err := s.calculateInvoiceAmounts(&account, accountModules, avgUnits, targetCurrency, rateDate)
+	if err != nil {
+		return nil, err
+	}
+	totalAmount := amounts.Total
+
+	if totalAmount == 0 {
+		settings, _ := s.repo.GetSettings()
+		if settings == nil || !settings.GenerateZeroInvoices {
+			log.Printf("Нулевой счёт для %s, пропускаем", account.Name)
+			return nil, nil
+		}
+		log.Printf("Нулевой счёт для %s — создаём (generate_zero_invoices)", account.Name)
+	}
+
+	// Создаём счёт
+	invoice := &models.Invoice{
+		AccountID:   account.ID,
+		Period:      period,
+		TotalAmount: totalAmount,
+		VATAmount:   amounts.VAT,
+		VATOnTop:    amounts.VATOnTop,
+		Currency:    targetCurrency,
+		Status:      "draft",
+		PeriodStart: &periodStart,
+		PeriodEnd:   &periodEnd,
+	}
+
+	// Курса на дату счёта ещё нет — цены в валюте модуля, пересчитаем после публикации курса
+	invoice.NeedsRateReissue = amounts.RateMissing
+
+	// Справочная сумма в валюте отображения — только для информации, сумма к оплате не меняется
+	if account.DisplayCurrency != "" && account.DisplayCurrency != targetCurrency {
+		converted, err := s.convertCurrency(totalAmount, targetCurrency, account.DisplayCurrency, rateDate)
+		if err != nil {
+			log.Printf("Справочная сумма %s для %s не рассчитана: %v", account.DisplayCurrency, account.Name, err)
+		} else {
+			refDate := rateDate
+			invoice.ReferenceAmount = s.RoundAmount(converted, account.DisplayCurrency)
+			invoice.ReferenceCurrency = account.DisplayCurrency
+			invoice.ReferenceRateDate = &refDate
+		}
+	}
+
+	invoice.Lines = amounts.Lines
+	return invoice, nil
+}
+
+// invoiceAmounts - строки и суммы счёта, рассчитанные по курсу на дату счёта
+type invoiceAmounts struct {
+	Lines       []models.InvoiceLine
+	Total       float64 // к оплате (с НДС)
+	VAT         float64
+	VATOnTop    bool
+	RateMissing bool // курса нет — цены части модулей остались в их валюте
+}
+
+// calculateInvoiceAmounts рассчитывает строки по модулям, НДС и применяет минимальную сумму
+// счёта. Общий расчёт для выставления и пересчёта по курсу. Сумма ниже минимальной
+// в режиме skip — BelowMinimumError.
+func (s *Service) calculateInvoiceAmounts(account *models.Account, accountModules []models.AccountModule, avgUnits float64,
+	currency string, rateDate time.Time) (*invoiceAmounts, error) {
+	rateMissing := false
+	lines, subtotal := s.buildInvoiceLines(accountModules, avgUnits, currency,
+		func(amount float64, from, to string) (float64, error) {
+			result, err := s.convertCurrency(amount, from, to, rateDate)
+			if err != nil {
+				rateMissing = true
+			}
+			return result, err
+		})
+
+	// НДС: включён в цены (выделяем из суммы) или начисляется сверху
+	vatAmount, totalAmount, vatOnTop := s.applyVAT(lines, subtotal, account)
+
+	// Минимальная сумма счёта: ниже порога — не выставляем или доводим до минимума
+	if minimum, mode := s.minimumInvoiceAmount(currency, rateDate); totalAmount > 0 && totalAmount < minimum {
+		if mode != models.OnBelowMinimumRoundUp {
+			log.Printf("Счёт для %s ниже минимальной суммы (%.2f < %.2f %s), пропускаем",
+				account.Name, totalAmount, minimum, currency)
+			return nil, &BelowMinimumError{BelowMinimum{
+				AccountID:   account.ID,
+				AccountName: account.Name,
+				Amount:      totalAmount,
+				Minimum:     minimum,
+				Currency:    currency,
+			}}
+		}
+		adjustment := s.minimumAdjustmentLine(minimum-totalAmount, vatOnTop, currency, account)
+		lines = append(lines, adjustment)
+		subtotal += adjustment.TotalPrice
+		vatAmount, totalAmount, vatOnTop = s.applyVAT(lines, subtotal, account)
+		log.Printf("Счёт для %s доведён до минимальной суммы %.2f %s", account.Name, minimum, currency)
+	}
+
+	return &invoiceAmounts{
+		Lines:       lines,
+		Total:       totalAmount,
+		VAT:         vatAmount,
+		VATOnTop:    vatOnTop,
+		RateMissing: rateMissing,
+	}, nil
+}
+
+// BelowMinimum - аккаунт, счёт которому не выставлен из-за суммы ниже минимальной
+type BelowMinimum struct {
+	AccountID   uint    `json:"account_id"`
+	AccountName string  `json:"account_name"`
+	Amount      float64 `json:"amount"`
+	Minimum     float64 `json:"minimum"`
+	Currency    string  `json:"currency"`
+}
+
+// BelowMinimumError - счёт не выставлен: сумма ниже минимальной (режим skip)
+type BelowMinimumError struct {
+	BelowMinimum
+}
+
+func (e *BelowMinimumError) Error() string {
+	return fmt.Sprintf("сумма счёта %.2f %s ниже минимальной %.2f", e.Amount, e.Currency, e.Minimum)
+}
+
+// InsufficientData - аккаунт, счёт которому не выставлен из-за нехватки снимков за период
+type InsufficientData struct {
+	AccountID    uint      `json:"account_id"`
+	AccountName  string    `json:"account_name"`
+	PeriodStart  time.Time `json:"period_start"`
+	PeriodEnd    time.Time `json:"period_end"`
+	SnapshotDays int       `json:"snapshot_days"` // дней со снимками
+	Required     int       `json:"required"`      // требуется (min_snapshot_days_for_billing)
+}
+
+// InsufficientDataError - счёт не выставлен: дней со снимками меньше min_snapshot_days_for_billing
+type InsufficientDataError struct {
+	InsufficientData
+}
+
+func (e *InsufficientDataError) Error() string {
+	return fmt.Sprintf("недостаточно данных: снимки есть за %d дн. из требуемых %d", e.SnapshotDays, e.Required)
+}
+
+// checkSnapshotCoverage проверяет, что за расчётный период есть снимки хотя бы за
+// min_snapshot_days_for_billing дней (не больше числа начисляемых дней периода)
+func (s *Service) checkSnapshotCoverage(account *models.Account, period time.Time) error {
+	settings, _ := s.repo.GetSettings()
+	if settings == nil || settings.MinSnapshotDaysForBilling <= 0 {
+		return nil
+	}
+
+	start, end := account.BillingPeriodRange(period)
+	_, snapshotDays, err := s.calculateAverageUnitsInRange(account.ID, account.BillingEndDate, start, end, false)
+	if err != nil {
+		return err
+	}
+
+	// Биллинг прекращён внутри периода — требуем не больше начисляемых дней
+	billedDays := 0
+	for d := start; !d.After(end); d = d.AddDate(0, 0, 1) {
+		if account.IsBilledOn(d) {
+			billedDays++
+		}
+	}
+	required := min(settings.MinSnapshotDaysForBilling, billedDays)
+
+	if snapshotDays >= required {
+		return nil
+	}
+	log.Printf("Счёт для %s не выставлен: снимки за %d дн. из требуемых %d",
+		account.Name, snapshotDays, required)
+	return &InsufficientDataError{InsufficientData{
+		AccountID:    account.ID,
+		AccountName:  account.Name,
+		PeriodStart:  start,
+		PeriodEnd:    end,
+		SnapshotDays: snapshotDays,
+		Required:     required,
+	}}
+}
+
+// minimumInvoiceAmount возвращает минимальную сумму счёта в валюте счёта и режим обработки.
+// 0 — порог не задан или не удалось пересчитать его в валюту счёта.
+func (s *Service) minimumInvoiceAmount(currency string, rateDate time.Time) (float64, string) {
+	settings, _ := s.repo.GetSettings()
+	if settings == nil || settings.MinimumInvoiceAmount <= 0 {
+		return 0, ""
+	}
 
-	// Рассчитываем стоимость по каждому модулю
+	minCurrency := settings.MinimumInvoiceCurrency
+	if minCurrency == "" {
+		minCurrency = "KZT"
+	}
+	minimum, err := s.convertCurrency(settings.MinimumInvoiceAmount, minCurrency, currency, rateDate)
+	if err != nil {
+		log.Printf("Минимальная сумма счёта не применена: %v", err)
+		return 0, ""
+	}
+	return s.RoundAmount(minimum, currency), settings.OnBelowMinimum
+}
+
+// minimumAdjustmentLine строит строку доплаты до минимальной суммы счёта.
+// diff — недостающая сумма к оплате; при НДС сверху строка берётся без НДС.
+func (s *Service) minimumAdjustmentLine(diff float64, vatOnTop bool, currency string, account *models.Account) models.InvoiceLine {
+	price := diff
+	if vatOnTop {
+		settings, _ := s.repo.GetSettings()
+		price = diff / (1 + ResolveVATRate(settings, account)/100)
+	}
+	price = s.RoundAmount(price, currency)
+
+	return models.InvoiceLine{
+		ModuleName:  "Доплата до минимальной суммы счёта",
+		ModuleUnit:  "усл.",
+		Quantity:    1,
+		UnitPrice:   price,
+		TotalPrice:  price,
+		Currency:    currency,
+		PricingType: "fixed",
+	}
+}
+
+// buildInvoiceLines рассчитывает строки счёта по модулям аккаунта.
+// convert — конвертация цены модуля в валюту аккаунта (по курсу нужной даты).
+func (s *Service) buildInvoiceLines(accountModules []models.AccountModule, avgUnits float64, targetCurrency string,
+	convert func(amount float64, from, to string) (float64, error)) ([]models.InvoiceLine, float64) {
 	var totalAmount float64
 	var lines []models.InvoiceLine
 
@@ -145,11 +633,11 @@ func (s *Service) generateInvoiceForAccount(account models.Account, period, rate
 
 			// Конвертируем цену в валюту аккаунта
 			if module.Currency != targetCurrency {
-				converted, err := s.convertCurrency(unitPrice, module.Currency, targetCurrency, rateDate)
+				converted, err := convert(unitPrice, module.Currency, targetCurrency)
 				if err != nil {
 					log.Printf("Ошибка конвертации %s→%s для модуля %s: %v", module.Currency, targetCurrency, module.Name, err)
 				} else {
-					unitPrice = math.Round(converted*100) / 100
+					unitPrice = s.RoundAmount(converted, targetCurrency)
 				}
 			}
 			totalPrice = unitPrice
@@ -160,16 +648,16 @@ func (s *Service) generateInvoiceForAccount(account models.Account, period, rate
 
 			// Сначала конвертируем цену ЗА ЕДИНИЦУ в валюту аккаунта
 			if module.Currency != targetCurrency {
-				converted, err := s.convertCurrency(unitPrice, module.Currency, targetCurrency, rateDate)
+				converted, err := convert(unitPrice, module.Currency, targetCurrency)
 				if err != nil {
 					log.Printf("Ошибка конвертации %s→%s для модуля %s: %v", module.Currency, targetCurrency, module.Name, err)
 				} else {
-					unitPrice = math.Round(converted*100) / 100 // round(eur_price × rate, 2)
+					unitPrice = s.RoundAmount(converted, targetCurrency) // round(eur_price × rate, точность валюты)
 				}
 			}
 
 			// Потом: Кол-во × Цена_KZT = Сумма (как в 1С)
-			totalPrice = math.Round(quantity*unitPrice*100) / 100
+			totalPrice = s.RoundAmount(quantity*unitPrice, targetCurrency)
 		}
 
 		line := models.InvoiceLine{
@@ -182,109 +670,218 @@ func (s *Service) generateInvoiceForAccount(account models.Account, period, rate
 			TotalPrice:  totalPrice,
 			Currency:    targetCurrency,
 			PricingType: module.PricingType,
+			VATExempt:   module.VATExempt,
 		}
 		lines = append(lines, line)
 		totalAmount += totalPrice
 	}
 
-	if totalAmount == 0 {
-		log.Printf("Нулевой счёт для %s, пропускаем", account.Name)
-		return nil, nil
-	}
-
-	// Глобальный порядковый номер (общий для всех аккаунтов)
-	globalSeqNum, _ := s.repo.GetMaxInvoiceSequence()
-	globalSeqNum++
+	return lines, totalAmount
+}
 
-	// Создаём счёт
-	invoice := &models.Invoice{
-		AccountID:   account.ID,
-		Period:      period,
-		TotalAmount: totalAmount,
-		Currency:    targetCurrency,
-		Status:      "draft",
+// applyVAT рассчитывает НДС по облагаемым строкам согласно настройкам.
+// Возвращает сумму НДС, итог к оплате и признак начисления НДС сверху.
+func (s *Service) applyVAT(lines []models.InvoiceLine, subtotal float64, account *models.Account) (vatAmount, total float64, onTop bool) {
+	settings, _ := s.repo.GetSettings()
+	if settings == nil {
+		settings = &models.BillingSettings{VATRate: defaultVATRate, PricesIncludeVAT: true}
 	}
+	// Ставка аккаунта (invoice preferences) или из настроек биллинга
+	vatRate := ResolveVATRate(settings, account)
+
+	// База НДС — только строки, облагаемые НДС
+	currency := linesCurrency(lines)
+	vatBase := taxableAmount(lines)
+	if settings.PricesIncludeVAT {
+		vatAmount = s.RoundAmount(vatBase*vatRate/(100+vatRate), currency)
+		return vatAmount, subtotal, false
+	}
+	vatAmount = s.RoundAmount(vatBase*vatRate/100, currency)
+	return vatAmount, s.RoundAmount(subtotal+vatAmount, currency), true
+}
 
-	// Формат: WH-{глобальный_номер}
-	invoice.Number = fmt.Sprintf("WH-%d", globalSeqNum)
-
-	if err := s.repo.CreateInvoice(invoice); err != nil {
-		return nil, err
+// taxableAmount возвращает сумму строк, облагаемых НДС
+func taxableAmount(lines []models.InvoiceLine) float64 {
+	var sum float64
+	for _, line := range lines {
+		if !line.VATExempt {
+			sum += line.TotalPrice
+		}
 	}
+	return sum
+}
 
-	// Создаём строки счёта
-	for i := range lines {
-		lines[i].InvoiceID = invoice.ID
-		if err := s.repo.CreateInvoiceLine(&lines[i]); err != nil {
-			log.Printf("Ошибка создания строки счёта: %v", err)
+// VATBreakdown возвращает сумму без НДС, НДС и итог к оплате для счёта.
+// Для счетов без зафиксированного НДС считает его включённым в сумму облагаемых строк по текущей ставке.
+// Суммы округляются с точностью валюты precision.
+func VATBreakdown(invoice *models.Invoice, settings *models.BillingSettings, precision Precision) (net, vat, total float64) {
+	total = invoice.TotalAmount
+	vat = invoice.VATAmount
+	if vat == 0 && !invoice.VATOnTop {
+		vatRate := ResolveVATRate(settings, &invoice.Account)
+		base := total
+		if len(invoice.Lines) > 0 {
+			base = taxableAmount(invoice.Lines)
 		}
+		vat = precision.RoundAmount(base*vatRate/(100+vatRate), invoice.Currency)
 	}
+	net = precision.RoundAmount(total-vat, invoice.Currency)
+	return net, vat, total
+}
 
-	invoice.Lines = lines
-	log.Printf("Создан счёт %s для %s: %.2f %s", invoice.Number, account.Name, totalAmount, targetCurrency)
+// ConversionResult - результат конвертации с использованными курсами
+type ConversionResult struct {
+	From     string               `json:"from"`
+	To       string               `json:"to"`
+	Amount   float64              `json:"amount"`
+	Result   float64              `json:"result"`
+	Date     string               `json:"date"`
+	FromRate *models.ExchangeRate `json:"from_rate,omitempty"` // курс from → KZT (nil для KZT)
+	ToRate   *models.ExchangeRate `json:"to_rate,omitempty"`   // курс to → KZT (nil для KZT)
+}
 
-	return invoice, nil
+// ConvertCurrency конвертирует сумму через KZT; при отсутствии курса на дату берёт последний известный
+func (s *Service) ConvertCurrency(amount float64, from, to string, date time.Time) (*ConversionResult, error) {
+	result, fromRate, toRate, err := s.convertWithRates(amount, from, to, date, true)
+	if err != nil {
+		return nil, err
+	}
+	return &ConversionResult{
+		From:     from,
+		To:       to,
+		Amount:   amount,
+		Result:   s.RoundAmount(result, to),
+		Date:     date.Format("2006-01-02"),
+		FromRate: fromRate,
+		ToRate:   toRate,
+	}, nil
 }
 
-// convertCurrency конвертирует сумму из одной валюты в другую через KZT
+// convertCurrency конвертирует сумму из одной валюты в другую через KZT (строго по курсу на дату)
 func (s *Service) convertCurrency(amount float64, from, to string, date time.Time) (float64, error) {
+	result, _, _, err := s.convertWithRates(amount, from, to, date, false)
+	return result, err
+}
+
+// convertWithRates конвертирует сумму через KZT и возвращает использованные курсы
+func (s *Service) convertWithRates(amount float64, from, to string, date time.Time, carryForward bool) (float64, *models.ExchangeRate, *models.ExchangeRate, error) {
 	if from == to {
-		return amount, nil
+		return amount, nil, nil, nil
 	}
 
 	// Получаем сумму в KZT
 	var amountInKZT float64
+	var fromRate *models.ExchangeRate
 
 	if from == "KZT" {
 		amountInKZT = amount
 	} else {
 		// Получаем курс from → KZT
-		rate, err := s.repo.GetExchangeRateByDate(from, date)
+		rate, err := s.findRate(from, date, carryForward)
 		if err != nil {
-			return 0, fmt.Errorf("курс %s за %s не найден: %w", from, date.Format("02.01.2006"), err)
+			return 0, nil, nil, fmt.Errorf("курс %s за %s не найден: %w", from, date.Format("02.01.2006"), err)
 		}
+		fromRate = rate
 		amountInKZT = amount * rate.Rate
 	}
 
 	// Конвертируем KZT → to
 	if to == "KZT" {
-		return amountInKZT, nil
+		return amountInKZT, fromRate, nil, nil
 	}
 
-	rateToTarget, err := s.repo.GetExchangeRateByDate(to, date)
+	rateToTarget, err := s.findRate(to, date, carryForward)
 	if err != nil {
-		return 0, fmt.Errorf("курс %s за %s не найден: %w", to, date.Format("02.01.2006"), err)
+		return 0, nil, nil, fmt.Errorf("курс %s за %s не найден: %w", to, date.Format("02.01.2006"), err)
 	}
 
-	return amountInKZT / rateToTarget.Rate, nil
+	return amountInKZT / rateToTarget.Rate, fromRate, rateToTarget, nil
+}
+
+// findRate ищет курс на дату; при carryForward — последний известный на дату или раньше
+func (s *Service) findRate(currency string, date time.Time, carryForward bool) (*models.ExchangeRate, error) {
+	rate, err := s.repo.GetExchangeRateByDate(currency, date)
+	if err == nil || !carryForward {
+		return rate, err
+	}
+	return s.repo.GetExchangeRateOnOrBefore(currency, date)
+}
+
+// calculateAverageUnits рассчитывает среднее количество АКТИВНЫХ объектов за расчётный период
+// с start по end включительно
+func (s *Service) calculateAverageUnits(accountID uint, billingEnd *time.Time, start, end time.Time) (float64, error) {
+	avg, _, err := s.calculateAverageUnitsInRange(accountID, billingEnd, start, end, false)
+	return avg, err
 }
 
-// calculateAverageUnits рассчитывает среднее количество АКТИВНЫХ объектов за месяц
-func (s *Service) calculateAverageUnits(accountID uint, year, month int) (float64, error) {
-	snapshots, err := s.repo.GetSnapshotsByAccountAndPeriod(accountID, year, month)
+// calculateAverageUnitsWithDays рассчитывает среднее АКТИВНЫХ объектов за календарный месяц.
+// byElapsed = false — делим на дни месяца (как в счёте), true — на число дней со снимками (для прогноза).
+// Возвращает также число дней со снимками.
+func (s *Service) calculateAverageUnitsWithDays(accountID uint, billingEnd *time.Time, year, month int, byElapsed bool) (float64, int, error) {
+	start, end := models.MonthRange(time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC))
+	return s.calculateAverageUnitsInRange(accountID, billingEnd, start, end, byElapsed)
+}
+
+// calculateAverageUnitsInRange рассчитывает среднее АКТИВНЫХ объектов за дни с start по end включительно.
+// Снимки после billingEnd (дата прекращения биллинга) не учитываются.
+func (s *Service) calculateAverageUnitsInRange(accountID uint, billingEnd *time.Time, start, end time.Time, byElapsed bool) (float64, int, error) {
+	snapshots, err := s.repo.GetSnapshotsByAccountAndRange(accountID, start, end)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	rangeStart := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	rangeEnd := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+	daysInPeriod := int(rangeEnd.Sub(rangeStart).Hours()/24) + 1
+	billedDays := daysInPeriod
+	if billingEnd != nil {
+		account := models.Account{BillingEndDate: billingEnd}
+		billed := snapshots[:0]
+		for _, snap := range snapshots {
+			if account.IsBilledOn(snap.SnapshotDate) {
+				billed = append(billed, snap)
+			}
+		}
+		snapshots = billed
+
+		billedDays = 0
+		for d := 0; d < daysInPeriod; d++ {
+			if account.IsBilledOn(rangeStart.AddDate(0, 0, d)) {
+				billedDays++
+			}
+		}
 	}
 
 	if len(snapshots) == 0 {
-		return 0, nil
+		return 0, 0, nil
+	}
+
+	// Льгота: недавно деактивированные объекты учитываются долей активного
+	graceUnits := make(map[uint]float64)
+	if settings, _ := s.repo.GetSettings(); settings != nil && settings.DeactivationGraceDays > 0 {
+		if graceUnits, err = s.repo.GetDeactivationGraceUnits(snapshots, settings.DeactivationGraceDays); err != nil {
+			return 0, 0, err
+		}
 	}
 
 	// Считаем сумму АКТИВНЫХ объектов по всем дням (без деактивированных)
-	var totalActiveUnits int
-	for _, s := range snapshots {
-		activeUnits := s.TotalUnits - s.UnitsDeactivated
+	var totalActiveUnits float64
+	for _, snap := range snapshots {
+		activeUnits := snap.TotalUnits - snap.UnitsDeactivated
 		if activeUnits < 0 {
 			activeUnits = 0
 		}
-		totalActiveUnits += activeUnits
+		totalActiveUnits += float64(activeUnits) + graceUnits[snap.ID]
 	}
 
-	// Количество дней в месяце
-	daysInMonth := time.Date(year, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	// Для прогноза — среднее по дням, за которые есть данные (с учётом доли начисляемых дней месяца)
+	if byElapsed {
+		avg := totalActiveUnits / float64(len(snapshots))
+		return avg * float64(billedDays) / float64(daysInPeriod), len(snapshots), nil
+	}
 
-	// Среднее = сумма активных / дней в месяце
-	return float64(totalActiveUnits) / float64(daysInMonth), nil
+	// Среднее = сумма активных / дней в расчётном периоде
+	return totalActiveUnits / float64(daysInPeriod), len(snapshots), nil
 }
 
 // RecalculateCurrentPeriod пересчитывает счёт за текущий период
@@ -299,5 +896,35 @@ func (s *Service) RecalculateCurrentPeriod(accountID uint) (*models.Invoice, err
 	}
 
 	rateDate := period.AddDate(0, 1, 0)
-	return s.generateInvoiceForAccount(account, period, rateDate)
+	return s.generateInvoiceForAccount(account, period, rateDate, false)
+}
+
+// ErrNothingToInvoice - за период нечего выставлять (нет модулей или нулевая сумма)
+var ErrNothingToInvoice = errors.New("за период нет начислений для счёта")
+
+// PreviewInvoice рассчитывает счёт аккаунта за период без записи в БД: номер не присваивается,
+// существующий счёт за период не удаляется
+func (s *Service) PreviewInvoice(accountID uint, period time.Time) (*models.Invoice, error) {
+	account, err := s.repo.GetAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	accountModules, err := s.repo.GetAccountModules(account.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(accountModules) == 0 {
+		return nil, ErrNothingToInvoice
+	}
+
+	inv, err := s.buildInvoice(*account, accountModules, period, period.AddDate(0, 1, 0))
+	if err != nil {
+		return nil, err
+	}
+	if inv == nil {
+		return nil, ErrNothingToInvoice
+	}
+	inv.Account = *account
+	return inv, nil
 }
@@ -0,0 +1,50 @@
+package invoice
+
+import (
+	"math"
+	"time"
+)
+
+// UsageSummary - итоги закрытого месяца по аккаунту для письма партнёру
+type UsageSummary struct {
+	AccountID      uint               `json:"account_id"`
+	Period         time.Time          `json:"period"`
+	AvgActiveUnits float64            `json:"avg_active_units"`
+	DaysWithData   int                `json:"days_with_data"`
+	Charges        map[string]float64 `json:"charges"` // начисления за месяц по валютам модулей
+}
+
+// MonthlySummary считает среднее активных объектов (как в счёте) и сумму ежедневных начислений за месяц
+func (s *Service) MonthlySummary(accountID uint, period time.Time) (*UsageSummary, error) {
+	year, month := period.Year(), int(period.Month())
+
+	account, err := s.repo.GetAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	avgUnits, daysWithData, err := s.calculateAverageUnitsWithDays(accountID, account.BillingEndDate, year, month, false)
+	if err != nil {
+		return nil, err
+	}
+
+	charges, err := s.repo.GetDailyCharges(accountID, 0, year, month, false)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &UsageSummary{
+		AccountID:      accountID,
+		Period:         time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC),
+		AvgActiveUnits: math.Round(avgUnits*100) / 100,
+		DaysWithData:   daysWithData,
+		Charges:        make(map[string]float64),
+	}
+	for _, charge := range charges {
+		summary.Charges[charge.Currency] += charge.DailyCost
+	}
+	for currency, total := range summary.Charges {
+		summary.Charges[currency] = s.RoundAmount(total, currency)
+	}
+	return summary, nil
+}
@@ -0,0 +1,127 @@
+package invoice
+
+import (
+	"math"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+)
+
+// DefaultValidationThreshold - допустимое отклонение количества в строке счёта, %
+const DefaultValidationThreshold = 5.0
+
+// Источники ожидаемого количества при проверке счёта
+const (
+	ValidationSourceSnapshots = "snapshots" // среднее активных объектов по снимкам за период
+	ValidationSourceWialon    = "wialon"    // активные объекты в Wialon на момент проверки
+)
+
+// LineDiscrepancy - строка счёта, количество в которой расходится с ожидаемым
+type LineDiscrepancy struct {
+	LineID           uint    `json:"line_id"`
+	ModuleID         uint    `json:"module_id"`
+	ModuleName       string  `json:"module_name"`
+	Source           string  `json:"source"` // snapshots или wialon
+	Quantity         float64 `json:"quantity"`
+	Expected         float64 `json:"expected"`
+	DeviationPercent float64 `json:"deviation_percent"`
+}
+
+// InvoiceValidation - результат сверки количеств счёта со снимками и Wialon (счёт не меняется)
+type InvoiceValidation struct {
+	InvoiceID           uint              `json:"invoice_id"`
+	AccountID           uint              `json:"account_id"`
+	PeriodStart         time.Time         `json:"period_start"`
+	PeriodEnd           time.Time         `json:"period_end"`
+	ThresholdPercent    float64           `json:"threshold_percent"`
+	SnapshotAvgUnits    float64           `json:"snapshot_avg_units"`    // пересчитанное среднее активных объектов
+	SnapshotDays        int               `json:"snapshot_days"`         // дней со снимками
+	MissingSnapshotDays int               `json:"missing_snapshot_days"` // дней периода без снимка
+	WialonActiveUnits   *int              `json:"wialon_active_units,omitempty"`
+	Valid               bool              `json:"valid"`
+	Discrepancies       []LineDiscrepancy `json:"discrepancies"`
+	CheckedAt           time.Time         `json:"checked_at"`
+}
+
+// ValidateInvoice сверяет количество в строках счёта (per_unit) со средним активных объектов,
+// пересчитанным по снимкам за расчётный период, и, если передано wialonActive, — с текущим
+// числом активных объектов в Wialon. Строки с отклонением больше thresholdPercent попадают
+// в Discrepancies. Счёт не изменяется.
+func (s *Service) ValidateInvoice(inv *models.Invoice, thresholdPercent float64, wialonActive *int) (*InvoiceValidation, error) {
+	start, end := inv.PeriodRange()
+
+	account, err := s.repo.GetAccountByID(inv.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	avgUnits, snapshotDays, err := s.calculateAverageUnitsInRange(inv.AccountID, account.BillingEndDate, start, end, false)
+	if err != nil {
+		return nil, err
+	}
+
+	rangeStart := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC)
+	rangeEnd := time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.UTC)
+	daysInPeriod := int(rangeEnd.Sub(rangeStart).Hours()/24) + 1
+	// Период ещё идёт — снимков за будущие дни нет
+	if today := time.Now().UTC(); rangeEnd.After(today) {
+		daysInPeriod = int(today.Sub(rangeStart).Hours()/24) + 1
+	}
+
+	result := &InvoiceValidation{
+		InvoiceID:           inv.ID,
+		AccountID:           inv.AccountID,
+		PeriodStart:         start,
+		PeriodEnd:           end,
+		ThresholdPercent:    thresholdPercent,
+		SnapshotAvgUnits:    math.Round(avgUnits*100) / 100,
+		SnapshotDays:        snapshotDays,
+		MissingSnapshotDays: max(daysInPeriod-snapshotDays, 0),
+		WialonActiveUnits:   wialonActive,
+		Discrepancies:       make([]LineDiscrepancy, 0),
+		CheckedAt:           time.Now().UTC(),
+	}
+
+	expected := map[string]float64{ValidationSourceSnapshots: math.Round(avgUnits)}
+	if wialonActive != nil {
+		expected[ValidationSourceWialon] = float64(*wialonActive)
+	}
+
+	for _, line := range inv.Lines {
+		if line.PricingType != "per_unit" {
+			continue
+		}
+		for _, source := range []string{ValidationSourceSnapshots, ValidationSourceWialon} {
+			want, ok := expected[source]
+			if !ok {
+				continue
+			}
+			deviation := quantityDeviation(line.Quantity, want)
+			if deviation <= thresholdPercent {
+				continue
+			}
+			result.Discrepancies = append(result.Discrepancies, LineDiscrepancy{
+				LineID:           line.ID,
+				ModuleID:         line.ModuleID,
+				ModuleName:       line.ModuleName,
+				Source:           source,
+				Quantity:         line.Quantity,
+				Expected:         want,
+				DeviationPercent: math.Round(deviation*100) / 100,
+			})
+		}
+	}
+
+	result.Valid = len(result.Discrepancies) == 0
+	return result, nil
+}
+
+// quantityDeviation - отклонение количества от ожидаемого, % (при ожидаемом 0 — 100% для любого ненулевого)
+func quantityDeviation(quantity, expected float64) float64 {
+	if expected == 0 {
+		if quantity == 0 {
+			return 0
+		}
+		return 100
+	}
+	return math.Abs(quantity-expected) / expected * 100
+}
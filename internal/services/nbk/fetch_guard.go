@@ -0,0 +1,63 @@
+package nbk
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultRefetchWindow — в течение этого времени курсы за уже загруженную дату не запрашиваются повторно
+const DefaultRefetchWindow = 6 * time.Hour
+
+// fetchGuard помнит, когда курс (валюта, дата) был успешно загружен из НБК
+type fetchGuard struct {
+	mu      sync.Mutex
+	window  time.Duration
+	fetched map[string]time.Time
+}
+
+func fetchGuardKey(currency string, date time.Time) string {
+	return currency + "|" + date.Format("2006-01-02")
+}
+
+// recent сообщает, загружены ли курсы всех валют за дату в пределах окна
+func (g *fetchGuard) recent(currencies []string, date time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.window <= 0 {
+		return false
+	}
+	for _, currency := range currencies {
+		at, ok := g.fetched[fetchGuardKey(currency, date)]
+		if !ok || time.Since(at) >= g.window {
+			return false
+		}
+	}
+	return true
+}
+
+// mark запоминает успешную загрузку курса
+func (g *fetchGuard) mark(currency string, date time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.fetched == nil {
+		g.fetched = make(map[string]time.Time)
+	}
+	now := time.Now()
+	// Заодно выбрасываем устаревшие записи, чтобы карта не росла
+	for key, at := range g.fetched {
+		if now.Sub(at) >= g.window {
+			delete(g.fetched, key)
+		}
+	}
+	g.fetched[fetchGuardKey(currency, date)] = now
+}
+
+// SetRefetchWindow задаёт окно, в течение которого загруженные курсы не запрашиваются повторно (0 — всегда запрашивать)
+func (s *Service) SetRefetchWindow(window time.Duration) {
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+	s.guard.window = window
+	s.guard.fetched = nil
+}
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/user/wialon-billing-api/internal/config"
 	"github.com/user/wialon-billing-api/internal/models"
 	"github.com/user/wialon-billing-api/internal/repository"
 )
@@ -22,6 +23,10 @@ const (
 type Service struct {
 	repo   *repository.Repository
 	client *http.Client
+	guard  fetchGuard
+
+	// Валюты, курсы которых к тенге загружаются из НБК
+	currencies []string
 }
 
 // NBKRate - курс валюты из API НБК
@@ -36,9 +41,45 @@ func NewService(repo *repository.Repository) *Service {
 	return &Service{
 		repo:   repo,
 		client: &http.Client{Timeout: 30 * time.Second},
+		guard:  fetchGuard{window: DefaultRefetchWindow},
+
+		currencies: config.DefaultNBKCurrencies,
 	}
 }
 
+// SetCurrencies задаёт валюты, курсы которых загружаются из НБК (пустой список — по умолчанию)
+func (s *Service) SetCurrencies(currencies []string) {
+	if len(currencies) == 0 {
+		currencies = config.DefaultNBKCurrencies
+	}
+	s.currencies = currencies
+}
+
+// Currencies возвращает валюты, курсы которых загружаются из НБК
+func (s *Service) Currencies() []string {
+	return s.currencies
+}
+
+// CheckTrackedCurrencies возвращает валюты модулей и аккаунтов, курсы которых не загружаются
+// из НБК: счета в них не пересчитаются в тенге («нет курса для валюты»)
+func (s *Service) CheckTrackedCurrencies() ([]string, error) {
+	used, err := s.repo.GetUsedCurrencies()
+	if err != nil {
+		return nil, err
+	}
+	tracked := make(map[string]bool, len(s.currencies))
+	for _, currency := range s.currencies {
+		tracked[currency] = true
+	}
+	var missing []string
+	for _, currency := range used {
+		if currency != "KZT" && !tracked[currency] {
+			missing = append(missing, currency)
+		}
+	}
+	return missing, nil
+}
+
 // FetchExchangeRates получает курсы валют из НБК
 func (s *Service) FetchExchangeRates() error {
 	return s.FetchExchangeRatesForDate(time.Now())
@@ -60,30 +101,75 @@ type XMLItem struct {
 // FetchExchangeRatesForDate получает курсы валют из НБК за конкретную дату
 func (s *Service) FetchExchangeRatesForDate(date time.Time) error {
 	dateStr := date.Format("02.01.2006")
+
+	// Курсы за эту дату уже загружались недавно — повторно НБК не запрашиваем
+	if s.guard.recent(s.currencies, date) {
+		log.Printf("Курсы за %s уже загружены, повторный запрос к НБК пропущен", dateStr)
+		return nil
+	}
+
+	rates, err := s.FetchRatesForDate(date)
+	if err != nil {
+		return err
+	}
+
+	// Сохраняем курсы отслеживаемых валют
+	saved := 0
+	for currency, rate := range rates {
+		exchangeRate := &models.ExchangeRate{
+			CurrencyFrom: currency,
+			CurrencyTo:   "KZT",
+			Rate:         rate,
+			RateDate:     date,
+		}
+
+		if err := s.repo.SaveExchangeRate(exchangeRate); err != nil {
+			log.Printf("Ошибка сохранения курса %s: %v", currency, err)
+			continue
+		}
+		s.guard.mark(currency, date)
+		saved++
+	}
+
+	if saved > 0 {
+		log.Printf("Сохранено %d курсов за %s", saved, dateStr)
+	}
+
+	return nil
+}
+
+// FetchRatesForDate запрашивает курсы отслеживаемых валют из НБК за дату без сохранения.
+// Пустая карта — НБК не опубликовал курсы на эту дату.
+func (s *Service) FetchRatesForDate(date time.Time) (map[string]float64, error) {
+	dateStr := date.Format("02.01.2006")
 	url := fmt.Sprintf(nbkAPIURL, dateStr)
 
 	resp, err := s.client.Get(url)
 	if err != nil {
-		return fmt.Errorf("ошибка запроса к НБК: %w", err)
+		return nil, fmt.Errorf("ошибка запроса к НБК: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("ошибка чтения ответа: %w", err)
+		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	rates := make(map[string]float64)
+	tracked := make(map[string]bool, len(s.currencies))
+	for _, currency := range s.currencies {
+		tracked[currency] = true
 	}
 
 	// Парсим XML
 	var xmlRates XMLRates
 	if err := xml.Unmarshal(body, &xmlRates); err != nil {
 		log.Printf("Ошибка парсинга XML за %s: %v", dateStr, err)
-		return nil
+		return rates, nil
 	}
 
-	// Сохраняем нужные курсы (EUR, RUB)
-	saved := 0
 	for _, item := range xmlRates.Items {
-		if item.Title == "EUR" || item.Title == "RUB" {
+		if tracked[item.Title] {
 			// Парсим курс из строки
 			rate, err := strconv.ParseFloat(item.Description, 64)
 			if err != nil {
@@ -95,26 +181,11 @@ func (s *Service) FetchExchangeRatesForDate(date time.Time) error {
 				rate = rate / float64(item.Quant)
 			}
 
-			exchangeRate := &models.ExchangeRate{
-				CurrencyFrom: item.Title,
-				CurrencyTo:   "KZT",
-				Rate:         rate,
-				RateDate:     date,
-			}
-
-			if err := s.repo.SaveExchangeRate(exchangeRate); err != nil {
-				log.Printf("Ошибка сохранения курса %s: %v", item.Title, err)
-				continue
-			}
-			saved++
+			rates[item.Title] = rate
 		}
 	}
 
-	if saved > 0 {
-		log.Printf("Сохранено %d курсов за %s", saved, dateStr)
-	}
-
-	return nil
+	return rates, nil
 }
 
 // fetchFromAlternativeAPI - альтернативный API (резерв)
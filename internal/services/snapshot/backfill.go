@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// backfillWorkers - число параллельных пересчётов при досчёте начислений по умолчанию
+const backfillWorkers = 4
+
+// maxBackfillErrors - сколько ошибок досчёта возвращать в ответе (остальные только в логе)
+const maxBackfillErrors = 50
+
+// ChargesBackfillError - ошибка пересчёта начислений аккаунта за месяц
+type ChargesBackfillError struct {
+	AccountID uint   `json:"account_id"`
+	Period    string `json:"period"`
+	Error     string `json:"error"`
+}
+
+// ChargesBackfillResult - итог досчёта начислений за диапазон месяцев
+type ChargesBackfillResult struct {
+	From      string                 `json:"from"`
+	To        string                 `json:"to"`
+	Accounts  int                    `json:"accounts"`
+	Months    int                    `json:"months"`
+	Total     int                    `json:"total"` // пар «аккаунт × месяц»
+	Succeeded int                    `json:"succeeded"`
+	Failed    int                    `json:"failed"`
+	Errors    []ChargesBackfillError `json:"errors"`
+	Duration  string                 `json:"duration"`
+}
+
+// BackfillDailyCharges пересчитывает начисления (CalculateDailyChargesForPeriod) за все месяцы
+// с from по to включительно — после загрузки исторических снимков (CreateSnapshotsForRange).
+// Пустой accountIDs — все аккаунты в биллинге. Пары «аккаунт × месяц» обрабатываются
+// пулом из workers горутин (<= 0 — backfillWorkers); ошибка одной пары не прерывает остальные.
+func (s *Service) BackfillDailyCharges(accountIDs []uint, from, to time.Time, workers int) (*ChargesBackfillResult, error) {
+	if len(accountIDs) == 0 {
+		accounts, err := s.repo.GetSelectedAccounts()
+		if err != nil {
+			return nil, err
+		}
+		for _, acc := range accounts {
+			accountIDs = append(accountIDs, acc.ID)
+		}
+	}
+	if workers <= 0 {
+		workers = backfillWorkers
+	}
+
+	type task struct {
+		accountID uint
+		month     time.Time
+	}
+
+	first := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+	last := time.Date(to.Year(), to.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var months []time.Time
+	for m := first; !m.After(last); m = m.AddDate(0, 1, 0) {
+		months = append(months, m)
+	}
+
+	result := &ChargesBackfillResult{
+		From:     first.Format("2006-01"),
+		To:       last.Format("2006-01"),
+		Accounts: len(accountIDs),
+		Months:   len(months),
+		Total:    len(accountIDs) * len(months),
+		Errors:   []ChargesBackfillError{},
+	}
+	started := time.Now()
+	log.Printf("BackfillDailyCharges: %s — %s, %d аккаунтов, %d пересчётов, %d потоков",
+		result.From, result.To, result.Accounts, result.Total, workers)
+
+	tasks := make(chan task)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	processed := 0
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				err := s.CalculateDailyChargesForPeriod(t.accountID, t.month.Year(), int(t.month.Month()))
+
+				mu.Lock()
+				processed++
+				if err != nil {
+					result.Failed++
+					log.Printf("BackfillDailyCharges: аккаунт %d за %s: %v", t.accountID, t.month.Format("2006-01"), err)
+					if len(result.Errors) < maxBackfillErrors {
+						result.Errors = append(result.Errors, ChargesBackfillError{
+							AccountID: t.accountID,
+							Period:    t.month.Format("2006-01"),
+							Error:     err.Error(),
+						})
+					}
+				} else {
+					result.Succeeded++
+				}
+				// Логируем прогресс каждые 100 пересчётов
+				if processed%100 == 0 {
+					log.Printf("BackfillDailyCharges: обработано %d/%d", processed, result.Total)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Месяц за месяцем: прошлые периоды становятся доступны для отчётов по порядку
+	for _, month := range months {
+		for _, accountID := range accountIDs {
+			tasks <- task{accountID: accountID, month: month}
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	result.Duration = time.Since(started).Round(time.Millisecond).String()
+	log.Printf("BackfillDailyCharges: завершено за %s, успешно %d, ошибок %d",
+		result.Duration, result.Succeeded, result.Failed)
+	return result, nil
+}
@@ -0,0 +1,80 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/services/wialon"
+)
+
+// RefreshBlockedStatus обновляет IsBlocked аккаунтов по флагу enabled из Wialon (как при входе партнёра).
+// Аккаунты в срезе обновляются на месте, изменения сохраняются в БД. Аккаунты, по которым
+// Wialon не ответил, сохраняют прежний статус.
+func (s *Service) RefreshBlockedStatus(ctx context.Context, accounts []models.Account) error {
+	byConnection := make(map[uint][]int)
+	for i := range accounts {
+		var connID uint
+		if accounts[i].ConnectionID != nil {
+			connID = *accounts[i].ConnectionID
+		}
+		byConnection[connID] = append(byConnection[connID], i)
+	}
+
+	var failed int
+	for connID, indexes := range byConnection {
+		wialonClient := s.wialon
+		var token string
+		if connID != 0 {
+			conn, err := s.repo.GetConnectionByID(connID)
+			if err != nil || conn == nil {
+				log.Printf("RefreshBlockedStatus: подключение %d не найдено, пропускаем", connID)
+				failed++
+				continue
+			}
+			token = conn.Token
+			wialonClient = s.newClient("https://"+conn.WialonHost, conn.Token, conn.RequestsPerSecond)
+		}
+		if err := wialonClient.Login(ctx); err != nil {
+			log.Printf("RefreshBlockedStatus: ошибка авторизации для подключения %d: %s", connID, wialon.ScrubError(err, token))
+			failed++
+			continue
+		}
+
+		wialonIDs := make([]int64, 0, len(indexes))
+		for _, i := range indexes {
+			wialonIDs = append(wialonIDs, accounts[i].WialonID)
+		}
+		data, _, err := wialonClient.GetAccountsDataBatch(ctx, wialonIDs)
+		if err != nil {
+			log.Printf("RefreshBlockedStatus: ошибка запроса данных подключения %d: %s", connID, wialon.ScrubError(err, token))
+			failed++
+			continue
+		}
+
+		for _, i := range indexes {
+			acc := &accounts[i]
+			accData, ok := data[acc.WialonID]
+			if !ok || accData == nil || accData.Enabled == nil {
+				continue
+			}
+			blocked := *accData.Enabled == 0
+			if acc.IsBlocked == blocked {
+				continue
+			}
+			if err := s.repo.SetAccountBlocked(acc.ID, blocked); err != nil {
+				log.Printf("RefreshBlockedStatus: ошибка сохранения статуса %s: %v", acc.Name, err)
+				continue
+			}
+			acc.IsBlocked = blocked
+			log.Printf("RefreshBlockedStatus: обновлён статус блокировки для %s (wialon_id=%d): is_blocked=%v",
+				acc.Name, acc.WialonID, blocked)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("статус блокировки не обновлён для %d подключений", failed)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/services/wialon"
+)
+
+// UsageSource - объекты одного владельца (bact), учитываемые для аккаунта
+type UsageSource struct {
+	WialonID    int64  `json:"wialon_id"`
+	Name        string `json:"name,omitempty"`  // имя из локальной БД, если аккаунт синхронизирован
+	Relation    string `json:"relation"`        // own — сам аккаунт, child — дочерний (parentAccountId)
+	Active      int    `json:"active"`          // активных объектов (не деактивированы)
+	Deactivated int    `json:"deactivated"`     // деактивированных (act = 0, dactt > 0)
+	Usage       *int   `json:"usage,omitempty"` // avl_unit.usage дочернего аккаунта
+}
+
+// UsageBreakdown - как получены цифры снимка для аккаунта (диагностика дилеров)
+type UsageBreakdown struct {
+	AccountID          uint             `json:"account_id"`
+	WialonID           int64            `json:"wialon_id"`
+	Name               string           `json:"name"`
+	IsDealer           bool             `json:"is_dealer"`
+	Strategy           string           `json:"strategy"`
+	OwnUsage           int              `json:"own_usage"`            // avl_unit.usage — только свои объекты → TotalUnits
+	ChildUsageSum      int              `json:"child_usage_sum"`      // сумма avl_unit.usage дочерних аккаунтов (в счёт не входит)
+	ChildActiveSum     int              `json:"child_active_sum"`     // активные объекты дочерних аккаунтов по bact
+	Sources            []UsageSource    `json:"sources"`              // объекты по владельцам (bact)
+	ComputedTotal      int              `json:"computed_total_units"` // TotalUnits, если снять снимок сейчас
+	ComputedDeactivate int              `json:"computed_deactivated"` // UnitsDeactivated: свои + дочерние
+	LastSnapshot       *models.Snapshot `json:"last_snapshot,omitempty"`
+	CheckedAt          time.Time        `json:"checked_at"`
+}
+
+// clientForAccount возвращает авторизованный клиент Wialon для аккаунта (подключение или глобальный)
+func (s *Service) clientForAccount(ctx context.Context, account *models.Account) (wialon.WialonAPI, string, error) {
+	client := s.wialon
+	strategy := models.SnapshotStrategyAuto
+	if account.ConnectionID != nil && *account.ConnectionID > 0 {
+		conn, err := s.repo.GetConnectionByID(*account.ConnectionID)
+		if err == nil && conn != nil {
+			client = s.newClient("https://"+conn.WialonHost, conn.Token, conn.RequestsPerSecond)
+			if conn.SnapshotStrategy != "" {
+				strategy = conn.SnapshotStrategy
+			}
+		}
+	}
+	if err := client.Login(ctx); err != nil {
+		return nil, strategy, fmt.Errorf("ошибка авторизации Wialon: %w", err)
+	}
+	return client, strategy, nil
+}
+
+// GetUsageBreakdown запрашивает в Wialon данные, из которых складываются цифры снимка аккаунта:
+// собственный avl_unit.usage, объекты по владельцам (bact) и дочерние аккаунты дилера
+func (s *Service) GetUsageBreakdown(ctx context.Context, accountID uint) (*UsageBreakdown, error) {
+	account, err := s.repo.GetAccountByID(accountID)
+	if err != nil || account == nil {
+		return nil, fmt.Errorf("аккаунт %d не найден", accountID)
+	}
+
+	client, strategy, err := s.clientForAccount(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UsageBreakdown{
+		AccountID: account.ID,
+		WialonID:  account.WialonID,
+		Name:      account.Name,
+		IsDealer:  account.IsDealer,
+		Strategy:  strategy,
+		CheckedAt: time.Now().UTC(),
+	}
+
+	// 1. Собственный avl_unit.usage
+	ownData, ownFailed, err := client.GetAccountsDataBatch(ctx, []int64{account.WialonID})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка GetAccountsDataBatch: %w", err)
+	}
+	if ownErr, failed := ownFailed[account.WialonID]; failed {
+		return nil, ownErr
+	}
+	result.OwnUsage = ownData[account.WialonID].GetUnitUsage()
+
+	// 2. Объекты по владельцам (bact)
+	unitsResp, err := client.GetAllUnitsWithStatus(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка GetAllUnitsWithStatus: %w", err)
+	}
+	byOwner := make(map[int64]*UsageSource)
+	for _, unit := range unitsResp.Items {
+		src, ok := byOwner[unit.AccountID]
+		if !ok {
+			src = &UsageSource{WialonID: unit.AccountID}
+			byOwner[unit.AccountID] = src
+		}
+		if unit.Active == 0 && unit.DeactivatedTime > 0 {
+			src.Deactivated++
+		} else {
+			src.Active++
+		}
+	}
+
+	// 3. Родители владельцев — как в resolveDeactivatedForDealers
+	ownerIDs := make([]int64, 0, len(byOwner))
+	for id := range byOwner {
+		ownerIDs = append(ownerIDs, id)
+	}
+	parents := make(map[int64]*wialon.AccountDataResponse)
+	if len(ownerIDs) > 0 {
+		if parents, _, err = client.GetAccountsDataBatch(ctx, ownerIDs); err != nil {
+			return nil, fmt.Errorf("ошибка получения parentAccountId: %w", err)
+		}
+	}
+
+	for id, src := range byOwner {
+		switch {
+		case id == account.WialonID:
+			src.Relation = "own"
+		case parents[id] != nil && parents[id].ParentAccountId == account.WialonID:
+			src.Relation = "child"
+			usage := parents[id].GetUnitUsage()
+			src.Usage = &usage
+			result.ChildUsageSum += usage
+			result.ChildActiveSum += src.Active
+		default:
+			continue
+		}
+		if local, err := s.repo.GetAccountByWialonID(id); err == nil && local != nil {
+			src.Name = local.Name
+		}
+		result.ComputedDeactivate += src.Deactivated
+		result.Sources = append(result.Sources, *src)
+	}
+	sort.Slice(result.Sources, func(i, j int) bool {
+		if result.Sources[i].Relation != result.Sources[j].Relation {
+			return result.Sources[i].Relation == "own"
+		}
+		return result.Sources[i].WialonID < result.Sources[j].WialonID
+	})
+
+	// TotalUnits при enumerate_units считается по объектам, иначе — по avl_unit.usage
+	result.ComputedTotal = result.OwnUsage
+	if strategy == models.SnapshotStrategyEnumerateUnits {
+		if own, ok := byOwner[account.WialonID]; ok {
+			result.ComputedTotal = own.Active
+		}
+	}
+
+	// 4. Последний сохранённый снимок (без детализации объектов)
+	if last, err := s.repo.GetLastSnapshot(account.ID); err == nil && last != nil {
+		last.Units = nil
+		result.LastSnapshot = last
+	}
+
+	return result, nil
+}
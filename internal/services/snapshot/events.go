@@ -0,0 +1,174 @@
+package snapshot
+
+import (
+	"log"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/services/wialon"
+)
+
+// UnitTally - оценка объектов аккаунта на текущий момент: состояние последнего снимка
+// плюс события Wialon, ещё не сверенные со снимком
+type UnitTally struct {
+	AccountID       uint           `json:"account_id"`
+	AccountWialonID int64          `json:"account_wialon_id"`
+	SnapshotID      *uint          `json:"snapshot_id"`
+	SnapshotDate    *time.Time     `json:"snapshot_date"`
+	SnapshotActive  int            `json:"snapshot_active"` // активных в последнем снимке
+	Active          int            `json:"active"`          // активных с учётом событий
+	Deactivated     int            `json:"deactivated"`     // деактивированных с учётом событий
+	PendingEvents   int            `json:"pending_events"`  // событий после снимка
+	EventsByType    map[string]int `json:"events_by_type"`
+	LastEventAt     *time.Time     `json:"last_event_at"`
+	ByUnitState     bool           `json:"by_unit_state"` // false — в снимке нет объектов, посчитано по разнице событий
+}
+
+// ReconcileUnitEvents сверяет несверенные события Wialon аккаунта с состоянием объектов,
+// полученным для снимка. По каждому объекту проверяется только последнее событие —
+// более ранние (внутридневные включения и отключения) поглощены им и считаются сверенными.
+func (s *Service) ReconcileUnitEvents(account models.Account, snapshot *models.Snapshot, units []wialon.WialonItem, fetchedAt time.Time) {
+	events, err := s.repo.GetPendingUnitEvents(account.WialonID, fetchedAt)
+	if err != nil {
+		log.Printf("ReconcileUnitEvents: %s: ошибка загрузки событий: %v", account.Name, err)
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	// Текущее состояние объектов аккаунта: есть ли объект и активен ли он
+	current := make(map[int64]bool)
+	for _, unit := range units {
+		if unit.AccountID == account.WialonID {
+			current[unit.ID] = !(unit.Active == 0 && unit.DeactivatedTime > 0)
+		}
+	}
+
+	last := make(map[int64]int, len(events))
+	for i, ev := range events {
+		last[ev.WialonUnitID] = i
+	}
+
+	ids := make([]uint, 0, len(events))
+	mismatches := make(map[uint]string)
+	for i, ev := range events {
+		ids = append(ids, ev.ID)
+		if last[ev.WialonUnitID] != i {
+			continue
+		}
+		active, exists := current[ev.WialonUnitID]
+		if note := unitEventMismatch(ev.EventType, exists, active); note != "" {
+			mismatches[ev.ID] = note
+		}
+	}
+
+	if err := s.repo.MarkUnitEventsReconciled(snapshot.ID, ids, mismatches); err != nil {
+		log.Printf("ReconcileUnitEvents: %s: ошибка сохранения сверки: %v", account.Name, err)
+		return
+	}
+	if len(mismatches) > 0 {
+		log.Printf("ReconcileUnitEvents: %s: сверено событий %d, не подтверждено снимком %d",
+			account.Name, len(ids), len(mismatches))
+	}
+}
+
+// unitEventMismatch возвращает пояснение, если состояние объекта в снимке противоречит событию
+func unitEventMismatch(eventType string, exists, active bool) string {
+	switch eventType {
+	case models.UnitEventCreated, models.UnitEventActivated:
+		if !exists {
+			return "объекта нет в снимке"
+		}
+		if !active {
+			return "объект деактивирован в снимке"
+		}
+	case models.UnitEventDeactivated:
+		if !exists {
+			return "объекта нет в снимке"
+		}
+		if active {
+			return "объект активен в снимке"
+		}
+	case models.UnitEventDeleted:
+		if exists {
+			return "объект есть в снимке"
+		}
+	}
+	return ""
+}
+
+// GetUnitTally считает объекты аккаунта на текущий момент: последний снимок плюс события после него.
+// Если объекты снимка не сохранялись (или удалены по retention), к числам снимка прибавляется
+// разница событий.
+func (s *Service) GetUnitTally(account *models.Account) (*UnitTally, error) {
+	tally := &UnitTally{
+		AccountID:       account.ID,
+		AccountWialonID: account.WialonID,
+		EventsByType:    make(map[string]int),
+	}
+
+	snapshot, err := s.repo.GetLastSnapshot(account.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := s.repo.GetPendingUnitEvents(account.WialonID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	tally.PendingEvents = len(events)
+	for _, ev := range events {
+		tally.EventsByType[ev.EventType]++
+	}
+	if len(events) > 0 {
+		tally.LastEventAt = &events[len(events)-1].OccurredAt
+	}
+
+	// Состояние объектов: из снимка, затем события по порядку
+	state := make(map[int64]bool)
+	if snapshot != nil {
+		tally.SnapshotID = &snapshot.ID
+		tally.SnapshotDate = &snapshot.SnapshotDate
+		tally.SnapshotActive = max(snapshot.TotalUnits-snapshot.UnitsDeactivated, 0)
+		for _, u := range snapshot.Units {
+			if u.AccountID == account.WialonID {
+				state[u.WialonUnitID] = u.IsActive
+			}
+		}
+	}
+
+	if len(state) > 0 {
+		tally.ByUnitState = true
+		for _, ev := range events {
+			switch ev.EventType {
+			case models.UnitEventCreated, models.UnitEventActivated:
+				state[ev.WialonUnitID] = true
+			case models.UnitEventDeactivated:
+				state[ev.WialonUnitID] = false
+			case models.UnitEventDeleted:
+				delete(state, ev.WialonUnitID)
+			}
+		}
+		for _, active := range state {
+			if active {
+				tally.Active++
+			} else {
+				tally.Deactivated++
+			}
+		}
+		return tally, nil
+	}
+
+	deactivated := 0
+	if snapshot != nil {
+		deactivated = snapshot.UnitsDeactivated
+	}
+	active := tally.SnapshotActive +
+		tally.EventsByType[models.UnitEventCreated] + tally.EventsByType[models.UnitEventActivated] -
+		tally.EventsByType[models.UnitEventDeactivated] - tally.EventsByType[models.UnitEventDeleted]
+	deactivated += tally.EventsByType[models.UnitEventDeactivated] - tally.EventsByType[models.UnitEventActivated]
+	tally.Active = max(active, 0)
+	tally.Deactivated = max(deactivated, 0)
+	return tally, nil
+}
@@ -0,0 +1,183 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/services/wialon"
+)
+
+// SnapshotGap - дни периода, за которые у аккаунта нет снимка
+type SnapshotGap struct {
+	AccountID    uint     `json:"account_id"`
+	AccountName  string   `json:"account_name"`
+	MissingDates []string `json:"missing_dates"` // YYYY-MM-DD по возрастанию
+}
+
+// FindSnapshotGaps сравнивает ожидаемые ежедневные снимки аккаунтов, участвующих в биллинге,
+// с сохранёнными за период from..to (метки дат, полночь UTC). accountID != 0 — только этот аккаунт.
+// Аккаунты без пропусков в результат не попадают.
+func (s *Service) FindSnapshotGaps(from, to time.Time, accountID uint) ([]SnapshotGap, error) {
+	accounts, err := s.repo.GetSelectedAccounts()
+	if err != nil {
+		return nil, err
+	}
+	if accountID != 0 {
+		filtered := accounts[:0:0]
+		for _, acc := range accounts {
+			if acc.ID == accountID {
+				filtered = append(filtered, acc)
+			}
+		}
+		accounts = filtered
+	}
+
+	ids := make([]uint, len(accounts))
+	for i, acc := range accounts {
+		ids[i] = acc.ID
+	}
+	existing, err := s.repo.GetSnapshotDatesByAccounts(ids, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	gaps := make([]SnapshotGap, 0)
+	for _, acc := range accounts {
+		var missing []string
+		for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+			if dateKey := d.Format("2006-01-02"); !existing[acc.ID][dateKey] {
+				missing = append(missing, dateKey)
+			}
+		}
+		if len(missing) > 0 {
+			gaps = append(gaps, SnapshotGap{AccountID: acc.ID, AccountName: acc.Name, MissingDates: missing})
+		}
+	}
+	return gaps, nil
+}
+
+// GapFillFailure - подключение, для аккаунтов которого пропуски не заполнялись
+type GapFillFailure struct {
+	ConnectionID uint   `json:"connection_id"` // 0 — глобальный токен
+	AccountIDs   []uint `json:"account_ids"`
+	Error        string `json:"error"`
+}
+
+// GapFillResult - итог заполнения пропусков снимков
+type GapFillResult struct {
+	Snapshots []models.Snapshot // созданные снимки
+	Found     []SnapshotGap     // пропуски до заполнения
+	Remaining []SnapshotGap     // пропуски, оставшиеся после заполнения
+	Failures  []GapFillFailure  // подключения, по которым заполнение не выполнено
+}
+
+// FillSnapshotGaps находит пропуски за период и создаёт снимки только за недостающие дни
+// обратным расчётом, как CreateSnapshotsForRange. Расчёт идёт от текущего usage, поэтому
+// диапазон расчёта продолжается до последних завершённых суток, даже если to раньше.
+// Сбои подключений (не найдено, ошибка авторизации или расчёта) не прерывают заполнение
+// остальных и возвращаются в Failures; Remaining — пропуски, найденные повторно после заполнения.
+func (s *Service) FillSnapshotGaps(ctx context.Context, from, to time.Time, accountID uint) (*GapFillResult, error) {
+	gaps, err := s.FindSnapshotGaps(from, to, accountID)
+	if err != nil {
+		return nil, err
+	}
+	result := &GapFillResult{Found: gaps, Remaining: gaps}
+	if len(gaps) == 0 {
+		return result, nil
+	}
+
+	missing := make(map[uint]map[string]bool, len(gaps))
+	for _, gap := range gaps {
+		missing[gap.AccountID] = make(map[string]bool, len(gap.MissingDates))
+		for _, dateKey := range gap.MissingDates {
+			missing[gap.AccountID][dateKey] = true
+		}
+	}
+
+	accounts, err := s.repo.GetSelectedAccounts()
+	if err != nil {
+		return nil, err
+	}
+
+	// Группируем аккаунты с пропусками по connection_id, запоминая самый ранний пропуск
+	accountsByConnection := make(map[uint][]models.Account)
+	earliest := make(map[uint]time.Time)
+	for _, acc := range accounts {
+		if missing[acc.ID] == nil {
+			continue
+		}
+		var connID uint
+		if acc.ConnectionID != nil {
+			connID = *acc.ConnectionID
+		}
+		accountsByConnection[connID] = append(accountsByConnection[connID], acc)
+		for dateKey := range missing[acc.ID] {
+			d, _ := time.Parse("2006-01-02", dateKey)
+			if first, ok := earliest[connID]; !ok || d.Before(first) {
+				earliest[connID] = d
+			}
+		}
+	}
+
+	// Якорь обратного расчёта — последние завершённые сутки в часовом поясе снимков
+	anchor := s.LastCompleteDay()
+	if to.After(anchor) {
+		anchor = to
+	}
+
+	log.Printf("FillSnapshotGaps: %s — %s, %d аккаунтов с пропусками в %d подключениях",
+		from.Format("2006-01-02"), to.Format("2006-01-02"), len(gaps), len(accountsByConnection))
+
+	fail := func(connID uint, connAccounts []models.Account, msg string) {
+		ids := make([]uint, len(connAccounts))
+		for i, acc := range connAccounts {
+			ids[i] = acc.ID
+		}
+		log.Printf("FillSnapshotGaps: подключение %d: %s", connID, msg)
+		result.Failures = append(result.Failures, GapFillFailure{ConnectionID: connID, AccountIDs: ids, Error: msg})
+	}
+
+	for connID, connAccounts := range accountsByConnection {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		var wialonClient wialon.WialonAPI
+
+		if connID == 0 {
+			wialonClient = s.wialon
+		} else {
+			conn, err := s.repo.GetConnectionByID(connID)
+			if err != nil {
+				fail(connID, connAccounts, fmt.Sprintf("ошибка чтения подключения: %v", err))
+				continue
+			}
+			if conn == nil {
+				fail(connID, connAccounts, "подключение не найдено")
+				continue
+			}
+			wialonURL := "https://" + conn.WialonHost
+			wialonClient = s.newClient(wialonURL, conn.Token, conn.RequestsPerSecond)
+		}
+
+		if err := wialonClient.Login(ctx); err != nil {
+			fail(connID, connAccounts, fmt.Sprintf("ошибка авторизации: %v", err))
+			continue
+		}
+
+		snapshots, err := s.createSnapshotsForConnectionRange(ctx, wialonClient, connAccounts, earliest[connID], anchor, missing)
+		if err != nil {
+			fail(connID, connAccounts, fmt.Sprintf("ошибка расчёта снимков: %v", err))
+			continue
+		}
+		result.Snapshots = append(result.Snapshots, snapshots...)
+	}
+
+	// Что осталось: аккаунты без usage, ошибки записи и сбои подключений
+	if result.Remaining, err = s.FindSnapshotGaps(from, to, accountID); err != nil {
+		return result, err
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+package snapshot
+
+import (
+	"log"
+	"time"
+)
+
+// snapshotSchedule возвращает часовой пояс суток снимка и задержку снимка после местной
+// полуночи: snapshot_timezone и snapshot_hour из настроек биллинга, но не меньше
+// snapshot_delay_hours конфигурации. Настройки читаются при каждой проверке — ежечасный
+// cron подхватывает изменения без перезапуска.
+func (s *Service) snapshotSchedule() (*time.Location, time.Duration) {
+	loc, delay := time.UTC, s.delay
+	settings, err := s.repo.GetSettings()
+	if err != nil || settings == nil {
+		return loc, delay
+	}
+	if settings.SnapshotTimezone != "" {
+		if l, err := time.LoadLocation(settings.SnapshotTimezone); err == nil {
+			loc = l
+		} else {
+			log.Printf("Снимки: неизвестный часовой пояс %q, используем UTC", settings.SnapshotTimezone)
+		}
+	}
+	if hour := time.Duration(settings.SnapshotHour) * time.Hour; hour > delay {
+		delay = hour
+	}
+	return loc, delay
+}
+
+// snapshotLocation возвращает часовой пояс суток снимка
+func (s *Service) snapshotLocation() *time.Location {
+	loc, _ := s.snapshotSchedule()
+	return loc
+}
+
+// LastCompleteDay возвращает метку последних завершённых суток снимка (полночь UTC) —
+// вчерашний день в часовом поясе снимков
+func (s *Service) LastCompleteDay() time.Time {
+	now := time.Now().In(s.snapshotLocation())
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, -1)
+}
+
+// dayStart возвращает начало суток снимка: snapshotDate — метка даты (полночь UTC, как хранится в БД),
+// сутки отсчитываются от полуночи в часовом поясе loc
+func dayStart(snapshotDate time.Time, loc *time.Location) time.Time {
+	return time.Date(snapshotDate.Year(), snapshotDate.Month(), snapshotDate.Day(), 0, 0, 0, 0, loc)
+}
@@ -1,7 +1,10 @@
 package snapshot
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"math"
 	"time"
 
 	"github.com/user/wialon-billing-api/internal/models"
@@ -11,23 +14,62 @@ import (
 
 // Service - сервис для работы со снимками
 type Service struct {
-	repo   *repository.Repository
-	wialon *wialon.Client
+	repo      *repository.Repository
+	wialon    wialon.WialonAPI
+	newClient wialon.ClientFactory // клиент для подключений пользователей
+	delay     time.Duration        // задержка ежедневного снимка (данные Wialon за день дозаполняются)
+
+	// Подставлять перебор объектов, если avl_unit.usage = 0, а активные объекты у bact есть
+	usageFallback bool
 }
 
 // NewService создаёт новый сервис снимков
-func NewService(repo *repository.Repository, wialon *wialon.Client) *Service {
+func NewService(repo *repository.Repository, wialonClient wialon.WialonAPI) *Service {
 	return &Service{
-		repo:   repo,
-		wialon: wialon,
+		repo:          repo,
+		wialon:        wialonClient,
+		newClient:     wialon.NewAPI,
+		usageFallback: true,
+	}
+}
+
+// SetClientFactory подменяет создание клиентов для подключений (например, заглушкой)
+func (s *Service) SetClientFactory(factory wialon.ClientFactory) {
+	s.newClient = factory
+}
+
+// SetSnapshotDelay задаёт задержку ежедневного снимка: день снимается не раньше
+// полуночи следующего дня + delay (отрицательное значение — без задержки)
+func (s *Service) SetSnapshotDelay(delay time.Duration) {
+	if delay < 0 {
+		delay = 0
+	}
+	s.delay = delay
+}
+
+// SetUsageFallback включает или отключает подстановку количества из перебора объектов,
+// когда avl_unit.usage вернул 0 (известная особенность Wialon для части дилерских аккаунтов)
+func (s *Service) SetUsageFallback(enabled bool) {
+	s.usageFallback = enabled
+}
+
+// fallbackUsage возвращает количество объектов для снимка: если avl_unit.usage = 0, а перебор
+// показывает активные объекты у bact аккаунта (особенность Wialon для части дилерских аккаунтов),
+// подставляет активные + деактивированные (TotalUnits, как и usage, включает деактивированные)
+func (s *Service) fallbackUsage(caller string, account *models.Account, usage, active, deactivated int) int {
+	if usage != 0 || !s.usageFallback || active == 0 {
+		return usage
 	}
+	log.Printf("%s: %s — avl_unit.usage = 0, по перебору объектов %d активных, в снимок записано %d",
+		caller, account.Name, active, active+deactivated)
+	return active + deactivated
 }
 
 // resolveDeactivatedForDealers разрешает подсчёт деактивированных объектов для дилерских аккаунтов.
 // Проблема: поле bact у объектов (avl_unit) указывает на суб-аккаунт (прямого владельца),
 // а не на дилерский аккаунт. Эта функция получает parentAccountId для каждого bact
 // и суммирует деактивированные из дочерних аккаунтов к родительскому (дилерскому).
-func resolveDeactivatedForDealers(wialonClient *wialon.Client, deactivatedByAccount map[int64]int) map[int64]int {
+func resolveDeactivatedForDealers(ctx context.Context, wialonClient wialon.WialonAPI, deactivatedByAccount map[int64]int) map[int64]int {
 	// Собираем уникальные bact с деактивированными объектами
 	bactIDs := make([]int64, 0, len(deactivatedByAccount))
 	for bact := range deactivatedByAccount {
@@ -38,7 +80,7 @@ func resolveDeactivatedForDealers(wialonClient *wialon.Client, deactivatedByAcco
 	}
 
 	// Получаем parentAccountId для каждого bact
-	parentData, err := wialonClient.GetAccountsDataBatch(bactIDs)
+	parentData, _, err := wialonClient.GetAccountsDataBatch(ctx, bactIDs)
 	if err != nil {
 		log.Printf("resolveDeactivatedForDealers: ошибка получения parentAccountId: %v", err)
 		return deactivatedByAccount
@@ -59,33 +101,47 @@ func resolveDeactivatedForDealers(wialonClient *wialon.Client, deactivatedByAcco
 	return result
 }
 
-// EnsureDailySnapshot — идемпотентная обёртка: создаёт снимки за вчерашний день,
-// только если их ещё нет. Безопасна для повторного вызова.
+// EnsureDailySnapshot — идемпотентная обёртка: создаёт снимки за последний день,
+// завершившийся раньше now - задержка, если их ещё нет или они сняты до истечения задержки
+// (тогда пересоздаёт через upsert). Безопасна для повторного вызова.
 // Использует CreateSnapshotsForDate (с Login и multi-connection поддержкой).
-func (s *Service) EnsureDailySnapshot() error {
-	yesterday := time.Now().UTC().AddDate(0, 0, -1)
-	snapshotDate := time.Date(yesterday.Year(), yesterday.Month(), yesterday.Day(), 0, 0, 0, 0, time.UTC)
-
-	exists, err := s.repo.HasSnapshotsForDate(snapshotDate)
+func (s *Service) EnsureDailySnapshot(ctx context.Context) error {
+	loc, delay := s.snapshotSchedule()
+	cutoff := time.Now().In(loc).Add(-delay)
+	day := time.Date(cutoff.Year(), cutoff.Month(), cutoff.Day(), 0, 0, 0, 0, loc).AddDate(0, 0, -1)
+	// Метка дня снимка в БД — полночь UTC той же календарной даты
+	snapshotDate := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	// Момент, после которого данные за день считаются стабильными
+	stableAt := day.AddDate(0, 0, 1).Add(delay)
+
+	takenAt, err := s.repo.LastSnapshotTimeForDate(snapshotDate)
 	if err != nil {
 		return err
 	}
-	if exists {
+	if takenAt != nil && !takenAt.Before(stableAt) {
 		log.Printf("Снимки за %s уже существуют, пропускаем", snapshotDate.Format("2006-01-02"))
 		return nil
 	}
 
-	log.Printf("Снимков за %s нет, создаём...", snapshotDate.Format("2006-01-02"))
-	snapshots, err := s.CreateSnapshotsForDate(snapshotDate)
+	if takenAt != nil {
+		log.Printf("Снимки за %s сняты в %s, до истечения задержки (%s) — пересоздаём...",
+			snapshotDate.Format("2006-01-02"), takenAt.UTC().Format("15:04"), delay)
+	} else {
+		log.Printf("Снимков за %s нет, создаём...", snapshotDate.Format("2006-01-02"))
+	}
+	snapshots, err := s.CreateSnapshotsForDate(ctx, snapshotDate)
 	if err != nil {
 		return err
 	}
 	log.Printf("EnsureDailySnapshot: создано %d снимков за %s", len(snapshots), snapshotDate.Format("2006-01-02"))
+
+	stats := s.repo.SelectedAccountsCacheStats()
+	log.Printf("EnsureDailySnapshot: кэш аккаунтов — попаданий %d, запросов к БД %d", stats.Hits, stats.Misses)
 	return nil
 }
 
 // CreateDailySnapshot создаёт ежедневный снимок для всех активных аккаунтов
-func (s *Service) CreateDailySnapshot() error {
+func (s *Service) CreateDailySnapshot(ctx context.Context) error {
 	// Получаем аккаунты, участвующие в биллинге
 	accounts, err := s.repo.GetSelectedAccounts()
 	if err != nil {
@@ -98,16 +154,17 @@ func (s *Service) CreateDailySnapshot() error {
 	}
 
 	// Получаем все объекты из Wialon с информацией о статусе активации
-	unitsResp, err := s.wialon.GetAllUnitsWithStatus()
+	unitsResp, err := s.wialon.GetAllUnitsWithStatus(ctx)
 	if err != nil {
 		return err
 	}
+	fetchedAt := time.Now().UTC()
 
 	log.Printf("Получено %d объектов из Wialon", unitsResp.TotalItemsCount)
 
 	// Создаём снимки для каждого аккаунта
 	for _, account := range accounts {
-		if err := s.createSnapshotForAccount(account, unitsResp.Items); err != nil {
+		if err := s.createSnapshotForAccount(account, unitsResp.Items, fetchedAt); err != nil {
 			log.Printf("Ошибка создания снимка для аккаунта %s: %v", account.Name, err)
 			continue
 		}
@@ -117,7 +174,8 @@ func (s *Service) CreateDailySnapshot() error {
 }
 
 // createSnapshotForAccount создаёт снимок для конкретного аккаунта
-func (s *Service) createSnapshotForAccount(account models.Account, allUnits []wialon.WialonItem) error {
+// (fetchedAt — время получения объектов, до него сверяются события Wialon)
+func (s *Service) createSnapshotForAccount(account models.Account, allUnits []wialon.WialonItem, fetchedAt time.Time) error {
 	// Фильтруем объекты по аккаунту
 	var accountUnits []wialon.WialonItem
 	for _, unit := range allUnits {
@@ -196,15 +254,17 @@ func (s *Service) createSnapshotForAccount(account models.Account, allUnits []wi
 
 	// Сравниваем с предыдущим снимком
 	if prevSnapshot != nil {
-		s.detectChanges(prevSnapshot, snapshot, accountUnits)
+		s.detectChanges(prevSnapshot, snapshot, accountUnits, true)
 	}
+	s.ReconcileUnitEvents(account, snapshot, accountUnits, fetchedAt)
 
 	log.Printf("Создан снимок для %s: %d активных, %d деактивированных", account.Name, activeCount, deactivatedCount)
 	return nil
 }
 
-// detectChanges обнаруживает изменения между снимками
-func (s *Service) detectChanges(prev, curr *models.Snapshot, currentUnits []wialon.WialonItem) {
+// detectChanges обнаруживает изменения между снимками: появившиеся, пропавшие и переименованные
+// объекты, а если у текущих объектов есть статус активации (withStatus) — деактивацию и повторную активацию
+func (s *Service) detectChanges(prev, curr *models.Snapshot, currentUnits []wialon.WialonItem, withStatus bool) {
 	// Создаём карту предыдущих объектов
 	prevUnits := make(map[int64]models.SnapshotUnit)
 	for _, u := range prev.Units {
@@ -217,39 +277,74 @@ func (s *Service) detectChanges(prev, curr *models.Snapshot, currentUnits []wial
 		currUnits[u.ID] = u
 	}
 
-	// Находим добавленные объекты
+	saveChange := func(change *models.Change) {
+		if err := s.repo.CreateChange(change); err != nil {
+			log.Printf("Ошибка сохранения изменения %s объекта %s: %v", change.ChangeType, change.UnitName, err)
+		}
+	}
+	newChange := func(unitID int64, unitName, changeType string) {
+		saveChange(&models.Change{
+			PrevSnapshotID: &prev.ID,
+			CurrSnapshotID: curr.ID,
+			WialonUnitID:   unitID,
+			UnitName:       unitName,
+			ChangeType:     changeType,
+		})
+	}
+
+	// Находим добавленные объекты и смену статуса активации
 	for _, u := range currentUnits {
-		if _, exists := prevUnits[u.ID]; !exists {
-			change := &models.Change{
+		prevUnit, exists := prevUnits[u.ID]
+		if !exists {
+			newChange(u.ID, u.Name, models.ChangeAdded)
+			log.Printf("Добавлен объект: %s", u.Name)
+			continue
+		}
+		// Пустое имя в предыдущем снимке — имя не сохранялось, это не переименование
+		if prevUnit.UnitName != "" && prevUnit.UnitName != u.Name {
+			saveChange(&models.Change{
 				PrevSnapshotID: &prev.ID,
 				CurrSnapshotID: curr.ID,
 				WialonUnitID:   u.ID,
 				UnitName:       u.Name,
-				ChangeType:     "added",
-			}
-			s.repo.CreateChange(change)
-			log.Printf("Добавлен объект: %s", u.Name)
+				ChangeType:     models.ChangeRenamed,
+				OldName:        prevUnit.UnitName,
+				NewName:        u.Name,
+			})
+			log.Printf("Переименован объект: %s → %s", prevUnit.UnitName, u.Name)
+		}
+		if !withStatus {
+			continue
+		}
+
+		isActive := !(u.Active == 0 && u.DeactivatedTime > 0)
+		switch {
+		case prevUnit.IsActive && !isActive:
+			newChange(u.ID, u.Name, models.ChangeDeactivated)
+			log.Printf("Деактивирован объект: %s", u.Name)
+		case !prevUnit.IsActive && isActive:
+			newChange(u.ID, u.Name, models.ChangeReactivated)
+			log.Printf("Активирован объект: %s", u.Name)
+		case !prevUnit.IsActive && !isActive && prevUnit.DeactivatedAt != nil &&
+			u.DeactivatedTime > prevUnit.DeactivatedAt.Unix():
+			// Между снимками объект включали и снова отключили
+			newChange(u.ID, u.Name, models.ChangeReactivated)
+			newChange(u.ID, u.Name, models.ChangeDeactivated)
+			log.Printf("Объект %s активирован и снова деактивирован", u.Name)
 		}
 	}
 
 	// Находим удалённые объекты
 	for _, u := range prev.Units {
 		if _, exists := currUnits[u.WialonUnitID]; !exists {
-			change := &models.Change{
-				PrevSnapshotID: &prev.ID,
-				CurrSnapshotID: curr.ID,
-				WialonUnitID:   u.WialonUnitID,
-				UnitName:       u.UnitName,
-				ChangeType:     "removed",
-			}
-			s.repo.CreateChange(change)
+			newChange(u.WialonUnitID, u.UnitName, models.ChangeRemoved)
 			log.Printf("Удалён объект: %s", u.UnitName)
 		}
 	}
 }
 
 // CreateManualSnapshot создаёт ручной снимок (для API)
-func (s *Service) CreateManualSnapshot(accountID uint) (*models.Snapshot, error) {
+func (s *Service) CreateManualSnapshot(ctx context.Context, accountID uint) (*models.Snapshot, error) {
 	// Получаем аккаунт
 	accounts, err := s.repo.GetAllAccounts()
 	if err != nil {
@@ -269,7 +364,7 @@ func (s *Service) CreateManualSnapshot(accountID uint) (*models.Snapshot, error)
 	}
 
 	// Получаем объекты
-	unitsResp, err := s.wialon.GetUnits()
+	unitsResp, err := s.wialon.GetUnits(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -299,7 +394,7 @@ func (s *Service) CreateManualSnapshot(accountID uint) (*models.Snapshot, error)
 // Алгоритм: берёт текущий avl_unit.usage, получает created/deleted за весь период,
 // и рассчитывает usage для каждого прошлого дня:
 // usage(день N) = usage(день N+1) - created(день N+1) + deleted(день N+1)
-func (s *Service) CreateSnapshotsForRange(fromDate, toDate time.Time) ([]models.Snapshot, error) {
+func (s *Service) CreateSnapshotsForRange(ctx context.Context, fromDate, toDate time.Time) ([]models.Snapshot, error) {
 	// Получаем аккаунты, участвующие в биллинге
 	accounts, err := s.repo.GetSelectedAccounts()
 	if err != nil {
@@ -326,7 +421,10 @@ func (s *Service) CreateSnapshotsForRange(fromDate, toDate time.Time) ([]models.
 	var allSnapshots []models.Snapshot
 
 	for connID, connAccounts := range accountsByConnection {
-		var wialonClient *wialon.Client
+		if err := ctx.Err(); err != nil {
+			return allSnapshots, err
+		}
+		var wialonClient wialon.WialonAPI
 
 		if connID == 0 {
 			wialonClient = s.wialon
@@ -337,15 +435,15 @@ func (s *Service) CreateSnapshotsForRange(fromDate, toDate time.Time) ([]models.
 				continue
 			}
 			wialonURL := "https://" + conn.WialonHost
-			wialonClient = wialon.NewClientWithToken(wialonURL, conn.Token)
+			wialonClient = s.newClient(wialonURL, conn.Token, conn.RequestsPerSecond)
 		}
 
-		if err := wialonClient.Login(); err != nil {
+		if err := wialonClient.Login(ctx); err != nil {
 			log.Printf("CreateSnapshotsForRange: ошибка авторизации для подключения %d: %v", connID, err)
 			continue
 		}
 
-		snapshots, err := s.createSnapshotsForConnectionRange(wialonClient, connAccounts, fromDate, toDate)
+		snapshots, err := s.createSnapshotsForConnectionRange(ctx, wialonClient, connAccounts, fromDate, toDate, nil)
 		if err != nil {
 			log.Printf("CreateSnapshotsForRange: ошибка для подключения %d: %v", connID, err)
 			continue
@@ -356,40 +454,77 @@ func (s *Service) CreateSnapshotsForRange(fromDate, toDate time.Time) ([]models.
 	return allSnapshots, nil
 }
 
-// createSnapshotsForConnectionRange создаёт снимки за диапазон с обратным расчётом
-func (s *Service) createSnapshotsForConnectionRange(wialonClient *wialon.Client, accounts []models.Account, fromDate, toDate time.Time) ([]models.Snapshot, error) {
+// createSnapshotsForConnectionRange создаёт снимки за диапазон с обратным расчётом.
+// only — даты (YYYY-MM-DD) по ID аккаунта, которые нужно записать; nil — записываются все дни.
+// Обратный расчёт в любом случае идёт от toDate, поэтому toDate должен быть последним днём.
+func (s *Service) createSnapshotsForConnectionRange(ctx context.Context, wialonClient wialon.WialonAPI, accounts []models.Account, fromDate, toDate time.Time, only map[uint]map[string]bool) ([]models.Snapshot, error) {
+	snapshots, err := s.rangeSnapshots(ctx, wialonClient, accounts, fromDate, toDate, s.snapshotLocation(), only)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[uint]string, len(accounts))
+	for _, acc := range accounts {
+		names[acc.ID] = acc.Name
+	}
+
+	var allSnapshots []models.Snapshot
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		if err := s.repo.UpsertSnapshot(snapshot); err != nil {
+			log.Printf("createSnapshotsForConnectionRange: ошибка upsert снимка для %s за %s: %v",
+				names[snapshot.AccountID], snapshot.SnapshotDate.Format("2006-01-02"), err)
+			continue
+		}
+		allSnapshots = append(allSnapshots, *snapshot)
+	}
+
+	return allSnapshots, nil
+}
+
+// rangeSnapshots рассчитывает снимки за диапазон без записи в БД: usage последнего дня берётся
+// из avl_unit.usage, предыдущие дни восстанавливаются по статистике created/deleted.
+// loc — часовой пояс, в котором статистика Wialon разбивается по дням.
+func (s *Service) rangeSnapshots(ctx context.Context, wialonClient wialon.WialonAPI, accounts []models.Account, fromDate, toDate time.Time, loc *time.Location, only map[uint]map[string]bool) ([]models.Snapshot, error) {
 	accountIDs := make([]int64, len(accounts))
 	for i, acc := range accounts {
 		accountIDs[i] = acc.WialonID
 	}
 
 	// 1. Текущий avl_unit.usage
-	accountsData, err := wialonClient.GetAccountsDataBatch(accountIDs)
+	accountsData, failedAccounts, err := wialonClient.GetAccountsDataBatch(ctx, accountIDs)
 	if err != nil {
 		return nil, err
 	}
 
 	// 2. Статистика created/deleted за весь диапазон (с запасом +1 день)
-	statsFrom := fromDate.Unix()
-	statsTo := toDate.Add(24 * time.Hour).Unix()
-	stats, err := wialonClient.GetStatistics(accountIDs, statsFrom, statsTo)
+	statsFrom := dayStart(fromDate, loc).Unix()
+	statsTo := dayStart(toDate, loc).AddDate(0, 0, 1).Unix()
+	stats, err := wialonClient.GetStatistics(ctx, accountIDs, statsFrom, statsTo)
 	if err != nil {
 		log.Printf("createSnapshotsForConnectionRange: ошибка GetStatistics: %v", err)
 	}
 
 	// 3. Деактивированные объекты
-	unitsResp, _ := wialonClient.GetAllUnitsWithStatus()
+	unitsResp, _ := wialonClient.GetAllUnitsWithStatus(ctx)
+	// Прерванный запрос не должен дать снимки с нулями вместо недополученных данных
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	deactivatedByAccount := make(map[int64]int)
+	activeByAccount := make(map[int64]int)
 	if unitsResp != nil {
 		for _, unit := range unitsResp.Items {
 			if unit.Active == 0 && unit.DeactivatedTime > 0 {
 				deactivatedByAccount[unit.AccountID]++
+			} else {
+				activeByAccount[unit.AccountID]++
 			}
 		}
 	}
 
 	// Разрешаем деактивированные для дилерских аккаунтов (bact → parentAccountId)
-	deactivatedByAccount = resolveDeactivatedForDealers(wialonClient, deactivatedByAccount)
+	deactivatedByAccount = resolveDeactivatedForDealers(ctx, wialonClient, deactivatedByAccount)
 
 	// 4. Собираем даты
 	var dates []time.Time
@@ -402,18 +537,26 @@ func (s *Service) createSnapshotsForConnectionRange(wialonClient *wialon.Client,
 	for _, account := range accounts {
 		wid := account.WialonID
 
+		// Без текущего usage обратный расчёт даст нули — пропускаем аккаунт
+		if accErr, failed := failedAccounts[wid]; failed {
+			log.Printf("rangeSnapshots: %s пропущен: %v", account.Name, accErr)
+			continue
+		}
+
 		// Текущий usage (на сегодня/последний день)
 		currentUsage := 0
 		if accData, ok := accountsData[wid]; ok {
 			currentUsage = accData.GetUnitUsage()
 		}
+		currentUsage = s.fallbackUsage("rangeSnapshots", &account, currentUsage,
+			activeByAccount[wid], deactivatedByAccount[wid])
 
 		// Индексируем created/deleted по датам для этого аккаунта
 		dailyStats := make(map[string]struct{ Created, Deleted int })
 		if stats != nil {
 			if accountStats, ok := stats[wid]; ok {
 				for _, ds := range accountStats {
-					dateKey := time.Unix(ds.Timestamp, 0).UTC().Format("2006-01-02")
+					dateKey := time.Unix(ds.Timestamp, 0).In(loc).Format("2006-01-02")
 					dailyStats[dateKey] = struct{ Created, Deleted int }{ds.UnitCreated, ds.UnitDeleted}
 				}
 			}
@@ -441,30 +584,27 @@ func (s *Service) createSnapshotsForConnectionRange(wialonClient *wialon.Client,
 		}
 
 		// Создаём снимки за каждый день
+		planned := 0
 		for _, date := range dates {
 			dateKey := date.Format("2006-01-02")
+			if only != nil && !only[account.ID][dateKey] {
+				continue
+			}
 			ds := dailyStats[dateKey]
 
-			snapshot := &models.Snapshot{
+			allSnapshots = append(allSnapshots, models.Snapshot{
 				AccountID:        account.ID,
 				SnapshotDate:     date,
 				TotalUnits:       usageByDate[dateKey],
 				UnitsCreated:     ds.Created,
 				UnitsDeleted:     ds.Deleted,
 				UnitsDeactivated: deactivatedByAccount[wid],
-			}
-
-			if err := s.repo.UpsertSnapshot(snapshot); err != nil {
-				log.Printf("createSnapshotsForConnectionRange: ошибка upsert снимка для %s за %s: %v",
-					account.Name, dateKey, err)
-				continue
-			}
-
-			allSnapshots = append(allSnapshots, *snapshot)
+			})
+			planned++
 		}
 
-		log.Printf("Создано %d снимков для %s (usage: %d→%d)",
-			len(dates), account.Name, usageByDate[dates[0].Format("2006-01-02")], currentUsage)
+		log.Printf("Рассчитано %d снимков для %s (usage: %d→%d)",
+			planned, account.Name, usageByDate[dates[0].Format("2006-01-02")], currentUsage)
 	}
 
 	return allSnapshots, nil
@@ -472,7 +612,7 @@ func (s *Service) createSnapshotsForConnectionRange(wialonClient *wialon.Client,
 
 // CreateSnapshotsForDate создаёт снимки для всех выбранных аккаунтов с указанной датой
 // Поддерживает multi-connection: группирует аккаунты по connection_id
-func (s *Service) CreateSnapshotsForDate(snapshotDate time.Time) ([]models.Snapshot, error) {
+func (s *Service) CreateSnapshotsForDate(ctx context.Context, snapshotDate time.Time) ([]models.Snapshot, error) {
 	// Получаем аккаунты, участвующие в биллинге
 	accounts, err := s.repo.GetSelectedAccounts()
 	if err != nil {
@@ -500,7 +640,11 @@ func (s *Service) CreateSnapshotsForDate(snapshotDate time.Time) ([]models.Snaps
 
 	// Обрабатываем каждое подключение отдельно
 	for connID, connAccounts := range accountsByConnection {
-		var wialonClient *wialon.Client
+		if err := ctx.Err(); err != nil {
+			return allSnapshots, err
+		}
+		var wialonClient wialon.WialonAPI
+		strategy := models.SnapshotStrategyAuto
 
 		if connID == 0 {
 			// Если connection_id не задан — используем глобальный клиент (legacy)
@@ -518,19 +662,22 @@ func (s *Service) CreateSnapshotsForDate(snapshotDate time.Time) ([]models.Snaps
 
 			// Создаём Wialon клиент с токеном подключения
 			wialonURL := "https://" + conn.WialonHost
-			wialonClient = wialon.NewClientWithToken(wialonURL, conn.Token)
-			log.Printf("CreateSnapshotsForDate: подключение %s (%s), %d аккаунтов",
-				conn.Name, conn.WialonHost, len(connAccounts))
+			wialonClient = s.newClient(wialonURL, conn.Token, conn.RequestsPerSecond)
+			if conn.SnapshotStrategy != "" {
+				strategy = conn.SnapshotStrategy
+			}
+			log.Printf("CreateSnapshotsForDate: подключение %s (%s), %d аккаунтов, стратегия %s",
+				conn.Name, conn.WialonHost, len(connAccounts), strategy)
 		}
 
 		// Авторизуемся
-		if err := wialonClient.Login(); err != nil {
+		if err := wialonClient.Login(ctx); err != nil {
 			log.Printf("CreateSnapshotsForDate: ошибка авторизации для подключения %d: %v", connID, err)
 			continue
 		}
 
 		// Создаём снимки для аккаунтов этого подключения
-		snapshots, err := s.createSnapshotsForConnection(wialonClient, connAccounts, snapshotDate)
+		snapshots, err := s.createSnapshotsForConnection(ctx, wialonClient, connAccounts, snapshotDate, strategy)
 		if err != nil {
 			log.Printf("CreateSnapshotsForDate: ошибка для подключения %d: %v", connID, err)
 			continue
@@ -547,7 +694,14 @@ func (s *Service) CreateSnapshotsForDate(snapshotDate time.Time) ([]models.Snaps
 //   - GetAccountsDataBatch для TotalUnits (avl_unit.usage — только свои объекты)
 //   - GetStatistics для UnitsCreated/UnitsDeleted
 //   - GetAllUnitsWithStatus для UnitsDeactivated
-func (s *Service) createSnapshotsForConnection(wialonClient *wialon.Client, accounts []models.Account, snapshotDate time.Time) ([]models.Snapshot, error) {
+//
+// strategy (из подключения): usage_api — без fallback, enumerate_units — сразу перебор объектов,
+// auto — fallback на перебор объектов при ошибке GetAccountsDataBatch
+func (s *Service) createSnapshotsForConnection(ctx context.Context, wialonClient wialon.WialonAPI, accounts []models.Account, snapshotDate time.Time, strategy string) ([]models.Snapshot, error) {
+	if strategy == models.SnapshotStrategyEnumerateUnits {
+		return s.createSnapshotsViaUnits(ctx, wialonClient, accounts, snapshotDate)
+	}
+
 	// Собираем WialonID всех аккаунтов
 	accountIDs := make([]int64, len(accounts))
 	for i, acc := range accounts {
@@ -555,45 +709,67 @@ func (s *Service) createSnapshotsForConnection(wialonClient *wialon.Client, acco
 	}
 
 	// 1. Получаем avl_unit.usage через GetAccountsDataBatch (только свои объекты, без дочерних)
-	accountsData, err := wialonClient.GetAccountsDataBatch(accountIDs)
+	accountsData, failedAccounts, err := wialonClient.GetAccountsDataBatch(ctx, accountIDs)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if strategy == models.SnapshotStrategyUsageAPI {
+			return nil, fmt.Errorf("GetAccountsDataBatch (стратегия usage_api, без fallback): %w", err)
+		}
 		log.Printf("createSnapshotsForConnection: ошибка GetAccountsDataBatch: %v, используем fallback", err)
-		return s.createSnapshotsViaUnits(wialonClient, accounts, snapshotDate)
+		return s.createSnapshotsViaUnits(ctx, wialonClient, accounts, snapshotDate)
 	}
 
 	// 2. Получаем статистику created/deleted через GetStatistics API
-	fromTime := snapshotDate.Unix()
-	toTime := snapshotDate.Add(24 * time.Hour).Unix()
+	// Сутки снимка — в часовом поясе snapshot_timezone
+	start := dayStart(snapshotDate, s.snapshotLocation())
+	fromTime := start.Unix()
+	toTime := start.AddDate(0, 0, 1).Unix()
 
-	stats, err := wialonClient.GetStatistics(accountIDs, fromTime, toTime)
+	stats, err := wialonClient.GetStatistics(ctx, accountIDs, fromTime, toTime)
 	if err != nil {
 		log.Printf("createSnapshotsForConnection: ошибка GetStatistics: %v (created/deleted будут 0)", err)
 		// Продолжаем без данных о created/deleted
 	}
 
 	// 3. Получаем все объекты с информацией о деактивации
-	unitsResp, err := wialonClient.GetAllUnitsWithStatus()
+	unitsResp, err := wialonClient.GetAllUnitsWithStatus(ctx)
 	if err != nil {
 		log.Printf("createSnapshotsForConnection: ошибка GetAllUnitsWithStatus: %v", err)
 		unitsResp = nil
 	}
+	// Прерванный запрос не должен дать снимки с нулями вместо недополученных данных
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fetchedAt := time.Now().UTC()
 
-	// Группируем деактивированные объекты по аккаунтам
+	// Группируем деактивированные и активные объекты по аккаунтам (bact)
 	deactivatedByAccount := make(map[int64]int)
+	activeByAccount := make(map[int64]int)
 	if unitsResp != nil {
 		for _, unit := range unitsResp.Items {
 			if unit.Active == 0 && unit.DeactivatedTime > 0 {
 				deactivatedByAccount[unit.AccountID]++
+			} else {
+				activeByAccount[unit.AccountID]++
 			}
 		}
 	}
 
 	// Разрешаем деактивированные для дилерских аккаунтов (bact → parentAccountId)
-	deactivatedByAccount = resolveDeactivatedForDealers(wialonClient, deactivatedByAccount)
+	deactivatedByAccount = resolveDeactivatedForDealers(ctx, wialonClient, deactivatedByAccount)
 
 	var snapshots []models.Snapshot
 
 	for _, account := range accounts {
+		// Данные аккаунта не загрузились — не записываем снимок с нулём (занизит счёт)
+		if accErr, failed := failedAccounts[account.WialonID]; failed {
+			log.Printf("createSnapshotsForConnection: %s пропущен, снимок не создан: %v", account.Name, accErr)
+			continue
+		}
+
 		// TotalUnits из avl_unit.usage (только свои объекты)
 		var totalUnits int
 		if accData, ok := accountsData[account.WialonID]; ok {
@@ -612,6 +788,9 @@ func (s *Service) createSnapshotsForConnection(wialonClient *wialon.Client, acco
 		// Деактивированные из GetAllUnitsWithStatus
 		unitsDeactivated := deactivatedByAccount[account.WialonID]
 
+		totalUnits = s.fallbackUsage("createSnapshotsForConnection", &account, totalUnits,
+			activeByAccount[account.WialonID], unitsDeactivated)
+
 		snapshot := &models.Snapshot{
 			AccountID:        account.ID,
 			SnapshotDate:     snapshotDate,
@@ -621,11 +800,17 @@ func (s *Service) createSnapshotsForConnection(wialonClient *wialon.Client, acco
 			UnitsDeactivated: unitsDeactivated,
 		}
 
-		if err := s.repo.CreateSnapshot(snapshot); err != nil {
+		// Upsert — повторный запуск за ту же дату обновляет снимок, а не падает на уникальном индексе
+		if err := s.repo.UpsertSnapshot(snapshot); err != nil {
 			log.Printf("createSnapshotsForConnection: ошибка создания снимка для %s: %v", account.Name, err)
 			continue
 		}
 
+		// События Wialon сверяются, только если состояние объектов получено
+		if unitsResp != nil {
+			s.ReconcileUnitEvents(account, snapshot, unitsResp.Items, fetchedAt)
+		}
+
 		log.Printf("Создан снимок для %s: %d объектов (+%d/-%d), деактивировано: %d на %s",
 			account.Name, totalUnits, unitsCreated, unitsDeleted, unitsDeactivated, snapshotDate.Format("2006-01-02"))
 		snapshots = append(snapshots, *snapshot)
@@ -635,17 +820,19 @@ func (s *Service) createSnapshotsForConnection(wialonClient *wialon.Client, acco
 }
 
 // createSnapshotsViaUnits - fallback через GetUnits (с сохранением SnapshotUnits и детекцией изменений)
-func (s *Service) createSnapshotsViaUnits(wialonClient *wialon.Client, accounts []models.Account, snapshotDate time.Time) ([]models.Snapshot, error) {
+func (s *Service) createSnapshotsViaUnits(ctx context.Context, wialonClient wialon.WialonAPI, accounts []models.Account, snapshotDate time.Time) ([]models.Snapshot, error) {
 	// Используем GetAllUnitsWithStatus для получения статуса деактивации
-	unitsResp, err := wialonClient.GetAllUnitsWithStatus()
+	unitsResp, err := wialonClient.GetAllUnitsWithStatus(ctx)
+	withStatus := err == nil
 	if err != nil {
 		// Fallback на обычный GetUnits
-		unitsResp, err = wialonClient.GetUnits()
+		unitsResp, err = wialonClient.GetUnits(ctx)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	fetchedAt := time.Now().UTC()
 	log.Printf("createSnapshotsViaUnits: получено %d объектов для %d аккаунтов",
 		unitsResp.TotalItemsCount, len(accounts))
 
@@ -679,7 +866,7 @@ func (s *Service) createSnapshotsViaUnits(wialonClient *wialon.Client, accounts
 					allDeactivated[unit.AccountID]++
 				}
 			}
-			resolved := resolveDeactivatedForDealers(wialonClient, allDeactivated)
+			resolved := resolveDeactivatedForDealers(ctx, wialonClient, allDeactivated)
 			if resolved[account.WialonID] > 0 {
 				deactivatedCount = resolved[account.WialonID]
 			}
@@ -696,11 +883,16 @@ func (s *Service) createSnapshotsViaUnits(wialonClient *wialon.Client, accounts
 			UnitsDeactivated: deactivatedCount,
 		}
 
-		if err := s.repo.CreateSnapshot(snapshot); err != nil {
+		if err := s.repo.UpsertSnapshot(snapshot); err != nil {
 			log.Printf("createSnapshotsViaUnits: ошибка создания снимка для %s: %v", account.Name, err)
 			continue
 		}
 
+		// При повторном запуске заменяем объекты снимка, а не дублируем
+		if err := s.repo.DeleteSnapshotUnits(snapshot.ID); err != nil {
+			log.Printf("createSnapshotsViaUnits: ошибка очистки объектов снимка %d: %v", snapshot.ID, err)
+		}
+
 		// Сохраняем объекты снимка для отслеживания изменений
 		for _, unit := range accountUnits {
 			isActive := !(unit.Active == 0 && unit.DeactivatedTime > 0)
@@ -725,8 +917,16 @@ func (s *Service) createSnapshotsViaUnits(wialonClient *wialon.Client, accounts
 		}
 
 		// Сравниваем с предыдущим снимком и фиксируем изменения
-		if prevSnapshot != nil && len(prevSnapshot.Units) > 0 {
-			s.detectChanges(prevSnapshot, snapshot, accountUnits)
+		// (при повторном запуске за последнюю дату предыдущим окажется сам снимок — пропускаем)
+		if prevSnapshot != nil && prevSnapshot.ID != snapshot.ID && len(prevSnapshot.Units) > 0 {
+			if err := s.repo.DeleteChangesBySnapshot(snapshot.ID); err != nil {
+				log.Printf("createSnapshotsViaUnits: ошибка очистки изменений снимка %d: %v", snapshot.ID, err)
+			}
+			s.detectChanges(prevSnapshot, snapshot, accountUnits, withStatus)
+		}
+		// Без статуса активации (GetUnits) события активации/деактивации не сверить
+		if withStatus {
+			s.ReconcileUnitEvents(account, snapshot, accountUnits, fetchedAt)
 		}
 
 		log.Printf("Создан снимок для %s: %d активных, %d деактивированных на %s",
@@ -738,12 +938,17 @@ func (s *Service) createSnapshotsViaUnits(wialonClient *wialon.Client, accounts
 }
 
 // CalculateDailyCharges рассчитывает ежедневные начисления для снэпшота
-// per_unit: price × units / daysInMonth (ежедневно)
+// per_unit: price × (units + graceUnits) / daysInMonth (ежедневно)
 // fixed: полная цена 1-го числа месяца (разово)
-func (s *Service) CalculateDailyCharges(snapshot *models.Snapshot, account *models.Account) error {
+// graceUnits — доли недавно деактивированных объектов (льгота deactivation_grace_days)
+func (s *Service) CalculateDailyCharges(snapshot *models.Snapshot, account *models.Account, graceUnits float64) error {
 	if account == nil || len(account.Modules) == 0 {
 		return nil
 	}
+	// После даты прекращения биллинга дни не начисляются
+	if !account.IsBilledOn(snapshot.SnapshotDate) {
+		return nil
+	}
 
 	// Количество дней в месяце снэпшота
 	year := snapshot.SnapshotDate.Year()
@@ -758,6 +963,7 @@ func (s *Service) CalculateDailyCharges(snapshot *models.Snapshot, account *mode
 	if activeUnits < 0 {
 		activeUnits = 0
 	}
+	graceUnits = math.Round(graceUnits*100) / 100
 
 	var charges []models.DailyCharge
 
@@ -784,10 +990,11 @@ func (s *Service) CalculateDailyCharges(snapshot *models.Snapshot, account *mode
 				DaysInMonth: daysInMonth,
 				DailyCost:   module.Price, // полная стоимость за месяц
 				Currency:    module.Currency,
+				GraceUnits:  graceUnits,
 			})
 		} else {
-			// per_unit: price × activeUnits / daysInMonth
-			dailyCost := module.Price * float64(activeUnits) / float64(daysInMonth)
+			// per_unit: price × (activeUnits + graceUnits) / daysInMonth
+			dailyCost := module.Price * (float64(activeUnits) + graceUnits) / float64(daysInMonth)
 			charges = append(charges, models.DailyCharge{
 				AccountID:   account.ID,
 				SnapshotID:  snapshot.ID,
@@ -800,6 +1007,7 @@ func (s *Service) CalculateDailyCharges(snapshot *models.Snapshot, account *mode
 				DaysInMonth: daysInMonth,
 				DailyCost:   dailyCost,
 				Currency:    module.Currency,
+				GraceUnits:  graceUnits,
 			})
 		}
 	}
@@ -845,8 +1053,16 @@ func (s *Service) CalculateDailyChargesForPeriod(accountID uint, year, month int
 		return err
 	}
 
+	// Льгота для недавно деактивированных объектов
+	graceUnits := make(map[uint]float64)
+	if settings, _ := s.repo.GetSettings(); settings != nil && settings.DeactivationGraceDays > 0 {
+		if graceUnits, err = s.repo.GetDeactivationGraceUnits(snapshots, settings.DeactivationGraceDays); err != nil {
+			return err
+		}
+	}
+
 	for _, snap := range snapshots {
-		if err := s.CalculateDailyCharges(&snap, account); err != nil {
+		if err := s.CalculateDailyCharges(&snap, account, graceUnits[snap.ID]); err != nil {
 			log.Printf("CalculateDailyChargesForPeriod: ошибка для снэпшота %d: %v", snap.ID, err)
 		}
 	}
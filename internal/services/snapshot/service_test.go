@@ -0,0 +1,232 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/models"
+	"github.com/user/wialon-billing-api/internal/services/wialon"
+)
+
+// fakeWialon — заглушка WialonAPI с фиксированными usage и статистикой
+type fakeWialon struct {
+	usage   map[int64]int
+	failed  map[int64]error
+	stats   map[int64][]wialon.DailyStats
+	units   []wialon.WialonItem
+	parents map[int64]int64
+}
+
+var _ wialon.WialonAPI = (*fakeWialon)(nil)
+
+func (f *fakeWialon) Login(ctx context.Context) error { return nil }
+func (f *fakeWialon) GetCurrentUserID() int64         { return 1 }
+func (f *fakeWialon) GetCurrentUserName() string      { return "test" }
+
+func (f *fakeWialon) GetUnits(ctx context.Context) (*wialon.SearchItemsResponse, error) {
+	return &wialon.SearchItemsResponse{Items: f.units}, nil
+}
+
+func (f *fakeWialon) GetAllUnitsWithStatus(ctx context.Context) (*wialon.SearchItemsResponse, error) {
+	return &wialon.SearchItemsResponse{Items: f.units}, nil
+}
+
+func (f *fakeWialon) GetAccounts(ctx context.Context) (*wialon.SearchItemsResponse, error) {
+	return &wialon.SearchItemsResponse{}, nil
+}
+
+func (f *fakeWialon) GetAccountData(ctx context.Context, accountID int64) (*wialon.AccountDataResponse, error) {
+	return f.accountData(accountID), nil
+}
+
+func (f *fakeWialon) GetAccountsDataBatch(ctx context.Context, accountIDs []int64) (map[int64]*wialon.AccountDataResponse, map[int64]error, error) {
+	data := make(map[int64]*wialon.AccountDataResponse)
+	failed := make(map[int64]error)
+	for _, id := range accountIDs {
+		if err, ok := f.failed[id]; ok {
+			failed[id] = err
+			continue
+		}
+		data[id] = f.accountData(id)
+	}
+	return data, failed, nil
+}
+
+func (f *fakeWialon) GetAccountHistory(ctx context.Context, accountID int64, days int) ([]wialon.AccountHistoryItem, error) {
+	return nil, nil
+}
+
+func (f *fakeWialon) GetStatistics(ctx context.Context, accountIDs []int64, fromTime, toTime int64) (map[int64][]wialon.DailyStats, error) {
+	result := make(map[int64][]wialon.DailyStats)
+	for _, id := range accountIDs {
+		for _, ds := range f.stats[id] {
+			if ds.Timestamp >= fromTime && ds.Timestamp < toTime {
+				result[id] = append(result[id], ds)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (f *fakeWialon) accountData(id int64) *wialon.AccountDataResponse {
+	return &wialon.AccountDataResponse{
+		ParentAccountId: f.parents[id],
+		Settings: map[string]interface{}{
+			"combined": map[string]interface{}{
+				"services": map[string]interface{}{
+					"avl_unit": map[string]interface{}{"usage": float64(f.usage[id])},
+				},
+			},
+		},
+	}
+}
+
+func day(d int) time.Time {
+	return time.Date(2026, time.March, d, 0, 0, 0, 0, time.UTC)
+}
+
+func dayStats(d, created, deleted int) wialon.DailyStats {
+	return wialon.DailyStats{Timestamp: day(d).Unix(), UnitCreated: created, UnitDeleted: deleted}
+}
+
+// usageByDay собирает TotalUnits снимков аккаунта по дням месяца
+func usageByDay(snapshots []models.Snapshot, accountID uint) map[int]int {
+	result := make(map[int]int)
+	for _, s := range snapshots {
+		if s.AccountID == accountID {
+			result[s.SnapshotDate.Day()] = s.TotalUnits
+		}
+	}
+	return result
+}
+
+func TestRangeSnapshotsReverseUsage(t *testing.T) {
+	api := &fakeWialon{
+		usage: map[int64]int{100: 10, 200: 3},
+		stats: map[int64][]wialon.DailyStats{
+			// 1 марта: 5 → 2 марта: +2 → 7 → 3 марта: +1 −2 → 6 → 4 марта: +4 → 10
+			100: {dayStats(2, 2, 0), dayStats(3, 1, 2), dayStats(4, 4, 0)},
+			// Удаления больше, чем было: обратный расчёт не уходит ниже нуля
+			200: {dayStats(4, 5, 0)},
+		},
+		units: []wialon.WialonItem{
+			{ID: 1, AccountID: 100, Active: 1},
+			{ID: 2, AccountID: 100, Active: 0, DeactivatedTime: day(1).Unix()},
+			{ID: 3, AccountID: 300, Active: 0, DeactivatedTime: day(1).Unix()},
+		},
+		// Деактивированный объект суб-аккаунта 300 учитывается у дилера 200
+		parents: map[int64]int64{300: 200},
+	}
+	accounts := []models.Account{
+		{ID: 1, WialonID: 100, Name: "Первый"},
+		{ID: 2, WialonID: 200, Name: "Второй"},
+	}
+
+	s := NewService(nil, api)
+	snapshots, err := s.rangeSnapshots(context.Background(), api, accounts, day(1), day(4), time.UTC, nil)
+	if err != nil {
+		t.Fatalf("rangeSnapshots: %v", err)
+	}
+	if len(snapshots) != 8 {
+		t.Fatalf("снимков %d, ожидалось 8", len(snapshots))
+	}
+
+	tests := []struct {
+		accountID uint
+		want      map[int]int
+	}{
+		{1, map[int]int{1: 5, 2: 7, 3: 6, 4: 10}},
+		{2, map[int]int{1: 0, 2: 0, 3: 0, 4: 3}},
+	}
+	for _, tt := range tests {
+		got := usageByDay(snapshots, tt.accountID)
+		for d, want := range tt.want {
+			if got[d] != want {
+				t.Errorf("аккаунт %d, %d марта: TotalUnits = %d, ожидалось %d", tt.accountID, d, got[d], want)
+			}
+		}
+	}
+
+	for _, snap := range snapshots {
+		if snap.AccountID == 1 && snap.SnapshotDate.Equal(day(3)) {
+			if snap.UnitsCreated != 1 || snap.UnitsDeleted != 2 {
+				t.Errorf("3 марта: created/deleted = %d/%d, ожидалось 1/2", snap.UnitsCreated, snap.UnitsDeleted)
+			}
+		}
+		wantDeactivated := 1
+		if snap.UnitsDeactivated != wantDeactivated {
+			t.Errorf("аккаунт %d: UnitsDeactivated = %d, ожидалось %d", snap.AccountID, snap.UnitsDeactivated, wantDeactivated)
+		}
+	}
+}
+
+func TestRangeSnapshotsOnly(t *testing.T) {
+	api := &fakeWialon{
+		usage: map[int64]int{100: 10, 200: 4},
+		stats: map[int64][]wialon.DailyStats{
+			100: {dayStats(2, 2, 0), dayStats(3, 1, 2), dayStats(4, 4, 0)},
+			200: {dayStats(3, 0, 1)},
+		},
+	}
+	accounts := []models.Account{
+		{ID: 1, WialonID: 100, Name: "Первый"},
+		{ID: 2, WialonID: 200, Name: "Второй"},
+	}
+	// Пропуски: у первого — 1 и 3 марта, у второго — только 2 марта
+	only := map[uint]map[string]bool{
+		1: {"2026-03-01": true, "2026-03-03": true},
+		2: {"2026-03-02": true},
+	}
+
+	s := NewService(nil, api)
+	snapshots, err := s.rangeSnapshots(context.Background(), api, accounts, day(1), day(4), time.UTC, only)
+	if err != nil {
+		t.Fatalf("rangeSnapshots: %v", err)
+	}
+
+	tests := []struct {
+		accountID uint
+		want      map[int]int
+	}{
+		// Обратный расчёт идёт по всему диапазону, записываются только пропущенные дни
+		{1, map[int]int{1: 5, 3: 6}},
+		{2, map[int]int{2: 5}},
+	}
+	for _, tt := range tests {
+		got := usageByDay(snapshots, tt.accountID)
+		if len(got) != len(tt.want) {
+			t.Errorf("аккаунт %d: записаны дни %v, ожидалось %v", tt.accountID, got, tt.want)
+			continue
+		}
+		for d, want := range tt.want {
+			if usage, ok := got[d]; !ok || usage != want {
+				t.Errorf("аккаунт %d, %d марта: TotalUnits = %d (есть: %v), ожидалось %d", tt.accountID, d, usage, ok, want)
+			}
+		}
+	}
+}
+
+func TestRangeSnapshotsSkipsFailedAccount(t *testing.T) {
+	api := &fakeWialon{
+		usage:  map[int64]int{100: 10},
+		failed: map[int64]error{200: errors.New("Wialon error 7")},
+	}
+	accounts := []models.Account{
+		{ID: 1, WialonID: 100, Name: "Первый"},
+		{ID: 2, WialonID: 200, Name: "Второй"},
+	}
+
+	s := NewService(nil, api)
+	snapshots, err := s.rangeSnapshots(context.Background(), api, accounts, day(1), day(2), time.UTC, nil)
+	if err != nil {
+		t.Fatalf("rangeSnapshots: %v", err)
+	}
+	if got := usageByDay(snapshots, 2); len(got) != 0 {
+		t.Errorf("аккаунт без usage не должен попадать в снимки: %v", got)
+	}
+	if got := usageByDay(snapshots, 1); got[1] != 10 || got[2] != 10 {
+		t.Errorf("аккаунт 1 без статистики: %v, ожидалось 10 в оба дня", got)
+	}
+}
@@ -0,0 +1,34 @@
+package wialon
+
+import (
+	"context"
+
+	"github.com/user/wialon-billing-api/internal/config"
+)
+
+// WialonAPI - методы Wialon, которые используют сервисы и обработчики.
+// Позволяет подменять клиент (например, заглушкой) без живого сервера Wialon.
+type WialonAPI interface {
+	Login(ctx context.Context) error
+	GetCurrentUserID() int64
+	GetCurrentUserName() string
+	GetUnits(ctx context.Context) (*SearchItemsResponse, error)
+	GetAllUnitsWithStatus(ctx context.Context) (*SearchItemsResponse, error)
+	GetAccounts(ctx context.Context) (*SearchItemsResponse, error)
+	GetAccountData(ctx context.Context, accountID int64) (*AccountDataResponse, error)
+	GetAccountsDataBatch(ctx context.Context, accountIDs []int64) (map[int64]*AccountDataResponse, map[int64]error, error)
+	GetAccountHistory(ctx context.Context, accountID int64, days int) ([]AccountHistoryItem, error)
+	GetStatistics(ctx context.Context, accountIDs []int64, fromTime, toTime int64) (map[int64][]DailyStats, error)
+}
+
+var _ WialonAPI = (*Client)(nil)
+
+// ClientFactory создаёт клиент для подключения (хост, токен и ограничение запросов/сек
+// из WialonConnection; 0 — ограничение по умолчанию)
+type ClientFactory func(baseURL, token string, requestsPerSecond float64) WialonAPI
+
+// NewAPI - фабрика по умолчанию: реальный клиент с токеном и настройками по умолчанию
+// (клиенты с настройками из конфигурации создаёт Factory.NewAPI)
+func NewAPI(baseURL, token string, requestsPerSecond float64) WialonAPI {
+	return NewFactory(config.WialonConfig{}).NewClient(baseURL, token, requestsPerSecond)
+}
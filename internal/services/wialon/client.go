@@ -1,9 +1,10 @@
 package wialon
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -11,6 +12,27 @@ import (
 	"time"
 
 	"github.com/user/wialon-billing-api/internal/config"
+	"golang.org/x/time/rate"
+)
+
+// Флаги данных (datablocks) объектов для core/search_items.
+// Итоговое значение flags — сумма нужных битов. Поля act/dactt/bact разные
+// версии Wialon отдают в разных блоках, поэтому набор настраивается.
+const (
+	UnitFlagBase         = 0x1   // 1 — базовые свойства (nm, id, uacl)
+	UnitFlagCustomProps  = 0x2   // 2 — произвольные свойства
+	UnitFlagBilling      = 0x4   // 4 — биллинг (crt, bact)
+	UnitFlagCustomFields = 0x8   // 8 — произвольные поля
+	UnitFlagImage        = 0x10  // 16 — иконка
+	UnitFlagAdmin        = 0x80  // 128 — административные поля
+	UnitFlagAdvanced     = 0x100 // 256 — расширенные свойства (act, dactt)
+	UnitFlagLastMessage  = 0x400 // 1024 — последнее сообщение и позиция
+
+	// UnitFlagsDefault - флаги GetUnits: 1 + 4 = 5
+	UnitFlagsDefault = UnitFlagBase | UnitFlagBilling
+	// UnitStatusFlagsDefault - флаги GetAllUnitsWithStatus: 1 + 2 + 4 + 8 + 16 + 128 + 256 + 1024 = 1439
+	UnitStatusFlagsDefault = UnitFlagBase | UnitFlagCustomProps | UnitFlagBilling | UnitFlagCustomFields |
+		UnitFlagImage | UnitFlagAdmin | UnitFlagAdvanced | UnitFlagLastMessage
 )
 
 // Client - клиент для Wialon API
@@ -21,6 +43,16 @@ type Client struct {
 	userID   int64  // ID авторизованного пользователя
 	userName string // Имя авторизованного пользователя
 	client   *http.Client
+	limiter  *rate.Limiter // лимитер подключения (общий для клиентов одной Factory)
+
+	// Настройки из config.WialonConfig (см. NewClient)
+	unitFlags        int // флаги core/search_items для GetUnits
+	unitStatusFlags  int // флаги core/search_items для GetAllUnitsWithStatus
+	rateLimitRetries int // повторов после ответа «слишком много запросов»
+
+	// Когда хост отказался выполнять core/get_statistics в core/batch (нулевое — не отказывался);
+	// до истечения statsBatchRetryAfter статистика запрашивается по одному аккаунту
+	statsBatchRejectedAt time.Time
 }
 
 // WialonUser - информация о пользователе Wialon
@@ -31,9 +63,10 @@ type WialonUser struct {
 
 // LoginResponse - ответ на авторизацию
 type LoginResponse struct {
-	EID   string      `json:"eid"`
-	User  *WialonUser `json:"user,omitempty"`
-	Error *int        `json:"error,omitempty"`
+	EID    string      `json:"eid"`
+	User   *WialonUser `json:"user,omitempty"`
+	Error  *int        `json:"error,omitempty"`
+	Reason string      `json:"reason,omitempty"` // пояснение Wialon к ошибке
 }
 
 // SearchItemsResponse - ответ на поиск элементов
@@ -41,6 +74,7 @@ type SearchItemsResponse struct {
 	TotalItemsCount int          `json:"totalItemsCount"`
 	Items           []WialonItem `json:"items"`
 	Error           *int         `json:"error,omitempty"`
+	Reason          string       `json:"reason,omitempty"` // пояснение Wialon к ошибке
 }
 
 // WialonItem - элемент Wialon (объект, аккаунт и т.д.)
@@ -60,6 +94,7 @@ type AccountDataResponse struct {
 	Settings        map[string]interface{} `json:"settings"`
 	Enabled         *int                   `json:"enabled"` // 0 - заблокирован, 1 - активен
 	Error           *int                   `json:"error,omitempty"`
+	Reason          string                 `json:"reason,omitempty"` // пояснение Wialon к ошибке
 }
 
 // GetUnitUsage извлекает avl_unit.usage из settings.combined.services.avl_unit.usage
@@ -105,26 +140,61 @@ func (r *AccountDataResponse) GetUnitUsage() int {
 	return 0
 }
 
-// NewClient создаёт новый клиент Wialon API
+// DefaultRequestTimeout - предел ожидания ответа Wialon на один запрос (вместе с чтением тела)
+const DefaultRequestTimeout = 60 * time.Second
+
+// ErrTimeout - Wialon не ответил за отведённое время
+var ErrTimeout = errors.New("Wialon timeout")
+
+// NewClient создаёт новый клиент Wialon API. Флаги объектов, таймаут и ограничение запросов
+// берутся из cfg (нулевые значения — по умолчанию); лимитер у клиента собственный —
+// клиенты подключений с общим лимитером создаёт Factory.
 func NewClient(cfg config.WialonConfig) *Client {
+	return newClient(cfg, 0)
+}
+
+// newClient создаёт клиент по cfg; timeout > 0 переопределяет request_timeout_seconds
+func newClient(cfg config.WialonConfig, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = time.Duration(cfg.RequestTimeoutSeconds) * time.Second
+	}
+	if timeout <= 0 {
+		timeout = DefaultRequestTimeout
+	}
+	unitFlags := cfg.UnitFlags
+	if unitFlags <= 0 {
+		unitFlags = UnitFlagsDefault
+	}
+	unitStatusFlags := cfg.UnitStatusFlags
+	if unitStatusFlags <= 0 {
+		unitStatusFlags = UnitStatusFlagsDefault
+	}
+	limit, burst, retries := rateLimitSettings(cfg)
+
 	return &Client{
-		baseURL: cfg.BaseURL,
-		token:   cfg.Token,
-		client:  &http.Client{},
+		baseURL:          cfg.BaseURL,
+		token:            cfg.Token,
+		client:           &http.Client{Timeout: timeout},
+		limiter:          rate.NewLimiter(limit, burst),
+		unitFlags:        unitFlags,
+		unitStatusFlags:  unitStatusFlags,
+		rateLimitRetries: retries,
 	}
 }
 
-// NewClientWithToken создаёт клиент с указанным токеном (для OAuth)
+// NewClientWithToken создаёт клиент с указанным токеном (для OAuth) и настройками по умолчанию
 func NewClientWithToken(baseURL, token string) *Client {
-	return &Client{
-		baseURL: baseURL,
-		token:   token,
-		client:  &http.Client{},
-	}
+	return NewClientWithTokenAndTimeout(baseURL, token, 0)
+}
+
+// NewClientWithTokenAndTimeout создаёт клиент с указанным токеном и своим пределом ожидания
+// ответа (0 — DefaultRequestTimeout); остальные настройки — по умолчанию
+func NewClientWithTokenAndTimeout(baseURL, token string, timeout time.Duration) *Client {
+	return newClient(config.WialonConfig{BaseURL: baseURL, Token: token}, timeout)
 }
 
 // Login выполняет авторизацию через токен
-func (c *Client) Login() error {
+func (c *Client) Login(ctx context.Context) error {
 	// Формируем JSON params
 	params := map[string]string{"token": c.token}
 	paramsJSON, _ := json.Marshal(params)
@@ -133,18 +203,9 @@ func (c *Client) Login() error {
 	reqURL := fmt.Sprintf("%s/wialon/ajax.html?svc=token/login&params=%s",
 		c.baseURL, url.QueryEscape(string(paramsJSON)))
 
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+	body, err := c.do(ctx, "token/login", func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	})
 	if err != nil {
 		return err
 	}
@@ -155,7 +216,7 @@ func (c *Client) Login() error {
 	}
 
 	if result.Error != nil {
-		return fmt.Errorf("ошибка авторизации Wialon: код %d", *result.Error)
+		return fmt.Errorf("ошибка авторизации Wialon: %w", wialonError(*result.Error, result.Reason))
 	}
 
 	c.sid = result.EID
@@ -177,148 +238,103 @@ func (c *Client) GetCurrentUserName() string {
 }
 
 // GetUnits получает все объекты
-func (c *Client) GetUnits() (*SearchItemsResponse, error) {
-	params := map[string]interface{}{
-		"spec": map[string]interface{}{
-			"itemsType":     "avl_unit",
-			"propName":      "sys_name",
-			"propValueMask": "*",
-			"sortType":      "sys_name",
-			"propType":      "property",
-		},
-		"force": 1,
-		"flags": 5, // 1 (основные) + 4 (биллинг)
-		"from":  0,
-		"to":    0,
-	}
-
-	paramsJSON, _ := json.Marshal(params)
-
-	resp, err := c.requestWithSID("core/search_items", string(paramsJSON))
-	if err != nil {
-		return nil, err
-	}
-
-	var result SearchItemsResponse
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга ответа: %v, raw: %s", err, string(resp)[:min(200, len(resp))])
-	}
-
-	if result.Error != nil {
-		return nil, fmt.Errorf("ошибка получения объектов: код %d", *result.Error)
+func (c *Client) GetUnits(ctx context.Context) (*SearchItemsResponse, error) {
+	spec := map[string]interface{}{
+		"itemsType":     "avl_unit",
+		"propName":      "sys_name",
+		"propValueMask": "*",
+		"sortType":      "sys_name",
+		"propType":      "property",
 	}
+	log.Printf("[Wialon] GetUnits: core/search_items flags=%d", c.unitFlags)
 
-	return &result, nil
+	return c.searchItems(ctx, spec, c.unitFlags, "ошибка получения объектов")
 }
 
 // GetAllUnitsWithStatus получает все объекты с информацией о статусе активации
 // Возвращает активные и деактивированные объекты с полями act и dactt
-func (c *Client) GetAllUnitsWithStatus() (*SearchItemsResponse, error) {
-	params := map[string]interface{}{
-		"spec": map[string]interface{}{
-			"itemsType":     "avl_unit",
-			"propName":      "sys_name",
-			"propValueMask": "*",
-			"sortType":      "sys_name",
-			"propType":      "property",
-		},
-		"force": 1,
-		"flags": 1439, // 1 (базовые) + 4 (биллинг) + 128 (административные) + 256 (деактивация) + 1024 (расширенные)
-		"from":  0,
-		"to":    0,
-	}
-
-	paramsJSON, _ := json.Marshal(params)
-
-	resp, err := c.requestWithSID("core/search_items", string(paramsJSON))
-	if err != nil {
-		return nil, err
-	}
-
-	var result SearchItemsResponse
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга ответа: %v, raw: %s", err, string(resp)[:min(200, len(resp))])
+func (c *Client) GetAllUnitsWithStatus(ctx context.Context) (*SearchItemsResponse, error) {
+	spec := map[string]interface{}{
+		"itemsType":     "avl_unit",
+		"propName":      "sys_name",
+		"propValueMask": "*",
+		"sortType":      "sys_name",
+		"propType":      "property",
 	}
+	log.Printf("[Wialon] GetAllUnitsWithStatus: core/search_items flags=%d", c.unitStatusFlags)
 
-	if result.Error != nil {
-		return nil, fmt.Errorf("ошибка получения объектов: код %d", *result.Error)
-	}
-
-	return &result, nil
+	return c.searchItems(ctx, spec, c.unitStatusFlags, "ошибка получения объектов")
 }
 
 // GetAccounts получает все учётные записи (ресурсы с rel_is_account=1)
-func (c *Client) GetAccounts() (*SearchItemsResponse, error) {
-	params := map[string]interface{}{
-		"spec": map[string]interface{}{
-			"itemsType":     "avl_resource",
-			"propName":      "rel_is_account",
-			"propValueMask": "1",
-			"sortType":      "sys_name",
-			"propType":      "property",
-		},
-		"force": 1,
-		"flags": 5,
-		"from":  0,
-		"to":    0,
-	}
-
-	paramsJSON, _ := json.Marshal(params)
-
-	resp, err := c.requestWithSID("core/search_items", string(paramsJSON))
-	if err != nil {
-		return nil, err
+func (c *Client) GetAccounts(ctx context.Context) (*SearchItemsResponse, error) {
+	spec := map[string]interface{}{
+		"itemsType":     "avl_resource",
+		"propName":      "rel_is_account",
+		"propValueMask": "1",
+		"sortType":      "sys_name",
+		"propType":      "property",
 	}
 
-	var result SearchItemsResponse
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга ответа: %v, raw: %s", err, string(resp)[:min(200, len(resp))])
-	}
+	return c.searchItems(ctx, spec, 5, "ошибка получения учётных записей")
+}
 
-	if result.Error != nil {
-		return nil, fmt.Errorf("ошибка получения учётных записей: код %d", *result.Error)
+// GetAccountsByCreatorName получает учётные записи по имени создателя (оптимизированный поиск)
+func (c *Client) GetAccountsByCreatorName(ctx context.Context, creatorName string) (*SearchItemsResponse, error) {
+	spec := map[string]interface{}{
+		"itemsType":     "avl_resource",
+		"propName":      "rel_is_account,rel_user_creator_name",
+		"propValueMask": "1," + creatorName,
+		"sortType":      "sys_name",
+		"propType":      "property",
 	}
 
-	return &result, nil
+	// 1 (базовые) + 4 (биллинг: crt, bact)
+	return c.searchItems(ctx, spec, 5, "ошибка поиска по создателю")
 }
 
-// GetAccountsByCreatorName получает учётные записи по имени создателя (оптимизированный поиск)
-func (c *Client) GetAccountsByCreatorName(creatorName string) (*SearchItemsResponse, error) {
-	params := map[string]interface{}{
-		"spec": map[string]interface{}{
-			"itemsType":     "avl_resource",
-			"propName":      "rel_is_account,rel_user_creator_name",
-			"propValueMask": "1," + creatorName,
-			"sortType":      "sys_name",
-			"propType":      "property",
-		},
-		"force": 1,
-		"flags": 5, // 1 (базовые) + 4 (биллинг: crt, bact)
-		"from":  0,
-		"to":    0,
-	}
+// searchPageSize - элементов на страницу core/search_items: ответ «всё сразу» на крупном
+// хостинге занимает десятки МБ и обрывается (GOAWAY)
+const searchPageSize = 1000
 
-	paramsJSON, _ := json.Marshal(params)
+// searchItems выполняет core/search_items постранично (from/to по searchPageSize)
+// и собирает все элементы в один ответ; errContext — начало текста ошибки Wialon
+func (c *Client) searchItems(ctx context.Context, spec map[string]interface{}, flags int, errContext string) (*SearchItemsResponse, error) {
+	all := SearchItemsResponse{Items: []WialonItem{}}
+	for from := 0; ; from += searchPageSize {
+		params := map[string]interface{}{
+			"spec":  spec,
+			"force": 1,
+			"flags": flags,
+			"from":  from,
+			"to":    from + searchPageSize - 1,
+		}
+		paramsJSON, _ := json.Marshal(params)
 
-	resp, err := c.requestWithSID("core/search_items", string(paramsJSON))
-	if err != nil {
-		return nil, err
-	}
+		resp, err := c.requestWithSID(ctx, "core/search_items", string(paramsJSON))
+		if err != nil {
+			return nil, err
+		}
 
-	var result SearchItemsResponse
-	if err := json.Unmarshal(resp, &result); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга ответа: %v, raw: %s", err, string(resp)[:min(200, len(resp))])
-	}
+		var page SearchItemsResponse
+		if err := json.Unmarshal(resp, &page); err != nil {
+			return nil, fmt.Errorf("ошибка парсинга ответа: %v, raw: %s", err, string(resp)[:min(200, len(resp))])
+		}
+		if page.Error != nil {
+			return nil, fmt.Errorf("%s: %w", errContext, wialonError(*page.Error, page.Reason))
+		}
 
-	if result.Error != nil {
-		return nil, fmt.Errorf("ошибка поиска по создателю: код %d", *result.Error)
+		all.TotalItemsCount = page.TotalItemsCount
+		all.Items = append(all.Items, page.Items...)
+		if len(page.Items) < searchPageSize || len(all.Items) >= page.TotalItemsCount {
+			break
+		}
 	}
-
-	return &result, nil
+	return &all, nil
 }
 
 // GetAccountData получает данные учётной записи
-func (c *Client) GetAccountData(accountID int64) (*AccountDataResponse, error) {
+func (c *Client) GetAccountData(ctx context.Context, accountID int64) (*AccountDataResponse, error) {
 	params := map[string]interface{}{
 		"itemId": accountID,
 		"type":   2, // usage с дочерними (type=6 показывает 0 для дилеров)
@@ -326,7 +342,7 @@ func (c *Client) GetAccountData(accountID int64) (*AccountDataResponse, error) {
 
 	paramsJSON, _ := json.Marshal(params)
 
-	resp, err := c.requestWithSID("account/get_account_data", string(paramsJSON))
+	resp, err := c.requestWithSID(ctx, "account/get_account_data", string(paramsJSON))
 	if err != nil {
 		return nil, err
 	}
@@ -337,15 +353,18 @@ func (c *Client) GetAccountData(accountID int64) (*AccountDataResponse, error) {
 	}
 
 	if result.Error != nil {
-		return nil, fmt.Errorf("ошибка получения данных аккаунта: код %d", *result.Error)
+		return nil, fmt.Errorf("ошибка получения данных аккаунта: %w", wialonError(*result.Error, result.Reason))
 	}
 
 	return &result, nil
 }
 
-// GetAccountsDataBatch получает данные множества учётных записей батч-запросами (по 50 за раз)
-func (c *Client) GetAccountsDataBatch(accountIDs []int64) (map[int64]*AccountDataResponse, error) {
+// GetAccountsDataBatch получает данные множества учётных записей батч-запросами (по 50 за раз).
+// Возвращает успешные результаты и ошибки по отдельным ID (код Wialon или отсутствие ответа);
+// общая ошибка — только если не удался сам батч-запрос.
+func (c *Client) GetAccountsDataBatch(ctx context.Context, accountIDs []int64) (map[int64]*AccountDataResponse, map[int64]error, error) {
 	resultMap := make(map[int64]*AccountDataResponse)
+	failed := make(map[int64]error)
 
 	// Размер чанка (уменьшен для избежания HTTP/2 GOAWAY)
 	const chunkSize = 50
@@ -377,75 +396,104 @@ func (c *Client) GetAccountsDataBatch(accountIDs []int64) (map[int64]*AccountDat
 
 		paramsJSON, _ := json.Marshal(params)
 
-		resp, err := c.requestWithSID("core/batch", string(paramsJSON))
+		resp, err := c.requestWithSID(ctx, "core/batch", string(paramsJSON))
 		if err != nil {
-			return nil, fmt.Errorf("ошибка батч-запроса (chunk %d-%d): %v", start, end, err)
+			return nil, nil, fmt.Errorf("ошибка батч-запроса (chunk %d-%d): %v", start, end, err)
 		}
 
 		// Парсим массив ответов
 		var results []AccountDataResponse
 		if err := json.Unmarshal(resp, &results); err != nil {
-			return nil, fmt.Errorf("ошибка парсинга батч-ответа: %v", err)
+			return nil, nil, fmt.Errorf("ошибка парсинга батч-ответа: %v", err)
 		}
 
-		// Сопоставляем результаты с ID
-		for i, result := range results {
-			if i < len(chunk) && result.Error == nil {
-				resultCopy := result
-				resultMap[chunk[i]] = &resultCopy
+		// Сопоставляем результаты с ID; ответы с ошибкой и без ответа — в failed
+		for i, id := range chunk {
+			if i >= len(results) {
+				failed[id] = fmt.Errorf("нет ответа в батче для учётной записи %d", id)
+				continue
 			}
+			if results[i].Error != nil {
+				failed[id] = fmt.Errorf("ошибка получения данных учётной записи %d: %w", id, wialonError(*results[i].Error, results[i].Reason))
+				continue
+			}
+			resultCopy := results[i]
+			resultMap[id] = &resultCopy
 		}
 
-		// Пауза между батчами для избежания перегрузки API
-		time.Sleep(100 * time.Millisecond)
 	}
 
-	return resultMap, nil
+	if len(failed) > 0 {
+		log.Printf("[Wialon] GetAccountsDataBatch: ошибки по %d из %d учётных записей", len(failed), len(accountIDs))
+	}
+
+	return resultMap, failed, nil
 }
 
 // request выполняет HTTP-запрос к Wialon API
-func (c *Client) request(svc string, params url.Values) ([]byte, error) {
+func (c *Client) request(ctx context.Context, svc string, params url.Values) ([]byte, error) {
 	reqURL := fmt.Sprintf("%s/wialon/ajax.html?svc=%s", c.baseURL, svc)
 
-	req, err := http.NewRequest("POST", reqURL, strings.NewReader(params.Encode()))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(ctx, svc, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", reqURL, strings.NewReader(params.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+}
 
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// Повтор запроса после потери сессии: за ночь сессия подключения истекает,
+// и первый запрос снимка получает ошибку 1 или 4
+const (
+	errCodeInvalidSession = 1 // неверная сессия
+	errCodeSessionExpired = 4 // сессия истекла (core/get_statistics); у прочих запросов — неверные параметры
 
-	return io.ReadAll(resp.Body)
-}
+	maxSessionRetries   = 2                      // повторных авторизаций на запрос
+	sessionRetryBackoff = 500 * time.Millisecond // пауза перед первой, далее удваивается
+)
 
-// requestWithSID выполняет запрос с session ID
-func (c *Client) requestWithSID(svc string, paramsJSON string) ([]byte, error) {
-	if c.sid == "" {
-		if err := c.Login(); err != nil {
-			return nil, err
+// requestWithSID выполняет запрос с session ID. Если Wialon отвечает, что сессия неверна
+// (истекла), авторизуется заново и повторяет запрос (не больше maxSessionRetries раз)
+func (c *Client) requestWithSID(ctx context.Context, svc string, paramsJSON string) ([]byte, error) {
+	backoff := sessionRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if c.sid == "" {
+			if err := c.Login(ctx); err != nil {
+				return nil, err
+			}
 		}
-	}
 
-	// Формируем URL с params в query string
-	reqURL := fmt.Sprintf("%s/wialon/ajax.html?svc=%s&sid=%s&params=%s",
-		c.baseURL, svc, c.sid, url.QueryEscape(paramsJSON))
+		// Формируем URL с params в query string
+		reqURL := fmt.Sprintf("%s/wialon/ajax.html?svc=%s&sid=%s&params=%s",
+			c.baseURL, svc, c.sid, url.QueryEscape(paramsJSON))
 
-	req, err := http.NewRequest("GET", reqURL, nil)
-	if err != nil {
-		return nil, err
-	}
+		body, err := c.do(ctx, svc, func() (*http.Request, error) {
+			return http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
 
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, err
+		code, ok := errorCode(body)
+		if !ok || !isSessionError(svc, code) || attempt >= maxSessionRetries {
+			return body, nil
+		}
+		log.Printf("[Wialon] %s: сессия недействительна (код %d), повторная авторизация через %s (%d/%d)",
+			svc, code, backoff, attempt+1, maxSessionRetries)
+		c.sid = ""
+		if err := sleepContext(ctx, backoff); err != nil {
+			return nil, err
+		}
+		backoff *= 2
 	}
-	defer resp.Body.Close()
+}
 
-	return io.ReadAll(resp.Body)
+// isSessionError распознаёт ошибку сессии: код 1 у любого запроса, код 4 — только
+// у core/get_statistics (истёкшая сессия), у остальных он означает неверные параметры
+func isSessionError(svc string, code int) bool {
+	return code == errCodeInvalidSession || (code == errCodeSessionExpired && svc == "core/get_statistics")
 }
 
 // AccountHistoryItem - элемент истории аккаунта
@@ -466,7 +514,7 @@ type AccountHistoryResponse struct {
 }
 
 // GetAccountHistory получает историю изменений аккаунта за указанный период
-func (c *Client) GetAccountHistory(accountID int64, days int) ([]AccountHistoryItem, error) {
+func (c *Client) GetAccountHistory(ctx context.Context, accountID int64, days int) ([]AccountHistoryItem, error) {
 	params := map[string]interface{}{
 		"itemId": accountID,
 		"days":   days,
@@ -475,7 +523,7 @@ func (c *Client) GetAccountHistory(accountID int64, days int) ([]AccountHistoryI
 
 	paramsJSON, _ := json.Marshal(params)
 
-	resp, err := c.requestWithSID("account/get_account_history", string(paramsJSON))
+	resp, err := c.requestWithSID(ctx, "account/get_account_history", string(paramsJSON))
 	if err != nil {
 		return nil, err
 	}
@@ -485,10 +533,11 @@ func (c *Client) GetAccountHistory(accountID int64, days int) ([]AccountHistoryI
 	if err := json.Unmarshal(resp, &rawResult); err != nil {
 		// Попробуем распарсить как ошибку
 		var errResp struct {
-			Error *int `json:"error"`
+			Error  *int   `json:"error"`
+			Reason string `json:"reason"`
 		}
 		if json.Unmarshal(resp, &errResp) == nil && errResp.Error != nil {
-			return nil, fmt.Errorf("ошибка Wialon API: код %d", *errResp.Error)
+			return nil, fmt.Errorf("ошибка Wialon API: %w", wialonError(*errResp.Error, errResp.Reason))
 		}
 		return nil, fmt.Errorf("ошибка парсинга ответа истории: %v, raw: %s", err, string(resp)[:min(500, len(resp))])
 	}
@@ -530,63 +579,171 @@ type DailyStats struct {
 	SensorCreated       int    `json:"sensor_created"`
 	SensorDeleted       int    `json:"sensor_deleted"`
 	NotificationCreated int    `json:"notification_created"`
+
+	// Raw — все счётчики Wialon как есть (сумма по ресурсам), включая поля без типизированного аналога
+	Raw map[string]int `json:"raw"`
 }
 
-// GetStatistics получает статистику изменений аккаунта по дням
-func (c *Client) GetStatistics(accountIDs []int64, fromTime, toTime int64) (map[int64][]DailyStats, error) {
-	result := make(map[int64][]DailyStats)
+// statisticsBatchSize - запросов core/get_statistics в одном core/batch
+const statisticsBatchSize = 50
+
+// statsBatchRetryAfter - через сколько после отказа хоста снова пробовать статистику в батче
+// (хост могут обновить, а разовый сбой не должен навсегда переводить клиент на запросы по одному)
+const statsBatchRetryAfter = time.Hour
+
+// errStatsBatchRejected - хост не выполнил ни одного запроса статистики из батча
+var errStatsBatchRejected = errors.New("core/get_statistics в core/batch не поддерживается")
+
+// GetStatistics получает статистику изменений аккаунтов по дням. Несколько аккаунтов
+// запрашиваются батчами через core/batch; если хост их не выполняет — по одному.
+func (c *Client) GetStatistics(ctx context.Context, accountIDs []int64, fromTime, toTime int64) (map[int64][]DailyStats, error) {
+	if len(accountIDs) > 1 {
+		if c.statsBatchRejectedAt.IsZero() || time.Since(c.statsBatchRejectedAt) >= statsBatchRetryAfter {
+			result, err := c.getStatisticsBatch(ctx, accountIDs, fromTime, toTime)
+			if !errors.Is(err, errStatsBatchRejected) {
+				c.statsBatchRejectedAt = time.Time{}
+				return result, err
+			}
+			c.statsBatchRejectedAt = time.Now()
+			log.Printf("[Wialon] GetStatistics: хост %s не выполняет статистику в батче, запросы по одному (повтор батча через %s)",
+				c.baseURL, statsBatchRetryAfter)
+		}
+	}
 
+	result := make(map[int64][]DailyStats)
 	// API принимает только один resourceId, поэтому делаем запросы для каждого аккаунта
 	for _, accountID := range accountIDs {
-		params := map[string]interface{}{
-			"resourceId": accountID,
-			"timeFrom":   fromTime,
-			"timeTo":     toTime,
-			"type":       "items", // "items" для статистики объектов
-			"recursive":  0,       // 0 = только этот аккаунт, без дочерних
+		stats, err := c.getAccountStatistics(ctx, accountID, fromTime, toTime)
+		if err != nil {
+			if errors.Is(err, errStatisticsParse) {
+				log.Printf("Ошибка парсинга статистики аккаунта %d: %v", accountID, err)
+				continue // Продолжаем с другими аккаунтами
+			}
+			return nil, err
 		}
+		result[accountID] = stats
+	}
 
-		paramsJSON, _ := json.Marshal(params)
+	return result, nil
+}
+
+// errStatisticsParse - ответ статистики аккаунта не разобран (ошибка Wialon или формат)
+var errStatisticsParse = errors.New("ошибка статистики")
+
+// getAccountStatistics запрашивает статистику одного аккаунта
+func (c *Client) getAccountStatistics(ctx context.Context, accountID, fromTime, toTime int64) ([]DailyStats, error) {
+	paramsJSON, _ := json.Marshal(statisticsParams(accountID, fromTime, toTime))
+
+	// Истёкшую сессию (коды 1 и 4) requestWithSID обновляет сам
+	resp, err := c.requestWithSID(ctx, "core/get_statistics", string(paramsJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := c.parseStatisticsResponse(resp, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errStatisticsParse, err)
+	}
+	return stats, nil
+}
+
+// getStatisticsBatch запрашивает статистику батчами по statisticsBatchSize аккаунтов.
+// Аккаунты, по которым в батче пришла ошибка, запрашиваются повторно по одному.
+// errStatsBatchRejected — хост не выполнил ни одного запроса первого батча.
+func (c *Client) getStatisticsBatch(ctx context.Context, accountIDs []int64, fromTime, toTime int64) (map[int64][]DailyStats, error) {
+	result := make(map[int64][]DailyStats)
+	var retry []int64
+	requests := 0
+
+	for start := 0; start < len(accountIDs); start += statisticsBatchSize {
+		end := min(start+statisticsBatchSize, len(accountIDs))
+		chunk := accountIDs[start:end]
 
-		// Первая попытка
-		resp, err := c.requestWithSID("core/get_statistics", string(paramsJSON))
+		batchParams := make([]map[string]interface{}, len(chunk))
+		for i, id := range chunk {
+			batchParams[i] = map[string]interface{}{
+				"svc":    "core/get_statistics",
+				"params": statisticsParams(id, fromTime, toTime),
+			}
+		}
+		paramsJSON, _ := json.Marshal(map[string]interface{}{
+			"params": batchParams,
+			"flags":  0, // Продолжать при ошибках
+		})
+
+		resp, err := c.requestWithSID(ctx, "core/batch", string(paramsJSON))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("ошибка батч-запроса статистики (chunk %d-%d): %v", start, end, err)
 		}
+		requests++
 
-		// Проверяем на ошибку сессии (код 4) для retry
-		var errResp struct {
-			Error *int `json:"error"`
+		var results []json.RawMessage
+		if err := json.Unmarshal(resp, &results); err != nil {
+			if start == 0 {
+				return nil, errStatsBatchRejected
+			}
+			return nil, fmt.Errorf("ошибка парсинга батч-ответа статистики: %v", err)
 		}
-		if json.Unmarshal(resp, &errResp) == nil && errResp.Error != nil && *errResp.Error == 4 {
-			// Сессия истекла — перелогиниваемся и повторяем
-			c.sid = "" // Сброс сессии
-			resp, err = c.requestWithSID("core/get_statistics", string(paramsJSON))
+
+		failed := 0
+		for i, id := range chunk {
+			if i >= len(results) {
+				retry = append(retry, id)
+				failed++
+				continue
+			}
+			stats, err := c.parseStatisticsResponse(results[i], id)
 			if err != nil {
-				return nil, err
+				retry = append(retry, id)
+				failed++
+				continue
 			}
+			result[id] = stats
 		}
+		if start == 0 && failed == len(chunk) {
+			return nil, errStatsBatchRejected
+		}
+	}
 
-		// Парсим результат для этого аккаунта
-		stats, err := c.parseStatisticsResponse(resp, accountID)
+	// Ошибки в батче — запросом по одному (ошибка сессии или временный сбой не теряют аккаунт)
+	for _, id := range retry {
+		stats, err := c.getAccountStatistics(ctx, id, fromTime, toTime)
+		requests++
 		if err != nil {
-			log.Printf("Ошибка парсинга статистики аккаунта %d: %v", accountID, err)
-			continue // Продолжаем с другими аккаунтами
+			if errors.Is(err, errStatisticsParse) {
+				log.Printf("Ошибка парсинга статистики аккаунта %d: %v", id, err)
+				continue
+			}
+			return nil, err
 		}
-		result[accountID] = stats
+		result[id] = stats
 	}
 
+	log.Printf("[Wialon] GetStatistics: %d аккаунтов за %d запросов вместо %d (повторено по одному: %d)",
+		len(accountIDs), requests, len(accountIDs), len(retry))
 	return result, nil
 }
 
+// statisticsParams - параметры core/get_statistics для одного аккаунта
+func statisticsParams(accountID, fromTime, toTime int64) map[string]interface{} {
+	return map[string]interface{}{
+		"resourceId": accountID,
+		"timeFrom":   fromTime,
+		"timeTo":     toTime,
+		"type":       "items", // "items" для статистики объектов
+		"recursive":  0,       // 0 = только этот аккаунт, без дочерних
+	}
+}
+
 // parseStatisticsResponse парсит ответ API статистики
 func (c *Client) parseStatisticsResponse(resp []byte, accountID int64) ([]DailyStats, error) {
 	// Проверяем на ошибку
 	var errResp struct {
-		Error *int `json:"error"`
+		Error  *int   `json:"error"`
+		Reason string `json:"reason"`
 	}
 	if json.Unmarshal(resp, &errResp) == nil && errResp.Error != nil {
-		return nil, fmt.Errorf("ошибка Wialon API: код %d", *errResp.Error)
+		return nil, fmt.Errorf("ошибка Wialon API: %w", wialonError(*errResp.Error, errResp.Reason))
 	}
 
 	// Ответ: { "timestamp": { "resourceId": { "avl_unit_total": 123, ... } }, "users": {...} }
@@ -626,6 +783,7 @@ func (c *Client) parseStatisticsResponse(resp []byte, accountID int64) ([]DailyS
 			dailyStat = &DailyStats{
 				Date:      dateStr,
 				Timestamp: timestamp,
+				Raw:       make(map[string]int),
 			}
 			dateMap[dateStr] = dailyStat
 		}
@@ -644,6 +802,10 @@ func (c *Client) parseStatisticsResponse(resp []byte, accountID int64) ([]DailyS
 			dailyStat.SensorCreated += stats["avl_unit_sensor_created"]
 			dailyStat.SensorDeleted += stats["avl_unit_sensor_deleted"]
 			dailyStat.NotificationCreated += stats["avl_notification_created"]
+
+			for key, value := range stats {
+				dailyStat.Raw[key] += value
+			}
 		}
 	}
 
@@ -0,0 +1,135 @@
+package wialon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/config"
+	"golang.org/x/time/rate"
+)
+
+func TestNewClientSettings(t *testing.T) {
+	c := NewClient(config.WialonConfig{BaseURL: "https://a", Token: "t"})
+	if c.unitFlags != UnitFlagsDefault || c.unitStatusFlags != UnitStatusFlagsDefault {
+		t.Errorf("флаги по умолчанию = %d/%d", c.unitFlags, c.unitStatusFlags)
+	}
+	if c.client.Timeout != DefaultRequestTimeout {
+		t.Errorf("таймаут по умолчанию = %s", c.client.Timeout)
+	}
+	if c.rateLimitRetries != DefaultRateLimitRetries || c.limiter.Limit() != rate.Limit(DefaultRequestsPerSecond) {
+		t.Errorf("ограничение по умолчанию: повторов %d, %v/сек", c.rateLimitRetries, c.limiter.Limit())
+	}
+
+	c = NewClient(config.WialonConfig{
+		UnitFlags:             1,
+		UnitStatusFlags:       257,
+		RequestTimeoutSeconds: 5,
+		RequestsPerSecond:     2,
+		RateLimitBurst:        4,
+		RateLimitRetries:      -1,
+	})
+	if c.unitFlags != 1 || c.unitStatusFlags != 257 {
+		t.Errorf("флаги = %d/%d, ожидалось 1/257", c.unitFlags, c.unitStatusFlags)
+	}
+	if c.client.Timeout != 5*time.Second {
+		t.Errorf("таймаут = %s, ожидалось 5s", c.client.Timeout)
+	}
+	if c.rateLimitRetries != 0 || c.limiter.Limit() != 2 || c.limiter.Burst() != 4 {
+		t.Errorf("ограничение: повторов %d, %v/сек, burst %d", c.rateLimitRetries, c.limiter.Limit(), c.limiter.Burst())
+	}
+
+	// Настройки одного клиента не влияют на другие
+	if other := NewClient(config.WialonConfig{}); other.unitFlags != UnitFlagsDefault {
+		t.Errorf("флаги другого клиента = %d", other.unitFlags)
+	}
+}
+
+func TestRateLimitSettings(t *testing.T) {
+	tests := []struct {
+		cfg         config.WialonConfig
+		wantLimit   rate.Limit
+		wantBurst   int
+		wantRetries int
+	}{
+		{config.WialonConfig{}, DefaultRequestsPerSecond, DefaultRateLimitBurst, DefaultRateLimitRetries},
+		{config.WialonConfig{RequestsPerSecond: 0.5, RateLimitBurst: 1, RateLimitRetries: 5}, 0.5, 1, 5},
+		{config.WialonConfig{RequestsPerSecond: -1, RateLimitRetries: -1}, rate.Inf, DefaultRateLimitBurst, 0},
+	}
+	for _, tt := range tests {
+		limit, burst, retries := rateLimitSettings(tt.cfg)
+		if limit != tt.wantLimit || burst != tt.wantBurst || retries != tt.wantRetries {
+			t.Errorf("rateLimitSettings(%+v) = %v, %d, %d, ожидалось %v, %d, %d",
+				tt.cfg, limit, burst, retries, tt.wantLimit, tt.wantBurst, tt.wantRetries)
+		}
+	}
+}
+
+func TestFactorySharesConnectionLimiter(t *testing.T) {
+	f := NewFactory(config.WialonConfig{UnitStatusFlags: 257, RequestsPerSecond: 3})
+
+	a := f.NewClient("https://hst", "token1", 0)
+	b := f.NewClient("https://hst", "token1", 0)
+	if a.limiter != b.limiter {
+		t.Error("клиенты одного подключения должны делить лимитер")
+	}
+	if a.limiter.Limit() != 3 {
+		t.Errorf("лимит из конфигурации = %v, ожидалось 3", a.limiter.Limit())
+	}
+	if a.unitStatusFlags != 257 || a.baseURL != "https://hst" || a.token != "token1" {
+		t.Errorf("клиент фабрики: flags %d, %s, %s", a.unitStatusFlags, a.baseURL, a.token)
+	}
+
+	// Своё ограничение подключения обновляет общий лимитер
+	c := f.NewClient("https://hst", "token1", 7)
+	if c.limiter != a.limiter || a.limiter.Limit() != 7 {
+		t.Errorf("лимитер подключения: общий %v, лимит %v, ожидалось 7", c.limiter == a.limiter, a.limiter.Limit())
+	}
+
+	if d := f.NewClient("https://hst", "token2", 0); d.limiter == a.limiter {
+		t.Error("у другого токена лимитер должен быть свой")
+	}
+	if other := NewFactory(config.WialonConfig{}).NewClient("https://hst", "token1", 0); other.limiter == a.limiter {
+		t.Error("разные фабрики не должны делить лимитер")
+	}
+}
+
+func TestIsSessionError(t *testing.T) {
+	tests := []struct {
+		svc  string
+		code int
+		want bool
+	}{
+		{"core/search_items", 1, true},
+		{"core/get_statistics", 1, true},
+		{"core/get_statistics", 4, true},
+		{"core/search_items", 4, false},
+		{"account/get_account_data", 4, false},
+		{"core/get_statistics", 7, false},
+	}
+	for _, tt := range tests {
+		if got := isSessionError(tt.svc, tt.code); got != tt.want {
+			t.Errorf("isSessionError(%q, %d) = %v, ожидалось %v", tt.svc, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestClientTimeoutOverride(t *testing.T) {
+	if c := NewClientWithTokenAndTimeout("https://a", "t", 3*time.Second); c.client.Timeout != 3*time.Second {
+		t.Errorf("NewClientWithTokenAndTimeout: таймаут %s, ожидалось 3s", c.client.Timeout)
+	}
+	if c := NewClientWithToken("https://a", "t"); c.client.Timeout != DefaultRequestTimeout {
+		t.Errorf("NewClientWithToken: таймаут %s, ожидалось %s", c.client.Timeout, DefaultRequestTimeout)
+	}
+
+	f := NewFactory(config.WialonConfig{RequestTimeoutSeconds: 20})
+	if c := f.NewClient("https://a", "t", 0); c.client.Timeout != 20*time.Second {
+		t.Errorf("Factory.NewClient: таймаут %s, ожидалось 20s", c.client.Timeout)
+	}
+	a := f.NewClientWithTimeout("https://a", "t", 0, 90*time.Second)
+	if a.client.Timeout != 90*time.Second {
+		t.Errorf("Factory.NewClientWithTimeout: таймаут %s, ожидалось 90s", a.client.Timeout)
+	}
+	if b := f.NewClient("https://a", "t", 0); b.client.Timeout != 20*time.Second || b.limiter != a.limiter {
+		t.Errorf("таймаут одного клиента не должен влиять на другие: %s", b.client.Timeout)
+	}
+}
@@ -0,0 +1,41 @@
+package wialon
+
+import "fmt"
+
+// errorDescriptions - расшифровка распространённых кодов ошибок Wialon
+var errorDescriptions = map[int]string{
+	1:    "недействительная сессия",
+	2:    "неверное имя сервиса",
+	3:    "неверный результат",
+	4:    "неверные параметры запроса",
+	5:    "ошибка выполнения запроса",
+	6:    "неизвестная ошибка",
+	7:    "доступ запрещён",
+	8:    "неверное имя пользователя или пароль",
+	9:    "сервер авторизации недоступен",
+	1001: "нет сообщений за выбранный интервал",
+	1002: "элемент с таким уникальным свойством уже существует или ограничен биллингом",
+	1003: "разрешён только один запрос одновременно",
+}
+
+// APIError - ошибка из ответа Wialon: код error и пояснение reason (если Wialon его прислал)
+type APIError struct {
+	Code   int
+	Reason string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("код %d", e.Code)
+	if desc, ok := errorDescriptions[e.Code]; ok {
+		msg += " (" + desc + ")"
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+// wialonError формирует ошибку Wialon по коду и reason ответа
+func wialonError(code int, reason string) error {
+	return &APIError{Code: code, Reason: reason}
+}
@@ -0,0 +1,238 @@
+package wialon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/user/wialon-billing-api/internal/config"
+	"golang.org/x/time/rate"
+)
+
+// Ограничение частоты запросов к Wialon. Клиенты, созданные одной Factory, делят лимитер
+// подключения (хост и токен): синхронизация, снимки и статистика могут идти параллельно.
+const (
+	DefaultRequestsPerSecond = 10 // запросов в секунду на подключение
+	DefaultRateLimitBurst    = 10 // запросов подряд без ожидания
+	DefaultRateLimitRetries  = 3  // повторов после ответа «слишком много запросов»
+
+	rateLimitBackoff    = time.Second      // первая пауза перед повтором, далее удваивается
+	maxRateLimitBackoff = 30 * time.Second // предел паузы (и Retry-After)
+
+	// errCodeTooManyRequests - код ошибки Wialon «сейчас разрешён только один запрос»
+	errCodeTooManyRequests = 1003
+)
+
+// ErrTooManyRequests - Wialon продолжает отвечать «слишком много запросов» после всех повторов
+var ErrTooManyRequests = errors.New("Wialon: превышен лимит запросов")
+
+// rateLimitSettings возвращает ограничение запросов из конфигурации с подставленными значениями
+// по умолчанию. requests_per_second: 0 — DefaultRequestsPerSecond, < 0 — без ограничения;
+// rate_limit_burst: 0 — DefaultRateLimitBurst; rate_limit_retries: 0 — DefaultRateLimitRetries, < 0 — без повторов.
+func rateLimitSettings(cfg config.WialonConfig) (limit rate.Limit, burst, retries int) {
+	limit = rate.Limit(DefaultRequestsPerSecond)
+	if cfg.RequestsPerSecond > 0 {
+		limit = rate.Limit(cfg.RequestsPerSecond)
+	} else if cfg.RequestsPerSecond < 0 {
+		limit = rate.Inf
+	}
+
+	burst = DefaultRateLimitBurst
+	if cfg.RateLimitBurst > 0 {
+		burst = cfg.RateLimitBurst
+	}
+
+	retries = DefaultRateLimitRetries
+	if cfg.RateLimitRetries > 0 {
+		retries = cfg.RateLimitRetries
+	} else if cfg.RateLimitRetries < 0 {
+		retries = 0
+	}
+	return limit, burst, retries
+}
+
+// Factory создаёт клиентов подключений с настройками из конфигурации. Лимитер запросов
+// один на хост и токен и общий для всех клиентов, созданных этой фабрикой.
+type Factory struct {
+	cfg config.WialonConfig
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewFactory создаёт фабрику клиентов Wialon (BaseURL и Token из cfg не используются —
+// их задаёт подключение)
+func NewFactory(cfg config.WialonConfig) *Factory {
+	return &Factory{cfg: cfg, limiters: make(map[string]*rate.Limiter)}
+}
+
+// NewClient создаёт клиент подключения. requestsPerSecond — ограничение подключения
+// (0 — requests_per_second из конфигурации).
+func (f *Factory) NewClient(baseURL, token string, requestsPerSecond float64) *Client {
+	return f.NewClientWithTimeout(baseURL, token, requestsPerSecond, 0)
+}
+
+// NewClientWithTimeout создаёт клиент подключения со своим пределом ожидания ответа
+// (0 — request_timeout_seconds из конфигурации)
+func (f *Factory) NewClientWithTimeout(baseURL, token string, requestsPerSecond float64, timeout time.Duration) *Client {
+	cfg := f.cfg
+	cfg.BaseURL = baseURL
+	cfg.Token = token
+	if requestsPerSecond > 0 {
+		cfg.RequestsPerSecond = requestsPerSecond
+	}
+
+	client := newClient(cfg, timeout)
+	client.limiter = f.limiter(baseURL+"|"+token, client.limiter)
+	return client
+}
+
+// NewAPI - то же, что NewClient, в виде ClientFactory
+func (f *Factory) NewAPI(baseURL, token string, requestsPerSecond float64) WialonAPI {
+	return f.NewClient(baseURL, token, requestsPerSecond)
+}
+
+// limiter возвращает общий лимитер подключения; если он уже есть, обновляет его частоту
+// по новому клиенту (ограничение подключения могли изменить)
+func (f *Factory) limiter(key string, fresh *rate.Limiter) *rate.Limiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if limiter, ok := f.limiters[key]; ok {
+		if limiter.Limit() != fresh.Limit() {
+			limiter.SetLimit(fresh.Limit())
+		}
+		return limiter
+	}
+	f.limiters[key] = fresh
+	return fresh
+}
+
+// do выполняет запрос с учётом ограничения частоты. На ответ «слишком много запросов»
+// (HTTP 429/503, код Wialon 1003, разрыв HTTP/2 GOAWAY) повторяет его с нарастающей паузой.
+// newRequest вызывается на каждую попытку, чтобы тело запроса читалось заново.
+func (c *Client) do(ctx context.Context, svc string, newRequest func() (*http.Request, error)) ([]byte, error) {
+	retries := c.rateLimitRetries
+	backoff := rateLimitBackoff
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		var body []byte
+		wait := backoff
+		resp, err := c.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if isTimeout(err) {
+				return nil, c.timeoutError(svc)
+			}
+			if !strings.Contains(err.Error(), "GOAWAY") {
+				return nil, err
+			}
+		} else {
+			body, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if isTimeout(err) {
+					return nil, c.timeoutError(svc)
+				}
+				return nil, err
+			}
+			if !isTooManyRequests(resp.StatusCode, body) {
+				return body, nil
+			}
+			if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > 0 {
+				wait = retryAfter
+			}
+		}
+
+		if attempt >= retries {
+			if err != nil {
+				return nil, fmt.Errorf("%w (%s): %v", ErrTooManyRequests, svc, err)
+			}
+			return nil, fmt.Errorf("%w (%s)", ErrTooManyRequests, svc)
+		}
+		log.Printf("[Wialon] %s: превышен лимит запросов, повтор через %s (%d/%d)", svc, wait, attempt+1, retries)
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+		backoff = min(backoff*2, maxRateLimitBackoff)
+	}
+}
+
+// sleepContext ждёт d или отмены ctx (тогда возвращает ошибку контекста)
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isTimeout распознаёт истечение таймаута HTTP-клиента (при соединении, ожидании или чтении ответа)
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// timeoutError - ошибка «Wialon не ответил» без URL запроса (в нём токен или сессия)
+func (c *Client) timeoutError(svc string) error {
+	return fmt.Errorf("%w after %s (%s)", ErrTimeout, c.client.Timeout, svc)
+}
+
+// isTooManyRequests распознаёт ответ «слишком много запросов»: по HTTP-статусу или по
+// короткому ответу с кодом ошибки Wialon 1003 (большие ответы с данными не разбираются)
+func isTooManyRequests(status int, body []byte) bool {
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		return true
+	}
+	code, ok := errorCode(body)
+	return ok && code == errCodeTooManyRequests
+}
+
+// errorCode возвращает код ошибки Wialon из короткого ответа вида {"error": N}
+// (большие ответы с данными не разбираются)
+func errorCode(body []byte) (int, bool) {
+	if len(body) > 256 || !strings.HasPrefix(strings.TrimSpace(string(body)), "{") {
+		return 0, false
+	}
+	var errResp struct {
+		Error *int `json:"error"`
+	}
+	if json.Unmarshal(body, &errResp) != nil || errResp.Error == nil {
+		return 0, false
+	}
+	return *errResp.Error, true
+}
+
+// parseRetryAfter разбирает заголовок Retry-After в секундах (0 — нет или не число)
+func parseRetryAfter(value string) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return min(time.Duration(seconds)*time.Second, maxRateLimitBackoff)
+}
@@ -0,0 +1,32 @@
+package wialon
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Параметры запросов Wialon с секретами: sid и токен попадают в текст ошибок net/http
+// вместе с URL запроса
+var (
+	secretQueryParam = regexp.MustCompile(`(?i)\b(sid|token|access_token|authHash)=[^&\s"']+`)
+	secretJSONField  = regexp.MustCompile(`(?i)("(?:token|sid|authHash)"\s*:\s*")[^"]*`)
+	secretEscapedArg = regexp.MustCompile(`(?i)(%22(?:token|sid|authHash)%22%3A%22)[^%]*`)
+)
+
+// ScrubError возвращает текст ошибки без сессий и токенов: параметры sid/token
+// в URL и JSON заменяются на ***, переданные секреты вырезаются буквально
+func ScrubError(err error, secrets ...string) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	for _, secret := range secrets {
+		if len(secret) >= 8 {
+			msg = strings.ReplaceAll(msg, secret, "***")
+		}
+	}
+	msg = secretQueryParam.ReplaceAllString(msg, "$1=***")
+	msg = secretJSONField.ReplaceAllString(msg, "${1}***")
+	msg = secretEscapedArg.ReplaceAllString(msg, "${1}***")
+	return msg
+}
@@ -0,0 +1,32 @@
+package version
+
+import "runtime"
+
+// Переменные сборки — задаются через -ldflags:
+//
+//	go build -ldflags "-X github.com/user/wialon-billing-api/internal/version.Version=1.2.3 \
+//	  -X github.com/user/wialon-billing-api/internal/version.GitCommit=$(git rev-parse --short HEAD) \
+//	  -X github.com/user/wialon-billing-api/internal/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildTime = "unknown"
+)
+
+// Info - информация о сборке
+type Info struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get возвращает информацию о текущей сборке
+func Get() Info {
+	return Info{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}